@@ -29,8 +29,10 @@ import (
 
 	"github.com/eclipse/paho.golang/autopaho/queue"
 	"github.com/eclipse/paho.golang/autopaho/queue/memory"
+	"github.com/eclipse/paho.golang/internal/categorised"
 	"github.com/eclipse/paho.golang/packets"
 	"github.com/eclipse/paho.golang/paho/log"
+	"github.com/eclipse/paho.golang/paho/session"
 	"github.com/eclipse/paho.golang/paho/session/state"
 	"github.com/gorilla/websocket"
 
@@ -47,13 +49,35 @@ import (
 // ConnectionDownError Down will be returned when a request is made but the connection to the server is down
 // Note: It is possible that the connection will drop between the request being made and a response being received, in
 // which case a different error will be received (this is only returned if the connection is down at the time the
-// request is made).
-var ConnectionDownError = errors.New("connection with the MQTT server is currently down")
+// request is made). It matches paho.ErrNotConnected (errors.Is).
+var ConnectionDownError = categorised.New("connection with the MQTT server is currently down", paho.ErrNotConnected)
+
+// PublishQueuedError will be returned by Publish if publishing is paused (see Pause); the message has been added to
+// the queue and will be transmitted after Resume is called.
+var PublishQueuedError = errors.New("publishing is paused; message queued")
+
+// PublishDroppedError will be returned by Publish or PublishViaQueue if publishing is paused, and the message was
+// discarded (QOS0 messages are discarded whilst paused if DropQoS0WhilePaused is set).
+var PublishDroppedError = errors.New("publishing is paused; QOS0 message discarded")
+
+// ErrManagerStopped is returned by AwaitConnection when the ConnectionManager has stopped (due to Disconnect being
+// called, the context passed to NewConnection being cancelled, or OnConnectionDown returning false); it will never
+// connect again.
+var ErrManagerStopped = errors.New("connection manager has stopped")
 
 // WebSocketConfig enables customisation of the websocket connection
+// Dialer and Header are called before each connection attempt, so values that change over time (e.g. short-lived
+// bearer tokens) can be refreshed when reconnecting.
 type WebSocketConfig struct {
-	Dialer func(url *url.URL, tlsCfg *tls.Config) *websocket.Dialer // If non-nil this will be called before each websocket connection (allows full configuration of the dialer used)
-	Header func(url *url.URL, tlsCfg *tls.Config) http.Header       // If non-nil this will be called before each connection attempt to get headers to include with request
+	Dialer       func(url *url.URL, tlsCfg *tls.Config) *websocket.Dialer // If non-nil this will be called before each websocket connection (allows full configuration of the dialer used, including proxy and TLS settings)
+	Header       func(url *url.URL, tlsCfg *tls.Config) http.Header       // If non-nil this will be called before each connection attempt to get headers to include with request
+	Subprotocols []string                                                 // If non-nil, overrides the subprotocols requested in the upgrade (Sec-WebSocket-Protocol); the default is "mqtt"
+}
+
+// ReconnectObserver may be implemented by the paho.Observer set in ClientConfig.Observer; if so, OnReconnect will be
+// called each time the connection is reestablished (it is not called for the initial connection).
+type ReconnectObserver interface {
+	OnReconnect()
 }
 
 type PublishReceived struct {
@@ -66,31 +90,120 @@ type PublishReceived struct {
 type ClientConfig struct {
 	ServerUrls                    []*url.URL  // URL(s) for the MQTT server (schemes supported include 'mqtt' and 'tls')
 	TlsCfg                        *tls.Config // Configuration used when connecting using TLS
-	KeepAlive                     uint16      // Keepalive period in seconds (the maximum time interval that is permitted to elapse between the point at which the Client finishes transmitting one MQTT Control Packet and the point it starts sending the next)
-	CleanStartOnInitialConnection bool        //  Clean Start flag, if true, existing session information will be cleared on the first connection (it will be false for subsequent connections)
-	SessionExpiryInterval         uint32      // Session Expiry Interval in seconds (if 0 the Session ends when the Network Connection is closed)
+	KeepAlive                     uint16      // Keepalive period in seconds (the maximum time interval that is permitted to elapse between the point at which the Client finishes transmitting one MQTT Control Packet and the point it starts sending the next). Requested on each connection; a Server Keep Alive in the CONNACK overrides it for that connection
+	CleanStartOnInitialConnection bool        //  Clean Start flag, if true, existing session information will be cleared on the first connection (it will be false for subsequent connections). This asks the server to discard its session; local state is discarded whenever the server reports no session (see ConnectionManager.ResetLocalSession to clear local state independently)
+	SessionExpiryInterval         uint32      // Session Expiry Interval in seconds (if 0 the Session ends when the Network Connection is closed, so must be non-zero if ClientConfig.Session is set, unless ConnectPacketBuilder or BuildConnect sets it). The server may override this; see ServerProperties
+
+	// TlsConfigFn, if set, is called before each connection attempt to obtain the TLS configuration (overriding TlsCfg).
+	// This enables a fresh configuration (e.g. with a renewed client certificate) to be used whenever the connection
+	// is reestablished. An error is treated as a failed connection attempt (the attempt will be retried after the
+	// backoff delay).
+	TlsConfigFn func(context.Context) (*tls.Config, error)
 
 	// Deprecated: ConnectRetryDelay is deprecated and its functionality is replaced by ReconnectBackoff.
 	ConnectRetryDelay time.Duration           // How long to wait between connection attempts (defaults to 10s)
 	ReconnectBackoff  func(int) time.Duration // How long to wait after failed connection attempt N (defaults to 10s)
-	ConnectTimeout    time.Duration           // How long to wait for the connection process to complete (defaults to 10s)
 	WebSocketCfg      *WebSocketConfig        // Enables customisation of the websocket connection
 
+	// ConnectTimeout bounds each connection attempt (dial, TLS/WebSocket handshake, CONNECT and CONNACK) independently
+	// of the context passed to NewConnection (defaults to 10s). If an attempt times out, the next of ServerUrls is
+	// tried (the reconnect backoff is applied once each of ServerUrls has been attempted), so a server that accepts the
+	// connection but never responds does not prevent failover.
+	ConnectTimeout time.Duration
+
+	// Proxy, if non-nil, determines the proxy (if any) used for each connection attempt using the `mqtt` and `mqtts`
+	// (and equivalent) schemes; e.g. ProxyURL(u) or ProxyFromEnvironment. HTTP CONNECT and SOCKS5 proxies are supported;
+	// where TLS is used, it is negotiated with the MQTT server through the tunnel (not with the proxy). If nil, the
+	// all_proxy environment variable is honoured. Not used for websocket connections (see WebSocketConfig.Dialer) or
+	// by AttemptConnection.
+	Proxy ProxyFunc
+
+	// ReconnectBackoffStrategy, if non-nil, is used in preference to ReconnectBackoff and is passed the error that
+	// caused the previous connection attempt to fail (allowing the delay to vary based upon the type of failure).
+	ReconnectBackoffStrategy ReconnectBackoff
+
+	// ServerSelector determines which of the ServerUrls is used for each connection attempt (defaults to
+	// RoundRobinSelector). See RandomSelector and PreferFirstSelector for alternatives.
+	ServerSelector ServerSelector
+
+	// FollowServerReference, if true, results in a Server Reference received in a DISCONNECT (typically with reason
+	// code 0x9C "Use another server" or 0x9D "Server moved") being used for the next connection attempt. This is a
+	// one-time redirect; ServerSelector is used as normal for subsequent attempts (including if the attempt fails).
+	// The reference may be a URL or `host[:port]` (in which case the scheme, and port if omitted, of the URL in use
+	// when the DISCONNECT was received are applied).
+	FollowServerReference bool
+
+	// OnServerReference, if non-nil, is called (when FollowServerReference is true) whenever a DISCONNECT containing a
+	// Server Reference is received, allowing redirects to be audited. reference is the value received, from is the
+	// URL in use when the DISCONNECT arrived and to is the URL that will be used for the next connection attempt. If
+	// the reference is malformed, to will be nil, err will describe the problem, and the redirect will not be followed.
+	// Supplied function must not block.
+	OnServerReference func(reference string, from, to *url.URL, err error)
+
 	Queue queue.Queue // Used to queue up publish messages (if nil an error will be returned if publish could not be transmitted)
 
+	// QueueCapacity, if greater than 0, limits the number of messages held in Queue (which must implement
+	// queue.Lengther). QueueFullPolicy determines what happens when a message is published and the queue is full.
+	// Note: The message being transmitted from the queue counts towards the capacity; it is removed once sent.
+	// Messages are only moved from the queue into the session when the number in flight is below the send window
+	// (the server's Receive Maximum, optionally reduced via ClientConfig.SendWindow); see Stats.
+	QueueCapacity   int
+	QueueFullPolicy QueueFullPolicy     // Action taken when the queue holds QueueCapacity messages (defaults to QueueFullDropOldest)
+	OnQueueDropped  func(*paho.Publish) // Called when a message is discarded due to QueueFullPolicy. Supplied function must not block.
+
+	// DropQoS0WhilePaused determines what happens to QOS0 messages published whilst publishing is paused (see
+	// ConnectionManager.Pause). By default, they are queued (along with QOS1+ messages); if true they will be discarded.
+	DropQoS0WhilePaused bool
+
 	// Depreciated: Use ServerUrls instead (this will be used if ServerUrls is empty). Will be removed in a future release.
 	BrokerUrls []*url.URL
 
-	// AttemptConnection, if provided, will be called to establish a network connection.
+	// AttemptConnection, if provided, will be called to establish a network connection (in place of the built-in
+	// TCP/TLS/WebSocket dialing); this enables the use of in-memory connections (e.g. pahotest.Broker), Unix sockets
+	// or other transports. The URL selected from ServerUrls is passed unaltered, and its scheme is not checked (so
+	// custom schemes, such as `unix:///run/mqtt.sock`, may be used). The returned connection is used, as is, for the
+	// MQTT CONNECT handshake; TlsCfg, TlsConfigFn and WebSocketCfg are not applied (so, if TLS is required, the function
+	// must perform the handshake itself; the config passed in includes TlsCfg, refreshed via TlsConfigFn if set).
+	// The context passed is that of the ConnectionManager (ConnectTimeout applies to the MQTT handshake only).
 	// The returned `conn` must support thread safe writing; most wrapped net.Conn implementations like tls.Conn
 	// are not thread safe for writing.
 	// To fix, use packets.NewThreadSafeConn wrapper or extend the custom net.Conn struct with sync.Locker.
 	AttemptConnection func(context.Context, ClientConfig, *url.URL) (net.Conn, error)
 
-	OnConnectionUp   func(*ConnectionManager, *paho.Connack) // Called when a connection is made (including reconnection). Connection Manager passed to simplify subscriptions. Supplied function must not block.
+	OnConnectionUp   func(*ConnectionManager, *paho.Connack) // Called when a connection is made (including reconnection). Connection Manager passed to simplify subscriptions; Connack.SessionPresent indicates whether the session was resumed. Supplied function must not block.
 	OnConnectionDown func() bool                             // Only called after the connection that resulted in OnConnectionUp is dropped. Returning false will cause autopaho to cease attempting to connect. Supplied function must not block.
 	OnConnectError   func(error)                             // Called (within a goroutine) whenever a connection attempt fails. Will wrap autopaho.ConnackError on server deny.
 
+	// OnConnectionLost, if set, is called when a connection that resulted in OnConnectionUp is lost due to a
+	// transport-level failure (e.g. a network error or keep alive timeout), with the error that caused the loss. It
+	// is not called when the connection drops because the server sent a DISCONNECT (OnServerDisconnect, in the
+	// embedded paho.ClientConfig, is called instead), or when Disconnect is called. For each connection, at most one
+	// of OnConnectionLost and OnServerDisconnect is called. Called before OnConnectionDown; must not block.
+	OnConnectionLost func(error)
+
+	// OnConnectAttemptFailed is called once for each failed connection attempt (DNS, TCP, TLS, websocket or a CONNACK
+	// rejection) with the server URL, the number of consecutive failed attempts (starting at 1 and reset when a
+	// connection is established) and the error (which will wrap autopaho.ConnackError on server deny).
+	// It is called before OnConnectError, and before the backoff delay preceding the next attempt. OnConnectionUp
+	// will be called when an attempt succeeds. Supplied function must not block.
+	OnConnectAttemptFailed func(serverURL *url.URL, attempt int, err error)
+
+	// ReconnectResubscribe, if true, results in autopaho recording all subscriptions accepted by the server (made via
+	// ConnectionManager.Subscribe, and removed by ConnectionManager.Unsubscribe). Should the server not retain the
+	// session (SessionPresent is false in the CONNACK) when reconnecting, these subscriptions will be reestablished
+	// (with the options and properties originally used) before OnConnectionUp is called.
+	ReconnectResubscribe bool
+
+	// WarnOnSubscriptionMismatch, if true, results in ReconcileSubscriptions being called after each successful call
+	// to Subscribe, Unsubscribe or ModifySubscriptions, with any discrepancies logged via Errors. This is intended
+	// to catch configuration drift (e.g. a handler registered for a topic that was never subscribed to) during
+	// development.
+	WarnOnSubscriptionMismatch bool
+
+	// EventBufferSize sets the capacity of the channel returned by ConnectionManager.Events (default 16). If the
+	// buffer is full when an event occurs, the oldest event is discarded.
+	EventBufferSize int
+
 	Debug      log.Logger // By default set to NOOPLogger{},set to a logger for debugging info
 	Errors     log.Logger // By default set to NOOPLogger{},set to a logger for errors
 	PahoDebug  log.Logger // debugger passed to the paho package (will default to NOOPLogger{})
@@ -99,10 +212,19 @@ type ClientConfig struct {
 	ConnectUsername string
 	ConnectPassword []byte
 
+	// WillMessage and WillProperties are included in every CONNECT (so the will is reestablished on each connection).
+	// paho.NewWill may be used to create these (e.g. cfg.WillMessage, cfg.WillProperties, err = paho.NewWill(...).Build()).
 	WillMessage    *paho.WillMessage
 	WillProperties *paho.WillProperties
 
-	ConnectPacketBuilder func(*paho.Connect, *url.URL) (*paho.Connect, error) // called prior to connection allowing customisation of the CONNECT packet
+	// WillDelayInterval, if non-zero, sets the Will Delay Interval (in seconds) in every CONNECT, overriding any value
+	// in WillProperties (requires WillMessage). The server publishes the will when this interval passes or the session
+	// ends, whichever is first; a delay longer than SessionExpiryInterval therefore has no effect.
+	WillDelayInterval uint32
+
+	// ConnectPacketBuilder is called prior to each connection attempt allowing customisation of the CONNECT packet. For
+	// fields/properties not exposed by paho.Connect, set ClientConfig.BuildConnect (which is passed the packet itself).
+	ConnectPacketBuilder func(*paho.Connect, *url.URL) (*paho.Connect, error)
 
 	// DisconnectPacketBuilder - called prior to disconnection allowing customisation of the DISCONNECT
 	// packet. If the function returns nil, then no DISCONNECT packet will be passed; if nil a default packet is sent.
@@ -126,10 +248,24 @@ type ConnectionManager struct {
 	queue   queue.Queue    // In not nil, this will be used to queue publish requests
 	queueWg sync.WaitGroup // Waits on goroutine that monitors Queue
 
-	done chan struct{} // Channel that will be closed when the process has cleanly shutdown
+	queueMu       sync.Mutex    // Held whilst checking the queue capacity, and whilst retrieving/releasing entries (never whilst publishing)
+	queueSpace    chan struct{} // Closed when an entry is removed from the queue, or released by managePublishQueue (created on demand; must lock queueMu to access)
+	queueInFlight bool          // true whilst the oldest entry is in use by managePublishQueue (must lock queueMu to access)
+
+	resume chan struct{} // Non-nil when publishing is paused (closed when Resume is called); must lock mu to access
+
+	assignedClientID string // Client identifier assigned by the server (if any); must lock mu to access
+
+	subscriptions *subscriptions // Subscriptions accepted by the server (reestablished if ReconnectResubscribe is set)
+	stats         connStats      // Statistics relating to the connection (see Stats)
 
-	debug  log.Logger // By default set to NOOPLogger{},set to a logger for debugging info
-	errors log.Logger // By default set to NOOPLogger{},set to a logger for errors
+	done   chan struct{} // Channel that will be closed when the process has cleanly shutdown
+	events *eventQueue   // Connection state transitions (see Events)
+
+	debug      *log.SwappableLogger // cfg.Debug (may be changed via SetDebugLogger)
+	errors     *log.SwappableLogger // cfg.Errors (may be changed via SetErrorLogger)
+	pahoDebug  *log.SwappableLogger // cfg.PahoDebug (may be changed via SetPahoDebugLogger)
+	pahoErrors *log.SwappableLogger // cfg.PahoErrors (may be changed via SetPahoErrorLogger)
 }
 
 // ResetUsernamePassword clears any configured username and password on the client configuration
@@ -157,7 +293,7 @@ func (cfg *ClientConfig) SetUsernamePassword(username string, password []byte) {
 // SetWillMessage configures the Will topic, payload, QOS and Retain facets of the client connection
 // These values are staged in the ClientConfig, for later preparation of the Connect packet.
 //
-// Deprecated: Set WillMessage and WillProperties directly instead.
+// Deprecated: Set WillMessage and WillProperties directly instead (paho.NewWill may be used to create these).
 func (cfg *ClientConfig) SetWillMessage(topic string, payload []byte, qos byte, retain bool) {
 	cfg.WillMessage = &paho.WillMessage{
 		Retain:  retain,
@@ -224,6 +360,11 @@ func (cfg *ClientConfig) buildConnectPacket(firstConnection bool, serverURL *url
 		} else {
 			cp.WillProperties = &paho.WillProperties{}
 		}
+		if cfg.WillDelayInterval != 0 {
+			wp := *cp.WillProperties // copy, so cfg.WillProperties is not modified
+			wp.WillDelayInterval = &cfg.WillDelayInterval
+			cp.WillProperties = &wp
+		}
 	}
 
 	if cfg.SessionExpiryInterval != 0 {
@@ -243,12 +384,11 @@ func (cfg *ClientConfig) buildConnectPacket(firstConnection bool, serverURL *url
 
 // NewConnection creates a connection manager and begins the connection process (will retry until the context is cancelled)
 func NewConnection(ctx context.Context, cfg ClientConfig) (*ConnectionManager, error) {
-	if cfg.Debug == nil {
-		cfg.Debug = log.NOOPLogger{}
-	}
-	if cfg.Errors == nil {
-		cfg.Errors = log.NOOPLogger{}
-	}
+	// Loggers are wrapped so that they can be changed whilst the connection manager is running (including in the
+	// paho.Client, which is recreated upon each reconnection).
+	debug, errs := log.NewSwappableLogger(cfg.Debug), log.NewSwappableLogger(cfg.Errors)
+	pahoDebug, pahoErrors := log.NewSwappableLogger(cfg.PahoDebug), log.NewSwappableLogger(cfg.PahoErrors)
+	cfg.Debug, cfg.Errors, cfg.PahoDebug, cfg.PahoErrors = debug, errs, pahoDebug, pahoErrors
 	if cfg.ReconnectBackoff == nil {
 		// for backwards compatibility we check for ConnectRetryDelay first
 		// before using the default constant backoff strategy (which behaves
@@ -259,6 +399,9 @@ func NewConnection(ctx context.Context, cfg ClientConfig) (*ConnectionManager, e
 			cfg.ReconnectBackoff = NewConstantBackoff(cfg.ConnectRetryDelay)
 		}
 	}
+	if cfg.ReconnectBackoffStrategy == nil {
+		cfg.ReconnectBackoffStrategy = Backoff(cfg.ReconnectBackoff)
+	}
 	if cfg.ConnectTimeout == 0 {
 		cfg.ConnectTimeout = 10 * time.Second
 	}
@@ -268,29 +411,54 @@ func NewConnection(ctx context.Context, cfg ClientConfig) (*ConnectionManager, e
 	if len(cfg.ServerUrls) == 0 { // This would cause an infinite loop
 		return nil, errors.New("no server urls provided")
 	}
+	if cfg.ServerSelector == nil {
+		cfg.ServerSelector = RoundRobinSelector{}
+	}
 	if cfg.Queue == nil {
 		cfg.Queue = memory.New()
 	}
+	if _, ok := cfg.Queue.(queue.Lengther); cfg.QueueCapacity > 0 && !ok {
+		return nil, errors.New("QueueCapacity requires a Queue that implements queue.Lengther")
+	}
+	if cfg.WillDelayInterval != 0 && cfg.WillMessage == nil {
+		return nil, fmt.Errorf("%w: WillDelayInterval requires WillMessage", paho.ErrInvalidArguments)
+	}
+	// A Session Expiry Interval of 0 means the session ends when the connection drops, so nothing held in a
+	// user-provided Session would survive a reconnection (ConnectPacketBuilder and BuildConnect may set the interval, so
+	// are trusted).
+	if cfg.Session != nil && cfg.SessionExpiryInterval == 0 && cfg.ConnectPacketBuilder == nil && cfg.BuildConnect == nil {
+		return nil, fmt.Errorf("%w: Session provided but SessionExpiryInterval is 0 (the session would end on disconnection)", paho.ErrInvalidArguments)
+	}
 	if cfg.Session == nil { // Must create this, or it will be recreated upon reconnection, and we will lose the session info
 		cfg.Session = state.NewInMemory()
 	}
 	innerCtx, cancel := context.WithCancel(ctx)
 	c := ConnectionManager{
-		cli:       nil,
-		connUp:    make(chan struct{}),
-		cfg:       cfg,
-		cancelCtx: cancel,
-		queue:     cfg.Queue,
-		done:      make(chan struct{}),
-		errors:    cfg.Errors,
-		debug:     cfg.Debug,
+		cli:        nil,
+		connUp:     make(chan struct{}),
+		cfg:        cfg,
+		cancelCtx:  cancel,
+		queue:      cfg.Queue,
+		done:       make(chan struct{}),
+		events:     newEventQueue(cfg.EventBufferSize),
+		errors:     errs,
+		debug:      debug,
+		pahoDebug:  pahoDebug,
+		pahoErrors: pahoErrors,
+
+		subscriptions: newSubscriptions(),
 	}
 	errChan := make(chan error, 1) // Will be sent one, and only one error per connection (buffered to prevent deadlock)
 	firstConnection := true        // Set to false after we have successfully connected
+	var redirect *url.URL          // Server to attempt first when reconnecting (see FollowServerReference)
 
 	go func() {
+		var stopErr error // Reason for shutdown (reported in EventStopped)
 		defer func() {
 			c.queueWg.Wait() // Separate goroutine handling queue may be running
+			c.stats.connectionDown()
+			c.events.emit(ConnectionEvent{Type: EventStopped, Err: stopErr})
+			c.events.close()
 			close(c.done)
 		}()
 
@@ -307,16 +475,45 @@ func NewConnection(ctx context.Context, cfg ClientConfig) (*ConnectionManager, e
 			cliCfg := cfg
 			cliCfg.OnClientError = eh.onClientError
 			cliCfg.OnServerDisconnect = eh.onServerDisconnect
-			cli, connAck := establishServerConnection(innerCtx, cliCfg, firstConnection)
+			c.events.emit(ConnectionEvent{Type: EventConnecting})
+			cli, connAck, connURL := establishServerConnection(innerCtx, cliCfg, firstConnection, redirect, &c.stats)
+			redirect = nil
 			if cli == nil {
+				stopErr = innerCtx.Err()
 				break mainLoop // Only occurs when context is cancelled
 			}
 
+			// If the server assigned a client identifier, it is used for subsequent connections (so the session,
+			// which is associated with the identifier, can be resumed)
+			assignedID := ""
+			if connAck.Properties != nil {
+				assignedID = connAck.Properties.AssignedClientID
+			}
+			if assignedID != "" && cfg.ClientID == "" {
+				cfg.ClientID = assignedID
+			}
+
 			c.mu.Lock()
 			c.cli = cli
 			c.connDown = make(chan struct{})
 			close(c.connUp)
+			if assignedID != "" {
+				c.assignedClientID = assignedID
+			}
 			c.mu.Unlock()
+			c.stats.connectionUp(firstConnection)
+			if ro, ok := cfg.Observer.(ReconnectObserver); ok && !firstConnection {
+				ro.OnReconnect()
+			}
+
+			if !connAck.SessionPresent { // The server holds no subscriptions
+				if cfg.ReconnectResubscribe {
+					c.resubscribe(innerCtx, cli)
+				} else {
+					c.subscriptions.reset()
+				}
+			}
+			c.events.emit(ConnectionEvent{Type: EventConnectionUp, Connack: connAck})
 
 			if cfg.OnConnectionUp != nil {
 				cfg.OnConnectionUp(&c, connAck)
@@ -352,6 +549,8 @@ func NewConnection(ctx context.Context, cfg ClientConfig) (*ConnectionManager, e
 				} else {
 					cfg.Debug.Printf("mainLoop: server connection handler exiting due to Disconnect call: %s\n", innerCtx.Err())
 				}
+				stopErr = innerCtx.Err()
+				c.events.emit(ConnectionEvent{Type: EventConnectionDown, Err: stopErr})
 				break mainLoop
 			}
 			<-cli.Done() // Wait for the client to fully shutdown
@@ -360,11 +559,30 @@ func NewConnection(ctx context.Context, cfg ClientConfig) (*ConnectionManager, e
 			close(c.connDown)
 			c.connUp = make(chan struct{})
 			c.mu.Unlock()
+			c.stats.connectionDown()
+			c.events.emit(ConnectionEvent{Type: EventConnectionDown, Err: err})
 
+			var de *DisconnectError
+			serverDisconnect := errors.As(err, &de)
+			if cfg.OnConnectionLost != nil && !serverDisconnect {
+				cfg.OnConnectionLost(err)
+			}
 			if cfg.OnConnectionDown != nil && !cfg.OnConnectionDown() {
 				cfg.Debug.Printf("mainLoop: connection to server lost (%s); OnConnectionDown aborts reconnect\n", err)
+				stopErr = err
 				break mainLoop
 			}
+			if cfg.FollowServerReference && serverDisconnect && de.ServerReference != "" {
+				var refErr error
+				if redirect, refErr = serverReferenceURL(de.ServerReference, connURL); refErr != nil {
+					cfg.Errors.Printf("mainLoop: ignoring invalid server reference (%s): %s\n", de.ServerReference, refErr)
+				} else {
+					cfg.Debug.Printf("mainLoop: server reference received; will connect to %s\n", redirect)
+				}
+				if cfg.OnServerReference != nil {
+					cfg.OnServerReference(de.ServerReference, connURL, redirect, refErr)
+				}
+			}
 			cfg.Debug.Printf("mainLoop: connection to server lost (%s); will reconnect\n", err)
 		}
 		cfg.Debug.Println("mainLoop: connection manager has terminated")
@@ -372,6 +590,15 @@ func NewConnection(ctx context.Context, cfg ClientConfig) (*ConnectionManager, e
 	return &c, nil
 }
 
+// Events returns a channel that receives connection state transitions (EventConnecting, EventConnectionUp,
+// EventConnectionDown and, finally, EventStopped), enabling these to be handled in a single goroutine as an alternative
+// to the OnConnectionUp/OnConnectionDown callbacks. The channel is buffered (see ClientConfig.EventBufferSize); if the
+// buffer is full then the oldest event is discarded, so events are never blocked on a slow reader (but may be missed).
+// The channel is closed when the ConnectionManager has shutdown (just before Done is closed).
+func (c *ConnectionManager) Events() <-chan ConnectionEvent {
+	return c.events.ch
+}
+
 // Disconnect closes the connection (if one is up) and shuts down any active processes before returning
 func (c *ConnectionManager) Disconnect(ctx context.Context) error {
 	c.cancelCtx()
@@ -383,27 +610,145 @@ func (c *ConnectionManager) Disconnect(ctx context.Context) error {
 	}
 }
 
+// queueWaitForEmpty may be implemented by a queue.Queue (both queue/memory and queue/file do); it is used by Shutdown.
+type queueWaitForEmpty interface {
+	WaitForEmpty() chan struct{}
+}
+
+// sessionWaitForNoInflight may be implemented by a session.SessionManager (state.State does); it is used by Shutdown.
+type sessionWaitForNoInflight interface {
+	InflightPublishes() int
+	WaitForNoInflightPublishes() chan struct{}
+}
+
+// errStopped is returned by awaitDelivery if the connection manager shuts down whilst it is waiting
+var errStopped = errors.New("connection manager shutdown before all messages were delivered")
+
+// deliveryPollInterval is the interval at which awaitDelivery checks for outstanding messages when the queue, or
+// session, cannot notify it when they have been delivered
+const deliveryPollInterval = 100 * time.Millisecond
+
+// AwaitDelivery blocks until all queued messages (see PublishViaQueue) have been transmitted, and all QOS1+ messages
+// have been acknowledged, whilst leaving the connection up (use Shutdown if you wish to disconnect afterwards).
+// Messages published whilst waiting are included. If ctx is done, or the connection manager shuts down, before this
+// completes, an error (wrapping ctx.Err() where relevant) reporting the number of messages outstanding is returned.
+// Note: As with Shutdown, only queues that implement WaitForEmpty() or queue.Lengther, and sessions that implement
+// WaitForNoInflightPublishes(), can be waited upon (the default queue and session implementations do); where
+// WaitForEmpty() is not available the queue length is polled.
+func (c *ConnectionManager) AwaitDelivery(ctx context.Context) error {
+	if err := c.awaitDelivery(ctx); err != nil {
+		return fmt.Errorf("%d message(s) undelivered: %w", c.undelivered(), err)
+	}
+	return nil
+}
+
+// awaitDelivery waits until the queue is empty and there are no QOS1+ messages inflight. Returns ctx.Err() if ctx
+// is done, or errStopped if the connection manager shuts down, first.
+func (c *ConnectionManager) awaitDelivery(ctx context.Context) error {
+	q, qOk := c.queue.(queueWaitForEmpty)
+	sess, sOk := c.cfg.Session.(sessionWaitForNoInflight)
+	for {
+		if qOk {
+			select {
+			case <-q.WaitForEmpty():
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-c.done: // connection manager has already shutdown (so queue will not be processed)
+				return errStopped
+			}
+		}
+		if sOk {
+			select {
+			case <-sess.WaitForNoInflightPublishes():
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-c.done:
+				return errStopped
+			}
+		}
+		// Messages may have been published whilst we were waiting. The queue is checked first because messages are
+		// added to the session before being removed from the queue.
+		if c.undelivered() == 0 {
+			return nil
+		}
+		if !qOk || !sOk { // No notification will be received when delivery completes, so poll (rather than spinning)
+			select {
+			case <-time.After(deliveryPollInterval):
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-c.done:
+				return errStopped
+			}
+		}
+	}
+}
+
+// undelivered returns the number of messages in the queue plus the number of QOS1+ messages inflight (where
+// these can be determined).
+func (c *ConnectionManager) undelivered() int {
+	var undelivered int
+	if l, ok := c.queue.(queue.Lengther); ok {
+		if n, err := l.Len(); err == nil {
+			undelivered += n
+		}
+	}
+	if sess, ok := c.cfg.Session.(sessionWaitForNoInflight); ok {
+		undelivered += sess.InflightPublishes()
+	}
+	return undelivered
+}
+
+// Shutdown attempts to deliver any queued messages (see PublishViaQueue) and waits for any QOS1+ messages to be
+// acknowledged before disconnecting (as per Disconnect). If ctx is done before this completes, the connection will be
+// closed anyway and an error returned (wrapping ctx.Err()) which reports the number of messages not delivered.
+// Note: Only queues that implement WaitForEmpty() or queue.Lengther, and sessions that implement
+// WaitForNoInflightPublishes(), can be drained (the default queue and session implementations do); where
+// WaitForEmpty() is not available the queue length is polled.
+func (c *ConnectionManager) Shutdown(ctx context.Context) error {
+	err := c.awaitDelivery(ctx)
+	if errors.Is(err, errStopped) {
+		err = nil // reported below if anything is undelivered
+	}
+
+	c.cancelCtx()
+	<-c.done // wait for goroutine to exit (the context has been cancelled so this should not take long)
+
+	if undelivered := c.undelivered(); err != nil || undelivered > 0 {
+		if err == nil {
+			err = errStopped
+		}
+		return fmt.Errorf("%d message(s) undelivered: %w", undelivered, err)
+	}
+	return nil
+}
+
 // Done returns a channel that will be closed when the connection handler has shutdown cleanly
 // Note: We cannot currently tell when the mqtt has fully shutdown (so it may still be in the process of closing down)
 func (c *ConnectionManager) Done() <-chan struct{} {
 	return c.done
 }
 
-// AwaitConnection will return when the connection comes up or the context is cancelled (only returns an error
-// if context is cancelled). If you require more complex connection management then consider using the OnConnectionUp
-// callback.
+// AwaitConnection will return when the connection comes up, the context is cancelled (ctx.Err() is returned) or the
+// ConnectionManager stops (ErrManagerStopped is returned; this includes calls made after it has stopped). All waiting
+// callers are released when the ConnectionManager stops. If you require more complex connection management then
+// consider using the OnConnectionUp callback.
 func (c *ConnectionManager) AwaitConnection(ctx context.Context) error {
 	c.mu.Lock()
 	ch := c.connUp
 	c.mu.Unlock()
 
+	select {
+	case <-c.done: // Checked first, as connUp may remain closed after the manager has stopped
+		return ErrManagerStopped
+	default:
+	}
 	select {
 	case <-ch:
 		return nil
 	case <-ctx.Done():
 		return ctx.Err()
 	case <-c.done: // If connection process is cancelled we should exit
-		return fmt.Errorf("connection manager shutting down")
+		return ErrManagerStopped
 	}
 }
 
@@ -435,7 +780,12 @@ func (c *ConnectionManager) Subscribe(ctx context.Context, s *paho.Subscribe) (*
 	if cli == nil {
 		return nil, ConnectionDownError
 	}
-	return cli.Subscribe(ctx, s)
+	sa, err := cli.Subscribe(ctx, s)
+	c.subscriptions.subscribed(s, sa)
+	if err == nil {
+		c.warnOnSubscriptionMismatch()
+	}
+	return sa, err
 }
 
 // Unsubscribe is used to send an Unsubscribe request to the MQTT server.
@@ -450,18 +800,137 @@ func (c *ConnectionManager) Unsubscribe(ctx context.Context, u *paho.Unsubscribe
 	if cli == nil {
 		return nil, ConnectionDownError
 	}
-	return cli.Unsubscribe(ctx, u)
+	ua, err := cli.Unsubscribe(ctx, u)
+	c.subscriptions.unsubscribed(u, ua)
+	if err == nil {
+		c.warnOnSubscriptionMismatch()
+	}
+	return ua, err
+}
+
+// SubscribeWithHandler subscribes to a single topic filter and registers h with ClientConfig.Router for that filter
+// (see paho.Client.SubscribeWithHandler). If the subscription is not accepted the handler is removed again (along with
+// any other handlers for the same filter) and the error will be a *paho.SubscribeError holding the reason code.
+// The subscription is recorded in the same way as one made via Subscribe, and the Router is retained across
+// connections, so the two remain aligned following a reconnection.
+func (c *ConnectionManager) SubscribeWithHandler(ctx context.Context, o paho.SubscribeOptions, h paho.MessageHandler) (*paho.Suback, error) {
+	if h == nil {
+		return nil, fmt.Errorf("%w: handler must not be nil", paho.ErrInvalidArguments)
+	}
+	if c.cfg.Router == nil {
+		return nil, fmt.Errorf("%w: no router to register handler with", paho.ErrInvalidArguments)
+	}
+
+	c.cfg.Router.RegisterHandler(o.Topic, h)
+	sa, err := c.Subscribe(ctx, &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{o}})
+	if err != nil {
+		c.cfg.Router.UnregisterHandler(o.Topic)
+	}
+	return sa, err
+}
+
+// UnsubscribeWithHandler unsubscribes from a single topic filter and, once the server has accepted the request,
+// unregisters the handlers for that filter from ClientConfig.Router.
+func (c *ConnectionManager) UnsubscribeWithHandler(ctx context.Context, topic string) (*paho.Unsuback, error) {
+	if c.cfg.Router == nil {
+		return nil, fmt.Errorf("%w: no router to unregister handler from", paho.ErrInvalidArguments)
+	}
+
+	ua, err := c.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{topic}})
+	if err == nil {
+		c.cfg.Router.UnregisterHandler(topic)
+	}
+	return ua, err
+}
+
+// SubscriptionChanges holds the responses to the requests sent by ModifySubscriptions (either may be nil if no
+// request was needed, or no response was received).
+type SubscriptionChanges struct {
+	Suback   *paho.Suback
+	Unsuback *paho.Unsuback
+}
+
+// ModifySubscriptions subscribes to the filters in add, and unsubscribes from those in remove, waiting for both the
+// SUBACK and UNSUBACK. MQTT provides no way to change subscriptions atomically; the SUBSCRIBE and UNSUBSCRIBE are
+// sent together (rather than waiting for one to be acknowledged before sending the other), minimising the period
+// in which messages may be missed or duplicated, but the server may process them in either order. The recorded
+// subscriptions (see ReconnectResubscribe) are updated in a single step once the responses are received.
+// A topic filter may not appear in both add and remove.
+func (c *ConnectionManager) ModifySubscriptions(ctx context.Context, add []paho.SubscribeOptions, remove []string) (*SubscriptionChanges, error) {
+	if len(add) == 0 && len(remove) == 0 {
+		return nil, fmt.Errorf("%w: no subscriptions to add or remove", paho.ErrInvalidArguments)
+	}
+	for _, topic := range remove {
+		for _, a := range add {
+			if a.Topic == topic {
+				return nil, fmt.Errorf("%w: %q is both added and removed", paho.ErrInvalidArguments, topic)
+			}
+		}
+	}
+
+	c.mu.Lock()
+	cli := c.cli
+	c.mu.Unlock()
+
+	if cli == nil {
+		return nil, ConnectionDownError
+	}
+
+	var (
+		res              SubscriptionChanges
+		subErr, unsubErr error
+		wg               sync.WaitGroup
+	)
+	s := &paho.Subscribe{Subscriptions: add}
+	if len(add) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res.Suback, subErr = cli.Subscribe(ctx, s)
+			if subErr != nil {
+				subErr = fmt.Errorf("subscribe failed: %w", subErr)
+			}
+		}()
+	}
+	u := &paho.Unsubscribe{Topics: remove}
+	if len(remove) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res.Unsuback, unsubErr = cli.Unsubscribe(ctx, u)
+			if unsubErr != nil {
+				unsubErr = fmt.Errorf("unsubscribe failed: %w", unsubErr)
+			}
+		}()
+	}
+	wg.Wait()
+
+	c.subscriptions.modified(s, res.Suback, u, res.Unsuback)
+	err := errors.Join(subErr, unsubErr)
+	if err == nil {
+		c.warnOnSubscriptionMismatch()
+	}
+	return &res, err
 }
 
 // Publish is used to send a publication to the MQTT server.
 // It is passed a pre-prepared `PUBLISH` packet and blocks waiting for the appropriate response,
 // or for the timeout to fire.
 // Any response message is returned from the function, along with any errors.
+// If publishing is paused (see Pause), the message will be queued (and PublishQueuedError returned) or, if it is QOS0
+// and DropQoS0WhilePaused is set, discarded (and PublishDroppedError returned).
 func (c *ConnectionManager) Publish(ctx context.Context, p *paho.Publish) (*paho.PublishResponse, error) {
 	c.mu.Lock()
 	cli := c.cli
+	paused := c.resume != nil
 	c.mu.Unlock()
 
+	if paused {
+		if err := c.PublishViaQueue(ctx, &QueuePublish{Publish: p}); err != nil {
+			return nil, err
+		}
+		return nil, PublishQueuedError
+	}
 	if cli == nil {
 		return nil, ConnectionDownError
 	}
@@ -485,14 +954,222 @@ type QueuePublish struct {
 //   - Set SessionExpiryInterval such that sessions will outlive anticipated outages (this impacts inflight messages only)
 //   - Set ClientConfig.Session to a session manager with persistent storage
 //   - Set ClientConfig.Queue to a queue with persistent storage
+//
+// If publishing is paused (see Pause) then messages will remain in the queue until Resume is called (QOS0 messages
+// will be discarded, and PublishDroppedError returned, if DropQoS0WhilePaused is set).
+// If QueueCapacity is set, and the queue is full, QueueFullPolicy determines the outcome (when the policy is
+// QueueFullBlock, ctx may be used to limit the time spent waiting).
+// If the message has a Message Expiry Interval, and the queue entries implement queue.EnqueuedAter (as the memory
+// and file queues do), the interval is reduced by the time spent in the queue, and the message is discarded if it
+// expires before it can be transmitted.
 func (c *ConnectionManager) PublishViaQueue(ctx context.Context, p *QueuePublish) error {
+	if p.QoS == 0 && c.cfg.DropQoS0WhilePaused && c.Paused() {
+		return PublishDroppedError
+	}
+	if p.Topic != "" || p.Properties == nil || p.Properties.TopicAlias == nil {
+		if err := paho.ValidatePublishTopic(p.Topic); err != nil {
+			return fmt.Errorf("%w: %w", paho.ErrInvalidArguments, err)
+		}
+	}
 	var b bytes.Buffer
 	if _, err := p.Packet().WriteTo(&b); err != nil {
 		return err
 	}
+	if c.cfg.QueueCapacity > 0 {
+		return c.enqueueBounded(ctx, p.Publish, &b)
+	}
 	return c.queue.Enqueue(&b)
 }
 
+// Pause stops messages being transmitted from the publish queue, and results in calls to Publish queueing the message
+// (rather than transmitting it), until Resume is called. The connection is not affected, so messages may still be
+// received, and a paused ConnectionManager will remain paused following a reconnection.
+// Note: Messages already passed to the client (e.g. a Publish call that began before Pause was called) will still be
+// transmitted.
+func (c *ConnectionManager) Pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resume == nil {
+		c.debug.Println("publishing paused")
+		c.resume = make(chan struct{})
+	}
+}
+
+// Resume restarts publishing following a call to Pause; queued messages will be transmitted in order.
+func (c *ConnectionManager) Resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resume != nil {
+		c.debug.Println("publishing resumed")
+		close(c.resume)
+		c.resume = nil
+	}
+}
+
+// Paused returns true if publishing is paused (see Pause)
+func (c *ConnectionManager) Paused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resume != nil
+}
+
+// awaitResume blocks whilst publishing is paused. Returns false if the connection drops (or ctx is cancelled) before
+// publishing is resumed.
+func (c *ConnectionManager) awaitResume(ctx context.Context, connDown <-chan struct{}) bool {
+	c.mu.Lock()
+	resume := c.resume
+	c.mu.Unlock()
+	if resume == nil {
+		return true
+	}
+	c.debug.Println("queue waiting for publishing to be resumed")
+	select {
+	case <-ctx.Done():
+		return false
+	case <-connDown:
+		return false
+	case <-resume:
+		return true
+	}
+}
+
+// Stats returns a snapshot of statistics relating to the connection (traffic totals, uptime etc).
+func (c *ConnectionManager) Stats() ConnectionStats {
+	cs := c.stats.snapshot()
+	cs.QueuedMessages = -1
+	if l, ok := c.queue.(queue.Lengther); ok {
+		if n, err := l.Len(); err == nil {
+			cs.QueuedMessages = n
+		}
+	}
+	cs.InflightMessages = -1
+	if sess, ok := c.cfg.Session.(sessionWaitForNoInflight); ok {
+		cs.InflightMessages = sess.InflightPublishes()
+	}
+	c.mu.Lock()
+	cli := c.cli
+	c.mu.Unlock()
+	if cli != nil {
+		if sp := cli.ServerProperties(); sp != nil {
+			cs.SendWindow = int(sp.ReceiveMaximum)
+			if c.cfg.SendWindow > 0 && int(c.cfg.SendWindow) < cs.SendWindow {
+				cs.SendWindow = int(c.cfg.SendWindow)
+			}
+		}
+		cs.TopicAliases = cli.TopicAliasStats()
+	}
+	return cs
+}
+
+// ConnectionHealth returns a snapshot of the health of the connection, suitable for use by liveness/readiness probes.
+// Healthy reflects the keepalive mechanism (see HealthStatus.PingOverdue) so will become false if the server stops
+// responding, even before the Pinger closes the connection.
+func (c *ConnectionManager) ConnectionHealth() HealthStatus {
+	return c.stats.health(time.Duration(c.cfg.KeepAlive) * time.Second)
+}
+
+// AssignedClientID returns the client identifier assigned by the server when ClientConfig.ClientID is empty (empty
+// until a CONNACK assigning an identifier has been received). The assigned identifier is used when reconnecting, so
+// the session can be resumed; to resume it following a restart, store the identifier and set ClientConfig.ClientID.
+func (c *ConnectionManager) AssignedClientID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.assignedClientID
+}
+
+// ServerProperties returns the values negotiated with the server when the current connection was established (nil
+// if the connection is down).
+func (c *ConnectionManager) ServerProperties() *paho.ServerConnackProperties {
+	c.mu.Lock()
+	cli := c.cli
+	c.mu.Unlock()
+	if cli == nil {
+		return nil
+	}
+	return cli.ServerProperties()
+}
+
+// SessionPresent returns the Session Present flag from the CONNACK for the current connection; true if the server
+// resumed an existing session, false if a new session was created (or the connection is down). The CONNACK is also
+// passed to OnConnectionUp (check Connack.SessionPresent there to decide whether state needs to be reestablished).
+func (c *ConnectionManager) SessionPresent() bool {
+	c.mu.Lock()
+	cli := c.cli
+	c.mu.Unlock()
+	if cli == nil {
+		return false
+	}
+	return cli.SessionPresent()
+}
+
+// InflightPublishes returns information on the QOS1/2 PUBLISH transactions that are in progress (nil if the Session
+// does not implement session.InflightManager). This includes messages awaiting retransmission whilst the connection
+// is down.
+func (c *ConnectionManager) InflightPublishes() []session.InflightInfo {
+	im, ok := c.cfg.Session.(session.InflightManager)
+	if !ok {
+		return nil
+	}
+	return im.InflightPublishInfo()
+}
+
+// CancelPublish abandons the QOS1/2 PUBLISH transaction with the specified packet identifier (see
+// paho.Client.CancelPublish). This may be called whilst the connection is down.
+func (c *ConnectionManager) CancelPublish(packetID uint16) error {
+	c.mu.Lock()
+	cli := c.cli
+	c.mu.Unlock()
+	if cli != nil {
+		return cli.CancelPublish(packetID)
+	}
+	im, ok := c.cfg.Session.(session.InflightManager)
+	if !ok {
+		return fmt.Errorf("%w: session does not support CancelPublish", paho.ErrInvalidArguments)
+	}
+	if err := im.CancelPublish(packetID); err != nil {
+		return fmt.Errorf("cannot cancel publish %d: %w", packetID, err)
+	}
+	return nil
+}
+
+// ResetLocalSession discards the session state held locally (see paho.Client.ResetLocalSession for details of how
+// this interacts with Clean Start and the server's Session Present flag). It may only be called whilst the connection
+// is down (e.g. from OnConnectionDown, or when AwaitConnection has not returned); an error wrapping
+// session.ErrConnectionActive is returned otherwise. To reset the session before the initial connection, call
+// Reset on the session.SessionManager before passing it to NewConnection (via ClientConfig.Session).
+func (c *ConnectionManager) ResetLocalSession() error {
+	r, ok := c.cfg.Session.(session.Resetter)
+	if !ok {
+		return fmt.Errorf("%w: session does not support reset", paho.ErrInvalidArguments)
+	}
+	if err := r.Reset(); err != nil {
+		return fmt.Errorf("cannot reset session: %w", err)
+	}
+	return nil
+}
+
+// SetDebugLogger replaces the logger used for autopaho debug output (ClientConfig.Debug); it may be called at any time
+func (c *ConnectionManager) SetDebugLogger(l log.Logger) {
+	c.debug.Set(l)
+}
+
+// SetErrorLogger replaces the logger used for autopaho errors (ClientConfig.Errors); it may be called at any time
+func (c *ConnectionManager) SetErrorLogger(l log.Logger) {
+	c.errors.Set(l)
+}
+
+// SetPahoDebugLogger replaces the debug logger passed to the paho.Client (ClientConfig.PahoDebug). The change applies
+// to the current connection (if any) and all subsequent connections.
+func (c *ConnectionManager) SetPahoDebugLogger(l log.Logger) {
+	c.pahoDebug.Set(l)
+}
+
+// SetPahoErrorLogger replaces the error logger passed to the paho.Client (ClientConfig.PahoErrors). The change applies
+// to the current connection (if any) and all subsequent connections.
+func (c *ConnectionManager) SetPahoErrorLogger(l log.Logger) {
+	c.pahoErrors.Set(l)
+}
+
 // TerminateConnectionForTest closes the active connection (if any). This function is intended for testing only, it
 // simulates connection loss which supports testing QOS1 and 2 message delivery.
 func (c *ConnectionManager) TerminateConnectionForTest() {
@@ -536,6 +1213,34 @@ func (c *ConnectionManager) AddOnPublishReceived(f func(PublishReceived) (bool,
 	}
 }
 
+// queuedMessageExpired reduces the Message Expiry Interval of pub (read from entry) by the time it has been in the
+// queue, returning true if the message has expired (so should be discarded). Messages are sent unaltered if the entry
+// does not implement queue.EnqueuedAter.
+func queuedMessageExpired(entry queue.Entry, pub *packets.Publish) (bool, error) {
+	if pub.Properties == nil || pub.Properties.MessageExpiry == nil {
+		return false, nil
+	}
+	if h, ok := entry.(*heldEntry); ok {
+		entry = h.Entry
+	}
+	ea, ok := entry.(queue.EnqueuedAter)
+	if !ok {
+		return false, nil
+	}
+	enqueuedAt, err := ea.EnqueuedAt()
+	if err != nil {
+		return false, err
+	}
+	expiry := time.Duration(*pub.Properties.MessageExpiry) * time.Second
+	elapsed := max(time.Since(enqueuedAt), 0)
+	if elapsed >= expiry {
+		return true, nil
+	}
+	remaining := uint32((expiry - elapsed + time.Second - 1) / time.Second) // round up (0 would mean no expiry)
+	pub.Properties.MessageExpiry = &remaining
+	return false, nil
+}
+
 // managePublishQueue sends messages from the publish queue.
 // blocks until the context is cancelled.
 func (c *ConnectionManager) managePublishQueue(ctx context.Context) error {
@@ -569,7 +1274,10 @@ connectionLoop:
 
 			// Connection is up, and we have at least one thing to send
 			for {
-				entry, err := c.queue.Peek() // If this succeeds, we MUST call Remove, Quarantine or Leave
+				if !c.awaitResume(ctx, connDown) {
+					continue connectionLoop
+				}
+				entry, err := c.peekQueue() // If this succeeds, we MUST call Remove, Quarantine or Leave
 				if errors.Is(err, queue.ErrEmpty) {
 					c.debug.Println("everything in queue transmitted")
 					continue queueLoop
@@ -609,6 +1317,15 @@ connectionLoop:
 					}
 					continue
 				}
+				if expired, err := queuedMessageExpired(entry, pub); err != nil {
+					c.errors.Printf("failed to determine when queued message was enqueued: %s", err)
+				} else if expired {
+					c.debug.Printf("queued message with topic %s expired; discarding", pub.Topic)
+					if err := entry.Remove(); err != nil {
+						c.errors.Printf("error removing queue entry: %s", err)
+					}
+					continue
+				}
 				pub2 := paho.Publish{
 					PacketID: 0,
 					QoS:      pub.QoS,
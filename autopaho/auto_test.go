@@ -20,11 +20,16 @@ package autopaho
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/synctest"
 	"time"
@@ -32,6 +37,8 @@ import (
 	"github.com/eclipse/paho.golang/internal/testserver"
 	"github.com/eclipse/paho.golang/packets"
 	paholog "github.com/eclipse/paho.golang/paho/log"
+	"github.com/eclipse/paho.golang/paho/pahotest"
+	"github.com/eclipse/paho.golang/paho/session/state"
 	"go.uber.org/goleak"
 
 	"github.com/eclipse/paho.golang/paho"
@@ -282,6 +289,1325 @@ func TestReconnect(t *testing.T) {
 	})
 }
 
+// TestReconnectBackoffStrategy confirms that the backoff strategy is passed the attempt number and previous error
+func TestReconnectBackoffStrategy(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		server, _ := url.Parse(dummyURL)
+		logger := paholog.NewTestLogger(t, "test:")
+		ts := testserver.New(paholog.NewTestLogger(t, "testServer:"))
+
+		errAttempt := errors.New("connection attempt failed")
+		type delayCall struct {
+			attempt int
+			err     error
+		}
+		var delayCalls []delayCall // only accessed from the connection goroutine until connection up
+		atCount := 0
+		var tsDone chan struct{}
+		pahoConnUpChan := make(chan struct{}, 1)
+
+		config := ClientConfig{
+			ServerUrls: []*url.URL{server},
+			KeepAlive:  60,
+			ReconnectBackoffStrategy: BackoffFunc(func(attempt int, lastErr error) time.Duration {
+				delayCalls = append(delayCalls, delayCall{attempt: attempt, err: lastErr})
+				return time.Millisecond
+			}),
+			ConnectTimeout: shortDelay,
+			AttemptConnection: func(ctx context.Context, _ ClientConfig, _ *url.URL) (net.Conn, error) {
+				atCount++
+				if atCount <= 2 {
+					return nil, errAttempt
+				}
+				conn, done, err := ts.Connect(ctx)
+				tsDone = done
+				return conn, err
+			},
+			OnConnectionUp: func(*ConnectionManager, *paho.Connack) { pahoConnUpChan <- struct{}{} },
+			Debug:          logger,
+			PahoDebug:      logger,
+			PahoErrors:     logger,
+			ClientConfig: paho.ClientConfig{
+				ClientID: "test",
+			},
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cm, err := NewConnection(ctx, config)
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+		select {
+		case <-pahoConnUpChan:
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting connection up")
+		}
+
+		if len(delayCalls) != 3 {
+			t.Fatalf("expected 3 calls to backoff strategy, got %d", len(delayCalls))
+		}
+		for i, dc := range delayCalls {
+			if dc.attempt != i {
+				t.Errorf("call %d: expected attempt %d, got %d", i, i, dc.attempt)
+			}
+			if i == 0 && dc.err != nil {
+				t.Errorf("call 0: expected nil error, got %s", dc.err)
+			}
+			if i > 0 && !errors.Is(dc.err, errAttempt) {
+				t.Errorf("call %d: expected error wrapping %s, got %v", i, errAttempt, dc.err)
+			}
+		}
+
+		cancel()
+		select {
+		case <-cm.Done():
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting connection manager shutdown")
+		}
+		select {
+		case <-tsDone:
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting test server shutdown")
+		}
+	})
+}
+
+// TestOnConnectAttemptFailed confirms that the callback is called for each failed attempt (including CONNACK rejection)
+func TestOnConnectAttemptFailed(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		server, _ := url.Parse(dummyURL)
+		logger := paholog.NewTestLogger(t, "test:")
+		ts := testserver.New(paholog.NewTestLogger(t, "testServer:"))
+		rejectConnect := true
+		ts.SetConnectCallback(func(cp *packets.Connect, ca *packets.Connack) {
+			if rejectConnect {
+				ca.ReasonCode = packets.ConnackNotAuthorized
+			}
+		})
+
+		errAttempt := errors.New("connection attempt failed")
+		type failedAttempt struct {
+			u       *url.URL
+			attempt int
+			err     error
+		}
+		var failed []failedAttempt
+		var connectErrs []error
+		atCount := 0
+		var tsDone chan struct{}
+		pahoConnUpChan := make(chan struct{}, 1)
+
+		config := ClientConfig{
+			ServerUrls:       []*url.URL{server},
+			KeepAlive:        60,
+			ReconnectBackoff: NewConstantBackoff(time.Millisecond),
+			ConnectTimeout:   shortDelay,
+			AttemptConnection: func(ctx context.Context, _ ClientConfig, _ *url.URL) (net.Conn, error) {
+				atCount++
+				switch atCount {
+				case 1:
+					return nil, errAttempt
+				case 3:
+					<-tsDone // Previous (rejected) connection must be fully closed
+					rejectConnect = false
+				}
+				conn, done, err := ts.Connect(ctx)
+				tsDone = done
+				return conn, err
+			},
+			OnConnectAttemptFailed: func(u *url.URL, attempt int, err error) {
+				failed = append(failed, failedAttempt{u: u, attempt: attempt, err: err})
+			},
+			OnConnectError: func(err error) {
+				if len(failed) != len(connectErrs)+1 {
+					t.Errorf("OnConnectAttemptFailed should be called before OnConnectError")
+				}
+				connectErrs = append(connectErrs, err)
+			},
+			OnConnectionUp: func(*ConnectionManager, *paho.Connack) { pahoConnUpChan <- struct{}{} },
+			Debug:          logger,
+			PahoDebug:      logger,
+			PahoErrors:     logger,
+			ClientConfig: paho.ClientConfig{
+				ClientID: "test",
+			},
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cm, err := NewConnection(ctx, config)
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+		select {
+		case <-pahoConnUpChan:
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting connection up")
+		}
+
+		if len(failed) != 2 {
+			t.Fatalf("expected 2 failed attempts, got %d", len(failed))
+		}
+		if len(connectErrs) != 2 {
+			t.Fatalf("expected 2 calls to OnConnectError, got %d", len(connectErrs))
+		}
+		for i, f := range failed {
+			if f.u != server {
+				t.Errorf("attempt %d: unexpected url %s", i, f.u)
+			}
+			if f.attempt != i+1 {
+				t.Errorf("attempt %d: expected attempt number %d, got %d", i, i+1, f.attempt)
+			}
+		}
+		if !errors.Is(failed[0].err, errAttempt) {
+			t.Errorf("expected first error to wrap %s, got %v", errAttempt, failed[0].err)
+		}
+		var connackErr *ConnackError
+		if !errors.As(failed[1].err, &connackErr) || connackErr.ReasonCode != packets.ConnackNotAuthorized {
+			t.Errorf("expected second error to be a ConnackError (not authorized), got %v", failed[1].err)
+		}
+
+		cancel()
+		select {
+		case <-cm.Done():
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting connection manager shutdown")
+		}
+		select {
+		case <-tsDone:
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting test server shutdown")
+		}
+	})
+}
+
+// TestTlsConfigFn checks that TlsConfigFn is called before each connection attempt and that an error is handled as
+// a failed attempt (with the connection being retried)
+func TestTlsConfigFn(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		server, _ := url.Parse(dummyURL)
+		logger := paholog.NewTestLogger(t, "test:")
+		ts := testserver.New(paholog.NewTestLogger(t, "testServer:"))
+
+		errTls := errors.New("certificate unavailable")
+		fnCount := 0
+		var failed []error
+		type tsConnUpMsg struct {
+			tlsCfg   *tls.Config // TlsCfg passed to AttemptConnection
+			cancelFn func()
+			done     chan struct{}
+		}
+		tsConnUpChan := make(chan tsConnUpMsg, 1)
+		pahoConnUpChan := make(chan struct{}, 1)
+
+		config := ClientConfig{
+			ServerUrls:       []*url.URL{server},
+			KeepAlive:        60,
+			ReconnectBackoff: NewConstantBackoff(time.Millisecond),
+			ConnectTimeout:   shortDelay,
+			TlsConfigFn: func(context.Context) (*tls.Config, error) {
+				fnCount++
+				if fnCount == 1 {
+					return nil, errTls
+				}
+				return &tls.Config{ServerName: fmt.Sprintf("cfg%d", fnCount)}, nil
+			},
+			AttemptConnection: func(ctx context.Context, cfg ClientConfig, _ *url.URL) (net.Conn, error) {
+				ctx, cancel := context.WithCancel(ctx)
+				conn, done, err := ts.Connect(ctx)
+				if err == nil { // The above may fail if attempted too quickly (before disconnect processed)
+					tsConnUpChan <- tsConnUpMsg{tlsCfg: cfg.TlsCfg, cancelFn: cancel, done: done}
+				} else {
+					cancel()
+				}
+				return conn, err
+			},
+			OnConnectAttemptFailed: func(_ *url.URL, _ int, err error) { failed = append(failed, err) },
+			OnConnectionUp:         func(*ConnectionManager, *paho.Connack) { pahoConnUpChan <- struct{}{} },
+			Debug:                  logger,
+			PahoDebug:              logger,
+			PahoErrors:             logger,
+			ClientConfig: paho.ClientConfig{
+				ClientID: "test",
+			},
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cm, err := NewConnection(ctx, config)
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+
+		var initialConnUpMsg tsConnUpMsg
+		select {
+		case initialConnUpMsg = <-tsConnUpChan:
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting initial connection request")
+		}
+		select {
+		case <-pahoConnUpChan:
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting connection up")
+		}
+		if len(failed) != 1 || !errors.Is(failed[0], errTls) {
+			t.Fatalf("expected a single failed attempt wrapping %s, got %v", errTls, failed)
+		}
+		if initialConnUpMsg.tlsCfg == nil || initialConnUpMsg.tlsCfg.ServerName != "cfg2" {
+			t.Fatalf("expected AttemptConnection to receive the config from TlsConfigFn, got %v", initialConnUpMsg.tlsCfg)
+		}
+
+		// Force a disconnect; a fresh config should be obtained for the reconnection
+		initialConnUpMsg.cancelFn()
+		select {
+		case <-initialConnUpMsg.done:
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting test server shutdown")
+		}
+		var reconnectMsg tsConnUpMsg
+		select {
+		case reconnectMsg = <-tsConnUpChan:
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting reconnection request")
+		}
+		select {
+		case <-pahoConnUpChan:
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting reconnection up")
+		}
+		if reconnectMsg.tlsCfg == nil || reconnectMsg.tlsCfg == initialConnUpMsg.tlsCfg {
+			t.Fatalf("expected a fresh config on reconnection, got %v", reconnectMsg.tlsCfg)
+		}
+
+		cancel()
+		select {
+		case <-cm.Done():
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting connection manager shutdown")
+		}
+		select {
+		case <-reconnectMsg.done:
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting test server shutdown")
+		}
+	})
+}
+
+// TestReconnectResubscribe checks that subscriptions are reestablished when the session is lost (and only then)
+func TestReconnectResubscribe(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		server, _ := url.Parse(dummyURL)
+		logger := paholog.NewTestLogger(t, "test:")
+		ts := testserver.New(paholog.NewTestLogger(t, "testServer:"))
+
+		var mu sync.Mutex
+		sessionPresent := false
+		var subscribes []*packets.Subscribe
+		ts.SetConnectCallback(func(cp *packets.Connect, ca *packets.Connack) {
+			mu.Lock()
+			ca.SessionPresent = sessionPresent
+			mu.Unlock()
+		})
+		ts.SetPacketReceivedCallback(func(cp *packets.ControlPacket) error {
+			if cp.Type == packets.SUBSCRIBE {
+				mu.Lock()
+				subscribes = append(subscribes, cp.Content.(*packets.Subscribe))
+				mu.Unlock()
+			}
+			return nil
+		})
+		getSubscribes := func() []*packets.Subscribe {
+			mu.Lock()
+			defer mu.Unlock()
+			s := subscribes
+			subscribes = nil
+			return s
+		}
+
+		var tsDone chan struct{}
+		pahoConnUpChan := make(chan struct{}, 1)
+		config := ClientConfig{
+			ServerUrls:           []*url.URL{server},
+			KeepAlive:            60,
+			ReconnectBackoff:     NewConstantBackoff(time.Millisecond),
+			ConnectTimeout:       shortDelay,
+			ReconnectResubscribe: true,
+			AttemptConnection: func(ctx context.Context, _ ClientConfig, _ *url.URL) (net.Conn, error) {
+				if tsDone != nil {
+					<-tsDone // Previous connection must be fully closed
+				}
+				conn, done, err := ts.Connect(ctx)
+				tsDone = done
+				return conn, err
+			},
+			OnConnectionUp: func(*ConnectionManager, *paho.Connack) { pahoConnUpChan <- struct{}{} },
+			Debug:          logger,
+			PahoDebug:      logger,
+			PahoErrors:     logger,
+			ClientConfig: paho.ClientConfig{
+				ClientID: "test",
+			},
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cm, err := NewConnection(ctx, config)
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+		awaitConnUp := func() {
+			select {
+			case <-pahoConnUpChan:
+			case <-time.After(shortDelay):
+				t.Fatal("timeout awaiting connection up")
+			}
+		}
+		awaitConnUp()
+
+		subID := 5
+		if _, err := cm.Subscribe(ctx, &paho.Subscribe{
+			Properties: &paho.SubscribeProperties{SubscriptionIdentifier: &subID},
+			Subscriptions: []paho.SubscribeOptions{
+				{Topic: "a", QoS: 1, NoLocal: true, RetainHandling: 2},
+				{Topic: "b", QoS: 2},
+			},
+		}); err != nil {
+			t.Fatalf("subscribe failed: %s", err)
+		}
+		if _, err := cm.Subscribe(ctx, &paho.Subscribe{
+			Subscriptions: []paho.SubscribeOptions{{Topic: "c", QoS: 0}, {Topic: "d", QoS: 1}},
+		}); err != nil {
+			t.Fatalf("subscribe failed: %s", err)
+		}
+		if _, err := cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{"b", "c"}}); err != nil {
+			t.Fatalf("unsubscribe failed: %s", err)
+		}
+		getSubscribes() // Clear the subscribes sent above
+
+		// New session so subscriptions should be reestablished
+		cm.TerminateConnectionForTest()
+		awaitConnUp()
+		subs := getSubscribes()
+		if len(subs) != 2 {
+			t.Fatalf("expected 2 SUBSCRIBE packets, got %d", len(subs))
+		}
+		if len(subs[0].Subscriptions) != 1 || subs[0].Subscriptions[0].Topic != "a" ||
+			subs[0].Subscriptions[0].QoS != 1 || !subs[0].Subscriptions[0].NoLocal || subs[0].Subscriptions[0].RetainHandling != 2 {
+			t.Errorf("unexpected first SUBSCRIBE: %v", subs[0].Subscriptions)
+		}
+		if subs[0].Properties == nil || subs[0].Properties.SubscriptionIdentifier == nil || *subs[0].Properties.SubscriptionIdentifier != subID {
+			t.Errorf("expected subscription identifier %d in first SUBSCRIBE", subID)
+		}
+		if len(subs[1].Subscriptions) != 1 || subs[1].Subscriptions[0].Topic != "d" || subs[1].Subscriptions[0].QoS != 1 {
+			t.Errorf("unexpected second SUBSCRIBE: %v", subs[1].Subscriptions)
+		}
+
+		// Session retained by server so no need to resubscribe
+		mu.Lock()
+		sessionPresent = true
+		mu.Unlock()
+		cm.TerminateConnectionForTest()
+		awaitConnUp()
+		if subs := getSubscribes(); len(subs) != 0 {
+			t.Errorf("expected no SUBSCRIBE packets when session present, got %d", len(subs))
+		}
+
+		cancel()
+		select {
+		case <-cm.Done():
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting connection manager shutdown")
+		}
+		select {
+		case <-tsDone:
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting test server shutdown")
+		}
+	})
+}
+
+// TestModifySubscriptions checks that ModifySubscriptions sends both requests, awaits both acknowledgements, and
+// updates the recorded subscriptions
+func TestModifySubscriptions(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		server, _ := url.Parse(dummyURL)
+		logger := paholog.NewTestLogger(t, "test:")
+		ts := testserver.New(paholog.NewTestLogger(t, "testServer:"))
+
+		release := make(chan struct{})
+		var blockUnsubscribe atomic.Bool
+		ts.SetPacketReceivedCallback(func(cp *packets.ControlPacket) error {
+			if cp.Type == packets.UNSUBSCRIBE && blockUnsubscribe.Load() {
+				<-release // Delay the UNSUBACK
+			}
+			return nil
+		})
+
+		var tsDone chan struct{}
+		pahoConnUpChan := make(chan struct{}, 1)
+		config := ClientConfig{
+			ServerUrls:           []*url.URL{server},
+			KeepAlive:            60,
+			ConnectTimeout:       shortDelay,
+			ReconnectResubscribe: true,
+			AttemptConnection: func(ctx context.Context, _ ClientConfig, _ *url.URL) (net.Conn, error) {
+				conn, done, err := ts.Connect(ctx)
+				tsDone = done
+				return conn, err
+			},
+			OnConnectionUp: func(*ConnectionManager, *paho.Connack) { pahoConnUpChan <- struct{}{} },
+			Debug:          logger,
+			PahoDebug:      logger,
+			PahoErrors:     logger,
+			ClientConfig: paho.ClientConfig{
+				ClientID: "test",
+			},
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cm, err := NewConnection(ctx, config)
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+		select {
+		case <-pahoConnUpChan:
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting connection up")
+		}
+
+		if _, err := cm.ModifySubscriptions(ctx, nil, nil); !errors.Is(err, paho.ErrInvalidArguments) {
+			t.Errorf("expected ErrInvalidArguments when nothing to do, got %v", err)
+		}
+		if _, err := cm.ModifySubscriptions(ctx, []paho.SubscribeOptions{{Topic: "a"}}, []string{"a"}); !errors.Is(err, paho.ErrInvalidArguments) {
+			t.Errorf("expected ErrInvalidArguments when topic added and removed, got %v", err)
+		}
+		if _, err := cm.Subscribe(ctx, &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{{Topic: "old", QoS: 1}}}); err != nil {
+			t.Fatalf("subscribe failed: %s", err)
+		}
+
+		blockUnsubscribe.Store(true)
+		type result struct {
+			changes *SubscriptionChanges
+			err     error
+		}
+		resChan := make(chan result, 1)
+		go func() {
+			changes, err := cm.ModifySubscriptions(ctx, []paho.SubscribeOptions{{Topic: "new", QoS: 2}}, []string{"old"})
+			resChan <- result{changes: changes, err: err}
+		}()
+		synctest.Wait()
+		select {
+		case <-resChan:
+			t.Fatal("ModifySubscriptions returned before UNSUBACK received")
+		default:
+		}
+
+		close(release)
+		var res result
+		select {
+		case res = <-resChan:
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting ModifySubscriptions")
+		}
+		if res.err != nil {
+			t.Fatalf("ModifySubscriptions failed: %s", res.err)
+		}
+		if res.changes.Suback == nil || len(res.changes.Suback.Reasons) != 1 || res.changes.Suback.Reasons[0] != 2 {
+			t.Errorf("unexpected SUBACK: %v", res.changes.Suback)
+		}
+		if res.changes.Unsuback == nil || len(res.changes.Unsuback.Reasons) != 1 || res.changes.Unsuback.Reasons[0] != 0 {
+			t.Errorf("unexpected UNSUBACK: %v", res.changes.Unsuback)
+		}
+
+		subs := cm.subscriptions.packets()
+		if len(subs) != 1 || len(subs[0].Subscriptions) != 1 || subs[0].Subscriptions[0].Topic != "new" {
+			t.Errorf("unexpected recorded subscriptions: %v", subs)
+		}
+
+		cancel()
+		select {
+		case <-cm.Done():
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting connection manager shutdown")
+		}
+		select {
+		case <-tsDone:
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting test server shutdown")
+		}
+	})
+}
+
+// TestAssignedClientID checks that a client identifier assigned by the server is exposed, and used when reconnecting
+func TestAssignedClientID(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		server, _ := url.Parse(dummyURL)
+		logger := paholog.NewTestLogger(t, "test:")
+		ts := testserver.New(paholog.NewTestLogger(t, "testServer:"))
+
+		connectIDs := make(chan string, 2)
+		ts.SetConnectCallback(func(cp *packets.Connect, ca *packets.Connack) {
+			connectIDs <- cp.ClientID
+			if cp.ClientID == "" {
+				ca.Properties.AssignedClientID = "server-assigned"
+			}
+		})
+
+		var tsDone chan struct{}
+		pahoConnUpChan := make(chan struct{}, 1)
+		config := ClientConfig{
+			ServerUrls:            []*url.URL{server},
+			KeepAlive:             60,
+			SessionExpiryInterval: 60,
+			ReconnectBackoff:      NewConstantBackoff(time.Millisecond),
+			ConnectTimeout:        shortDelay,
+			AttemptConnection: func(ctx context.Context, _ ClientConfig, _ *url.URL) (net.Conn, error) {
+				if tsDone != nil {
+					<-tsDone // Previous connection must be fully closed
+				}
+				conn, done, err := ts.Connect(ctx)
+				tsDone = done
+				return conn, err
+			},
+			OnConnectionUp: func(*ConnectionManager, *paho.Connack) { pahoConnUpChan <- struct{}{} },
+			Debug:          logger,
+			PahoDebug:      logger,
+			PahoErrors:     logger,
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cm, err := NewConnection(ctx, config)
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+		awaitConnUp := func() {
+			select {
+			case <-pahoConnUpChan:
+			case <-time.After(shortDelay):
+				t.Fatal("timeout awaiting connection up")
+			}
+		}
+		awaitConnUp()
+		if id := <-connectIDs; id != "" {
+			t.Errorf("expected empty client identifier in first CONNECT, got %q", id)
+		}
+		if id := cm.AssignedClientID(); id != "server-assigned" {
+			t.Errorf("expected AssignedClientID to return server-assigned, got %q", id)
+		}
+
+		// The assigned identifier should be used when reconnecting (so the session can be resumed)
+		cm.TerminateConnectionForTest()
+		awaitConnUp()
+		if id := <-connectIDs; id != "server-assigned" {
+			t.Errorf("expected assigned client identifier in second CONNECT, got %q", id)
+		}
+		if id := cm.AssignedClientID(); id != "server-assigned" {
+			t.Errorf("expected AssignedClientID to return server-assigned after reconnection, got %q", id)
+		}
+
+		cancel()
+		select {
+		case <-cm.Done():
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting connection manager shutdown")
+		}
+		select {
+		case <-tsDone:
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting test server shutdown")
+		}
+	})
+}
+
+// TestWillDelayAndSessionExpiry checks that the Will Delay Interval and Session Expiry Interval are sent in the
+// CONNECT, and that a Session Expiry Interval in the CONNACK is exposed via ServerProperties.
+func TestWillDelayAndSessionExpiry(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		server, _ := url.Parse(dummyURL)
+		logger := paholog.NewTestLogger(t, "test:")
+		ts := testserver.New(paholog.NewTestLogger(t, "testServer:"))
+
+		connects := make(chan *packets.Connect, 1)
+		ts.SetConnectCallback(func(cp *packets.Connect, ca *packets.Connack) {
+			connects <- cp
+			cappedExpiry := uint32(30)
+			ca.Properties.SessionExpiryInterval = &cappedExpiry // server caps the Session Expiry Interval
+		})
+
+		willDelay := uint32(5)
+		willProperties := &paho.WillProperties{WillDelayInterval: &willDelay}
+		var tsDone chan struct{}
+		config := ClientConfig{
+			ServerUrls:            []*url.URL{server},
+			KeepAlive:             60,
+			SessionExpiryInterval: 600,
+			WillMessage:           &paho.WillMessage{Topic: "status", Payload: []byte("offline")},
+			WillProperties:        willProperties,
+			WillDelayInterval:     120,
+			ConnectTimeout:        shortDelay,
+			AttemptConnection: func(ctx context.Context, _ ClientConfig, _ *url.URL) (net.Conn, error) {
+				conn, done, err := ts.Connect(ctx)
+				tsDone = done
+				return conn, err
+			},
+			Debug:      logger,
+			PahoDebug:  logger,
+			PahoErrors: logger,
+			ClientConfig: paho.ClientConfig{
+				Session: state.NewInMemory(),
+			},
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cm, err := NewConnection(ctx, config)
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+		if err := cm.AwaitConnection(ctx); err != nil {
+			t.Fatalf("expected connection: %s", err)
+		}
+
+		cp := <-connects
+		if !cp.WillFlag || cp.WillProperties == nil || cp.WillProperties.WillDelayInterval == nil {
+			t.Fatalf("expected Will Delay Interval in CONNECT: %s", cp)
+		}
+		if got := *cp.WillProperties.WillDelayInterval; got != 120 {
+			t.Errorf("expected Will Delay Interval 120, got %d", got)
+		}
+		if cp.Properties == nil || cp.Properties.SessionExpiryInterval == nil {
+			t.Fatalf("expected Session Expiry Interval in CONNECT: %s", cp)
+		}
+		if got := *cp.Properties.SessionExpiryInterval; got != 600 {
+			t.Errorf("expected Session Expiry Interval 600, got %d", got)
+		}
+		if *willProperties.WillDelayInterval != 5 {
+			t.Errorf("WillProperties in config should not be modified")
+		}
+		if sp := cm.ServerProperties(); sp == nil || sp.SessionExpiryInterval != 30 {
+			t.Errorf("expected negotiated Session Expiry Interval of 30, got %+v", sp)
+		}
+
+		cancel()
+		<-cm.Done()
+		<-tsDone
+	})
+}
+
+// TestSessionExpiryValidation checks the validation of WillDelayInterval and SessionExpiryInterval in NewConnection
+func TestSessionExpiryValidation(t *testing.T) {
+	server, _ := url.Parse(dummyURL)
+	tests := []struct {
+		name  string
+		cfg   ClientConfig
+		valid bool
+	}{
+		{"will delay without will", ClientConfig{WillDelayInterval: 10}, false},
+		{"session without expiry", ClientConfig{ClientConfig: paho.ClientConfig{Session: state.NewInMemory()}}, false},
+		// The interval may be set when the CONNECT is built
+		{"session with ConnectPacketBuilder", ClientConfig{
+			ConnectPacketBuilder: func(c *paho.Connect, _ *url.URL) (*paho.Connect, error) { return c, nil },
+			ClientConfig:         paho.ClientConfig{Session: state.NewInMemory()},
+		}, true},
+		{"session with BuildConnect", ClientConfig{ClientConfig: paho.ClientConfig{
+			Session:      state.NewInMemory(),
+			BuildConnect: func(*packets.Connect) {},
+		}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(t.Context())
+			defer cancel()
+			tt.cfg.ServerUrls = []*url.URL{server}
+			tt.cfg.AttemptConnection = func(context.Context, ClientConfig, *url.URL) (net.Conn, error) {
+				return nil, errors.New("no connection in test")
+			}
+			cm, err := NewConnection(ctx, tt.cfg)
+			if !tt.valid {
+				if !errors.Is(err, paho.ErrInvalidArguments) {
+					t.Errorf("expected ErrInvalidArguments, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			cancel()
+			<-cm.Done()
+		})
+	}
+}
+
+// TestFollowServerReference checks that the Server Reference in a DISCONNECT is passed to the user, and used for the
+// next connection attempt (once) when FollowServerReference is set.
+func TestFollowServerReference(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		server, _ := url.Parse("mqtt://a.example.com:1883")
+		brokers := map[string]*pahotest.Broker{
+			"a.example.com:1883": pahotest.NewBroker(nil),
+			"b.example.com:1883": pahotest.NewBroker(nil),
+		}
+		for _, b := range brokers {
+			defer b.Close()
+		}
+
+		connectedTo := make(chan string, 3)
+		serverDisconnect := make(chan *paho.Disconnect, 1)
+		var references []string
+		cm, err := NewConnection(t.Context(), ClientConfig{
+			ServerUrls:            []*url.URL{server},
+			KeepAlive:             60,
+			ReconnectBackoff:      NewConstantBackoff(time.Second),
+			FollowServerReference: true,
+			OnServerReference: func(reference string, from, to *url.URL, err error) {
+				references = append(references, fmt.Sprintf("%s %s %s %v", reference, from, to, err))
+			},
+			AttemptConnection: func(ctx context.Context, _ ClientConfig, u *url.URL) (net.Conn, error) {
+				connectedTo <- u.Host
+				return brokers[u.Host].Connect(ctx)
+			},
+			ClientConfig: paho.ClientConfig{
+				ClientID:           "client",
+				OnServerDisconnect: func(d *paho.Disconnect) { serverDisconnect <- d },
+			},
+		})
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+		awaitConnection := func(expected string) {
+			t.Helper()
+			time.Sleep(2 * time.Second) // Reconnect backoff is 1s
+			if err := cm.AwaitConnection(t.Context()); err != nil {
+				t.Fatalf("AwaitConnection failed: %s", err)
+			}
+			if host := <-connectedTo; host != expected {
+				t.Fatalf("expected connection to %s, got %s", expected, host)
+			}
+		}
+		awaitConnection("a.example.com:1883")
+
+		if err := brokers["a.example.com:1883"].SendDisconnect("client", &packets.Disconnect{
+			ReasonCode: packets.DisconnectUseAnotherServer,
+			Properties: &packets.Properties{
+				ReasonString:    "maintenance",
+				ServerReference: "b.example.com",
+				User:            []packets.User{{Key: "k", Value: "v"}},
+			},
+		}); err != nil {
+			t.Fatalf("SendDisconnect failed: %s", err)
+		}
+		d := <-serverDisconnect
+		if d.ReasonCode != packets.DisconnectUseAnotherServer || d.Properties.ReasonString != "maintenance" ||
+			d.Properties.ServerReference != "b.example.com" || !reflect.DeepEqual(d.Properties.User, paho.UserProperties{{Key: "k", Value: "v"}}) {
+			t.Errorf("unexpected DISCONNECT passed to OnServerDisconnect: %+v %+v", d, d.Properties)
+		}
+		awaitConnection("b.example.com:1883") // Scheme and port come from the URL in use
+
+		// The redirect is one-time; when the connection drops the configured server is used again
+		if err := brokers["b.example.com:1883"].DropConnection("client"); err != nil {
+			t.Fatalf("DropConnection failed: %s", err)
+		}
+		awaitConnection("a.example.com:1883")
+
+		// A malformed reference is reported, but not followed
+		if err := brokers["a.example.com:1883"].SendDisconnect("client", &packets.Disconnect{
+			ReasonCode: packets.DisconnectServerMoved,
+			Properties: &packets.Properties{ServerReference: "b.example.com:99999"},
+		}); err != nil {
+			t.Fatalf("SendDisconnect failed: %s", err)
+		}
+		<-serverDisconnect
+		awaitConnection("a.example.com:1883")
+
+		synctest.Wait()
+		if len(references) != 2 || references[0] != "b.example.com mqtt://a.example.com:1883 mqtt://b.example.com:1883 <nil>" ||
+			!strings.HasPrefix(references[1], "b.example.com:99999 mqtt://a.example.com:1883 <nil> server reference") {
+			t.Errorf("unexpected OnServerReference calls: %q", references)
+		}
+
+		if err := cm.Disconnect(t.Context()); err != nil {
+			t.Errorf("Disconnect failed: %s", err)
+		}
+		<-cm.Done()
+	})
+}
+
+// TestConnectionStats checks that Stats returns the expected values
+func TestConnectionStats(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		server, _ := url.Parse(dummyURL)
+		logger := paholog.NewTestLogger(t, "test:")
+		ts := testserver.New(paholog.NewTestLogger(t, "testServer:"))
+
+		var tsDone chan struct{}
+		var userWrites atomic.Uint64 // Calls to the user's OnBytesWritten hook (should still be called)
+		pahoConnUpChan := make(chan struct{}, 1)
+		config := ClientConfig{
+			ServerUrls:       []*url.URL{server},
+			KeepAlive:        60,
+			ReconnectBackoff: NewConstantBackoff(time.Millisecond),
+			ConnectTimeout:   shortDelay,
+			AttemptConnection: func(ctx context.Context, _ ClientConfig, _ *url.URL) (net.Conn, error) {
+				if tsDone != nil {
+					<-tsDone // Previous connection must be fully closed
+				}
+				conn, done, err := ts.Connect(ctx)
+				tsDone = done
+				return conn, err
+			},
+			OnConnectionUp: func(*ConnectionManager, *paho.Connack) { pahoConnUpChan <- struct{}{} },
+			Debug:          logger,
+			PahoDebug:      logger,
+			PahoErrors:     logger,
+			ClientConfig: paho.ClientConfig{
+				ClientID:       "test",
+				OnBytesWritten: func([]byte) { userWrites.Add(1) },
+			},
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cm, err := NewConnection(ctx, config)
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+		awaitConnUp := func() {
+			select {
+			case <-pahoConnUpChan:
+			case <-time.After(shortDelay):
+				t.Fatal("timeout awaiting connection up")
+			}
+		}
+		awaitConnUp()
+
+		if _, err := cm.Publish(ctx, &paho.Publish{Topic: "test/topic", QoS: 1, Payload: []byte("test")}); err != nil {
+			t.Fatalf("publish failed: %s", err)
+		}
+		time.Sleep(time.Second)
+
+		s := cm.Stats()
+		if !s.Connected || s.Uptime < time.Second || s.Reconnects != 0 || s.LastPingResp.IsZero() {
+			t.Errorf("unexpected connection stats: %+v", s)
+		}
+		if s.PacketsSent != 3 || s.PacketsReceived != 3 { // CONNECT, PINGREQ and PUBLISH / CONNACK, PINGRESP and PUBACK
+			t.Errorf("expected 3 packets sent and received, got %d and %d", s.PacketsSent, s.PacketsReceived)
+		}
+		if w := userWrites.Load(); w != s.PacketsSent {
+			t.Errorf("expected OnBytesWritten to be called for each of the %d packets sent, got %d", s.PacketsSent, w)
+		}
+		if s.BytesSent == 0 || s.BytesReceived == 0 {
+			t.Errorf("expected bytes to be sent and received, got %d and %d", s.BytesSent, s.BytesReceived)
+		}
+		if s.QueuedMessages != 0 {
+			t.Errorf("expected empty queue, got %d", s.QueuedMessages)
+		}
+
+		cm.TerminateConnectionForTest()
+		awaitConnUp()
+		s2 := cm.Stats()
+		if !s2.Connected || s2.Uptime >= time.Second || s2.Reconnects != 1 {
+			t.Errorf("unexpected connection stats after reconnect: %+v", s2)
+		}
+		if s2.PacketsSent <= s.PacketsSent || s2.BytesReceived <= s.BytesReceived {
+			t.Errorf("expected totals to be retained across connections: %+v", s2)
+		}
+
+		cancel()
+		select {
+		case <-cm.Done():
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting connection manager shutdown")
+		}
+		if cm.Stats().Connected {
+			t.Errorf("expected Connected to be false after shutdown")
+		}
+		select {
+		case <-tsDone:
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting test server shutdown")
+		}
+	})
+}
+
+// TestConnectionEvents checks that connection state transitions are reported via Events
+func TestConnectionEvents(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		server, _ := url.Parse(dummyURL)
+		logger := paholog.NewTestLogger(t, "test:")
+		ts := testserver.New(paholog.NewTestLogger(t, "testServer:"))
+
+		var tsDone chan struct{}
+		config := ClientConfig{
+			ServerUrls:       []*url.URL{server},
+			KeepAlive:        60,
+			ReconnectBackoff: NewConstantBackoff(time.Millisecond),
+			ConnectTimeout:   shortDelay,
+			AttemptConnection: func(ctx context.Context, _ ClientConfig, _ *url.URL) (net.Conn, error) {
+				if tsDone != nil {
+					<-tsDone // Previous connection must be fully closed
+				}
+				conn, done, err := ts.Connect(ctx)
+				tsDone = done
+				return conn, err
+			},
+			Debug:      logger,
+			PahoDebug:  logger,
+			PahoErrors: logger,
+			ClientConfig: paho.ClientConfig{
+				ClientID: "test",
+			},
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cm, err := NewConnection(ctx, config)
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+		var got []ConnectionEventType
+		awaitEvent := func(want ConnectionEventType) ConnectionEvent {
+			select {
+			case e, ok := <-cm.Events():
+				if !ok {
+					t.Fatalf("events channel closed awaiting %s", want)
+				}
+				got = append(got, e.Type)
+				if e.Type != want {
+					t.Fatalf("expected %s event, got %s (events: %v)", want, e.Type, got)
+				}
+				return e
+			case <-time.After(shortDelay):
+				t.Fatalf("timeout awaiting %s event", want)
+			}
+			return ConnectionEvent{}
+		}
+
+		awaitEvent(EventConnecting)
+		if e := awaitEvent(EventConnectionUp); e.Connack == nil {
+			t.Errorf("expected Connack in EventConnectionUp")
+		}
+		cm.TerminateConnectionForTest()
+		if e := awaitEvent(EventConnectionDown); e.Err == nil {
+			t.Errorf("expected Err in EventConnectionDown")
+		}
+		awaitEvent(EventConnecting)
+		awaitEvent(EventConnectionUp)
+
+		cancel()
+		if e := awaitEvent(EventConnectionDown); !errors.Is(e.Err, context.Canceled) {
+			t.Errorf("expected context.Canceled in EventConnectionDown, got %v", e.Err)
+		}
+		if e := awaitEvent(EventStopped); !errors.Is(e.Err, context.Canceled) {
+			t.Errorf("expected context.Canceled in EventStopped, got %v", e.Err)
+		}
+		if _, ok := <-cm.Events(); ok {
+			t.Errorf("expected events channel to be closed following EventStopped")
+		}
+		<-cm.Done()
+		<-tsDone
+	})
+}
+
+// TestEventQueueDropsOldest checks that the oldest event is discarded when the buffer is full
+func TestEventQueueDropsOldest(t *testing.T) {
+	q := newEventQueue(2)
+	q.emit(ConnectionEvent{Type: EventConnecting})
+	q.emit(ConnectionEvent{Type: EventConnectionUp})
+	q.emit(ConnectionEvent{Type: EventConnectionDown})
+	q.close()
+	var got []ConnectionEventType
+	for e := range q.ch {
+		got = append(got, e.Type)
+	}
+	if len(got) != 2 || got[0] != EventConnectionUp || got[1] != EventConnectionDown {
+		t.Errorf("expected [up down], got %v", got)
+	}
+}
+
+// TestShutdown checks that Shutdown delivers queued messages before disconnecting
+func TestShutdown(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		server, _ := url.Parse(dummyURL)
+		logger := paholog.NewTestLogger(t, "test:")
+		ts := testserver.New(paholog.NewTestLogger(t, "testServer:"))
+
+		var mu sync.Mutex
+		var published []string
+		ts.SetPacketReceivedCallback(func(cp *packets.ControlPacket) error {
+			if cp.Type == packets.PUBLISH {
+				mu.Lock()
+				published = append(published, string(cp.Content.(*packets.Publish).Payload))
+				mu.Unlock()
+			}
+			return nil
+		})
+
+		var tsDone chan struct{}
+		connUp := make(chan struct{})
+		config := ClientConfig{
+			ServerUrls:       []*url.URL{server},
+			KeepAlive:        60,
+			ReconnectBackoff: NewConstantBackoff(time.Millisecond),
+			ConnectTimeout:   shortDelay,
+			AttemptConnection: func(ctx context.Context, _ ClientConfig, _ *url.URL) (net.Conn, error) {
+				<-connUp // Messages will be queued before the connection is available
+				conn, done, err := ts.Connect(ctx)
+				tsDone = done
+				return conn, err
+			},
+			Debug:      logger,
+			PahoDebug:  logger,
+			PahoErrors: logger,
+			ClientConfig: paho.ClientConfig{
+				ClientID: "test",
+			},
+		}
+
+		cm, err := NewConnection(t.Context(), config)
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+		for i := 0; i < 3; i++ {
+			if err := cm.PublishViaQueue(t.Context(), &QueuePublish{Publish: &paho.Publish{
+				QoS:     1,
+				Topic:   "test/topic",
+				Payload: []byte(strconv.Itoa(i)),
+			}}); err != nil {
+				t.Fatalf("PublishViaQueue failed: %s", err)
+			}
+		}
+		close(connUp)
+
+		ctx, cancel := context.WithTimeout(t.Context(), shortDelay)
+		defer cancel()
+		if err := cm.Shutdown(ctx); err != nil {
+			t.Fatalf("expected Shutdown success: %s", err)
+		}
+		mu.Lock()
+		if !reflect.DeepEqual(published, []string{"0", "1", "2"}) {
+			t.Errorf("expected all queued messages to be published, got %v", published)
+		}
+		mu.Unlock()
+		select {
+		case <-tsDone:
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting test server shutdown")
+		}
+	})
+}
+
+// TestShutdownUndelivered checks that Shutdown reports undelivered messages when the context expires
+func TestShutdownUndelivered(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		server, _ := url.Parse(dummyURL)
+		logger := paholog.NewTestLogger(t, "test:")
+		config := ClientConfig{
+			ServerUrls:       []*url.URL{server},
+			KeepAlive:        60,
+			ReconnectBackoff: NewConstantBackoff(time.Second),
+			ConnectTimeout:   shortDelay,
+			AttemptConnection: func(ctx context.Context, _ ClientConfig, _ *url.URL) (net.Conn, error) {
+				return nil, errors.New("connection refused")
+			},
+			Debug: logger,
+			ClientConfig: paho.ClientConfig{
+				ClientID: "test",
+			},
+		}
+
+		cm, err := NewConnection(t.Context(), config)
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := cm.PublishViaQueue(t.Context(), &QueuePublish{Publish: &paho.Publish{
+				QoS:     1,
+				Topic:   "test/topic",
+				Payload: []byte(strconv.Itoa(i)),
+			}}); err != nil {
+				t.Fatalf("PublishViaQueue failed: %s", err)
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(t.Context(), shortDelay)
+		defer cancel()
+		err = cm.Shutdown(ctx)
+		if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "2 message(s) undelivered") {
+			t.Fatalf("expected undelivered error, got %v", err)
+		}
+		select {
+		case <-cm.Done():
+		default:
+			t.Fatal("connection manager should be done after Shutdown returns")
+		}
+	})
+}
+
+// TestAwaitDelivery checks that AwaitDelivery waits for queued messages to be delivered (leaving the connection up)
+func TestAwaitDelivery(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		server, _ := url.Parse(dummyURL)
+		logger := paholog.NewTestLogger(t, "test:")
+		ts := testserver.New(paholog.NewTestLogger(t, "testServer:"))
+
+		var mu sync.Mutex
+		var published []string
+		ts.SetPacketReceivedCallback(func(cp *packets.ControlPacket) error {
+			if cp.Type == packets.PUBLISH {
+				mu.Lock()
+				published = append(published, string(cp.Content.(*packets.Publish).Payload))
+				mu.Unlock()
+			}
+			return nil
+		})
+
+		var tsDone chan struct{}
+		connUp := make(chan struct{})
+		config := ClientConfig{
+			ServerUrls:       []*url.URL{server},
+			KeepAlive:        60,
+			ReconnectBackoff: NewConstantBackoff(time.Millisecond),
+			ConnectTimeout:   shortDelay,
+			AttemptConnection: func(ctx context.Context, _ ClientConfig, _ *url.URL) (net.Conn, error) {
+				<-connUp // Messages will be queued before the connection is available
+				conn, done, err := ts.Connect(ctx)
+				tsDone = done
+				return conn, err
+			},
+			Debug:      logger,
+			PahoDebug:  logger,
+			PahoErrors: logger,
+			ClientConfig: paho.ClientConfig{
+				ClientID: "test",
+			},
+		}
+
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+		cm, err := NewConnection(ctx, config)
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+		publish := func(payload string) {
+			if err := cm.PublishViaQueue(ctx, &QueuePublish{Publish: &paho.Publish{
+				QoS:     1,
+				Topic:   "test/topic",
+				Payload: []byte(payload),
+			}}); err != nil {
+				t.Fatalf("PublishViaQueue failed: %s", err)
+			}
+		}
+		for i := 0; i < 3; i++ {
+			publish(strconv.Itoa(i))
+		}
+		close(connUp)
+
+		awaitCtx, awaitCancel := context.WithTimeout(ctx, shortDelay)
+		defer awaitCancel()
+		if err := cm.AwaitDelivery(awaitCtx); err != nil {
+			t.Fatalf("expected AwaitDelivery success: %s", err)
+		}
+		mu.Lock()
+		if !reflect.DeepEqual(published, []string{"0", "1", "2"}) {
+			t.Errorf("expected all queued messages to be published, got %v", published)
+		}
+		mu.Unlock()
+
+		// Connection should remain available
+		select {
+		case <-cm.Done():
+			t.Fatal("connection manager should not be done after AwaitDelivery returns")
+		default:
+		}
+		publish("3")
+		if err := cm.AwaitDelivery(awaitCtx); err != nil {
+			t.Fatalf("expected AwaitDelivery success: %s", err)
+		}
+		mu.Lock()
+		if len(published) != 4 {
+			t.Errorf("expected 4 messages to be published, got %v", published)
+		}
+		mu.Unlock()
+
+		cancel()
+		<-cm.Done()
+		select {
+		case <-tsDone:
+		case <-time.After(shortDelay):
+			t.Fatal("timeout awaiting test server shutdown")
+		}
+	})
+}
+
+// TestAwaitDeliveryUndelivered checks that AwaitDelivery reports undelivered messages when the context expires
+func TestAwaitDeliveryUndelivered(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		server, _ := url.Parse(dummyURL)
+		logger := paholog.NewTestLogger(t, "test:")
+		config := ClientConfig{
+			ServerUrls:       []*url.URL{server},
+			KeepAlive:        60,
+			ReconnectBackoff: NewConstantBackoff(time.Second),
+			ConnectTimeout:   shortDelay,
+			AttemptConnection: func(ctx context.Context, _ ClientConfig, _ *url.URL) (net.Conn, error) {
+				return nil, errors.New("connection refused")
+			},
+			Debug: logger,
+			ClientConfig: paho.ClientConfig{
+				ClientID: "test",
+			},
+		}
+
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+		cm, err := NewConnection(ctx, config)
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := cm.PublishViaQueue(ctx, &QueuePublish{Publish: &paho.Publish{
+				QoS:     1,
+				Topic:   "test/topic",
+				Payload: []byte(strconv.Itoa(i)),
+			}}); err != nil {
+				t.Fatalf("PublishViaQueue failed: %s", err)
+			}
+		}
+
+		awaitCtx, awaitCancel := context.WithTimeout(ctx, shortDelay)
+		defer awaitCancel()
+		err = cm.AwaitDelivery(awaitCtx)
+		if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "2 message(s) undelivered") {
+			t.Fatalf("expected undelivered error, got %v", err)
+		}
+		select {
+		case <-cm.Done():
+			t.Fatal("connection manager should not be done after AwaitDelivery returns")
+		default:
+		}
+
+		cancel()
+		<-cm.Done()
+	})
+}
+
 // TestBasicPubSub performs pub/sub operations at each QOS level
 func TestBasicPubSub(t *testing.T) {
 	t.Parallel()
@@ -652,3 +1978,286 @@ func ExampleClientConfig_ConnectPacketBuilder() {
 	fmt.Printf("user: %s, pass: %s", cp.Username, string(cp.Password))
 	// Output: user: mqtt_user, pass: mqtt_pass
 }
+
+// TestSubscribeWithHandler checks that handlers are registered with the router only when the subscription is accepted
+// (and that retained messages sent immediately after the SUBACK are passed to the handler).
+func TestSubscribeWithHandler(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		b := pahotest.NewBroker(nil)
+		defer b.Close()
+		b.SetConnackFn(func(_ *packets.Connect, ca *packets.Connack) { ca.Properties.SharedSubAvailable = nil }) // broker will reject $share
+		b.Publish(&packets.Publish{Topic: "a/1", Retain: true, Payload: []byte("retained")})
+
+		server, _ := url.Parse("mqtt://127.0.0.1:1883")
+		router := paho.NewStandardRouter()
+		cm, err := NewConnection(t.Context(), ClientConfig{
+			ServerUrls: []*url.URL{server},
+			KeepAlive:  60,
+			AttemptConnection: func(ctx context.Context, _ ClientConfig, _ *url.URL) (net.Conn, error) {
+				return b.Connect(ctx)
+			},
+			ClientConfig: paho.ClientConfig{ClientID: "client", Router: router},
+		})
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+		if err = cm.AwaitConnection(t.Context()); err != nil {
+			t.Fatalf("AwaitConnection failed: %s", err)
+		}
+
+		var received []string
+		if _, err = cm.SubscribeWithHandler(t.Context(), paho.SubscribeOptions{Topic: "a/#"}, func(p *paho.Publish) {
+			received = append(received, p.Topic)
+		}); err != nil {
+			t.Fatalf("SubscribeWithHandler failed: %s", err)
+		}
+		synctest.Wait()
+		if !reflect.DeepEqual(received, []string{"a/1"}) {
+			t.Errorf("expected retained message to be passed to handler, got %v", received)
+		}
+
+		// Rejected subscription; the handler must not remain registered
+		sa, err := cm.SubscribeWithHandler(t.Context(), paho.SubscribeOptions{Topic: "$share/g/b"}, func(*paho.Publish) {})
+		var se *paho.SubscribeError
+		if !errors.As(err, &se) || sa == nil || !reflect.DeepEqual(se.Reasons, []byte{packets.SubackSharedSubscriptionnotsupported}) {
+			t.Fatalf("expected SubscribeError, got %v", err)
+		}
+		if subs := router.Subscriptions(); !reflect.DeepEqual(subs, map[string]int{"a/#": 1}) {
+			t.Errorf("unexpected router subscriptions: %v", subs)
+		}
+		if d := cm.ReconcileSubscriptions(); len(d) != 0 {
+			t.Errorf("unexpected discrepancies: %v", d)
+		}
+
+		if _, err = cm.UnsubscribeWithHandler(t.Context(), "a/#"); err != nil {
+			t.Fatalf("UnsubscribeWithHandler failed: %s", err)
+		}
+		if subs := router.Subscriptions(); len(subs) != 0 {
+			t.Errorf("expected no router subscriptions, got %v", subs)
+		}
+		b.Publish(&packets.Publish{Topic: "a/2"})
+		synctest.Wait()
+		if len(received) != 1 {
+			t.Errorf("no further messages expected, got %v", received)
+		}
+
+		if err := cm.Disconnect(t.Context()); err != nil {
+			t.Errorf("Disconnect failed: %s", err)
+		}
+		<-cm.Done()
+	})
+}
+
+// stallPinger is a paho.Pinger that does not close the connection when a PINGRESP is not received (enabling the
+// unhealthy state to be observed whilst connected)
+type stallPinger struct {
+	*paho.DefaultPinger
+}
+
+// Run implements paho.Pinger
+func (p stallPinger) Run(ctx context.Context, conn net.Conn, keepAlive uint16) error {
+	if err := p.DefaultPinger.Run(ctx, conn, keepAlive); err != nil {
+		<-ctx.Done()
+	}
+	return nil
+}
+
+// TestConnectionHealth checks that ConnectionHealth reflects the keepalive mechanism
+func TestConnectionHealth(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		b := pahotest.NewBroker(nil)
+		defer b.Close()
+
+		server, _ := url.Parse("mqtt://127.0.0.1:1883")
+		cm, err := NewConnection(t.Context(), ClientConfig{
+			ServerUrls: []*url.URL{server},
+			KeepAlive:  10,
+			AttemptConnection: func(ctx context.Context, _ ClientConfig, _ *url.URL) (net.Conn, error) {
+				return b.Connect(ctx)
+			},
+			ClientConfig: paho.ClientConfig{ClientID: "client", PingHandler: stallPinger{paho.NewDefaultPinger()}},
+		})
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+		if h := cm.ConnectionHealth(); h.Connected || h.Healthy {
+			t.Errorf("should not be healthy before connecting: %+v", h)
+		}
+		if err = cm.AwaitConnection(t.Context()); err != nil {
+			t.Fatalf("AwaitConnection failed: %s", err)
+		}
+		synctest.Wait() // initial PINGREQ is sent immediately
+
+		h := cm.ConnectionHealth()
+		if !h.Connected || !h.Healthy || h.PingOverdue || h.ConnectedAt.IsZero() || h.LastPingSent.IsZero() ||
+			h.LastPingResp.IsZero() || h.LastPacketSent.IsZero() || h.LastPacketReceived.IsZero() {
+			t.Errorf("unexpected health: %+v", h)
+		}
+
+		// Keepalive continues to operate, so the connection remains healthy
+		time.Sleep(35 * time.Second)
+		synctest.Wait()
+		if h2 := cm.ConnectionHealth(); !h2.Healthy || !h2.LastPingResp.After(h.LastPingResp) {
+			t.Errorf("expected connection to remain healthy: %+v", h2)
+		}
+
+		// Server stops responding to PINGREQ
+		b.SetSendFilter(func(_ string, cp *packets.ControlPacket) bool { return cp.Type != packets.PINGRESP })
+		time.Sleep(17 * time.Second) // PINGREQ is sent after 5s; overdue once unanswered for over 10s (the server drops the connection after 20s)
+		synctest.Wait()
+		if h = cm.ConnectionHealth(); !h.Connected || h.Healthy || !h.PingOverdue {
+			t.Errorf("expected ping to be overdue: %+v", h)
+		}
+
+		if err := cm.Disconnect(t.Context()); err != nil {
+			t.Errorf("Disconnect failed: %s", err)
+		}
+		<-cm.Done()
+		if h = cm.ConnectionHealth(); h.Connected || h.Healthy {
+			t.Errorf("should not be healthy after disconnecting: %+v", h)
+		}
+	})
+}
+
+// TestAwaitConnectionStopped checks that callers waiting in AwaitConnection are released with ErrManagerStopped when
+// the ConnectionManager stops
+func TestAwaitConnectionStopped(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		server, _ := url.Parse(dummyURL)
+		cm, err := NewConnection(t.Context(), ClientConfig{
+			ServerUrls:       []*url.URL{server},
+			KeepAlive:        60,
+			ReconnectBackoff: NewConstantBackoff(time.Second),
+			AttemptConnection: func(context.Context, ClientConfig, *url.URL) (net.Conn, error) {
+				return nil, errors.New("connection attempt failed") // never connects
+			},
+			ClientConfig: paho.ClientConfig{ClientID: "test"},
+		})
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+
+		const waiters = 3
+		errs := make(chan error, waiters)
+		for range waiters {
+			go func() { errs <- cm.AwaitConnection(context.Background()) }()
+		}
+		time.Sleep(5 * time.Second) // Several connection attempts will fail
+		synctest.Wait()
+		select {
+		case err := <-errs:
+			t.Fatalf("AwaitConnection returned before manager stopped: %v", err)
+		default:
+		}
+
+		start := time.Now()
+		if err := cm.Disconnect(t.Context()); err != nil {
+			t.Fatalf("Disconnect failed: %s", err)
+		}
+		for range waiters {
+			if err := <-errs; !errors.Is(err, ErrManagerStopped) {
+				t.Errorf("expected ErrManagerStopped, got %v", err)
+			}
+		}
+		if d := time.Since(start); d > 0 {
+			t.Errorf("waiters should be released immediately, took %s", d)
+		}
+
+		// Calls made after the manager has stopped return immediately
+		if err := cm.AwaitConnection(context.Background()); !errors.Is(err, ErrManagerStopped) {
+			t.Errorf("expected ErrManagerStopped, got %v", err)
+		}
+	})
+}
+
+// TestServerDisconnectVsConnectionLost checks that a DISCONNECT from the server results in OnServerDisconnect being
+// called (and not OnConnectionLost), and that a transport failure results in OnConnectionLost being called (and not
+// OnServerDisconnect)
+func TestServerDisconnectVsConnectionLost(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		server, _ := url.Parse(dummyURL)
+		broker := pahotest.NewBroker(nil)
+		defer broker.Close()
+
+		var serverDisconnects []*paho.Disconnect
+		var connectionLost []error
+		var connectionDown int
+		cm, err := NewConnection(t.Context(), ClientConfig{
+			ServerUrls:       []*url.URL{server},
+			KeepAlive:        60,
+			ReconnectBackoff: NewConstantBackoff(time.Second),
+			AttemptConnection: func(ctx context.Context, _ ClientConfig, _ *url.URL) (net.Conn, error) {
+				return broker.Connect(ctx)
+			},
+			OnConnectionLost: func(err error) { connectionLost = append(connectionLost, err) },
+			OnConnectionDown: func() bool { connectionDown++; return true },
+			ClientConfig: paho.ClientConfig{
+				ClientID:           "client",
+				OnServerDisconnect: func(d *paho.Disconnect) { serverDisconnects = append(serverDisconnects, d) },
+			},
+		})
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+		if err := cm.AwaitConnection(t.Context()); err != nil {
+			t.Fatalf("AwaitConnection failed: %s", err)
+		}
+
+		// Server initiated DISCONNECT
+		if err := broker.SendDisconnect("client", &packets.Disconnect{
+			ReasonCode: packets.DisconnectServerShuttingDown,
+			Properties: &packets.Properties{ReasonString: "maintenance"},
+		}); err != nil {
+			t.Fatalf("SendDisconnect failed: %s", err)
+		}
+		time.Sleep(2 * time.Second) // Reconnect backoff is 1s
+		if err := cm.AwaitConnection(t.Context()); err != nil {
+			t.Fatalf("AwaitConnection failed: %s", err)
+		}
+		synctest.Wait()
+		if len(serverDisconnects) != 1 || serverDisconnects[0].ReasonCode != packets.DisconnectServerShuttingDown ||
+			serverDisconnects[0].Properties.ReasonString != "maintenance" {
+			t.Errorf("expected one call to OnServerDisconnect with the DISCONNECT, got %+v", serverDisconnects)
+		}
+		if len(connectionLost) != 0 {
+			t.Errorf("OnConnectionLost should not be called following DISCONNECT, got %v", connectionLost)
+		}
+		if connectionDown != 1 {
+			t.Errorf("expected OnConnectionDown to be called once, got %d", connectionDown)
+		}
+
+		// Transport failure
+		if err := broker.DropConnection("client"); err != nil {
+			t.Fatalf("DropConnection failed: %s", err)
+		}
+		time.Sleep(2 * time.Second)
+		if err := cm.AwaitConnection(t.Context()); err != nil {
+			t.Fatalf("AwaitConnection failed: %s", err)
+		}
+		synctest.Wait()
+		if len(serverDisconnects) != 1 {
+			t.Errorf("OnServerDisconnect should not be called following transport failure, got %+v", serverDisconnects)
+		}
+		var de *DisconnectError
+		if len(connectionLost) != 1 || connectionLost[0] == nil || errors.As(connectionLost[0], &de) {
+			t.Errorf("expected one call to OnConnectionLost with the transport error, got %v", connectionLost)
+		}
+		if connectionDown != 2 {
+			t.Errorf("expected OnConnectionDown to be called twice, got %d", connectionDown)
+		}
+
+		// Neither is called when the client disconnects
+		if err := cm.Disconnect(t.Context()); err != nil {
+			t.Errorf("Disconnect failed: %s", err)
+		}
+		<-cm.Done()
+		synctest.Wait()
+		if len(serverDisconnects) != 1 || len(connectionLost) != 1 {
+			t.Errorf("unexpected calls following Disconnect: %v %v", serverDisconnects, connectionLost)
+		}
+	})
+}
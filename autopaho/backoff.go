@@ -24,6 +24,27 @@ import (
 // attempt starts at "0" indicating the delay BEFORE the first attempt
 type Backoff func(attempt int) time.Duration
 
+// ReconnectBackoff is implemented by reconnection strategies that need to take into account the error that caused
+// the previous connection attempt to fail (e.g. to back off for longer when authentication fails).
+type ReconnectBackoff interface {
+	// Delay returns the time to wait before connection attempt N (attempt starts at "0" indicating the delay BEFORE the
+	// first attempt). lastErr is the error that caused the most recent attempt to fail (nil if attempt is 0).
+	Delay(attempt int, lastErr error) time.Duration
+}
+
+// Delay implements ReconnectBackoff (the error is ignored)
+func (b Backoff) Delay(attempt int, _ error) time.Duration {
+	return b(attempt)
+}
+
+// BackoffFunc is an adapter that allows a function to be used as a ReconnectBackoff
+type BackoffFunc func(attempt int, lastErr error) time.Duration
+
+// Delay implements ReconnectBackoff
+func (b BackoffFunc) Delay(attempt int, lastErr error) time.Duration {
+	return b(attempt, lastErr)
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // implementation for constant backoff
 ////////////////////////////////////////////////////////////////////////////////
@@ -129,6 +150,51 @@ func DefaultExponentialBackoff() Backoff {
 	)
 }
 
+////////////////////////////////////////////////////////////////////////////////
+// implementation for an exponential backoff with jitter
+////////////////////////////////////////////////////////////////////////////////
+
+// NewJitteredExponentialBackoff provides a backoff that doubles, starting at the initial value, with each attempt up to
+// the specified max value. A random jitter is then applied to spread out reconnection attempts from multiple clients.
+//
+// Configuration parameters:
+//   - initialDelay - delay before the second attempt (there is no delay before the first)
+//   - maxDelay     - upper bound for computed backoff (jitter will not take the delay above this value)
+//   - jitter       - proportion (0-1) by which the delay may be randomly varied (e.g. 0.2 = +/-20%)
+func NewJitteredExponentialBackoff(initialDelay time.Duration, maxDelay time.Duration, jitter float64) Backoff {
+	if initialDelay <= 0 {
+		panic("initial delay must NOT be less than or equal to: 0")
+	}
+	if maxDelay < initialDelay {
+		panic("max delay must NOT be less than: initial delay")
+	}
+	if jitter < 0 || jitter > 1 {
+		panic("jitter must be in range of: [0, 1]")
+	}
+
+	return func(attempt int) time.Duration {
+		if attempt <= 0 {
+			return 0
+		}
+
+		delay := initialDelay
+		for i := 1; i < attempt && delay < maxDelay; i++ {
+			delay *= 2
+		}
+		if delay > maxDelay || delay <= 0 { // delay <= 0 catches numerical overflow
+			delay = maxDelay
+		}
+
+		if jitter > 0 {
+			delay = time.Duration(float64(delay) * (1 - jitter + 2*jitter*rand.Float64()))
+			if delay > maxDelay {
+				delay = maxDelay
+			}
+		}
+		return delay
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // util functions
 ////////////////////////////////////////////////////////////////////////////////
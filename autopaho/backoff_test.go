@@ -135,3 +135,44 @@ func doSetupAndTestRandomExponentialBackoff(t *testing.T) {
 		}
 	}
 }
+
+// tests for the jittered exponential backoff strategy implementation
+
+func TestJitteredExponentialBackoff(t *testing.T) {
+	initial := time.Second
+	maxDelay := 30 * time.Second
+	jitter := 0.25
+	backoff := NewJitteredExponentialBackoff(initial, maxDelay, jitter)
+
+	if actual := backoff(0); actual != 0 {
+		t.Fatalf("First attempt should not have any delay")
+	}
+	expected := initial
+	for i := 1; i < 20; i++ {
+		for j := 0; j < 50; j++ { // multiple runs due to random component
+			actual := backoff(i)
+			low := time.Duration(float64(expected) * (1 - jitter))
+			high := time.Duration(float64(expected) * (1 + jitter))
+			if high > maxDelay {
+				high = maxDelay
+			}
+			if actual < low || actual > high {
+				t.Fatalf("attempt %d: expected delay in range [%s, %s], actual `%s`", i, low, high, actual)
+			}
+		}
+		expected *= 2
+		if expected > maxDelay {
+			expected = maxDelay
+		}
+	}
+}
+
+func TestJitteredExponentialBackoffNoJitter(t *testing.T) {
+	backoff := NewJitteredExponentialBackoff(time.Second, 5*time.Second, 0)
+	expected := []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, e := range expected {
+		if actual := backoff.Delay(i, nil); actual != e {
+			t.Fatalf("attempt %d: expected value: `%s`, actual `%s`", i, e, actual)
+		}
+	}
+}
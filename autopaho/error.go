@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"sync"
 
+	"github.com/eclipse/paho.golang/packets"
 	"github.com/eclipse/paho.golang/paho"
 	"github.com/eclipse/paho.golang/paho/log"
 )
@@ -26,9 +27,9 @@ import (
 // errorHandler provides the onClientError callback function that will be called by the Paho library. The sole aim
 // of this is to pass a single error onto the error channel (the library may send multiple errors; only the first
 // will be processed).
-// The callback userOnClientError will be called a maximum of one time. If userOnServerDisconnect is called, then
-// userOnClientError will not be called (but there is a small chance that userOnClientError will be called followed
-// by userOnServerDisconnect (if we encounter an error sending but there is a DISCONNECT in the queue).
+// Only the callback relating to the first error is called: userOnClientError or userOnServerDisconnect (so, if we
+// encounter an error sending but there is a DISCONNECT in the queue, the DISCONNECT is not passed on), and a maximum
+// of one time.
 type errorHandler struct {
 	debug log.Logger
 
@@ -57,8 +58,16 @@ func (e *errorHandler) onClientError(err error) {
 // clean server shutdown). We want to begin attempting to reconnect when this occurs (and pass a detectable error
 // to the user)
 func (e *errorHandler) onServerDisconnect(d *paho.Disconnect) {
-	e.handleError(&DisconnectError{err: fmt.Sprintf("server requested disconnect (reason: %d)", d.ReasonCode)})
-	if e.userOnServerDisconnect != nil {
+	de := &DisconnectError{err: fmt.Sprintf("server requested disconnect (reason: %d)", d.ReasonCode), ReasonCode: d.ReasonCode}
+	if d.Properties != nil {
+		de.ReasonString = d.Properties.ReasonString
+		de.ServerReference = d.Properties.ServerReference
+		de.User = d.Properties.User
+		if de.ReasonString != "" {
+			de.err = fmt.Sprintf("server requested disconnect (reason: %d, %s)", d.ReasonCode, de.ReasonString)
+		}
+	}
+	if e.handleError(de) && e.userOnServerDisconnect != nil {
 		go e.userOnServerDisconnect(d)
 	}
 }
@@ -80,13 +89,36 @@ func (e *errorHandler) handleError(err error) bool {
 	return false
 }
 
-// DisconnectError will be passed when the server requests disconnection (allows this error type to be detected)
-type DisconnectError struct{ err string }
+// DisconnectError will be passed when the server requests disconnection (allows this error type to be detected).
+// It matches paho.ErrDisconnected (errors.Is) and, if the reason code indicates an error, paho.ReasonCodeError
+// (errors.As).
+type DisconnectError struct {
+	err             string
+	ReasonCode      byte                // DISCONNECT reason code
+	ReasonString    string              // DISCONNECT Reason String from properties
+	ServerReference string              // DISCONNECT Server Reference from properties (see FollowServerReference)
+	User            paho.UserProperties // DISCONNECT User Properties
+}
 
 func (d *DisconnectError) Error() string {
 	return d.err
 }
 
+// Is enables errors.Is(err, paho.ErrDisconnected)
+func (d *DisconnectError) Is(target error) bool {
+	return target == paho.ErrDisconnected
+}
+
+// As enables errors.As(err, **paho.ReasonCodeError)
+func (d *DisconnectError) As(target any) bool {
+	t, ok := target.(**paho.ReasonCodeError)
+	if !ok || d.ReasonCode < 0x80 {
+		return false
+	}
+	*t = &paho.ReasonCodeError{PacketType: packets.DISCONNECT, ReasonCode: d.ReasonCode, ReasonString: d.ReasonString}
+	return true
+}
+
 // ConnackError will be passed when the server denies connection in CONNACK packet
 type ConnackError struct {
 	ReasonCode byte   // CONNACK reason code
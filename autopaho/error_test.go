@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package autopaho
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	paholog "github.com/eclipse/paho.golang/paho/log"
+)
+
+// TestErrorCategories checks that autopaho errors match the paho error categories
+func TestErrorCategories(t *testing.T) {
+	if !errors.Is(ConnectionDownError, paho.ErrNotConnected) {
+		t.Error("ConnectionDownError should match paho.ErrNotConnected")
+	}
+	if !errors.Is(QueueFullError, paho.ErrQueueFull) {
+		t.Error("QueueFullError should match paho.ErrQueueFull")
+	}
+	if errors.Is(QueueFullError, paho.ErrNotConnected) {
+		t.Error("QueueFullError should not match paho.ErrNotConnected")
+	}
+
+	errChan := make(chan error, 1)
+	eh := errorHandler{debug: paholog.NOOPLogger{}, errChan: errChan}
+	eh.onServerDisconnect(&paho.Disconnect{
+		ReasonCode: packets.DisconnectServerShuttingDown,
+		Properties: &paho.DisconnectProperties{ReasonString: "maintenance"},
+	})
+	err := <-errChan
+	var de *DisconnectError
+	if !errors.As(err, &de) {
+		t.Fatalf("expected DisconnectError, got %v", err)
+	}
+	if !errors.Is(err, paho.ErrDisconnected) {
+		t.Error("DisconnectError should match paho.ErrDisconnected")
+	}
+	var rce *paho.ReasonCodeError
+	if !errors.As(err, &rce) {
+		t.Fatalf("expected ReasonCodeError, got %v", err)
+	}
+	if rce.PacketType != packets.DISCONNECT || rce.ReasonCode != packets.DisconnectServerShuttingDown || rce.ReasonString != "maintenance" || !rce.Retryable() {
+		t.Errorf("unexpected ReasonCodeError %+v", rce)
+	}
+
+	// A normal disconnection is not an error from the server's perspective
+	if errors.As(&DisconnectError{ReasonCode: packets.DisconnectNormalDisconnection}, &rce) {
+		t.Error("normal disconnection should not be a ReasonCodeError")
+	}
+}
+
+// TestDisconnectErrorProperties checks that DisconnectError includes the properties sent in the DISCONNECT
+func TestDisconnectErrorProperties(t *testing.T) {
+	errChan := make(chan error, 1)
+	eh := errorHandler{debug: paholog.NOOPLogger{}, errChan: errChan}
+	eh.onServerDisconnect(&paho.Disconnect{
+		ReasonCode: packets.DisconnectServerMoved,
+		Properties: &paho.DisconnectProperties{
+			ReasonString:    "moved",
+			ServerReference: "b.example.com",
+			User:            paho.UserProperties{{Key: "k", Value: "v"}},
+		},
+	})
+	var de *DisconnectError
+	if !errors.As(<-errChan, &de) {
+		t.Fatal("expected DisconnectError")
+	}
+	if de.ReasonCode != packets.DisconnectServerMoved || de.ReasonString != "moved" || de.ServerReference != "b.example.com" {
+		t.Errorf("unexpected DisconnectError: %+v", de)
+	}
+	if len(de.User) != 1 || de.User[0] != (paho.UserProperty{Key: "k", Value: "v"}) {
+		t.Errorf("unexpected User Properties: %v", de.User)
+	}
+	if !strings.Contains(de.Error(), "moved") {
+		t.Errorf("expected error message to include the reason string: %s", de)
+	}
+}
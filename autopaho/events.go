@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package autopaho
+
+import (
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// defaultEventBufferSize is the capacity of the channel returned by ConnectionManager.Events if
+// ClientConfig.EventBufferSize is 0
+const defaultEventBufferSize = 16
+
+// ConnectionEventType identifies the connection state transition that a ConnectionEvent reports
+type ConnectionEventType int
+
+const (
+	EventConnecting     ConnectionEventType = iota // Attempting to establish a connection (emitted before each series of connection attempts)
+	EventConnectionUp                              // A connection has been established (Connack is set)
+	EventConnectionDown                            // The connection has been lost (Err holds the reason) or closed due to shutdown
+	EventStopped                                   // The ConnectionManager has shutdown and will not reconnect (final event)
+)
+
+// String implements fmt.Stringer
+func (t ConnectionEventType) String() string {
+	switch t {
+	case EventConnecting:
+		return "connecting"
+	case EventConnectionUp:
+		return "up"
+	case EventConnectionDown:
+		return "down"
+	case EventStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// ConnectionEvent reports a change in the state of the connection managed by a ConnectionManager
+type ConnectionEvent struct {
+	Type    ConnectionEventType
+	Time    time.Time     // When the transition occurred
+	Connack *paho.Connack // The CONNACK received from the server (EventConnectionUp only)
+	// Err is the reason the connection was lost (EventConnectionDown) or the ConnectionManager stopped (EventStopped).
+	// When shutdown is due to the context being cancelled (or Disconnect called) this will be the context error.
+	Err error
+}
+
+// eventQueue delivers ConnectionEvents to a buffered channel; if the buffer is full the oldest event is dropped (so
+// that connection management is never blocked by a slow, or absent, reader).
+type eventQueue struct {
+	ch chan ConnectionEvent
+}
+
+// newEventQueue creates an eventQueue with the specified buffer size
+func newEventQueue(size int) *eventQueue {
+	if size <= 0 {
+		size = defaultEventBufferSize
+	}
+	return &eventQueue{ch: make(chan ConnectionEvent, size)}
+}
+
+// emit adds an event to the queue (dropping the oldest event if the queue is full).
+// Must only be called from a single goroutine (the connection manager's main loop).
+func (q *eventQueue) emit(e ConnectionEvent) {
+	e.Time = time.Now()
+	for {
+		select {
+		case q.ch <- e:
+			return
+		default:
+		}
+		select {
+		case <-q.ch: // Make room by dropping the oldest event (the reader may have consumed one in the meantime)
+		default:
+		}
+	}
+}
+
+// close closes the channel (no further events may be emitted)
+func (q *eventQueue) close() {
+	close(q.ch)
+}
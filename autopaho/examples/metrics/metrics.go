@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+const clientID = "PahoGoClient" // Change this to something random if using a public test server
+
+// This example demonstrates the use of a paho.Observer to collect metrics (published via expvar; view them at
+// http://localhost:8080/debug/vars).
+
+// expvarObserver implements paho.Observer (and autopaho.ReconnectObserver), recording metrics in an expvar.Map
+type expvarObserver struct {
+	m *expvar.Map
+}
+
+func (o expvarObserver) OnPublishSent(qos byte) {
+	o.m.Add("publish_sent_qos"+strconv.Itoa(int(qos)), 1)
+}
+
+func (o expvarObserver) OnPublishAcked(qos byte, reasonCode byte, latency time.Duration) {
+	o.m.Add("publish_acked_qos"+strconv.Itoa(int(qos)), 1)
+	if reasonCode >= 0x80 {
+		o.m.Add("publish_failed", 1)
+	}
+	o.m.AddFloat("publish_ack_latency_seconds_total", latency.Seconds())
+}
+
+func (o expvarObserver) OnSubscribeAcked(latency time.Duration) {
+	o.m.Add("subscribe_acked", 1)
+	o.m.AddFloat("subscribe_latency_seconds_total", latency.Seconds())
+}
+
+func (o expvarObserver) OnMessageReceived(qos byte) {
+	o.m.Add("received_qos"+strconv.Itoa(int(qos)), 1)
+}
+
+func (o expvarObserver) OnReconnect() {
+	o.m.Add("reconnects", 1)
+}
+
+func main() {
+	// App will run until cancelled by user (e.g. ctrl-c)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// expvar registers a handler for /debug/vars with http.DefaultServeMux
+	go func() {
+		if err := http.ListenAndServe("localhost:8080", nil); err != nil {
+			fmt.Printf("http server failed: %s\n", err)
+		}
+	}()
+
+	// We will connect to the Eclipse test server (note that you may see messages that other users publish)
+	u, err := url.Parse("mqtt://mqtt.eclipseprojects.io:1883")
+	if err != nil {
+		panic(err)
+	}
+
+	cliCfg := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{u},
+		KeepAlive:                     20,
+		CleanStartOnInitialConnection: true,
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, connAck *paho.Connack) {
+			fmt.Println("mqtt connection up")
+			if _, err := cm.Subscribe(context.Background(), &paho.Subscribe{
+				Subscriptions: []paho.SubscribeOptions{
+					{Topic: "test/metrics", QoS: 1},
+				},
+			}); err != nil {
+				fmt.Printf("failed to subscribe (%s)\n", err)
+			}
+		},
+		OnConnectError: func(err error) { fmt.Printf("error whilst attempting connection: %s\n", err) },
+		ClientConfig: paho.ClientConfig{
+			ClientID: clientID,
+			Observer: expvarObserver{m: expvar.NewMap("mqtt")},
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(pr paho.PublishReceived) (bool, error) {
+					fmt.Printf("received message on topic %s\n", pr.Packet.Topic)
+					return true, nil
+				}},
+		},
+	}
+
+	c, err := autopaho.NewConnection(ctx, cliCfg) // starts process; will reconnect until context cancelled
+	if err != nil {
+		panic(err)
+	}
+
+	// Publish a message every second (metrics will be updated as messages are sent and received)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err = c.AwaitConnection(ctx); err != nil {
+				continue // context cancelled
+			}
+			if _, err := c.Publish(ctx, &paho.Publish{
+				QoS:     1,
+				Topic:   "test/metrics",
+				Payload: []byte("metrics test message"),
+			}); err != nil && ctx.Err() == nil {
+				fmt.Printf("error publishing: %s\n", err)
+			}
+		case <-ctx.Done():
+			<-c.Done() // Wait for clean shutdown (cancelling the context triggered the shutdown)
+			return
+		}
+	}
+}
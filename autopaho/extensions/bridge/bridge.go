@@ -0,0 +1,370 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+// Package bridge republishes messages between two MQTT servers (a "local" and a "remote" server), in a similar way
+// to the bridge functionality offered by many brokers.
+//
+// A Bridge manages two autopaho ConnectionManagers; each reconnects independently, and the subscriptions required
+// by the rules are made whenever a connection comes up. Messages are forwarded via ConnectionManager.PublishViaQueue,
+// so they are held in the destination's queue whilst it is disconnected.
+//
+// Backpressure: the receiving connection's OnPublishReceived callback blocks until the message has been added to
+// the destination's queue. Setting QueueCapacity, with QueueFullPolicy set to autopaho.QueueFullBlock, in the
+// destination's config will, when the queue is full, stop the bridge reading from the source connection (so the
+// source server's flow control applies). Other policies result in messages being dropped (or logged as errors).
+//
+// Loop prevention: subscriptions are made with NoLocal set (so a message forwarded to a server will not be received
+// back on the same connection), and each forwarded message carries a user property (MarkerKey, with the value
+// Config.Name); messages carrying this marker are not forwarded again. This prevents loops where messages pass through
+// multiple bridges with the same name (or where the servers themselves are bridged).
+//
+// Example configuration (forward sensor readings to the remote server under a site prefix, and receive commands):
+//
+//	b, err := bridge.New(ctx, bridge.Config{
+//		Local:  localCfg,  // autopaho.ClientConfig
+//		Remote: remoteCfg, // autopaho.ClientConfig
+//		Rules: []bridge.Rule{
+//			{Filter: "sensors/#", Topic: "site1/{topic}", QoS: 1},
+//			{Filter: "site1/cmd/+", Topic: "cmd/{3}", QoS: 1, Direction: bridge.In, Retain: bridge.RetainNever},
+//		},
+//	})
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/log"
+)
+
+// MarkerKey is the key of the user property added to each forwarded message (the value is Config.Name)
+const MarkerKey = "paho-bridge"
+
+// subscribeTimeout limits the time taken to subscribe following connection
+const subscribeTimeout = 30 * time.Second
+
+// Direction determines which way messages matching a Rule are forwarded
+type Direction int
+
+const (
+	Out  Direction = iota // Messages received from the local server are published to the remote server (default)
+	In                    // Messages received from the remote server are published to the local server
+	Both                  // Messages are forwarded in both directions
+)
+
+// String implements fmt.Stringer
+func (d Direction) String() string {
+	switch d {
+	case Out:
+		return "out"
+	case In:
+		return "in"
+	case Both:
+		return "both"
+	}
+	return "Direction(" + strconv.Itoa(int(d)) + ")"
+}
+
+// RetainHandling determines the retain flag on forwarded messages
+type RetainHandling int
+
+const (
+	RetainAsPublished RetainHandling = iota // Retain flag is copied from the received message (default)
+	RetainNever                             // Retain flag is always false
+	RetainAlways                            // Retain flag is always true
+)
+
+// Rule specifies messages to be forwarded
+type Rule struct {
+	Filter string // Topic filter subscribed to on the source server (may include wildcards)
+
+	// Topic is a template used to generate the destination topic; `{topic}` is replaced with the full topic the
+	// message was received on, and `{n}` with level n (starting at 1) of that topic (e.g. "site1/{topic}" or
+	// "archive/{2}"). If empty, the message is published to the topic it was received on.
+	Topic string
+
+	QoS       byte           // QoS used both to subscribe, and to publish forwarded messages
+	Retain    RetainHandling // Determines the retain flag on forwarded messages
+	Direction Direction      // Which way messages are forwarded
+}
+
+// Config is used to configure a Bridge
+type Config struct {
+	// Local and Remote are the configurations used to connect to each server. The bridge adds its own
+	// OnPublishReceived and OnConnectionUp callbacks (any already set will still be called). Note that both
+	// connections must use different client identifiers if they connect to the same server.
+	Local, Remote autopaho.ClientConfig
+
+	Rules []Rule // Forwarding rules; where multiple rules match a message, only the first (in order) is used
+
+	// Name is used as the value of the MarkerKey user property added to forwarded messages (defaults to "bridge").
+	// Messages received carrying this property, with the same value, are not forwarded.
+	Name string
+
+	Errors log.Logger // Errors forwarding messages are logged here (By default set to NOOPLogger{})
+}
+
+// Bridge forwards messages between two servers; create one with New
+type Bridge struct {
+	local, remote *autopaho.ConnectionManager
+	rules         []Rule
+	name          string
+	errors        log.Logger
+	ready         chan struct{} // Closed once both ConnectionManagers have been created
+}
+
+// New validates the rules and establishes connections to both servers (connection attempts continue in the
+// background, as with autopaho.NewConnection). The bridge will run until ctx is cancelled, or Disconnect is called.
+func New(ctx context.Context, cfg Config) (*Bridge, error) {
+	if len(cfg.Rules) == 0 {
+		return nil, fmt.Errorf("%w: no rules provided", paho.ErrInvalidArguments)
+	}
+	for i, r := range cfg.Rules {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("%w: rule %d: %w", paho.ErrInvalidArguments, i, err)
+		}
+	}
+	b := &Bridge{
+		rules:  cfg.Rules,
+		name:   cfg.Name,
+		errors: cfg.Errors,
+		ready:  make(chan struct{}),
+	}
+	if b.name == "" {
+		b.name = "bridge"
+	}
+	if b.errors == nil {
+		b.errors = log.NOOPLogger{}
+	}
+
+	defer close(b.ready)
+	var err error
+	b.local, err = autopaho.NewConnection(ctx, b.configure(ctx, cfg.Local, Out, &b.remote))
+	if err != nil {
+		return nil, fmt.Errorf("local connection: %w", err)
+	}
+	b.remote, err = autopaho.NewConnection(ctx, b.configure(ctx, cfg.Remote, In, &b.local))
+	if err != nil {
+		_ = b.local.Disconnect(context.Background())
+		return nil, fmt.Errorf("remote connection: %w", err)
+	}
+	return b, nil
+}
+
+// Local returns the ConnectionManager for the local server
+func (b *Bridge) Local() *autopaho.ConnectionManager { return b.local }
+
+// Remote returns the ConnectionManager for the remote server
+func (b *Bridge) Remote() *autopaho.ConnectionManager { return b.remote }
+
+// AwaitConnection will return when both connections are up, or the context is cancelled
+func (b *Bridge) AwaitConnection(ctx context.Context) error {
+	if err := b.local.AwaitConnection(ctx); err != nil {
+		return err
+	}
+	return b.remote.AwaitConnection(ctx)
+}
+
+// Disconnect closes both connections (messages that have not been forwarded will remain in the queues) and waits
+// for the ConnectionManagers to shut down (or the context to be cancelled).
+func (b *Bridge) Disconnect(ctx context.Context) error {
+	return errors.Join(b.local.Disconnect(ctx), b.remote.Disconnect(ctx))
+}
+
+// Done returns a channel that will be closed when both ConnectionManagers have shut down
+func (b *Bridge) Done() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		<-b.local.Done()
+		<-b.remote.Done()
+		close(done)
+	}()
+	return done
+}
+
+// configure returns a copy of cfg with the bridge callbacks added; dir is the direction messages received on this
+// connection travel, and dest will point to the ConnectionManager they are forwarded to.
+func (b *Bridge) configure(ctx context.Context, cfg autopaho.ClientConfig, dir Direction, dest **autopaho.ConnectionManager) autopaho.ClientConfig {
+	var rules []Rule
+	for _, r := range b.rules {
+		if r.Direction == dir || r.Direction == Both {
+			rules = append(rules, r)
+		}
+	}
+	if len(rules) == 0 {
+		return cfg
+	}
+
+	var subs []paho.SubscribeOptions
+	for _, r := range rules {
+		subs = append(subs, paho.SubscribeOptions{
+			Topic:             r.Filter,
+			QoS:               r.QoS,
+			NoLocal:           true,
+			RetainAsPublished: r.Retain == RetainAsPublished,
+		})
+	}
+	onUp := cfg.OnConnectionUp
+	cfg.OnConnectionUp = func(cm *autopaho.ConnectionManager, ca *paho.Connack) {
+		go func() { // OnConnectionUp must not block
+			select {
+			case <-b.ready:
+			case <-ctx.Done():
+				return
+			}
+			sctx, cancel := context.WithTimeout(ctx, subscribeTimeout)
+			defer cancel()
+			if _, err := cm.Subscribe(sctx, &paho.Subscribe{Subscriptions: subs}); err != nil {
+				b.errors.Printf("bridge (%s) failed to subscribe: %s", dir, err)
+			}
+		}()
+		if onUp != nil {
+			onUp(cm, ca)
+		}
+	}
+	cfg.OnPublishReceived = append([]func(paho.PublishReceived) (bool, error){
+		func(pr paho.PublishReceived) (bool, error) {
+			return b.forward(pr, rules, dest)
+		},
+	}, cfg.OnPublishReceived...)
+	return cfg
+}
+
+// forward publishes the received message to dest if it matches one of the rules
+func (b *Bridge) forward(pr paho.PublishReceived, rules []Rule, dest **autopaho.ConnectionManager) (bool, error) {
+	select { // Messages may arrive before New completes (if the session was resumed)
+	case <-b.ready:
+	case <-pr.Context().Done():
+		return false, pr.Context().Err()
+	}
+	in := pr.Packet
+	if *dest == nil || b.forwarded(in) {
+		return false, nil
+	}
+	for _, r := range rules {
+		if !match(r.Filter, in.Topic) {
+			continue
+		}
+		out := &paho.Publish{
+			QoS:        r.QoS,
+			Retain:     in.Retain,
+			Topic:      r.topic(in.Topic),
+			Properties: copyProperties(in.Properties),
+			Payload:    in.Payload,
+		}
+		switch r.Retain {
+		case RetainNever:
+			out.Retain = false
+		case RetainAlways:
+			out.Retain = true
+		}
+		out.Properties.User = append(out.Properties.User, paho.UserProperty{Key: MarkerKey, Value: b.name})
+		if err := (*dest).PublishViaQueue(pr.Context(), &autopaho.QueuePublish{Publish: out}); err != nil {
+			err = fmt.Errorf("failed to forward message from %s to %s: %w", in.Topic, out.Topic, err)
+			b.errors.Println(err)
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// forwarded returns true if p carries the marker added by this bridge
+func (b *Bridge) forwarded(p *paho.Publish) bool {
+	if p.Properties == nil {
+		return false
+	}
+	for _, u := range p.Properties.User {
+		if u.Key == MarkerKey && u.Value == b.name {
+			return true
+		}
+	}
+	return false
+}
+
+// copyProperties returns the properties that should be retained when a message is forwarded (the Topic Alias and
+// Subscription Identifier relate to the connection the message was received on, so are not copied).
+func copyProperties(p *paho.PublishProperties) *paho.PublishProperties {
+	if p == nil {
+		return &paho.PublishProperties{}
+	}
+	return &paho.PublishProperties{
+		PayloadFormat:   p.PayloadFormat,
+		MessageExpiry:   p.MessageExpiry,
+		ContentType:     p.ContentType,
+		ResponseTopic:   p.ResponseTopic,
+		CorrelationData: p.CorrelationData,
+		User:            append(paho.UserProperties(nil), p.User...),
+	}
+}
+
+// validate checks that the rule is usable
+func (r Rule) validate() error {
+	if r.Filter == "" {
+		return errors.New("filter must not be empty")
+	}
+	if r.QoS > 2 {
+		return fmt.Errorf("invalid QoS (%d)", r.QoS)
+	}
+	if strings.ContainsAny(r.Topic, "+#") {
+		return fmt.Errorf("topic template (%s) must not contain wildcards", r.Topic)
+	}
+	if r.Direction < Out || r.Direction > Both {
+		return fmt.Errorf("invalid direction (%d)", r.Direction)
+	}
+	return nil
+}
+
+// topic generates the destination topic for a message received on the source topic
+func (r Rule) topic(source string) string {
+	if r.Topic == "" {
+		return source
+	}
+	levels := strings.Split(source, "/")
+	repl := make([]string, 0, 2+2*len(levels))
+	repl = append(repl, "{topic}", source)
+	for i, l := range levels {
+		repl = append(repl, "{"+strconv.Itoa(i+1)+"}", l)
+	}
+	return strings.NewReplacer(repl...).Replace(r.Topic)
+}
+
+// match returns true if the topic matches the filter
+func match(filter, topic string) bool {
+	if strings.HasPrefix(filter, "$share/") { // $share/{group}/{filter}; only the filter is used for matching
+		if parts := strings.SplitN(filter, "/", 3); len(parts) == 3 {
+			filter = parts[2]
+		}
+	}
+	fl, tl := strings.Split(filter, "/"), strings.Split(topic, "/")
+	if strings.HasPrefix(topic, "$") && (fl[0] == "+" || fl[0] == "#") {
+		return false // Wildcards at the first level do not match topics beginning with $
+	}
+	for i, f := range fl {
+		if f == "#" {
+			return true
+		}
+		if i >= len(tl) || (f != "+" && f != tl[i]) {
+			return false
+		}
+	}
+	return len(fl) == len(tl)
+}
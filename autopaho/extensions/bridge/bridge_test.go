@@ -0,0 +1,234 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/pahotest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// clientConfig returns an autopaho config that connects to b
+func clientConfig(b *pahotest.Broker, clientID string) autopaho.ClientConfig {
+	server, _ := url.Parse("mqtt://127.0.0.1:1883")
+	return autopaho.ClientConfig{
+		ServerUrls:       []*url.URL{server},
+		KeepAlive:        30,
+		ReconnectBackoff: autopaho.NewConstantBackoff(time.Second),
+		AttemptConnection: func(ctx context.Context, _ autopaho.ClientConfig, _ *url.URL) (net.Conn, error) {
+			return b.Connect(ctx)
+		},
+		ClientConfig: paho.ClientConfig{ClientID: clientID},
+	}
+}
+
+// observe connects a client to b that subscribes to all topics; messages received are sent to the returned channel
+func observe(t *testing.T, b *pahotest.Broker) <-chan *paho.Publish {
+	t.Helper()
+	conn, err := b.Connect(t.Context())
+	require.NoError(t, err)
+	msgs := make(chan *paho.Publish, 10)
+	c := paho.NewClient(paho.ClientConfig{
+		Conn: conn,
+		OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+			func(pr paho.PublishReceived) (bool, error) {
+				msgs <- pr.Packet
+				return true, nil
+			},
+		},
+	})
+	_, err = c.Connect(t.Context(), &paho.Connect{ClientID: "observer", KeepAlive: 30, CleanStart: true})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.Disconnect(&paho.Disconnect{}) })
+	_, err = c.Subscribe(t.Context(), &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{{Topic: "#", QoS: 1, RetainAsPublished: true}}})
+	require.NoError(t, err)
+	return msgs
+}
+
+// receive returns the next message on msgs (nil if there is none)
+func receive(msgs <-chan *paho.Publish) *paho.Publish {
+	synctest.Wait()
+	select {
+	case m := <-msgs:
+		return m
+	default:
+		return nil
+	}
+}
+
+// TestBridge checks that messages are forwarded in each direction as per the rules
+func TestBridge(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		local, remote := pahotest.NewBroker(nil), pahotest.NewBroker(nil)
+		defer local.Close()
+		defer remote.Close()
+		localMsgs, remoteMsgs := observe(t, local), observe(t, remote)
+
+		b, err := New(t.Context(), Config{
+			Local:  clientConfig(local, "bridge"),
+			Remote: clientConfig(remote, "bridge"),
+			Rules: []Rule{
+				{Filter: "sensors/#", Topic: "site1/{topic}", QoS: 1},
+				{Filter: "site1/cmd/+", Topic: "cmd/{3}", QoS: 1, Direction: In, Retain: RetainNever},
+			},
+		})
+		require.NoError(t, err)
+		require.NoError(t, b.AwaitConnection(t.Context()))
+		synctest.Wait() // Allow subscriptions to complete
+
+		local.Publish(&packets.Publish{
+			Topic:   "sensors/temp",
+			QoS:     1,
+			Retain:  true,
+			Payload: []byte("21.5"),
+			Properties: &packets.Properties{
+				CorrelationData: []byte("id"),
+				ContentType:     "text/plain",
+				User:            []packets.User{{Key: "unit", Value: "C"}},
+			},
+		})
+		assert.Equal(t, "sensors/temp", receive(localMsgs).Topic)
+		m := receive(remoteMsgs)
+		require.NotNil(t, m)
+		assert.Equal(t, "site1/sensors/temp", m.Topic)
+		assert.Equal(t, []byte("21.5"), m.Payload)
+		assert.Equal(t, byte(1), m.QoS)
+		assert.True(t, m.Retain)
+		assert.Equal(t, []byte("id"), m.Properties.CorrelationData)
+		assert.Equal(t, "text/plain", m.Properties.ContentType)
+		assert.Equal(t, paho.UserProperties{{Key: "unit", Value: "C"}, {Key: MarkerKey, Value: "bridge"}}, m.Properties.User)
+
+		remote.Publish(&packets.Publish{Topic: "site1/cmd/reboot", Retain: true, Payload: []byte("now")})
+		assert.Equal(t, "site1/cmd/reboot", receive(remoteMsgs).Topic)
+		m = receive(localMsgs)
+		require.NotNil(t, m)
+		assert.Equal(t, "cmd/reboot", m.Topic)
+		assert.False(t, m.Retain)
+
+		// Messages that do not match a rule, or that have already passed through the bridge, are not forwarded
+		remote.Publish(&packets.Publish{Topic: "site1/other"})
+		local.Publish(&packets.Publish{
+			Topic:      "sensors/loop",
+			Properties: &packets.Properties{User: []packets.User{{Key: MarkerKey, Value: "bridge"}}},
+		})
+		assert.Equal(t, "site1/other", receive(remoteMsgs).Topic)
+		assert.Equal(t, "sensors/loop", receive(localMsgs).Topic)
+		assert.Nil(t, receive(localMsgs))
+		assert.Nil(t, receive(remoteMsgs))
+
+		require.NoError(t, b.Disconnect(t.Context()))
+		<-b.Done()
+	})
+}
+
+// TestBridgeReconnect checks that messages are queued whilst the destination is disconnected, and that subscriptions
+// are reestablished when the source reconnects
+func TestBridgeReconnect(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		local, remote := pahotest.NewBroker(nil), pahotest.NewBroker(nil)
+		defer local.Close()
+		defer remote.Close()
+		remoteMsgs := observe(t, remote)
+
+		b, err := New(t.Context(), Config{
+			Local:  clientConfig(local, "bridge"),
+			Remote: clientConfig(remote, "bridge"),
+			Rules:  []Rule{{Filter: "a/#", QoS: 1}},
+		})
+		require.NoError(t, err)
+		require.NoError(t, b.AwaitConnection(t.Context()))
+		synctest.Wait()
+
+		// The broker does not retain sessions, so the bridge must resubscribe after the local connection drops
+		require.NoError(t, local.DropConnection("bridge"))
+		time.Sleep(2 * time.Second)
+		synctest.Wait()
+		local.Publish(&packets.Publish{Topic: "a/1", QoS: 1})
+		assert.Equal(t, "a/1", receive(remoteMsgs).Topic)
+
+		// Messages received whilst the remote connection is down are delivered once it comes back up
+		remote.SetConnackFn(func(_ *packets.Connect, ca *packets.Connack) { ca.ReasonCode = packets.ConnackServerBusy })
+		require.NoError(t, remote.DropConnection("bridge"))
+		synctest.Wait()
+		local.Publish(&packets.Publish{Topic: "a/2", QoS: 1})
+		assert.Nil(t, receive(remoteMsgs))
+		remote.SetConnackFn(nil)
+		time.Sleep(2 * time.Second)
+		assert.Equal(t, "a/2", receive(remoteMsgs).Topic)
+
+		require.NoError(t, b.Disconnect(t.Context()))
+		<-b.Done()
+	})
+}
+
+// TestNewInvalid checks that invalid rules are rejected
+func TestNewInvalid(t *testing.T) {
+	for name, r := range map[string]Rule{
+		"empty filter":      {},
+		"invalid QoS":       {Filter: "a", QoS: 3},
+		"wildcard topic":    {Filter: "a/#", Topic: "b/#"},
+		"invalid direction": {Filter: "a", Direction: 7},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := New(t.Context(), Config{Rules: []Rule{r}})
+			assert.True(t, errors.Is(err, paho.ErrInvalidArguments), err)
+		})
+	}
+}
+
+func TestRuleTopic(t *testing.T) {
+	tests := []struct {
+		template, source, want string
+	}{
+		{"", "a/b/c", "a/b/c"},
+		{"site1/{topic}", "a/b/c", "site1/a/b/c"},
+		{"{3}/{1}", "a/b/c", "c/a"},
+		{"x/{4}", "a/b/c", "x/{4}"}, // Placeholders beyond the topic levels are left alone
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, Rule{Topic: tt.template}.topic(tt.source), tt.template)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "$SYS/x", false},
+		{"$share/g/a/+", "a/b", true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, match(tt.filter, tt.topic), tt.filter+" "+tt.topic)
+	}
+}
@@ -32,29 +32,46 @@ import (
 
 	"github.com/eclipse/paho.golang/packets"
 	"github.com/eclipse/paho.golang/paho"
-
-	"golang.org/x/net/proxy"
 )
 
 // Network (establishing connection) functionality for AutoPaho
 
 // establishServerConnection - establishes a connection with the MQTT server retrying until successful or the
-// context is cancelled (in which case nil will be returned).
-func establishServerConnection(ctx context.Context, cfg ClientConfig, firstConnection bool) (*paho.Client, *paho.Connack) {
+// context is cancelled (in which case nil will be returned). Traffic on the connection will be recorded in stats.
+// If redirect is non-nil, it is used for the first attempt (in place of a server from cfg.ServerUrls). The URL of the
+// server connected to is returned.
+func establishServerConnection(ctx context.Context, cfg ClientConfig, firstConnection bool, redirect *url.URL, stats *connStats) (*paho.Client, *paho.Connack, *url.URL) {
 	// Note: We do not touch b.cli in order to avoid adding thread safety issues.
 
 	var attempt int = 0
+	var lastErr error      // The error that caused the most recent connection attempt to fail
+	var failedAttempts int // Number of consecutive failed connection attempts (across all server URLs)
+
+	// The hooks and pinger are wrapped for each attempt, so retain the originals (cfg is modified within the loop)
+	onBytesRead, onBytesWritten := stats.tap(cfg.OnBytesRead, cfg.OnBytesWritten)
+	pingHandler := cfg.PingHandler
 	for {
 		// Delay before attempting connection
 		select {
-		case <-time.After(cfg.ReconnectBackoff(attempt)):
+		case <-time.After(cfg.ReconnectBackoffStrategy.Delay(attempt, lastErr)):
 		case <-ctx.Done():
-			return nil, nil
+			return nil, nil, nil
 		}
-		for _, u := range cfg.ServerUrls {
+		for range cfg.ServerUrls {
 			var connack *paho.Connack
+			u := redirect
+			if u != nil {
+				redirect = nil
+			} else {
+				u = cfg.ServerSelector.Select(cfg.ServerUrls, failedAttempts, lastErr)
+			}
 
 			cp, err := cfg.buildConnectPacket(firstConnection, u)
+			if err == nil && cfg.TlsConfigFn != nil { // Obtain a fresh config for each attempt (cfg is a copy, so TlsCfg can be replaced)
+				if cfg.TlsCfg, err = cfg.TlsConfigFn(ctx); err != nil {
+					err = fmt.Errorf("failed to obtain TLS config: %w", err)
+				}
+			}
 			if err == nil {
 				connectionCtx, cancelConnCtx := context.WithTimeout(ctx, cfg.ConnectTimeout)
 
@@ -63,36 +80,39 @@ func establishServerConnection(ctx context.Context, cfg ClientConfig, firstConne
 				} else {
 					switch strings.ToLower(u.Scheme) {
 					case "mqtt", "tcp", "":
-						cfg.Conn, err = attemptTCPConnection(connectionCtx, u.Host)
+						cfg.Conn, err = attemptTCPConnection(connectionCtx, cfg.Proxy, u)
 					case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
-						cfg.Conn, err = attemptTLSConnection(connectionCtx, cfg.TlsCfg, u.Host)
+						cfg.Conn, err = attemptTLSConnection(connectionCtx, cfg.TlsCfg, cfg.Proxy, u)
 					case "ws":
 						cfg.Conn, err = attemptWebsocketConnection(connectionCtx, nil, cfg.WebSocketCfg, u)
 					case "wss":
 						cfg.Conn, err = attemptWebsocketConnection(connectionCtx, cfg.TlsCfg, cfg.WebSocketCfg, u)
 					default:
-						if cfg.OnConnectError != nil {
-							cfg.OnConnectError(fmt.Errorf("unsupported scheme (%s) user in url %s", u.Scheme, u.String()))
-						}
-						cancelConnCtx()
-						continue
+						err = fmt.Errorf("unsupported scheme (%s) user in url %s", u.Scheme, u.String())
 					}
 				}
 
 				if err == nil {
-					cli := paho.NewClient(cfg.ClientConfig)
-					if cfg.PahoDebug != nil {
-						cli.SetDebugLogger(cfg.PahoDebug)
+					cfg.OnBytesRead, cfg.OnBytesWritten = onBytesRead, onBytesWritten
+					pinger := pingHandler
+					if pinger == nil { // paho would create this, but we need to wrap it
+						pinger = paho.NewDefaultPinger()
+						pinger.SetDebug(cfg.PahoDebug)
 					}
+					cfg.PingHandler = &statsPinger{Pinger: pinger, stats: stats}
+					stats.setPinger(cfg.PingHandler)
 
-					if cfg.PahoErrors != nil {
-						cli.SetErrorLogger(cfg.PahoErrors)
-					}
+					cli := paho.NewClient(cfg.ClientConfig)
+					cli.SetDebugLogger(cfg.PahoDebug) // cfg.PahoDebug and cfg.PahoErrors are set in NewConnection
+					cli.SetErrorLogger(cfg.PahoErrors)
 
 					connack, err = cli.Connect(connectionCtx, cp) // will return an error if the connection is unsuccessful (checks the reason code)
-					if err == nil {                               // Successfully connected
+					if connack != nil {                           // CONNACK is not passed to the pinger
+						stats.packetReceived()
+					}
+					if err == nil { // Successfully connected
 						cancelConnCtx()
-						return cli, connack
+						return cli, connack, u
 					}
 				}
 				cancelConnCtx()
@@ -100,15 +120,20 @@ func establishServerConnection(ctx context.Context, cfg ClientConfig, firstConne
 
 			// Possible failure was due to outer context being cancelled
 			if ctx.Err() != nil {
-				return nil, nil
+				return nil, nil, nil
 			}
 			cfg.Debug.Printf("failed to connect to %s: %s", u.String(), err)
 
+			cerr := fmt.Errorf("failed to connect to %s: %w", u.String(), err)
+			if connack != nil {
+				cerr = NewConnackError(err, connack)
+			}
+			lastErr = cerr
+			failedAttempts++
+			if cfg.OnConnectAttemptFailed != nil {
+				cfg.OnConnectAttemptFailed(u, failedAttempts, cerr)
+			}
 			if cfg.OnConnectError != nil {
-				cerr := fmt.Errorf("failed to connect to %s: %w", u.String(), err)
-				if connack != nil {
-					cerr = NewConnackError(err, connack)
-				}
 				cfg.OnConnectError(cerr)
 			}
 		}
@@ -117,39 +142,39 @@ func establishServerConnection(ctx context.Context, cfg ClientConfig, firstConne
 	}
 }
 
-// attemptTCPConnection - makes a single attempt at establishing a TCP connection with the server
-func attemptTCPConnection(ctx context.Context, address string) (net.Conn, error) {
-	allProxy := os.Getenv("all_proxy")
-	if len(allProxy) == 0 {
-		var d net.Dialer
-		return d.DialContext(ctx, "tcp", address)
-	}
-	// Note: if custom dialer does not implement proxy.ContextDialer, a new goroutine is blocked ("leaked")
-	//until the provided implementation of Dial() times out
-	return proxy.Dial(ctx, "tcp", address)
+// attemptTCPConnection - makes a single attempt at establishing a TCP connection with the server (via a proxy if
+// proxyFn returns one)
+func attemptTCPConnection(ctx context.Context, proxyFn ProxyFunc, serverURL *url.URL) (net.Conn, error) {
+	return dialTCP(ctx, proxyFn, serverURL)
 }
 
-// attemptTLSConnection - makes a single attempt at establishing a TLS connection with the server
-func attemptTLSConnection(ctx context.Context, tlsCfg *tls.Config, address string) (net.Conn, error) {
-	allProxy := os.Getenv("all_proxy")
-	if len(allProxy) == 0 {
+// attemptTLSConnection - makes a single attempt at establishing a TLS connection with the server. Where a proxy is
+// used, TLS is negotiated with the server through the tunnel.
+func attemptTLSConnection(ctx context.Context, tlsCfg *tls.Config, proxyFn ProxyFunc, serverURL *url.URL) (net.Conn, error) {
+	if proxyFn == nil && len(os.Getenv("all_proxy")) == 0 {
 		d := tls.Dialer{
 			Config: tlsCfg,
 		}
-		conn, err := d.DialContext(ctx, "tcp", address)
+		conn, err := d.DialContext(ctx, "tcp", serverURL.Host)
 		return packets.NewThreadSafeConn(conn), err
 	}
 
-	// Note: if custom dialer does not implement proxy.ContextDialer, a new goroutine is blocked ("leaked")
-	//until the provided implementation of Dial() times out
-	conn, err := proxy.Dial(ctx, "tcp", address)
+	conn, err := dialTCP(ctx, proxyFn, serverURL)
 	if err != nil {
 		return nil, err
 	}
 
+	if tlsCfg == nil || tlsCfg.ServerName == "" { // As tls.Dialer would, verify the certificate against the server's name
+		if tlsCfg == nil {
+			tlsCfg = &tls.Config{}
+		} else {
+			tlsCfg = tlsCfg.Clone()
+		}
+		tlsCfg.ServerName = serverURL.Hostname()
+	}
 	tlsConn := tls.Client(conn, tlsCfg)
 
-	err = tlsConn.Handshake()
+	err = tlsConn.HandshakeContext(ctx)
 	if err != nil {
 		_ = conn.Close()
 		return nil, err
@@ -176,6 +201,11 @@ func attemptWebsocketConnection(ctx context.Context, tlsc *tls.Config, cfg *WebS
 		d.Subprotocols = []string{"mqtt"}
 		dialer = &d
 	}
+	if cfg != nil && cfg.Subprotocols != nil {
+		d := *dialer // Take a copy so that a user supplied dialer is not modified
+		d.Subprotocols = cfg.Subprotocols
+		dialer = &d
+	}
 	ws, _, err := dialer.DialContext(ctx, serverURL.String(), requestHeader)
 	if err != nil {
 		return nil, fmt.Errorf("websocket connection failed: %w", err)
@@ -0,0 +1,357 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package autopaho
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	paholog "github.com/eclipse/paho.golang/paho/log"
+	"github.com/eclipse/paho.golang/paho/pahotest"
+	"github.com/gorilla/websocket"
+)
+
+// TestWebsocketConfig checks that headers and subprotocols are applied (with headers being requested on each attempt)
+func TestWebsocketConfig(t *testing.T) {
+	type request struct {
+		auth        string
+		subprotocol string
+	}
+	requests := make(chan request, 2)
+	upgrader := websocket.Upgrader{Subprotocols: []string{"custom", "mqtt"}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- request{auth: r.Header.Get("Authorization"), subprotocol: r.Header.Get("Sec-WebSocket-Protocol")}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		_ = c.Close()
+	}))
+	defer srv.Close()
+
+	serverURL, err := url.Parse(strings.Replace(srv.URL, "http", "ws", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := 0
+	cfg := &WebSocketConfig{
+		Header: func(*url.URL, *tls.Config) http.Header {
+			token++ // New token for each attempt
+			return http.Header{"Authorization": []string{"Bearer " + strconv.Itoa(token)}}
+		},
+		Subprotocols: []string{"custom"},
+	}
+	for i := 1; i <= 2; i++ {
+		conn, err := attemptWebsocketConnection(t.Context(), nil, cfg, serverURL)
+		if err != nil {
+			t.Fatalf("connection attempt %d failed: %s", i, err)
+		}
+		_ = conn.Close()
+		r := <-requests
+		if want := "Bearer " + strconv.Itoa(i); r.auth != want {
+			t.Errorf("attempt %d: expected Authorization %q, got %q", i, want, r.auth)
+		}
+		if r.subprotocol != "custom" {
+			t.Errorf("attempt %d: expected subprotocol %q, got %q", i, "custom", r.subprotocol)
+		}
+	}
+}
+
+// TestAttemptConnectionCustomTransport checks that AttemptConnection can be used to connect over a transport that
+// autopaho does not support (a Unix socket, using a custom URL scheme).
+func TestAttemptConnectionCustomTransport(t *testing.T) {
+	dir, err := os.MkdirTemp("", "mqtt") // t.TempDir() may exceed the maximum socket path length
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	sockPath := filepath.Join(dir, "mqtt.sock")
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Skipf("unix sockets not available: %s", err)
+	}
+	defer l.Close()
+
+	b := pahotest.NewBroker(paholog.NewTestLogger(t, "broker:"))
+	defer b.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = b.ServeConn(context.Background(), conn)
+		}
+	}()
+
+	server, _ := url.Parse("unix://" + sockPath)
+	connUp := make(chan struct{})
+	cm, err := NewConnection(t.Context(), ClientConfig{
+		ServerUrls: []*url.URL{server},
+		KeepAlive:  30,
+		AttemptConnection: func(ctx context.Context, _ ClientConfig, u *url.URL) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", u.Path)
+		},
+		OnConnectionUp: func(*ConnectionManager, *paho.Connack) { close(connUp) },
+		Debug:          paholog.NewTestLogger(t, "test:"),
+		ClientConfig:   paho.ClientConfig{ClientID: "unix"},
+	})
+	if err != nil {
+		t.Fatalf("expected NewConnection success: %s", err)
+	}
+	select {
+	case <-connUp:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout awaiting connection")
+	}
+	if !b.Connected("unix") {
+		t.Fatal("client should be connected to the broker")
+	}
+	if err = cm.Disconnect(t.Context()); err != nil {
+		t.Fatalf("Disconnect failed: %s", err)
+	}
+	<-cm.Done()
+}
+
+// TestConnectTimeoutFailover checks that a connection attempt to a server that accepts the TCP connection, but never
+// sends CONNACK, is abandoned after ConnectTimeout (and the next server is tried).
+func TestConnectTimeoutFailover(t *testing.T) {
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer silent.Close()
+	go func() { // Accept connections, and discard anything received, but never respond
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	working, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer working.Close()
+	b := pahotest.NewBroker(paholog.NewTestLogger(t, "broker:"))
+	defer b.Close()
+	go func() {
+		for {
+			conn, err := working.Accept()
+			if err != nil {
+				return
+			}
+			_ = b.ServeConn(context.Background(), conn)
+		}
+	}()
+
+	silentURL, _ := url.Parse("mqtt://" + silent.Addr().String())
+	workingURL, _ := url.Parse("mqtt://" + working.Addr().String())
+	const connectTimeout = 200 * time.Millisecond
+	type failure struct {
+		u       *url.URL
+		err     error
+		elapsed time.Duration
+	}
+	failures := make(chan failure, 10)
+	connUp := make(chan struct{})
+	start := time.Now()
+	cm, err := NewConnection(context.Background(), ClientConfig{ // The context does not time out
+		ServerUrls:       []*url.URL{silentURL, workingURL},
+		KeepAlive:        30,
+		ConnectTimeout:   connectTimeout,
+		ReconnectBackoff: NewConstantBackoff(time.Hour), // Failover should not wait for the backoff
+		OnConnectAttemptFailed: func(u *url.URL, _ int, err error) {
+			failures <- failure{u: u, err: err, elapsed: time.Since(start)}
+		},
+		OnConnectionUp: func(*ConnectionManager, *paho.Connack) { close(connUp) },
+		Debug:          paholog.NewTestLogger(t, "test:"),
+		ClientConfig:   paho.ClientConfig{ClientID: "failover"},
+	})
+	if err != nil {
+		t.Fatalf("expected NewConnection success: %s", err)
+	}
+	select {
+	case <-connUp:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout awaiting connection")
+	}
+
+	f := <-failures
+	if f.u != silentURL {
+		t.Errorf("expected failure connecting to %s, got %s", silentURL, f.u)
+	}
+	if !errors.Is(f.err, context.DeadlineExceeded) {
+		t.Errorf("expected error wrapping context.DeadlineExceeded, got %v", f.err)
+	}
+	if f.elapsed < connectTimeout || f.elapsed > 10*connectTimeout {
+		t.Errorf("attempt should be abandoned after ConnectTimeout (%s), took %s", connectTimeout, f.elapsed)
+	}
+	if !b.Connected("failover") {
+		t.Error("client should be connected to the second server")
+	}
+	if err = cm.Disconnect(context.Background()); err != nil {
+		t.Fatalf("Disconnect failed: %s", err)
+	}
+	<-cm.Done()
+}
+
+// TestProxyHTTPConnect checks that connections are established via an HTTP CONNECT proxy, and that TLS is negotiated
+// with the MQTT server through the tunnel
+func TestProxyHTTPConnect(t *testing.T) {
+	tlsSrv := httptest.NewTLSServer(nil) // Provides a certificate valid for 127.0.0.1
+	defer tlsSrv.Close()
+	serverTLS := &tls.Config{Certificates: tlsSrv.TLS.Certificates}
+	clientTLS := &tls.Config{RootCAs: tlsSrv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+
+	for _, tc := range []struct {
+		scheme string
+		tls    bool
+	}{{"mqtt", false}, {"mqtts", true}} {
+		t.Run(tc.scheme, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("failed to listen: %s", err)
+			}
+			if tc.tls {
+				l = tls.NewListener(l, serverTLS)
+			}
+			defer l.Close()
+			b := pahotest.NewBroker(paholog.NewTestLogger(t, "broker:"))
+			defer b.Close()
+			go func() {
+				for {
+					conn, err := l.Accept()
+					if err != nil {
+						return
+					}
+					_ = b.ServeConn(context.Background(), conn)
+				}
+			}()
+
+			type connectReq struct{ host, auth string }
+			requests := make(chan connectReq, 1)
+			pl, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("failed to listen: %s", err)
+			}
+			defer pl.Close()
+			go func() { // Minimal HTTP CONNECT proxy
+				conn, err := pl.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				requests <- connectReq{host: req.Host, auth: req.Header.Get("Proxy-Authorization")}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go func() { _, _ = io.Copy(target, conn) }()
+				_, _ = io.Copy(conn, target)
+			}()
+
+			serverURL, _ := url.Parse(tc.scheme + "://" + l.Addr().String())
+			proxyURL, _ := url.Parse("http://user:pass@" + pl.Addr().String())
+			connUp := make(chan struct{})
+			cm, err := NewConnection(context.Background(), ClientConfig{
+				ServerUrls:     []*url.URL{serverURL},
+				TlsCfg:         clientTLS,
+				Proxy:          ProxyURL(proxyURL),
+				KeepAlive:      30,
+				OnConnectionUp: func(*ConnectionManager, *paho.Connack) { close(connUp) },
+				ClientConfig:   paho.ClientConfig{ClientID: "proxied"},
+			})
+			if err != nil {
+				t.Fatalf("expected NewConnection success: %s", err)
+			}
+			select {
+			case <-connUp:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout awaiting connection")
+			}
+
+			req := <-requests
+			if req.host != l.Addr().String() {
+				t.Errorf("expected CONNECT to %s, got %s", l.Addr(), req.host)
+			}
+			if req.auth != "Basic dXNlcjpwYXNz" { // user:pass
+				t.Errorf("unexpected Proxy-Authorization: %q", req.auth)
+			}
+			if !b.Connected("proxied") {
+				t.Error("client should be connected to the server")
+			}
+			if err = cm.Disconnect(context.Background()); err != nil {
+				t.Fatalf("Disconnect failed: %s", err)
+			}
+			<-cm.Done()
+		})
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	t.Setenv("HTTP_PROXY", "http://plain.example:3128")
+	t.Setenv("HTTPS_PROXY", "socks5://secure.example:1080")
+	t.Setenv("NO_PROXY", "local.example")
+
+	for _, tc := range []struct{ server, proxy string }{
+		{"mqtt://broker.example:1883", "http://plain.example:3128"},
+		{"mqtts://broker.example:8883", "socks5://secure.example:1080"},
+		{"mqtt://local.example:1883", ""},
+	} {
+		u, _ := url.Parse(tc.server)
+		p, err := ProxyFromEnvironment(u)
+		if err != nil {
+			t.Fatalf("ProxyFromEnvironment(%s) failed: %s", tc.server, err)
+		}
+		var got string
+		if p != nil {
+			got = p.String()
+		}
+		if got != tc.proxy {
+			t.Errorf("ProxyFromEnvironment(%s) = %v, expected %q", tc.server, p, tc.proxy)
+		}
+	}
+}
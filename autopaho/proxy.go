@@ -0,0 +1,183 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package autopaho
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// ProxyFunc returns the URL of the proxy to use when connecting to serverURL (nil means connect directly). Supported
+// proxy schemes are `http` and `https` (HTTP CONNECT tunnel, with Basic authentication if the URL includes user
+// information) along with `socks5` and `socks5h`.
+type ProxyFunc func(serverURL *url.URL) (*url.URL, error)
+
+// ProxyURL returns a ProxyFunc that always returns proxyURL
+func ProxyURL(proxyURL *url.URL) ProxyFunc {
+	return func(*url.URL) (*url.URL, error) {
+		return proxyURL, nil
+	}
+}
+
+// ProxyFromEnvironment is a ProxyFunc that uses the HTTPS_PROXY (for TLS schemes), HTTP_PROXY (for other schemes) and
+// NO_PROXY environment variables (or their lowercase versions) in the same way as http.ProxyFromEnvironment.
+func ProxyFromEnvironment(serverURL *url.URL) (*url.URL, error) {
+	u := *serverURL
+	u.Scheme = "http"
+	if isTLSScheme(serverURL.Scheme) {
+		u.Scheme = "https"
+	}
+	return httpproxy.FromEnvironment().ProxyFunc()(&u)
+}
+
+// isTLSScheme returns true if scheme is one that autopaho connects to using TLS over TCP
+func isTLSScheme(scheme string) bool {
+	switch strings.ToLower(scheme) {
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+		return true
+	}
+	return false
+}
+
+// dialTCP establishes a TCP connection to serverURL.Host; this will be via a proxy if proxyFn returns one. If proxyFn
+// is nil, the all_proxy environment variable is honoured (via golang.org/x/net/proxy).
+func dialTCP(ctx context.Context, proxyFn ProxyFunc, serverURL *url.URL) (net.Conn, error) {
+	if proxyFn == nil {
+		if len(os.Getenv("all_proxy")) == 0 {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", serverURL.Host)
+		}
+		// Note: if custom dialer does not implement proxy.ContextDialer, a new goroutine is blocked ("leaked")
+		//until the provided implementation of Dial() times out
+		return proxy.Dial(ctx, "tcp", serverURL.Host)
+	}
+
+	proxyURL, err := proxyFn(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine proxy: %w", err)
+	}
+	if proxyURL == nil {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", serverURL.Host)
+	}
+	switch strings.ToLower(proxyURL.Scheme) {
+	case "http", "https":
+		return dialHTTPConnect(ctx, proxyURL, serverURL.Host)
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(proxyURL, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer).DialContext(ctx, "tcp", serverURL.Host)
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme (%s)", proxyURL.Scheme)
+	}
+}
+
+// dialHTTPConnect establishes a tunnel to address via the HTTP proxy at proxyURL (using the CONNECT method)
+func dialHTTPConnect(ctx context.Context, proxyURL *url.URL, address string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if strings.ToLower(proxyURL.Scheme) == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+
+	var conn net.Conn
+	var err error
+	if strings.ToLower(proxyURL.Scheme) == "https" {
+		d := tls.Dialer{Config: &tls.Config{ServerName: proxyURL.Hostname()}}
+		conn, err = d.DialContext(ctx, "tcp", proxyAddr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", proxyAddr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy: %w", err)
+	}
+
+	// The CONNECT exchange must not outlast ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Unix(1, 0)) })
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	br := bufio.NewReader(conn)
+	err = req.Write(conn)
+	var resp *http.Response
+	if err == nil {
+		resp, err = http.ReadResponse(br, req)
+	}
+	if err == nil {
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("proxy refused CONNECT to %s: %s", address, resp.Status)
+		}
+	}
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+			err = fmt.Errorf("%w: %w", ctxErr, err)
+		}
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	if br.Buffered() > 0 { // The server sent data immediately following the CONNECT response
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn where data already read from the connection is held in r
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read reads from the buffer before reading from the connection
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
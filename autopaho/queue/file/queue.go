@@ -20,6 +20,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -29,11 +30,16 @@ import (
 // A queue implementation that stores all data on disk
 // This will be slow when there are a lot of messages queued. That is because the directory is read with every call to
 // Peek/DeQueue (could cache some of this in RAM, but there is a reasonable chance that the OS does this for us).
+//
+// Each entry is written to a temporary file which is renamed once the write is complete; this means that a partially
+// written entry (e.g. due to a power failure) will never be returned by Peek. Entries that are not valid (corrupt) are
+// expected to be passed to Quarantine by the user (autopaho does this, and logs the issue).
 
 const (
 	folderPermissions = os.FileMode(0770)
 	filePermissions   = os.FileMode(0666)
 	corruptExtension  = ".CORRUPT" // quarantined files will be given this extension
+	partialExtension  = ".PARTIAL" // files being written will have this extension (until complete)
 )
 
 var (
@@ -47,14 +53,15 @@ type Queue struct {
 	prefix          string
 	extension       string
 	queueEmpty      bool              // true is the queue is currently empty
+	seq             uint64            // incremented with each entry written (ensures filenames sort in order written)
 	waiting         []chan<- struct{} // closed when something arrives in the queue
 	waitingForEmpty []chan<- struct{} // closed when queue is empty
 }
 
 // New creates a new file-based queue. Note that a file is written, read and deleted as part of this process to check
-// that the path is usable.
-// NOTE: Order is maintained using file ModTime, so there may be issues if the interval between messages is less than
-// the file system ModTime resolution.
+// that the path is usable. Any partially written entries (left over from a previous run) will be removed.
+// NOTE: Order is maintained using file ModTime, with the filename (which includes the time written and a sequence
+// number) used where the ModTime is the same (file system ModTime resolution may be low).
 func New(path string, prefix string, extension string) (*Queue, error) {
 	if len(extension) > 0 && extension[0] != '.' {
 		extension = "." + extension
@@ -76,13 +83,24 @@ func New(path string, prefix string, extension string) (*Queue, error) {
 		return nil, fmt.Errorf("failed to remove test file from specified folder: %w", err)
 	}
 
+	// Partial files cannot be used (the write did not complete) so are removed
+	partial, err := filepath.Glob(filepath.Join(path, prefix+"*"+extension+partialExtension))
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for partial files: %w", err)
+	}
+	for _, fn := range partial {
+		if err := os.Remove(fn); err != nil {
+			return nil, fmt.Errorf("failed to remove partial file %s: %w", fn, err)
+		}
+	}
+
 	q := &Queue{
 		path:      path,
 		prefix:    prefix,
 		extension: extension,
 	}
 
-	_, err := q.oldestEntry()
+	_, err = q.oldestEntry()
 	if err == io.EOF {
 		q.queueEmpty = true
 	} else if err != nil {
@@ -156,9 +174,10 @@ func (q *Queue) Peek() (queue.Entry, error) {
 }
 
 // put writes out an item to disk
+// caller must hold lock on mu
 func (q *Queue) put(p io.Reader) error {
-	// Use CreateTemp to generate a file with a unique name (it will be removed when packet has been transmitted)
-	f, err := os.CreateTemp(q.path, q.prefix+"*"+q.extension)
+	// Use CreateTemp to generate a file with a unique name (it will be renamed once the write is complete)
+	f, err := os.CreateTemp(q.path, q.prefix+"*"+q.extension+partialExtension)
 	if err != nil {
 		return err
 	}
@@ -172,6 +191,14 @@ func (q *Queue) put(p io.Reader) error {
 		_ = os.Remove(f.Name()) // Attempt to remove the partial file (not much we can do if this fails)
 		return err
 	}
+
+	// The filename sorts in the order entries were written (used when ModTime is the same)
+	q.seq++
+	fn := filepath.Join(q.path, fmt.Sprintf("%s%020d-%010d%s", q.prefix, time.Now().UnixNano(), q.seq, q.extension))
+	if err = os.Rename(f.Name(), fn); err != nil {
+		_ = os.Remove(f.Name()) // Attempt to remove the partial file (not much we can do if this fails)
+		return err
+	}
 	return nil
 }
 
@@ -205,8 +232,8 @@ func (q *Queue) oldestEntry() (string, error) {
 			continue
 		}
 		fn := entry.Name()
-		if match, err := filepath.Match(q.prefix+"*"+q.extension, fn); err != nil {
-			return "", fmt.Errorf("failed to read match %s: %w", fn, err)
+		if match, err := q.isEntry(fn); err != nil {
+			return "", err
 		} else if !match {
 			continue
 		}
@@ -215,16 +242,49 @@ func (q *Queue) oldestEntry() (string, error) {
 			return "", fmt.Errorf("failed to retrieve file info for %s: %w", fn, err)
 		}
 		fileModTime := info.ModTime()
-		if !fileModTime.Before(oldTime) {
+		if fileModTime.After(oldTime) || (fileModTime.Equal(oldTime) && fn > oldFn) {
 			continue
 		}
-		oldFn = filepath.Join(q.path, fn)
+		oldFn = fn
 		oldTime = fileModTime
 	}
 	if oldTime.Equal(maxTime) {
 		return "", io.EOF
 	}
-	return oldFn, nil
+	return filepath.Join(q.path, oldFn), nil
+}
+
+// isEntry returns true if the filename passed is a queue entry
+func (q *Queue) isEntry(fn string) (bool, error) {
+	if strings.HasSuffix(fn, partialExtension) || strings.HasSuffix(fn, corruptExtension) {
+		return false, nil // may match the pattern below if extension is ""
+	}
+	match, err := filepath.Match(q.prefix+"*"+q.extension, fn)
+	if err != nil {
+		return false, fmt.Errorf("failed to read match %s: %w", fn, err)
+	}
+	return match, nil
+}
+
+// Len returns the number of entries in the queue (implements queue.Lengther)
+// Note: This reads the directory so may be slow if the queue is large
+func (q *Queue) Len() (int, error) {
+	entries, err := os.ReadDir(q.path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read dir: %w", err)
+	}
+	var count int
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if match, err := q.isEntry(entry.Name()); err != nil {
+			return 0, err
+		} else if match {
+			count++
+		}
+	}
+	return count, nil
 }
 
 // entry is used to return a queue entry from Peek
@@ -237,6 +297,15 @@ func (e entry) Reader() (io.Reader, error) {
 	return e.f, nil
 }
 
+// EnqueuedAt returns the time the entry was added to the queue (the file ModTime; implements queue.EnqueuedAter)
+func (e entry) EnqueuedAt() (time.Time, error) {
+	fi, err := e.f.Stat()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to stat queue entry: %w", err)
+	}
+	return fi.ModTime(), nil
+}
+
 // Leave closes the entry leaving it in the queue (will be returned on subsequent calls to Peek)
 func (e entry) Leave() error {
 	return e.f.Close()
@@ -20,6 +20,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -157,3 +158,67 @@ func TestLeaveAndError(t *testing.T) {
 		t.Errorf(".corrupt file not found in test folder")
 	}
 }
+
+// TestPartialAndRestart checks that partially written files are ignored/removed and that entries survive a restart
+func TestPartialAndRestart(t *testing.T) {
+	testDirectory := t.TempDir()
+	q, err := New(testDirectory, "queueTest-", "")
+	if err != nil {
+		t.Fatalf("failed to create queue: %s", err)
+	}
+
+	// Simulate a write that did not complete (e.g. power failure) and a corrupt entry
+	partialFn := filepath.Join(testDirectory, "queueTest-123"+partialExtension)
+	if err := os.WriteFile(partialFn, []byte("partial"), filePermissions); err != nil {
+		t.Fatalf("failed to write partial file: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(testDirectory, "queueTest-456"+corruptExtension), []byte("corrupt"), filePermissions); err != nil {
+		t.Fatalf("failed to write corrupt file: %s", err)
+	}
+	if _, err := q.Peek(); !errors.Is(err, queue.ErrEmpty) {
+		t.Fatalf("expected ErrEmpty, got %s", err)
+	}
+
+	const entryFormat = "Queue entry %d for testing"
+	for i := 0; i < 5; i++ {
+		if err := q.Enqueue(bytes.NewReader([]byte(fmt.Sprintf(entryFormat, i)))); err != nil {
+			t.Fatalf("error adding entry %d: %s", i, err)
+		}
+	}
+
+	if l, err := q.Len(); err != nil || l != 5 {
+		t.Fatalf("expected Len of 5 (partial and corrupt files ignored), got %d (%v)", l, err)
+	}
+
+	// Simulate a restart; the partial file should be removed and entries returned in the order they were added
+	q, err = New(testDirectory, "queueTest-", "")
+	if err != nil {
+		t.Fatalf("failed to create queue: %s", err)
+	}
+	if _, err := os.Stat(partialFn); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected partial file to be removed, got %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		entry, err := q.Peek()
+		if err != nil {
+			t.Fatalf("error peeking entry %d: %s", i, err)
+		}
+		r, err := entry.Reader()
+		if err != nil {
+			t.Fatalf("error getting reader for entry %d: %s", i, err)
+		}
+		buf := &bytes.Buffer{}
+		if _, err = buf.ReadFrom(r); err != nil {
+			t.Fatalf("error reading entry %d: %s", i, err)
+		}
+		if err = entry.Remove(); err != nil {
+			t.Fatalf("error removing queue entry %d: %s", i, err)
+		}
+		if expected := fmt.Sprintf(entryFormat, i); expected != buf.String() {
+			t.Fatalf("expected \"%s\", got \"%s\"", expected, buf.String())
+		}
+	}
+	if _, err := q.Peek(); !errors.Is(err, queue.ErrEmpty) {
+		t.Errorf("expected ErrEmpty, got %s", err)
+	}
+}
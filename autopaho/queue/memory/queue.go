@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/eclipse/paho.golang/autopaho/queue"
 )
@@ -29,11 +30,17 @@ import (
 // Queue - basic memory based queue
 type Queue struct {
 	mu              sync.Mutex
-	messages        [][]byte
+	messages        []message
 	waiting         []chan<- struct{} // closed when something arrives in the queue
 	waitingForEmpty []chan<- struct{} // closed when queue is empty
 }
 
+// message is an entry in the queue
+type message struct {
+	data       []byte
+	enqueuedAt time.Time
+}
+
 // New creates a new memory-based queue
 func New() *Queue {
 	return &Queue{}
@@ -76,7 +83,7 @@ func (q *Queue) Enqueue(p io.Reader) error {
 	}
 	q.mu.Lock()
 	defer q.mu.Unlock()
-	q.messages = append(q.messages, b.Bytes())
+	q.messages = append(q.messages, message{data: b.Bytes(), enqueuedAt: time.Now()})
 	for _, c := range q.waiting {
 		close(c)
 	}
@@ -84,6 +91,13 @@ func (q *Queue) Enqueue(p io.Reader) error {
 	return nil
 }
 
+// Len returns the number of entries in the queue (implements queue.Lengther)
+func (q *Queue) Len() (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.messages), nil
+}
+
 // Peek retrieves the oldest item from the queue (without removing it)
 func (q *Queue) Peek() (queue.Entry, error) {
 	q.mu.Lock()
@@ -103,7 +117,17 @@ func (q *Queue) Reader() (io.Reader, error) {
 	if len(q.messages) == 0 {
 		return nil, queue.ErrEmpty
 	}
-	return bytes.NewReader(q.messages[0]), nil
+	return bytes.NewReader(q.messages[0].data), nil
+}
+
+// EnqueuedAt implements queue.EnqueuedAter - returns the time the entry was added to the queue
+func (q *Queue) EnqueuedAt() (time.Time, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.messages) == 0 {
+		return time.Time{}, queue.ErrEmpty
+	}
+	return q.messages[0].enqueuedAt, nil
 }
 
 // Leave implements Entry.Leave - the entry (will be returned on subsequent calls to Peek)
@@ -128,3 +128,33 @@ func TestLeaveAndQuarantine(t *testing.T) {
 		t.Errorf("expected ErrEmpty, got %s", err)
 	}
 }
+
+// TestEnqueuedAt checks that entries report the time they were added to the queue
+func TestEnqueuedAt(t *testing.T) {
+	q := New()
+	before := time.Now()
+	if err := q.Enqueue(bytes.NewReader([]byte("test"))); err != nil {
+		t.Fatalf("error adding to queue: %s", err)
+	}
+	entry, err := q.Peek()
+	if err != nil {
+		t.Fatalf("error peeking: %s", err)
+	}
+	ea, ok := entry.(queue.EnqueuedAter)
+	if !ok {
+		t.Fatal("entry should implement queue.EnqueuedAter")
+	}
+	at, err := ea.EnqueuedAt()
+	if err != nil {
+		t.Fatalf("EnqueuedAt failed: %s", err)
+	}
+	if at.Before(before) || at.After(time.Now()) {
+		t.Errorf("unexpected enqueue time %s", at)
+	}
+	if err = entry.Remove(); err != nil {
+		t.Fatalf("error removing entry: %s", err)
+	}
+	if _, err = ea.EnqueuedAt(); !errors.Is(err, queue.ErrEmpty) {
+		t.Errorf("expected ErrEmpty once queue is empty, got %v", err)
+	}
+}
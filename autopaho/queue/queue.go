@@ -18,6 +18,7 @@ package queue
 import (
 	"errors"
 	"io"
+	"time"
 )
 
 var (
@@ -48,3 +49,17 @@ type Queue interface {
 	// Warning: Peek is not safe for concurrent use (it may return the same Entry leading to unpredictable results)
 	Peek() (Entry, error)
 }
+
+// Lengther may optionally be implemented by a Queue that is able to report the number of entries it holds (used
+// when reporting statistics).
+type Lengther interface {
+	// Len returns the number of entries currently in the queue
+	Len() (int, error)
+}
+
+// EnqueuedAter may optionally be implemented by an Entry that is able to report when it was added to the queue. This
+// enables the Message Expiry Interval of a queued PUBLISH to be reduced by the time spent in the queue (and expired
+// messages to be dropped rather than transmitted).
+type EnqueuedAter interface {
+	EnqueuedAt() (time.Time, error) // Returns the time that the entry was passed to Enqueue
+}
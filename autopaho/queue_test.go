@@ -24,6 +24,7 @@ import (
 	"net"
 	"net/url"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"testing/synctest"
@@ -391,3 +392,631 @@ func TestPreloadPublish(t *testing.T) {
 		}
 	})
 }
+
+// TestPauseResume confirms that messages are held whilst publishing is paused (including across a reconnection) and
+// sent, in order, when publishing resumes.
+func TestPauseResume(t *testing.T) {
+	t.Parallel()
+
+	synctest.Test(t, func(t *testing.T) {
+		server, _ := url.Parse(dummyURL)
+		logger := paholog.NewTestLogger(t, "test:")
+		ts := testserver.New(paholog.NewTestLogger(t, "testServer:"))
+
+		var connections atomic.Int32
+		received := make(chan string, 10)
+		ts.SetPacketReceivedCallback(func(cp *packets.ControlPacket) error {
+			if cp.Type == packets.PUBLISH {
+				received <- cp.Content.(*packets.Publish).Topic
+			}
+			return nil
+		})
+		ts.SetConnectCallback(func(*packets.Connect, *packets.Connack) {
+			connections.Add(1)
+		})
+
+		var tsDone chan struct{} // Set on AttemptConnection and closed when that test server connection is done
+		config := ClientConfig{
+			ServerUrls:          []*url.URL{server},
+			ReconnectBackoff:    NewConstantBackoff(shortDelay),
+			ConnectTimeout:      shortDelay,
+			DropQoS0WhilePaused: true,
+			AttemptConnection: func(ctx context.Context, _ ClientConfig, _ *url.URL) (net.Conn, error) {
+				if tsDone != nil { // Wait for previous connection to close
+					<-tsDone
+				}
+				var conn net.Conn
+				var err error
+				conn, tsDone, err = ts.Connect(ctx)
+				return conn, err
+			},
+			Debug:      logger,
+			PahoDebug:  logger,
+			PahoErrors: logger,
+			ClientConfig: paho.ClientConfig{
+				ClientID:      "test",
+				PacketTimeout: shortDelay,
+			},
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		cm, err := NewConnection(ctx, config)
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+		if err = cm.AwaitConnection(ctx); err != nil {
+			t.Fatalf("connection failed: %s", err)
+		}
+
+		cm.Pause()
+		if !cm.Paused() {
+			t.Fatal("expected Paused to return true")
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := cm.Publish(ctx, &paho.Publish{QoS: 1, Topic: strconv.Itoa(i)}); !errors.Is(err, PublishQueuedError) {
+				t.Fatalf("expected PublishQueuedError, got %v", err)
+			}
+		}
+		if err := cm.PublishViaQueue(ctx, &QueuePublish{Publish: &paho.Publish{QoS: 0, Topic: "qos0"}}); !errors.Is(err, PublishDroppedError) {
+			t.Fatalf("expected PublishDroppedError, got %v", err)
+		}
+		if err := cm.PublishViaQueue(ctx, &QueuePublish{Publish: &paho.Publish{QoS: 1, Topic: "2"}}); err != nil {
+			t.Fatalf("PublishViaQueue failed: %s", err)
+		}
+
+		// Paused state should survive reconnection
+		cm.TerminateConnectionForTest()
+		time.Sleep(longerDelay)
+		if c := connections.Load(); c != 2 {
+			t.Fatalf("expected 2 connections, got %d", c)
+		}
+		synctest.Wait()
+		select {
+		case topic := <-received:
+			t.Fatalf("message %s sent whilst paused", topic)
+		default:
+		}
+
+		cm.Resume()
+		for i := 0; i < 3; i++ {
+			select {
+			case topic := <-received:
+				if topic != strconv.Itoa(i) {
+					t.Fatalf("expected message %d, got %s", i, topic)
+				}
+			case <-time.After(longerDelay):
+				t.Fatalf("timeout awaiting message %d", i)
+			}
+		}
+
+		cancel()
+		<-cm.Done()
+		<-tsDone // Ensure the test server has shutdown
+	})
+}
+
+// TestQueueFullPolicy checks the behaviour of each QueueFullPolicy when a message is published to a full queue
+func TestQueueFullPolicy(t *testing.T) {
+	t.Parallel()
+
+	// queueTopics removes all entries from the queue returning their topics
+	queueTopics := func(t *testing.T, q queue.Queue) []string {
+		var topics []string
+		for {
+			entry, err := q.Peek()
+			if errors.Is(err, queue.ErrEmpty) {
+				return topics
+			} else if err != nil {
+				t.Fatalf("Peek failed: %s", err)
+			}
+			r, err := entry.Reader()
+			if err != nil {
+				t.Fatalf("Reader failed: %s", err)
+			}
+			cp, err := packets.ReadPacket(r)
+			if err != nil {
+				t.Fatalf("ReadPacket failed: %s", err)
+			}
+			topics = append(topics, cp.Content.(*packets.Publish).Topic)
+			if err = entry.Remove(); err != nil && !errors.Is(err, queue.ErrEmpty) {
+				t.Fatalf("Remove failed: %s", err)
+			}
+		}
+	}
+
+	tests := []struct {
+		policy      QueueFullPolicy
+		expectErr   error
+		wantDropped []string
+		wantQueue   []string
+	}{
+		{policy: QueueFullDropOldest, wantDropped: []string{"0"}, wantQueue: []string{"1", "2"}},
+		{policy: QueueFullDropNewest, wantDropped: []string{"2"}, wantQueue: []string{"0", "1"}},
+		{policy: QueueFullReturnError, expectErr: QueueFullError, wantQueue: []string{"0", "1"}},
+		{policy: QueueFullBlock, expectErr: context.DeadlineExceeded, wantQueue: []string{"0", "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				server, _ := url.Parse(dummyURL)
+				q := memqueue.New()
+				var dropped []string
+				config := ClientConfig{
+					ServerUrls:       []*url.URL{server},
+					ReconnectBackoff: NewConstantBackoff(time.Hour), // Messages should remain in the queue
+					AttemptConnection: func(context.Context, ClientConfig, *url.URL) (net.Conn, error) {
+						return nil, errors.New("connection refused")
+					},
+					Queue:           q,
+					QueueCapacity:   2,
+					QueueFullPolicy: tt.policy,
+					OnQueueDropped:  func(p *paho.Publish) { dropped = append(dropped, p.Topic) },
+					Debug:           paholog.NewTestLogger(t, "test:"),
+					ClientConfig:    paho.ClientConfig{ClientID: "test"},
+				}
+				ctx, cancel := context.WithCancel(context.Background())
+				cm, err := NewConnection(ctx, config)
+				if err != nil {
+					t.Fatalf("expected NewConnection success: %s", err)
+				}
+
+				for i := 0; i < 2; i++ {
+					if err := cm.PublishViaQueue(ctx, &QueuePublish{Publish: &paho.Publish{QoS: 1, Topic: strconv.Itoa(i)}}); err != nil {
+						t.Fatalf("PublishViaQueue %d failed: %s", i, err)
+					}
+				}
+				pubCtx, pubCancel := context.WithTimeout(ctx, time.Second)
+				err = cm.PublishViaQueue(pubCtx, &QueuePublish{Publish: &paho.Publish{QoS: 1, Topic: "2"}})
+				pubCancel()
+				if !errors.Is(err, tt.expectErr) {
+					t.Fatalf("expected error %v, got %v", tt.expectErr, err)
+				}
+				if fmt.Sprint(dropped) != fmt.Sprint(tt.wantDropped) {
+					t.Errorf("expected %v to be dropped, got %v", tt.wantDropped, dropped)
+				}
+
+				cancel()
+				<-cm.Done()
+				if topics := queueTopics(t, q); fmt.Sprint(topics) != fmt.Sprint(tt.wantQueue) {
+					t.Errorf("expected queue to hold %v, got %v", tt.wantQueue, topics)
+				}
+			})
+		})
+	}
+}
+
+// TestQueueFullBlock checks that, with QueueFullBlock, PublishViaQueue returns once a message is removed from the queue
+func TestQueueFullBlock(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		server, _ := url.Parse(dummyURL)
+		config := ClientConfig{
+			ServerUrls:       []*url.URL{server},
+			ReconnectBackoff: NewConstantBackoff(time.Hour),
+			AttemptConnection: func(context.Context, ClientConfig, *url.URL) (net.Conn, error) {
+				return nil, errors.New("connection refused")
+			},
+			QueueCapacity:   1,
+			QueueFullPolicy: QueueFullBlock,
+			Debug:           paholog.NewTestLogger(t, "test:"),
+			ClientConfig:    paho.ClientConfig{ClientID: "test"},
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cm, err := NewConnection(ctx, config)
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+		if err = cm.PublishViaQueue(ctx, &QueuePublish{Publish: &paho.Publish{QoS: 1, Topic: "0"}}); err != nil {
+			t.Fatalf("PublishViaQueue failed: %s", err)
+		}
+
+		pubErr := make(chan error, 1)
+		go func() {
+			pubErr <- cm.PublishViaQueue(ctx, &QueuePublish{Publish: &paho.Publish{QoS: 1, Topic: "1"}})
+		}()
+		synctest.Wait()
+		select {
+		case err := <-pubErr:
+			t.Fatalf("PublishViaQueue should block whilst queue is full (returned %v)", err)
+		default:
+		}
+
+		// Removing an entry (as would happen when it is transmitted) should unblock the publisher
+		entry, err := cm.peekQueue()
+		if err != nil {
+			t.Fatalf("peekQueue failed: %s", err)
+		}
+		if err = entry.Remove(); err != nil && !errors.Is(err, queue.ErrEmpty) {
+			t.Fatalf("Remove failed: %s", err)
+		}
+		if err = <-pubErr; err != nil {
+			t.Fatalf("PublishViaQueue failed: %s", err)
+		}
+
+		cancel()
+		<-cm.Done()
+	})
+}
+
+// TestQueueSendWindow checks that, with a send window of 1, queued messages are moved into the session (and
+// transmitted) one acknowledgement at a time, and that the queue and inflight counts are reported by Stats.
+func TestQueueSendWindow(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		server, _ := url.Parse(dummyURL)
+		ts := testserver.New(paholog.NewTestLogger(t, "testServer:"))
+		var received atomic.Int32
+		release := make(chan struct{}) // PUBACK is not sent until a value is received
+		ts.SetPacketReceivedCallback(func(cp *packets.ControlPacket) error {
+			if cp.Type == packets.PUBLISH {
+				received.Add(1)
+				<-release
+			}
+			return nil
+		})
+
+		var allowConnection atomic.Bool
+		var tsDone chan struct{}
+		connUp := make(chan struct{})
+		logger := paholog.NewTestLogger(t, "test:")
+		cm, err := NewConnection(t.Context(), ClientConfig{
+			ServerUrls:       []*url.URL{server},
+			KeepAlive:        60,
+			ReconnectBackoff: NewConstantBackoff(time.Second),
+			AttemptConnection: func(ctx context.Context, _ ClientConfig, _ *url.URL) (net.Conn, error) {
+				if !allowConnection.Load() {
+					return nil, errors.New("connection refused")
+				}
+				var conn net.Conn
+				var err error
+				conn, tsDone, err = ts.Connect(ctx)
+				return conn, err
+			},
+			OnConnectionUp: func(*ConnectionManager, *paho.Connack) { close(connUp) },
+			Debug:          logger,
+			PahoDebug:      logger,
+			QueueCapacity:  10, // The queue depth is independent of the send window
+			ClientConfig: paho.ClientConfig{
+				ClientID:   "test",
+				SendWindow: 1,
+			},
+		})
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+		for i := range 3 {
+			if err = cm.PublishViaQueue(t.Context(), &QueuePublish{Publish: &paho.Publish{QoS: 1, Topic: strconv.Itoa(i)}}); err != nil {
+				t.Fatalf("PublishViaQueue failed: %s", err)
+			}
+		}
+		if s := cm.Stats(); s.QueuedMessages != 3 || s.InflightMessages != 0 || s.SendWindow != 0 {
+			t.Fatalf("unexpected stats whilst offline: %+v", s)
+		}
+		allowConnection.Store(true)
+		<-connUp
+
+		for i := range 3 {
+			time.Sleep(10 * time.Millisecond) // The test server delays outgoing packets slightly
+			synctest.Wait()
+			if n := received.Load(); n != int32(i+1) {
+				t.Fatalf("expected %d PUBLISH packets to have been received, got %d", i+1, n)
+			}
+			if s := cm.Stats(); s.QueuedMessages != 2-i || s.InflightMessages != 1 || s.SendWindow != 1 {
+				t.Fatalf("unexpected stats with %d messages sent: %+v", i+1, s)
+			}
+			release <- struct{}{}
+		}
+		time.Sleep(10 * time.Millisecond)
+		synctest.Wait()
+		if s := cm.Stats(); s.QueuedMessages != 0 || s.InflightMessages != 0 {
+			t.Fatalf("unexpected stats once all messages acknowledged: %+v", s)
+		}
+
+		if err = cm.Disconnect(t.Context()); err != nil {
+			t.Fatalf("Disconnect failed: %s", err)
+		}
+		<-cm.Done()
+		<-tsDone
+	})
+}
+
+// TestQueueFullWhilstPublishing checks that PublishViaQueue does not wait for managePublishQueue whilst it is blocked
+// transmitting a message (here due to the send window), and that the message being transmitted is not dropped.
+func TestQueueFullWhilstPublishing(t *testing.T) {
+	t.Parallel()
+	for _, policy := range []QueueFullPolicy{QueueFullReturnError, QueueFullDropOldest} {
+		t.Run(policy.String(), func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				server, _ := url.Parse(dummyURL)
+				ts := testserver.New(paholog.NewTestLogger(t, "testServer:"))
+				var received atomic.Int32
+				release := make(chan struct{}) // PUBACK is not sent until release is closed
+				ts.SetPacketReceivedCallback(func(cp *packets.ControlPacket) error {
+					if cp.Type == packets.PUBLISH {
+						received.Add(1)
+						<-release
+					}
+					return nil
+				})
+
+				var allowConnection atomic.Bool
+				var tsDone chan struct{}
+				connUp := make(chan struct{})
+				var dropped []string
+				logger := paholog.NewTestLogger(t, "test:")
+				cm, err := NewConnection(t.Context(), ClientConfig{
+					ServerUrls:       []*url.URL{server},
+					KeepAlive:        60,
+					ReconnectBackoff: NewConstantBackoff(time.Second),
+					AttemptConnection: func(ctx context.Context, _ ClientConfig, _ *url.URL) (net.Conn, error) {
+						if !allowConnection.Load() {
+							return nil, errors.New("connection refused")
+						}
+						var conn net.Conn
+						var err error
+						conn, tsDone, err = ts.Connect(ctx)
+						return conn, err
+					},
+					OnConnectionUp:  func(*ConnectionManager, *paho.Connack) { close(connUp) },
+					Debug:           logger,
+					PahoDebug:       logger,
+					QueueCapacity:   2,
+					QueueFullPolicy: policy,
+					OnQueueDropped:  func(p *paho.Publish) { dropped = append(dropped, p.Topic) },
+					ClientConfig: paho.ClientConfig{
+						ClientID:   "test",
+						SendWindow: 1,
+					},
+				})
+				if err != nil {
+					t.Fatalf("expected NewConnection success: %s", err)
+				}
+				publish := func(ctx context.Context, topic string) error {
+					return cm.PublishViaQueue(ctx, &QueuePublish{Publish: &paho.Publish{QoS: 1, Topic: topic}})
+				}
+				for i := range 2 {
+					if err = publish(t.Context(), strconv.Itoa(i)); err != nil {
+						t.Fatalf("PublishViaQueue failed: %s", err)
+					}
+				}
+				allowConnection.Store(true)
+				<-connUp
+				time.Sleep(10 * time.Millisecond) // The test server delays outgoing packets slightly
+				synctest.Wait()
+				// "0" has been sent (awaiting PUBACK) and "1" is blocked waiting for the send window
+				if n := received.Load(); n != 1 {
+					t.Fatalf("expected 1 PUBLISH to have been received, got %d", n)
+				}
+				if err = publish(t.Context(), "2"); err != nil {
+					t.Fatalf("PublishViaQueue failed: %s", err)
+				}
+
+				pubErr := make(chan error, 1)
+				go func() { pubErr <- publish(t.Context(), "3") }()
+				synctest.Wait()
+				switch policy {
+				case QueueFullReturnError:
+					select {
+					case err = <-pubErr:
+						if !errors.Is(err, QueueFullError) {
+							t.Fatalf("expected QueueFullError, got %v", err)
+						}
+					default:
+						t.Fatal("PublishViaQueue blocked whilst a queued message was being transmitted")
+					}
+				case QueueFullDropOldest:
+					select {
+					case err = <-pubErr:
+						t.Fatalf("PublishViaQueue should wait for the message being transmitted (returned %v)", err)
+					default:
+					}
+				}
+
+				close(release) // "1" will now be transmitted (so leaves the queue)
+				if policy == QueueFullDropOldest {
+					if err = <-pubErr; err != nil {
+						t.Fatalf("PublishViaQueue failed: %s", err)
+					}
+				}
+				time.Sleep(100 * time.Millisecond)
+				synctest.Wait()
+				if len(dropped) != 0 {
+					t.Errorf("expected no messages to be dropped, got %v", dropped)
+				}
+				want := int32(3)
+				if policy == QueueFullDropOldest {
+					want = 4
+				}
+				if n := received.Load(); n != want {
+					t.Errorf("expected %d PUBLISH packets to have been received, got %d", want, n)
+				}
+
+				if err = cm.Disconnect(t.Context()); err != nil {
+					t.Fatalf("Disconnect failed: %s", err)
+				}
+				<-cm.Done()
+				<-tsDone
+			})
+		})
+	}
+}
+
+// TestQueueMessageExpiry checks that the Message Expiry Interval of a queued message is reduced by the time spent in
+// the queue, and that messages that expire whilst queued are not transmitted.
+func TestQueueMessageExpiry(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		server, _ := url.Parse(dummyURL)
+		ts := testserver.New(paholog.NewTestLogger(t, "testServer:"))
+		var mu sync.Mutex
+		expiries := make(map[string]*uint32) // Message Expiry Interval received, by topic
+		ts.SetPacketReceivedCallback(func(cp *packets.ControlPacket) error {
+			if cp.Type == packets.PUBLISH {
+				p := cp.Content.(*packets.Publish)
+				mu.Lock()
+				expiries[p.Topic] = p.Properties.MessageExpiry
+				mu.Unlock()
+			}
+			return nil
+		})
+
+		var allowConnection atomic.Bool
+		var tsDone chan struct{}
+		connUp := make(chan struct{})
+		logger := paholog.NewTestLogger(t, "test:")
+		cm, err := NewConnection(t.Context(), ClientConfig{
+			ServerUrls:       []*url.URL{server},
+			KeepAlive:        60,
+			ReconnectBackoff: NewConstantBackoff(time.Second),
+			AttemptConnection: func(ctx context.Context, _ ClientConfig, _ *url.URL) (net.Conn, error) {
+				if !allowConnection.Load() {
+					return nil, errors.New("connection refused")
+				}
+				var conn net.Conn
+				var err error
+				conn, tsDone, err = ts.Connect(ctx)
+				return conn, err
+			},
+			OnConnectionUp: func(*ConnectionManager, *paho.Connack) { close(connUp) },
+			Debug:          logger,
+			PahoDebug:      logger,
+			ClientConfig:   paho.ClientConfig{ClientID: "test"},
+		})
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+		for topic, expiry := range map[string]*uint32{"short": paho.Uint32(10), "long": paho.Uint32(100), "none": nil} {
+			p := &paho.Publish{QoS: 1, Topic: topic, Properties: &paho.PublishProperties{MessageExpiry: expiry}}
+			if err = cm.PublishViaQueue(t.Context(), &QueuePublish{Publish: p}); err != nil {
+				t.Fatalf("PublishViaQueue failed: %s", err)
+			}
+		}
+
+		time.Sleep(30 * time.Second) // Messages remain in the queue whilst offline
+		allowConnection.Store(true)
+		<-connUp
+		time.Sleep(100 * time.Millisecond)
+		synctest.Wait()
+
+		mu.Lock()
+		if _, ok := expiries["short"]; ok {
+			t.Error("expired message should not be transmitted")
+		}
+		// The connection is established up to a second (ReconnectBackoff) after being allowed
+		if e, ok := expiries["long"]; !ok || e == nil || *e < 69 || *e > 70 {
+			t.Errorf("expected Message Expiry Interval of 69-70 (100 less 30-31s in queue), got %v", e)
+		}
+		if e, ok := expiries["none"]; !ok || e != nil {
+			t.Errorf("expected message without Message Expiry Interval to be transmitted unaltered (got %v, %t)", e, ok)
+		}
+		mu.Unlock()
+		if n := cm.Stats().QueuedMessages; n != 0 {
+			t.Errorf("expected queue to be empty, got %d messages", n)
+		}
+
+		if err = cm.Disconnect(t.Context()); err != nil {
+			t.Fatalf("Disconnect failed: %s", err)
+		}
+		<-cm.Done()
+		<-tsDone
+	})
+}
+
+// TestQueueCapacityRequiresLengther checks that NewConnection rejects a QueueCapacity that cannot be enforced
+func TestQueueCapacityRequiresLengther(t *testing.T) {
+	server, _ := url.Parse(dummyURL)
+	_, err := NewConnection(context.Background(), ClientConfig{
+		ServerUrls:    []*url.URL{server},
+		Queue:         struct{ queue.Queue }{memqueue.New()}, // Hides Len
+		QueueCapacity: 1,
+	})
+	if err == nil {
+		t.Fatal("expected NewConnection to fail")
+	}
+}
+
+// TestPublishViaQueueInvalidTopic checks that messages with an invalid topic are rejected rather than queued
+func TestPublishViaQueueInvalidTopic(t *testing.T) {
+	server, _ := url.Parse(dummyURL)
+	q := memqueue.New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cm, err := NewConnection(ctx, ClientConfig{
+		ServerUrls: []*url.URL{server},
+		Queue:      q,
+		AttemptConnection: func(context.Context, ClientConfig, *url.URL) (net.Conn, error) {
+			return nil, errors.New("no connection")
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected NewConnection success: %s", err)
+	}
+	for _, topic := range []string{"", "a/#", "a/+/b"} {
+		err = cm.PublishViaQueue(ctx, &QueuePublish{Publish: &paho.Publish{QoS: 1, Topic: topic}})
+		if !errors.Is(err, paho.ErrInvalidTopic) || !errors.Is(err, paho.ErrInvalidArguments) {
+			t.Errorf("expected ErrInvalidTopic for %q, got %v", topic, err)
+		}
+	}
+	if _, err = q.Peek(); !errors.Is(err, queue.ErrEmpty) {
+		t.Errorf("queue should be empty, got %v", err)
+	}
+	cancel()
+	<-cm.Done()
+}
+
+// lenCountingQueue implements queue.Lengther, but not WaitForEmpty, and counts the calls to Len
+type lenCountingQueue struct {
+	*memqueue.Queue
+	lenCalls atomic.Int32
+}
+
+// Len implements queue.Lengther
+func (q *lenCountingQueue) Len() (int, error) {
+	q.lenCalls.Add(1)
+	return q.Queue.Len()
+}
+
+// WaitForEmpty hides the method provided by memqueue.Queue (so AwaitDelivery must poll)
+func (q *lenCountingQueue) WaitForEmpty() {}
+
+// TestAwaitDeliveryPollsQueue checks that AwaitDelivery polls a queue that cannot notify it when empty (rather than
+// spinning)
+func TestAwaitDeliveryPollsQueue(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		server, _ := url.Parse(dummyURL)
+		q := &lenCountingQueue{Queue: memqueue.New()}
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+		cm, err := NewConnection(ctx, ClientConfig{
+			ServerUrls:       []*url.URL{server},
+			Queue:            q,
+			ReconnectBackoff: NewConstantBackoff(time.Second),
+			AttemptConnection: func(context.Context, ClientConfig, *url.URL) (net.Conn, error) {
+				return nil, errors.New("no connection")
+			},
+		})
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+		if err = cm.PublishViaQueue(ctx, &QueuePublish{Publish: &paho.Publish{QoS: 1, Topic: "test/topic"}}); err != nil {
+			t.Fatalf("PublishViaQueue failed: %s", err)
+		}
+
+		awaitCtx, awaitCancel := context.WithTimeout(ctx, shortDelay)
+		defer awaitCancel()
+		before := q.lenCalls.Load()
+		if err = cm.AwaitDelivery(awaitCtx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected DeadlineExceeded, got %v", err)
+		}
+		// A call every deliveryPollInterval, plus one for the error (spinning would never let the deadline pass)
+		if n, limit := q.lenCalls.Load()-before, int32(shortDelay/deliveryPollInterval)+2; n > limit {
+			t.Errorf("expected at most %d calls to Len, got %d", limit, n)
+		}
+
+		cancel()
+		<-cm.Done()
+	})
+}
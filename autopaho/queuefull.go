@@ -0,0 +1,216 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package autopaho
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/eclipse/paho.golang/autopaho/queue"
+	"github.com/eclipse/paho.golang/internal/categorised"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// QueueFullError will be returned by PublishViaQueue (or Publish whilst paused) if the queue holds
+// ClientConfig.QueueCapacity messages and QueueFullPolicy is QueueFullReturnError. It matches paho.ErrQueueFull
+// (errors.Is).
+var QueueFullError = categorised.New("publish queue is full", paho.ErrQueueFull)
+
+// QueueFullPolicy determines what happens when a message is published via the queue, and the queue already holds
+// ClientConfig.QueueCapacity messages.
+type QueueFullPolicy int
+
+const (
+	QueueFullDropOldest  QueueFullPolicy = iota // The oldest message in the queue is discarded to make room (default); if it is being transmitted, waits until it leaves the queue
+	QueueFullDropNewest                         // The message being published is discarded (no error is returned)
+	QueueFullBlock                              // Block until there is room in the queue (or the context passed to PublishViaQueue is done)
+	QueueFullReturnError                        // The message is not queued, and QueueFullError is returned
+)
+
+// String implements fmt.Stringer
+func (p QueueFullPolicy) String() string {
+	switch p {
+	case QueueFullDropOldest:
+		return "drop oldest"
+	case QueueFullDropNewest:
+		return "drop newest"
+	case QueueFullBlock:
+		return "block"
+	case QueueFullReturnError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// enqueueBounded adds the PUBLISH, p (encoded in r), to the queue, applying cfg.QueueFullPolicy if the queue
+// holds cfg.QueueCapacity messages. NewConnection ensures that c.queue implements queue.Lengther.
+func (c *ConnectionManager) enqueueBounded(ctx context.Context, p *paho.Publish, r io.Reader) error {
+	l := c.queue.(queue.Lengther)
+	for {
+		c.queueMu.Lock()
+		n, err := l.Len()
+		if err != nil {
+			c.queueMu.Unlock()
+			return fmt.Errorf("failed to determine queue length: %w", err)
+		}
+		if n < c.cfg.QueueCapacity {
+			err = c.queue.Enqueue(r)
+			c.queueMu.Unlock()
+			return err
+		}
+
+		switch c.cfg.QueueFullPolicy {
+		case QueueFullDropNewest:
+			c.queueMu.Unlock()
+			c.debug.Printf("queue full; discarding message with topic %s", p.Topic)
+			c.queueDropped(p)
+			return nil
+		case QueueFullBlock:
+			space := c.awaitQueueSpace()
+			c.queueMu.Unlock()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-space:
+			}
+		case QueueFullReturnError:
+			c.queueMu.Unlock()
+			return QueueFullError
+		default: // QueueFullDropOldest
+			if c.queueInFlight { // The oldest entry is being transmitted (so cannot be dropped); wait for it to be released
+				space := c.awaitQueueSpace()
+				c.queueMu.Unlock()
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-space:
+				}
+				continue
+			}
+			dropped, err := c.dropOldest()
+			c.queueMu.Unlock()
+			if err != nil {
+				return err
+			}
+			if dropped != nil {
+				c.debug.Printf("queue full; discarded oldest message with topic %s", dropped.Topic)
+				c.queueDropped(dropped)
+			}
+			// Loop to check the length again (Len may be an estimate, so we do not assume there is now room)
+		}
+	}
+}
+
+// dropOldest removes the oldest entry from the queue, returning the PUBLISH that it held (nil if it could not be
+// decoded). c.queueMu must be held, and the oldest entry must not be in use by managePublishQueue.
+func (c *ConnectionManager) dropOldest() (*paho.Publish, error) {
+	entry, err := c.queue.Peek()
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve oldest queue entry: %w", err)
+	}
+	var pub *paho.Publish
+	if r, err := entry.Reader(); err == nil {
+		if cp, err := packets.ReadPacket(r); err == nil {
+			if p, ok := cp.Content.(*packets.Publish); ok {
+				pub = paho.PublishFromPacketPublish(p)
+				pub.PacketID = 0 // Queued messages are allocated an ID when sent
+			}
+		}
+	}
+	if pub == nil {
+		err = entry.Quarantine() // The entry is corrupt but still needs to be removed
+	} else {
+		err = entry.Remove()
+	}
+	if err != nil && !errors.Is(err, queue.ErrEmpty) {
+		return nil, fmt.Errorf("failed to remove oldest queue entry: %w", err)
+	}
+	c.signalQueueSpace()
+	return pub, nil
+}
+
+// queueDropped passes a message discarded due to QueueFullPolicy to OnQueueDropped
+func (c *ConnectionManager) queueDropped(p *paho.Publish) {
+	if c.cfg.OnQueueDropped != nil {
+		c.cfg.OnQueueDropped(p)
+	}
+}
+
+// awaitQueueSpace returns a channel that will be closed when an entry leaves the queue, or the entry in use by
+// managePublishQueue is released. c.queueMu must be held.
+func (c *ConnectionManager) awaitQueueSpace() chan struct{} {
+	if c.queueSpace == nil {
+		c.queueSpace = make(chan struct{})
+	}
+	return c.queueSpace
+}
+
+// signalQueueSpace notifies any goroutines blocked waiting for room in the queue. c.queueMu must be held.
+func (c *ConnectionManager) signalQueueSpace() {
+	if c.queueSpace != nil {
+		close(c.queueSpace)
+		c.queueSpace = nil
+	}
+}
+
+// peekQueue retrieves the oldest entry from the queue for transmission. The entry is marked as in flight until it is
+// released (via Leave, Remove or Quarantine), so that it is not removed from beneath managePublishQueue by
+// QueueFullDropOldest. c.queueMu is not held whilst the entry is in use (publishing may block on network I/O).
+func (c *ConnectionManager) peekQueue() (queue.Entry, error) {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	entry, err := c.queue.Peek()
+	if err != nil {
+		return nil, err
+	}
+	c.queueInFlight = true
+	return &heldEntry{Entry: entry, c: c}, nil
+}
+
+// heldEntry wraps a queue.Entry returned by peekQueue, clearing the in flight mark when the entry is released
+type heldEntry struct {
+	queue.Entry
+	c *ConnectionManager
+}
+
+// Leave implements queue.Entry
+func (e *heldEntry) Leave() error {
+	return e.release(e.Entry.Leave)
+}
+
+// Remove implements queue.Entry
+func (e *heldEntry) Remove() error {
+	return e.release(e.Entry.Remove)
+}
+
+// Quarantine implements queue.Entry
+func (e *heldEntry) Quarantine() error {
+	return e.release(e.Entry.Quarantine)
+}
+
+// release calls f (which releases the entry) and then clears the in flight mark, notifying any goroutines waiting for
+// room in the queue (the entry may have been removed, or, if left, can now be dropped by QueueFullDropOldest)
+func (e *heldEntry) release(f func() error) error {
+	e.c.queueMu.Lock()
+	defer e.c.queueMu.Unlock()
+	err := f()
+	e.c.queueInFlight = false
+	e.c.signalQueueSpace()
+	return err
+}
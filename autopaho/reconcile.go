@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package autopaho
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DiscrepancyType identifies the kind of mismatch reported in a Discrepancy
+type DiscrepancyType int
+
+const (
+	DiscrepancyNoSubscription DiscrepancyType = iota // A router handler is registered for a filter that no active subscription overlaps
+	DiscrepancyNoHandler                             // An active subscription has no overlapping router handler
+)
+
+// String implements fmt.Stringer
+func (d DiscrepancyType) String() string {
+	switch d {
+	case DiscrepancyNoSubscription:
+		return "handler without subscription"
+	case DiscrepancyNoHandler:
+		return "subscription without handler"
+	}
+	return "unknown"
+}
+
+// Discrepancy describes a mismatch between the topic filters registered with the router and the active subscriptions
+type Discrepancy struct {
+	Type   DiscrepancyType
+	Filter string // The router filter (DiscrepancyNoSubscription) or subscription filter (DiscrepancyNoHandler)
+}
+
+// String implements fmt.Stringer
+func (d Discrepancy) String() string {
+	return fmt.Sprintf("%s: %s", d.Type, d.Filter)
+}
+
+// routerSubscriptions is implemented by routers that can report the topic filters for which handlers are registered
+// (paho.StandardRouter does).
+type routerSubscriptions interface {
+	Subscriptions() map[string]int
+}
+
+// ReconcileSubscriptions compares the topic filters for which handlers are registered with ClientConfig.Router, and
+// the subscriptions made via this ConnectionManager that the server has accepted (and that are believed to remain
+// active), returning any router filter that no subscription overlaps, and any subscription that no router filter
+// overlaps. Filters "overlap" if at least one topic could match both (so a handler for `a/b` is satisfied by a
+// subscription to `a/#`). Results are sorted by type and then filter.
+// nil is returned if the Router does not report its filters (as paho.StandardRouter does). Handlers registered by
+// subscription identifier, default handlers and OnPublishReceived callbacks are not taken into account.
+func (c *ConnectionManager) ReconcileSubscriptions() []Discrepancy {
+	rs, ok := c.cfg.Router.(routerSubscriptions)
+	if !ok {
+		return nil
+	}
+	var handlers []string
+	for filter := range rs.Subscriptions() {
+		handlers = append(handlers, filter)
+	}
+	subs := c.subscriptions.filters()
+	sort.Strings(handlers)
+	sort.Strings(subs)
+
+	var d []Discrepancy
+	for _, h := range handlers {
+		if !anyOverlap(h, subs) {
+			d = append(d, Discrepancy{Type: DiscrepancyNoSubscription, Filter: h})
+		}
+	}
+	for _, s := range subs {
+		if !anyOverlap(s, handlers) {
+			d = append(d, Discrepancy{Type: DiscrepancyNoHandler, Filter: s})
+		}
+	}
+	return d
+}
+
+// warnOnSubscriptionMismatch logs the results of ReconcileSubscriptions (if WarnOnSubscriptionMismatch is set)
+func (c *ConnectionManager) warnOnSubscriptionMismatch() {
+	if !c.cfg.WarnOnSubscriptionMismatch {
+		return
+	}
+	for _, d := range c.ReconcileSubscriptions() {
+		c.errors.Printf("subscription mismatch: %s", d)
+	}
+}
+
+// anyOverlap returns true if filter overlaps with any of filters
+func anyOverlap(filter string, filters []string) bool {
+	for _, f := range filters {
+		if filtersOverlap(filter, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// filtersOverlap returns true if there is at least one topic that would match both topic filters (the shared
+// subscription prefix, `$share/{group}/`, is ignored).
+func filtersOverlap(a, b string) bool {
+	as, bs := filterLevels(a), filterLevels(b)
+	// Wildcards at the first level do not match topics beginning with `$` [MQTT-4.7.2-1]
+	if strings.HasPrefix(as[0], "$") != strings.HasPrefix(bs[0], "$") {
+		return false
+	}
+	for i := 0; ; i++ {
+		switch {
+		case i == len(as) && i == len(bs):
+			return true
+		case i < len(as) && as[i] == "#", i < len(bs) && bs[i] == "#":
+			return true // `#` also matches the parent level (e.g. `a/#` matches `a`)
+		case i == len(as) || i == len(bs):
+			return false
+		case as[i] != bs[i] && as[i] != "+" && bs[i] != "+":
+			return false
+		}
+	}
+}
+
+// filterLevels splits a topic filter into its levels (removing any shared subscription prefix)
+func filterLevels(filter string) []string {
+	levels := strings.Split(filter, "/")
+	if levels[0] == "$share" && len(levels) > 2 {
+		levels = levels[2:]
+	}
+	return levels
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package autopaho
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"slices"
+	"testing"
+	"testing/synctest"
+
+	"github.com/eclipse/paho.golang/internal/testserver"
+	"github.com/eclipse/paho.golang/paho"
+	paholog "github.com/eclipse/paho.golang/paho/log"
+)
+
+func TestFiltersOverlap(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/b", "a/+", true},
+		{"a/b", "a/#", true},
+		{"a", "a/#", true}, // `#` matches the parent level
+		{"a/b/c", "a/+", false},
+		{"+/b", "a/+", true},
+		{"#", "x/y/z", true},
+		{"#", "$SYS/x", false},
+		{"$SYS/#", "$SYS/x", true},
+		{"$share/group/a/+", "a/b", true},
+		{"a/b", "a/b/c", false},
+	}
+	for _, tt := range tests {
+		if got := filtersOverlap(tt.a, tt.b); got != tt.want {
+			t.Errorf("filtersOverlap(%q, %q) = %t, expected %t", tt.a, tt.b, got, tt.want)
+		}
+		if got := filtersOverlap(tt.b, tt.a); got != tt.want {
+			t.Errorf("filtersOverlap(%q, %q) = %t, expected %t", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestReconcileSubscriptions(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		server, _ := url.Parse(dummyURL)
+		logger := paholog.NewTestLogger(t, "test:")
+		ts := testserver.New(paholog.NewTestLogger(t, "testServer:"))
+
+		router := paho.NewStandardRouter()
+		router.RegisterHandler("a/b", func(*paho.Publish) {})
+		router.RegisterHandler("c/+", func(*paho.Publish) {})
+
+		var tsDone chan struct{}
+		connUp := make(chan struct{})
+		cm, err := NewConnection(t.Context(), ClientConfig{
+			ServerUrls:     []*url.URL{server},
+			KeepAlive:      60,
+			ConnectTimeout: shortDelay,
+			AttemptConnection: func(ctx context.Context, _ ClientConfig, _ *url.URL) (net.Conn, error) {
+				conn, done, err := ts.Connect(ctx)
+				tsDone = done
+				return conn, err
+			},
+			OnConnectionUp:             func(*ConnectionManager, *paho.Connack) { close(connUp) },
+			WarnOnSubscriptionMismatch: true,
+			Debug:                      logger,
+			Errors:                     logger,
+			PahoDebug:                  logger,
+			ClientConfig: paho.ClientConfig{
+				ClientID: "test",
+				Router:   router,
+			},
+		})
+		if err != nil {
+			t.Fatalf("expected NewConnection success: %s", err)
+		}
+		<-connUp
+
+		if _, err = cm.Subscribe(t.Context(), &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{
+			{Topic: "a/#", QoS: 1},
+			{Topic: "d", QoS: 1},
+		}}); err != nil {
+			t.Fatalf("Subscribe failed: %s", err)
+		}
+		want := []Discrepancy{
+			{Type: DiscrepancyNoSubscription, Filter: "c/+"},
+			{Type: DiscrepancyNoHandler, Filter: "d"},
+		}
+		if got := cm.ReconcileSubscriptions(); !slices.Equal(got, want) {
+			t.Fatalf("ReconcileSubscriptions returned %v, expected %v", got, want)
+		}
+
+		// Resolving the discrepancies
+		router.RegisterHandler("d", func(*paho.Publish) {})
+		if _, err = cm.Subscribe(t.Context(), &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{{Topic: "c/d", QoS: 1}}}); err != nil {
+			t.Fatalf("Subscribe failed: %s", err)
+		}
+		if got := cm.ReconcileSubscriptions(); len(got) != 0 {
+			t.Fatalf("expected no discrepancies, got %v", got)
+		}
+
+		// Unsubscribing leaves a handler without a subscription
+		if _, err = cm.Unsubscribe(t.Context(), &paho.Unsubscribe{Topics: []string{"d"}}); err != nil {
+			t.Fatalf("Unsubscribe failed: %s", err)
+		}
+		want = []Discrepancy{{Type: DiscrepancyNoSubscription, Filter: "d"}}
+		if got := cm.ReconcileSubscriptions(); !slices.Equal(got, want) {
+			t.Fatalf("ReconcileSubscriptions returned %v, expected %v", got, want)
+		}
+
+		if err = cm.Disconnect(t.Context()); err != nil {
+			t.Fatalf("Disconnect failed: %s", err)
+		}
+		<-cm.Done()
+		<-tsDone
+	})
+}
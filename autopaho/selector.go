@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package autopaho
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ServerSelector determines which server URL is used for each connection attempt.
+// When establishing a connection, len(ServerUrls) attempts are made between each reconnection delay (as determined by
+// ReconnectBackoffStrategy), with Select being called before each attempt.
+type ServerSelector interface {
+	// Select returns the URL to use for connection attempt N (attempt starts at "0" for the first attempt following
+	// loss of the connection). lastErr is the error that caused the previous attempt to fail (nil if attempt is 0).
+	// urls will always contain at least one entry.
+	Select(urls []*url.URL, attempt int, lastErr error) *url.URL
+}
+
+// ServerSelectorFunc is an adapter that allows a function to be used as a ServerSelector
+type ServerSelectorFunc func(urls []*url.URL, attempt int, lastErr error) *url.URL
+
+// Select implements ServerSelector
+func (f ServerSelectorFunc) Select(urls []*url.URL, attempt int, lastErr error) *url.URL {
+	return f(urls, attempt, lastErr)
+}
+
+// RoundRobinSelector tries each URL in turn, starting with the first (this is the default)
+type RoundRobinSelector struct{}
+
+// Select implements ServerSelector
+func (RoundRobinSelector) Select(urls []*url.URL, attempt int, _ error) *url.URL {
+	return urls[attempt%len(urls)]
+}
+
+// RandomSelector selects a URL at random (spreading load when many clients reconnect at the same time). Where
+// possible, the URL used for the previous attempt will not be selected again immediately after a failure.
+// The zero value is ready to use.
+type RandomSelector struct {
+	last int // 1 + the index of the URL selected previously (0 if none, so the zero value is valid)
+}
+
+// NewRandomSelector creates a RandomSelector
+func NewRandomSelector() *RandomSelector {
+	return &RandomSelector{}
+}
+
+// Select implements ServerSelector
+// Note: Connection attempts are made sequentially, so Select will not be called concurrently.
+func (r *RandomSelector) Select(urls []*url.URL, attempt int, lastErr error) *url.URL {
+	i := rand.Intn(len(urls))
+	if lastErr != nil && len(urls) > 1 && i+1 == r.last {
+		i = (i + 1 + rand.Intn(len(urls)-1)) % len(urls) // Any URL other than the one that just failed
+	}
+	r.last = i + 1
+	return urls[i]
+}
+
+// PreferFirstSelector treats the first URL as the primary server; other URLs are only used when the primary is
+// unavailable, and the primary is retried after each failed attempt to connect to another server (giving the attempts
+// primary, secondary, primary, tertiary, primary, secondary...).
+type PreferFirstSelector struct{}
+
+// Select implements ServerSelector
+func (PreferFirstSelector) Select(urls []*url.URL, attempt int, _ error) *url.URL {
+	if len(urls) == 1 || attempt%2 == 0 {
+		return urls[0]
+	}
+	return urls[1+(attempt/2)%(len(urls)-1)]
+}
+
+// serverReferenceURL converts a Server Reference (received in a DISCONNECT) into a URL. The reference may be a URL
+// or, more commonly, `host[:port]`, in which case the scheme (and port, if omitted) of current are used. Where the
+// reference contains multiple servers (space separated), the first is used. An error is returned if the reference
+// cannot be used to connect (unsupported scheme, missing host or invalid port).
+func serverReferenceURL(ref string, current *url.URL) (*url.URL, error) {
+	fields := strings.Fields(ref)
+	if len(fields) == 0 {
+		return nil, errors.New("empty server reference")
+	}
+	ref = fields[0]
+	var u *url.URL
+	if strings.Contains(ref, "://") {
+		var err error
+		if u, err = url.Parse(ref); err != nil {
+			return nil, err
+		}
+	} else {
+		if strings.ContainsAny(ref, "/?#@") {
+			return nil, fmt.Errorf("server reference %q is not a valid host[:port]", ref)
+		}
+		cu := *current
+		u = &cu
+		u.Host = ref
+		if _, _, err := net.SplitHostPort(ref); err != nil { // No port (note that an IPv6 address must be bracketed)
+			u.Host = net.JoinHostPort(strings.Trim(ref, "[]"), current.Port())
+			if current.Port() == "" {
+				u.Host = ref
+			}
+		}
+	}
+	if !supportedScheme(u.Scheme) && !strings.EqualFold(u.Scheme, current.Scheme) { // current may use a custom scheme (see AttemptConnection)
+		return nil, fmt.Errorf("server reference %q has unsupported scheme %q", ref, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("server reference %q has no host", ref)
+	}
+	if _, port, err := net.SplitHostPort(u.Host); err == nil { // u.Port() ignores non-numeric ports
+		if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+			return nil, fmt.Errorf("server reference %q has invalid port %q", ref, port)
+		}
+	}
+	return u, nil
+}
+
+// supportedScheme returns true if scheme is one that establishServerConnection can connect to
+func supportedScheme(scheme string) bool {
+	switch strings.ToLower(scheme) {
+	case "", "mqtt", "tcp", "ssl", "tls", "mqtts", "mqtt+ssl", "tcps", "ws", "wss":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package autopaho
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+// selectorUrls returns URLs for use when testing selectors
+func selectorUrls(t *testing.T, hosts ...string) []*url.URL {
+	t.Helper()
+	var urls []*url.URL
+	for _, h := range hosts {
+		u, err := url.Parse("mqtt://" + h + ":1883")
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, u)
+	}
+	return urls
+}
+
+// selectHosts calls s.Select n times, returning the hosts selected
+func selectHosts(s ServerSelector, urls []*url.URL, n int) []string {
+	var hosts []string
+	var lastErr error
+	for i := 0; i < n; i++ {
+		hosts = append(hosts, s.Select(urls, i, lastErr).Hostname())
+		lastErr = errors.New("failed")
+	}
+	return hosts
+}
+
+func TestRoundRobinSelector(t *testing.T) {
+	urls := selectorUrls(t, "a", "b", "c")
+	got := selectHosts(RoundRobinSelector{}, urls, 7)
+	want := []string{"a", "b", "c", "a", "b", "c", "a"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestPreferFirstSelector(t *testing.T) {
+	urls := selectorUrls(t, "a", "b", "c")
+	got := selectHosts(PreferFirstSelector{}, urls, 7)
+	want := []string{"a", "b", "a", "c", "a", "b", "a"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+
+	got = selectHosts(PreferFirstSelector{}, urls[:1], 3)
+	for _, h := range got {
+		if h != "a" {
+			t.Fatalf("expected only a to be selected, got %v", got)
+		}
+	}
+}
+
+func TestRandomSelector(t *testing.T) {
+	urls := selectorUrls(t, "a", "b", "c")
+	s := NewRandomSelector()
+	got := selectHosts(s, urls, 1000)
+	seen := make(map[string]int)
+	for i, h := range got {
+		seen[h]++
+		if i > 0 && got[i-1] == h {
+			t.Fatalf("URL %s selected again following failure", h)
+		}
+	}
+	if len(seen) != len(urls) {
+		t.Fatalf("expected all URLs to be selected, got %v", seen)
+	}
+
+	if h := s.Select(urls[:1], 0, errors.New("failed")).Hostname(); h != "a" {
+		t.Fatalf("expected a, got %s", h)
+	}
+}
+
+// TestRandomSelectorZeroValue checks that the zero value does not treat the first URL as the one previously selected
+func TestRandomSelectorZeroValue(t *testing.T) {
+	urls := selectorUrls(t, "a", "b", "c")
+	seen := make(map[string]int)
+	for range 300 {
+		var s RandomSelector
+		seen[s.Select(urls, 1, errors.New("failed")).Hostname()]++
+	}
+	if len(seen) != len(urls) {
+		t.Fatalf("expected all URLs to be selected, got %v", seen)
+	}
+}
+
+func TestServerReferenceURL(t *testing.T) {
+	current, _ := url.Parse("mqtts://a.example.com:8883")
+	tests := []struct {
+		ref, want string
+	}{
+		{"b.example.com:1883", "mqtts://b.example.com:1883"},
+		{"b.example.com", "mqtts://b.example.com:8883"},
+		{"[::1]", "mqtts://[::1]:8883"},
+		{"ws://b.example.com/mqtt", "ws://b.example.com/mqtt"},
+		{"b.example.com:1883 c.example.com:1883", "mqtts://b.example.com:1883"},
+	}
+	for _, tt := range tests {
+		u, err := serverReferenceURL(tt.ref, current)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.ref, err)
+		}
+		if u.String() != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.ref, tt.want, u)
+		}
+	}
+	for _, ref := range []string{" ", "b.example.com:abc", "b.example.com:0", "b.example.com:70000", "b.example.com:",
+		"b.example.com/mqtt", "user@b.example.com", "http://b.example.com", "mqtt://:1883", "mqtt://b.example.com:x",
+		"mqtt://[::1"} {
+		if u, err := serverReferenceURL(ref, current); err == nil {
+			t.Errorf("%q: expected error, got %s", ref, u)
+		}
+	}
+	// A custom scheme is accepted if it matches the scheme currently in use (AttemptConnection may support it)
+	custom, _ := url.Parse("quic://a.example.com:1883")
+	if u, err := serverReferenceURL("quic://b.example.com:1883", custom); err != nil || u.Host != "b.example.com:1883" {
+		t.Errorf("expected custom scheme to be accepted, got %v, %v", u, err)
+	}
+}
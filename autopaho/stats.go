@@ -0,0 +1,242 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package autopaho
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// ConnectionStats is a snapshot of statistics relating to the connection managed by a ConnectionManager
+type ConnectionStats struct {
+	Connected   bool          // true if the connection is currently up
+	ConnectedAt time.Time     // When the current connection was established (zero if the connection is down)
+	Uptime      time.Duration // How long the current connection has been up (zero if the connection is down)
+	Reconnects  uint64        // Number of times the connection has been reestablished (the initial connection is not included)
+
+	// The following are totals across all connections (they are not reset when a new connection is established)
+	BytesSent       uint64
+	BytesReceived   uint64
+	PacketsSent     uint64
+	PacketsReceived uint64
+
+	LastPingResp   time.Time // When the most recent PINGRESP was received (zero if none received)
+	QueuedMessages int       // Number of messages in the queue (-1 if the queue does not implement queue.Lengther)
+
+	// InflightMessages is the number of QoS1/2 PUBLISH transactions in the session (sent, or awaiting retransmission,
+	// but not fully acknowledged); -1 if the Session does not report this. Messages move from the queue into the
+	// session only when the number in flight is below SendWindow.
+	InflightMessages int
+	SendWindow       int // Maximum number of PUBLISH transactions in flight on the current connection (0 if down)
+
+	// TopicAliases reports on the use of outbound topic aliases on the current connection (zero if the connection is
+	// down, or aliases are not in use; see paho.ClientConfig.EnableTopicAliases)
+	TopicAliases paho.TopicAliasStats
+}
+
+// HealthStatus is a snapshot of the health of the connection managed by a ConnectionManager (see ConnectionHealth);
+// times are zero if the event has not occurred on the current connection.
+type HealthStatus struct {
+	Connected          bool
+	ConnectedAt        time.Time
+	LastPacketSent     time.Time
+	LastPacketReceived time.Time // Includes the CONNACK
+	LastPingSent       time.Time // Only available if the Pinger implements paho.PingerStatusReporter (as the default does)
+	LastPingResp       time.Time
+
+	// PingOverdue is true if the server appears unresponsive: a PINGREQ has been awaiting a response for longer than
+	// the keepalive interval, or nothing has been received for over twice that interval (the Pinger sends a PINGREQ
+	// within one interval of the last packet received and the server should respond within another).
+	PingOverdue bool
+	// Healthy is true if the connection is up and no ping is overdue (if KeepAlive is 0 this reflects Connected only)
+	Healthy bool
+}
+
+// connStats holds the statistics for a ConnectionManager; counters are updated as data is sent/received
+type connStats struct {
+	bytesSent       atomic.Uint64
+	bytesReceived   atomic.Uint64
+	packetsSent     atomic.Uint64
+	packetsReceived atomic.Uint64
+
+	// Times (UnixNano) of the last packet sent/received on the current connection (0 if none)
+	lastPacketSent     atomic.Int64
+	lastPacketReceived atomic.Int64
+
+	mu           sync.Mutex
+	connected    bool
+	connectedAt  time.Time
+	reconnects   uint64
+	lastPingResp time.Time
+	pinger       paho.Pinger // Pinger used by the current connection (nil if down)
+}
+
+// connectionUp should be called when a connection has been established
+func (s *connStats) connectionUp(firstConnection bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connected = true
+	s.connectedAt = time.Now()
+	if !firstConnection {
+		s.reconnects++
+	}
+}
+
+// connectionDown should be called when the connection has been lost
+func (s *connStats) connectionDown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connected = false
+	s.connectedAt = time.Time{}
+	s.pinger = nil
+	s.lastPacketSent.Store(0)
+	s.lastPacketReceived.Store(0)
+}
+
+// setPinger records the Pinger in use by a new connection (called before connectionUp)
+func (s *connStats) setPinger(p paho.Pinger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pinger = p
+}
+
+// packetReceived records the receipt of a packet
+func (s *connStats) packetReceived() {
+	s.packetsReceived.Add(1)
+	s.lastPacketReceived.Store(time.Now().UnixNano())
+}
+
+// health returns the current HealthStatus; keepAlive is the keepalive interval in use
+func (s *connStats) health(keepAlive time.Duration) HealthStatus {
+	s.mu.Lock()
+	hs := HealthStatus{
+		Connected:    s.connected,
+		ConnectedAt:  s.connectedAt,
+		LastPingResp: s.lastPingResp,
+	}
+	pinger := s.pinger
+	s.mu.Unlock()
+	hs.LastPacketSent = unixNanoTime(s.lastPacketSent.Load())
+	hs.LastPacketReceived = unixNanoTime(s.lastPacketReceived.Load())
+	if !hs.Connected {
+		return hs
+	}
+
+	var pingOutstanding bool
+	if r, ok := pinger.(paho.PingerStatusReporter); ok {
+		ps := r.Status()
+		hs.LastPingSent = ps.LastPingSent
+		pingOutstanding = ps.PingOutstanding
+		if hs.LastPingSent.After(hs.LastPacketSent) { // The Pinger writes PINGREQ directly to the connection
+			hs.LastPacketSent = hs.LastPingSent
+		}
+	}
+	if keepAlive > 0 {
+		now := time.Now()
+		lastReceived := hs.LastPacketReceived
+		if lastReceived.IsZero() {
+			lastReceived = hs.ConnectedAt
+		}
+		hs.PingOverdue = (pingOutstanding && now.Sub(hs.LastPingSent) > keepAlive) || now.Sub(lastReceived) > 2*keepAlive
+	}
+	hs.Healthy = !hs.PingOverdue
+	return hs
+}
+
+// unixNanoTime converts a time recorded via UnixNano back into a time.Time (0 is the zero time)
+func unixNanoTime(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// snapshot returns the current statistics (QueuedMessages is not populated)
+func (s *connStats) snapshot() ConnectionStats {
+	s.mu.Lock()
+	cs := ConnectionStats{
+		Connected:    s.connected,
+		ConnectedAt:  s.connectedAt,
+		Reconnects:   s.reconnects,
+		LastPingResp: s.lastPingResp,
+	}
+	s.mu.Unlock()
+	if cs.Connected {
+		cs.Uptime = time.Since(cs.ConnectedAt)
+	}
+	cs.BytesSent = s.bytesSent.Load()
+	cs.BytesReceived = s.bytesReceived.Load()
+	cs.PacketsSent = s.packetsSent.Load()
+	cs.PacketsReceived = s.packetsReceived.Load()
+	return cs
+}
+
+// tap returns OnBytesRead and OnBytesWritten hooks (see paho.ClientConfig) that record traffic in s before passing
+// the data on to onRead and onWrite (either may be nil). paho calls OnBytesWritten once for each packet written, so
+// this also counts packets sent (packets received are counted by statsPinger).
+func (s *connStats) tap(onRead, onWrite func([]byte)) (func([]byte), func([]byte)) {
+	read := func(b []byte) {
+		s.bytesReceived.Add(uint64(len(b)))
+		if onRead != nil {
+			onRead(b)
+		}
+	}
+	write := func(b []byte) {
+		s.bytesSent.Add(uint64(len(b)))
+		s.packetsSent.Add(1)
+		if onWrite != nil {
+			onWrite(b)
+		}
+	}
+	return read, write
+}
+
+// statsPinger wraps a paho.Pinger, counting packets received and recording the time of the last PINGRESP
+type statsPinger struct {
+	paho.Pinger
+	stats *connStats
+}
+
+// PacketSent implements paho.Pinger
+func (p *statsPinger) PacketSent() {
+	p.stats.lastPacketSent.Store(time.Now().UnixNano())
+	p.Pinger.PacketSent()
+}
+
+// PacketReceived implements paho.Pinger
+func (p *statsPinger) PacketReceived() {
+	p.stats.packetReceived()
+	p.Pinger.PacketReceived()
+}
+
+// Status implements paho.PingerStatusReporter (if the wrapped Pinger does)
+func (p *statsPinger) Status() paho.PingerStatus {
+	if r, ok := p.Pinger.(paho.PingerStatusReporter); ok {
+		return r.Status()
+	}
+	return paho.PingerStatus{}
+}
+
+// PingResp implements paho.Pinger
+func (p *statsPinger) PingResp() {
+	p.stats.mu.Lock()
+	p.stats.lastPingResp = time.Now()
+	p.stats.mu.Unlock()
+	p.Pinger.PingResp()
+}
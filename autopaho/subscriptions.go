@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package autopaho
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// subscription holds the details of a single subscription (as accepted by the server)
+type subscription struct {
+	options    paho.SubscribeOptions
+	properties *paho.SubscribeProperties // shared by all subscriptions from the same SUBSCRIBE packet
+	seq        uint64                    // used to replay subscriptions in the order they were made
+}
+
+// subscriptions records the subscriptions that have been accepted by the server, so they can be reestablished
+// if the session is lost (when ReconnectResubscribe is set) and compared with the router (see ReconcileSubscriptions)
+type subscriptions struct {
+	mu    sync.Mutex
+	topic map[string]subscription // The topic filter is the key (a later subscription to the same filter replaces an earlier one)
+	seq   uint64
+}
+
+// newSubscriptions creates a subscriptions ready for use
+func newSubscriptions() *subscriptions {
+	return &subscriptions{
+		topic: make(map[string]subscription),
+	}
+}
+
+// subscribed records the subscriptions in s that were accepted by the server (as per sa)
+func (r *subscriptions) subscribed(s *paho.Subscribe, sa *paho.Suback) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subscribedLocked(s, sa)
+}
+
+// subscribedLocked implements subscribed; r.mu must be held
+func (r *subscriptions) subscribedLocked(s *paho.Subscribe, sa *paho.Suback) {
+	if sa == nil {
+		return
+	}
+	for i, sub := range s.Subscriptions {
+		if i >= len(sa.Reasons) || sa.Reasons[i] >= 0x80 {
+			continue // Subscription was not accepted
+		}
+		r.seq++
+		r.topic[sub.Topic] = subscription{
+			options:    sub,
+			properties: s.Properties,
+			seq:        r.seq,
+		}
+	}
+}
+
+// unsubscribed removes the subscriptions in u that the server has unsubscribed (as per ua)
+func (r *subscriptions) unsubscribed(u *paho.Unsubscribe, ua *paho.Unsuback) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.unsubscribedLocked(u, ua)
+}
+
+// unsubscribedLocked implements unsubscribed; r.mu must be held
+func (r *subscriptions) unsubscribedLocked(u *paho.Unsubscribe, ua *paho.Unsuback) {
+	if ua == nil {
+		return
+	}
+	for i, topic := range u.Topics {
+		if i >= len(ua.Reasons) || ua.Reasons[i] >= 0x80 {
+			continue // Unsubscribe was refused, so the subscription may remain
+		}
+		delete(r.topic, topic)
+	}
+}
+
+// modified records the outcome of ModifySubscriptions
+func (r *subscriptions) modified(s *paho.Subscribe, sa *paho.Suback, u *paho.Unsubscribe, ua *paho.Unsuback) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subscribedLocked(s, sa)
+	r.unsubscribedLocked(u, ua)
+}
+
+// reset removes all recorded subscriptions (e.g. when the server has not retained the session)
+func (r *subscriptions) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clear(r.topic)
+}
+
+// filters returns the topic filters of the recorded subscriptions
+func (r *subscriptions) filters() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := make([]string, 0, len(r.topic))
+	for topic := range r.topic {
+		f = append(f, topic)
+	}
+	return f
+}
+
+// packets returns SUBSCRIBE packets that will reestablish the recorded subscriptions (in the order they were made).
+// Subscriptions originating from the same SUBSCRIBE packet will be grouped (so they share properties, including
+// the subscription identifier).
+func (r *subscriptions) packets() []*paho.Subscribe {
+	r.mu.Lock()
+	subs := make([]subscription, 0, len(r.topic))
+	for _, s := range r.topic {
+		subs = append(subs, s)
+	}
+	r.mu.Unlock()
+	sort.Slice(subs, func(i, j int) bool { return subs[i].seq < subs[j].seq })
+
+	var ps []*paho.Subscribe
+	for _, s := range subs {
+		if len(ps) > 0 && ps[len(ps)-1].Properties == s.properties {
+			ps[len(ps)-1].Subscriptions = append(ps[len(ps)-1].Subscriptions, s.options)
+			continue
+		}
+		ps = append(ps, &paho.Subscribe{
+			Properties:    s.properties,
+			Subscriptions: []paho.SubscribeOptions{s.options},
+		})
+	}
+	return ps
+}
+
+// resubscribe sends SUBSCRIBE packets to reestablish the recorded subscriptions (should be called when a new
+// session has been created).
+func (c *ConnectionManager) resubscribe(ctx context.Context, cli *paho.Client) {
+	for _, s := range c.subscriptions.packets() {
+		if _, err := cli.Subscribe(ctx, s); err != nil {
+			c.errors.Printf("resubscribe failed: %s", err)
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package autopaho
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// TestSubscriptionsUnsubscribed checks that only subscriptions the server has unsubscribed are removed
+func TestSubscriptionsUnsubscribed(t *testing.T) {
+	subs := newSubscriptions()
+	subs.subscribed(&paho.Subscribe{Subscriptions: []paho.SubscribeOptions{
+		{Topic: "a"}, {Topic: "b"}, {Topic: "c"}, {Topic: "d"}, {Topic: "e"},
+	}}, &paho.Suback{Reasons: []byte{0, 0, 0, 0, 0}})
+
+	// A partly refused UNSUBACK; "No subscription existed" (0x11) is not a failure
+	subs.unsubscribed(&paho.Unsubscribe{Topics: []string{"a", "b", "c", "d"}},
+		&paho.Unsuback{Reasons: []byte{0x00, 0x87, 0x11, 0x80}})
+	got := subs.filters()
+	slices.Sort(got)
+	if want := []string{"b", "d", "e"}; !slices.Equal(got, want) {
+		t.Errorf("expected %v after partly refused UNSUBACK, got %v", want, got)
+	}
+
+	// Topics without a reason code are retained, as is everything if there was no UNSUBACK
+	subs.unsubscribed(&paho.Unsubscribe{Topics: []string{"b", "d"}}, &paho.Unsuback{Reasons: []byte{0x00}})
+	subs.modified(nil, nil, &paho.Unsubscribe{Topics: []string{"e"}}, nil)
+	got = subs.filters()
+	slices.Sort(got)
+	if want := []string{"d", "e"}; !slices.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
@@ -39,6 +39,8 @@ type TestServer struct {
 	receivedMu      sync.Mutex
 	receivedPubacks []*packets.Puback
 	receivedPubrecs []*packets.Pubrec
+	receivedDiscon  *packets.Disconnect
+	receivedAuth    *packets.Auth
 
 	logger Logger
 }
@@ -139,6 +141,9 @@ func (t *TestServer) Run() {
 				}
 			case packets.AUTH:
 				t.logger.Println("received", recv.Content.(*packets.Auth))
+				t.receivedMu.Lock()
+				t.receivedAuth = recv.Content.(*packets.Auth)
+				t.receivedMu.Unlock()
 				if p, ok := t.responses[packets.AUTH]; ok {
 					t.logger.Println("sending auth")
 					if _, err := p.WriteTo(t.conn); err != nil {
@@ -197,7 +202,10 @@ func (t *TestServer) Run() {
 					}
 				}
 			case packets.DISCONNECT:
-				t.logger.Println("received")
+				t.logger.Println("received", recv.Content.(*packets.Disconnect))
+				t.receivedMu.Lock()
+				t.receivedDiscon = recv.Content.(*packets.Disconnect)
+				t.receivedMu.Unlock()
 			case packets.PINGREQ:
 				t.logger.Println("test server sending pingresp")
 				pr := packets.NewControlPacket(packets.PINGRESP)
@@ -228,3 +236,17 @@ func (t *TestServer) ReceivedPubrecs() []packets.Pubrec {
 	}
 	return ret
 }
+
+// ReceivedDisconnect returns the DISCONNECT received from the client (nil if none received)
+func (t *TestServer) ReceivedDisconnect() *packets.Disconnect {
+	t.receivedMu.Lock()
+	defer t.receivedMu.Unlock()
+	return t.receivedDiscon
+}
+
+// ReceivedAuth returns the most recent AUTH received from the client (nil if none received)
+func (t *TestServer) ReceivedAuth() *packets.Auth {
+	t.receivedMu.Lock()
+	defer t.receivedMu.Unlock()
+	return t.receivedAuth
+}
@@ -0,0 +1,36 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+// Package categorised provides an error type, shared by paho and autopaho, that matches one of the paho error
+// categories (e.g. paho.ErrTimeout) whilst retaining its own identity and message.
+package categorised
+
+// errorWithCategory is an error with a fixed message that also matches (via errors.Is) its category
+type errorWithCategory struct {
+	msg      string
+	category error
+}
+
+// New returns an error with the message msg that matches category (as well as itself) via errors.Is. This allows
+// sentinel errors to be categorised without changing their message.
+func New(msg string, category error) error {
+	return &errorWithCategory{msg: msg, category: category}
+}
+
+// Error implements error
+func (e *errorWithCategory) Error() string { return e.msg }
+
+// Is enables errors.Is(err, category)
+func (e *errorWithCategory) Is(target error) bool { return target == e.category }
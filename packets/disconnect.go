@@ -68,6 +68,12 @@ const (
 // Unpack is the implementation of the interface required function for a packet
 func (d *Disconnect) Unpack(r *bytes.Buffer) error {
 	var err error
+	// The reason code and properties may be omitted; a remaining length of 0 means 0x00 (normal disconnection)
+	// and a remaining length of 1 means there are no properties (MQTT-3.14.2.1 / 3.14.2.2.1).
+	if r.Len() == 0 {
+		d.ReasonCode = DisconnectNormalDisconnection
+		return nil
+	}
 	noProps := r.Len() == 1
 	d.ReasonCode, err = r.ReadByte()
 	if err != nil {
@@ -22,6 +22,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"unicode/utf8"
 )
 
 // PacketType is a type alias to byte representing the different
@@ -243,6 +244,14 @@ func NewControlPacket(t byte) *ControlPacket {
 // ReadPacket reads a control packet from a io.Reader and returns a completed
 // struct with the appropriate data
 func ReadPacket(r io.Reader) (*ControlPacket, error) {
+	return ReadPacketStreamed(r, 0)
+}
+
+// ReadPacketStreamed is equivalent to ReadPacket except that, if payloadThreshold is greater than 0 and a PUBLISH
+// packet is received whose remaining length exceeds payloadThreshold bytes, the payload will not be read. Instead,
+// Publish.PayloadReader will be set, allowing the payload to be streamed from r. The caller MUST fully consume
+// PayloadReader before reading the next packet from r.
+func ReadPacketStreamed(r io.Reader, payloadThreshold int) (*ControlPacket, error) {
 	t := [1]byte{}
 	_, err := io.ReadFull(r, t[:])
 	if err != nil {
@@ -313,6 +322,13 @@ func ReadPacket(r io.Reader) (*ControlPacket, error) {
 		return nil, err
 	}
 
+	if cp.Type == PUBLISH && payloadThreshold > 0 && cp.remainingLength > payloadThreshold {
+		if err = cp.Content.(*Publish).unpackStreamed(r, cp.remainingLength); err != nil {
+			return nil, err
+		}
+		return cp, nil
+	}
+
 	b := make([]byte, cp.remainingLength)
 	n, err := io.ReadFull(r, b)
 	if err != nil {
@@ -472,10 +488,15 @@ func writeUint32(u uint32, b *bytes.Buffer) error {
 	return b.WriteByte(byte(u))
 }
 
+// writeString writes s as an MQTT UTF-8 Encoded String (the content is not checked; see ValidateUTF8)
 func writeString(s string, b *bytes.Buffer) {
 	// Due to the 16 bit header strings are limited to 65535 bytes
 	if len(s) > 65535 {
-		s = s[:65535]
+		n := 65535
+		for n > 0 && !utf8.RuneStart(s[n]) { // do not split a multibyte character
+			n--
+		}
+		s = s[:n]
 	}
 	writeUint16(uint16(len(s)), b)
 	b.WriteString(s)
@@ -536,6 +557,7 @@ func readBinary(b *bytes.Buffer) ([]byte, error) {
 	return s, nil
 }
 
+// readString reads an MQTT UTF-8 Encoded String (the content is not checked; see ValidateUTF8)
 func readString(b *bytes.Buffer) (string, error) {
 	s, err := readBinary(b)
 	return string(s), err
@@ -181,6 +181,28 @@ func TestReadPacketConnect(t *testing.T) {
 	assert.Equal(t, uint32(30), *c.Content.(*Connect).Properties.SessionExpiryInterval)
 }
 
+func TestReadPacketDisconnect(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		reason byte
+	}{
+		{name: "NoReasonCode", packet: []byte{0xe0, 0x00}, reason: DisconnectNormalDisconnection},
+		{name: "NoProps", packet: []byte{0xe0, 0x01, 0x8e}, reason: DisconnectSessionTakenOver},
+		{name: "EmptyProps", packet: []byte{0xe0, 0x02, 0x8e, 0x00}, reason: DisconnectSessionTakenOver},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ReadPacket(bytes.NewReader(tt.packet))
+			require.NoError(t, err)
+			d, ok := c.Content.(*Disconnect)
+			require.True(t, ok)
+			assert.Equal(t, tt.reason, d.ReasonCode)
+			assert.NotNil(t, d.Properties)
+		})
+	}
+}
+
 func TestReadStringWriteString(t *testing.T) {
 	var b bytes.Buffer
 	const test1 = "Test string 世界" // include unicode
@@ -195,6 +217,73 @@ func TestReadStringWriteString(t *testing.T) {
 	overlengthStr := strings.Repeat("A", 65600) // longer than 2^16
 	writeString(overlengthStr, &b)
 	assert.Equal(t, 65537, b.Len()) // Two byte length so 65535 + 2 = 65537
+
+	// Multibyte characters are not split when truncating
+	b.Reset()
+	writeString("A"+strings.Repeat("世", 21845), &b) // 65536 bytes
+	s, err = readString(&b)
+	require.NoError(t, err)
+	assert.Len(t, s, 65533)
+}
+
+func TestUTF8Validation(t *testing.T) {
+	tests := []struct {
+		name   string
+		s      string
+		offset int
+		reason string
+	}{
+		{"null", "a/\x00/b", 2, "U+0000"},
+		{"surrogate", "ab\xed\xa0\x80", 2, "surrogate"},
+		{"non-shortest form", "\xc0\x80", 0, "non-shortest"},
+		{"above maximum", "x\xf4\x90\x80\x80", 1, "U+10FFFF"},
+		{"continuation", "世\x80", 3, "continuation"},
+		{"truncated", "a\xe4\xb8", 1, "incomplete"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateUTF8(tt.s)
+			require.NotNil(t, err)
+			assert.ErrorIs(t, err, ErrInvalidUTF8)
+			assert.Equal(t, tt.offset, err.Offset)
+			assert.Contains(t, err.Reason, tt.reason)
+
+			// Strings are not checked when reading/writing (the policy is applied via ValidateUTF8)
+			var b bytes.Buffer
+			writeString(tt.s, &b)
+			s, rErr := readString(&b)
+			require.NoError(t, rErr)
+			assert.Equal(t, tt.s, s)
+		})
+	}
+
+	// ValidateUTF8 checks the strings within each packet type, identifying the field, unless UTF8Lenient is used
+	const bad = "a\x00b"
+	packets := []struct {
+		p     Packet
+		field string
+	}{
+		{&Connect{ClientID: "c", WillTopic: bad}, "WillTopic"},
+		{&Connect{WillProperties: &Properties{ContentType: bad}}, "WillProperties.ContentType"},
+		{&Connack{Properties: &Properties{AssignedClientID: bad}}, "Properties.AssignedClientID"},
+		{&Publish{Topic: bad}, "Topic"},
+		{&Publish{Topic: "a", Properties: &Properties{User: []User{{Key: "k", Value: bad}}}}, "Properties.User[0].Value"},
+		{&Puback{Properties: &Properties{ReasonString: bad}}, "Properties.ReasonString"},
+		{&Subscribe{Subscriptions: []SubOptions{{Topic: "a"}, {Topic: bad}}}, "Subscriptions[1].Topic"},
+		{&Unsubscribe{Topics: []string{bad}}, "Topics[0]"},
+		{&Disconnect{Properties: &Properties{ServerReference: bad}}, "Properties.ServerReference"},
+		{&Auth{Properties: &Properties{AuthMethod: bad}}, "Properties.AuthMethod"},
+	}
+	for _, tt := range packets {
+		err := ValidateUTF8(tt.p, UTF8Strict)
+		var ue *UTF8Error
+		if assert.ErrorAs(t, err, &ue, "%T", tt.p) {
+			assert.Equal(t, tt.field, ue.Field)
+			assert.Equal(t, 1, ue.Offset)
+		}
+		assert.NoError(t, ValidateUTF8(tt.p, UTF8Lenient))
+	}
+	assert.NoError(t, ValidateUTF8(&Publish{Topic: "a/世界", Properties: &Properties{}}, UTF8Strict))
 }
 
 func TestReadStringWriteBinary(t *testing.T) {
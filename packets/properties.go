@@ -84,6 +84,11 @@ type Properties struct {
 	// SubscriptionIdentifier is an identifier of the subscription to which
 	// the Publish matched
 	SubscriptionIdentifier *int
+	// SubscriptionIdentifiers holds all subscription identifiers included in a
+	// received Publish (a Publish that matches multiple subscriptions may carry
+	// more than one). Only populated by Unpack (SubscriptionIdentifier is used
+	// when packing).
+	SubscriptionIdentifiers []int
 	// SessionExpiryInterval is the time in seconds after a client disconnects
 	// that the server should retain the session information (subscriptions etc)
 	SessionExpiryInterval *uint32
@@ -174,6 +179,9 @@ func (p *Properties) String() string {
 	if p.SubscriptionIdentifier != nil {
 		fmt.Fprintf(&b, "\tSubscriptionIdentifier:%d\n", *p.SubscriptionIdentifier)
 	}
+	if len(p.SubscriptionIdentifiers) > 1 {
+		fmt.Fprintf(&b, "\tSubscriptionIdentifiers:%v\n", p.SubscriptionIdentifiers)
+	}
 	if p.SessionExpiryInterval != nil {
 		fmt.Fprintf(&b, "\tSessionExpiryInterval:%d\n", *p.SessionExpiryInterval)
 	}
@@ -644,6 +652,7 @@ func (i *Properties) Unpack(r *bytes.Buffer, p byte) error {
 				return err
 			}
 			i.SubscriptionIdentifier = &si
+			i.SubscriptionIdentifiers = append(i.SubscriptionIdentifiers, si)
 		case PropSessionExpiryInterval:
 			se, err := readUint32(buf)
 			if err != nil {
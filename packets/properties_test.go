@@ -16,6 +16,7 @@
 package packets
 
 import (
+	"bytes"
 	"fmt"
 	"testing"
 )
@@ -167,3 +168,15 @@ func BenchmarkPropertyCreationStruct(b *testing.B) {
 	}
 	fmt.Sprintln(p)
 }
+
+// TestMultipleSubscriptionIdentifiers confirms that all subscription identifiers in a PUBLISH are retained
+func TestMultipleSubscriptionIdentifiers(t *testing.T) {
+	b := bytes.NewBuffer([]byte{4, PropSubscriptionIdentifier, 1, PropSubscriptionIdentifier, 2})
+	var p Properties
+	if err := p.Unpack(b, PUBLISH); err != nil {
+		t.Fatalf("failed to unpack properties: %s", err)
+	}
+	if len(p.SubscriptionIdentifiers) != 2 || p.SubscriptionIdentifiers[0] != 1 || p.SubscriptionIdentifiers[1] != 2 {
+		t.Fatalf("expected subscription identifiers [1 2], got %v", p.SubscriptionIdentifiers)
+	}
+}
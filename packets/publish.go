@@ -32,6 +32,11 @@ type Publish struct {
 	QoS        byte
 	Duplicate  bool
 	Retain     bool
+
+	// PayloadReader is only set when the packet was read by ReadPacketStreamed and the payload exceeded the threshold.
+	// In this case Payload will be nil, and the payload must be read from PayloadReader (which reads directly from the
+	// network connection; no further packets can be read until it has been fully consumed).
+	PayloadReader io.Reader
 }
 
 func (p *Publish) String() string {
@@ -50,6 +55,21 @@ func (s *Publish) Type() byte {
 
 // Unpack is the implementation of the interface required function for a packet
 func (p *Publish) Unpack(r *bytes.Buffer) error {
+	err := p.unpackHeader(r)
+	if err != nil {
+		return err
+	}
+
+	p.Payload, err = ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// unpackHeader unpacks the variable header (topic, packet identifier and properties) from r
+func (p *Publish) unpackHeader(r *bytes.Buffer) error {
 	var err error
 	p.Topic, err = readString(r)
 	if err != nil {
@@ -62,19 +82,70 @@ func (p *Publish) Unpack(r *bytes.Buffer) error {
 		}
 	}
 
-	err = p.Properties.Unpack(r, PUBLISH)
+	return p.Properties.Unpack(r, PUBLISH)
+}
+
+// unpackStreamed reads the variable header from r, leaving the payload (the remainder of the packet, which is
+// remainingLength bytes in total) to be read via p.PayloadReader
+func (p *Publish) unpackStreamed(r io.Reader, remainingLength int) error {
+	var topicLen [2]byte
+	if _, err := io.ReadFull(r, topicLen[:]); err != nil {
+		return err
+	}
+	hdr := make([]byte, 2+int(topicLen[0])<<8+int(topicLen[1]))
+	if p.QoS > 0 {
+		hdr = append(hdr, 0, 0)
+	}
+	copy(hdr, topicLen[:])
+	if _, err := io.ReadFull(r, hdr[2:]); err != nil {
+		return err
+	}
+	propLenVBI, err := getVBI(r)
 	if err != nil {
 		return err
 	}
-
-	p.Payload, err = ioutil.ReadAll(r)
+	b := bytes.NewBuffer(hdr)
+	b.Write(propLenVBI.Bytes())
+	propLen, err := decodeVBI(propLenVBI)
 	if err != nil {
 		return err
 	}
-
+	if b.Len()+propLen > remainingLength {
+		return fmt.Errorf("PUBLISH variable header exceeds remaining length (%d)", remainingLength)
+	}
+	if _, err := io.CopyN(b, r, int64(propLen)); err != nil {
+		return err
+	}
+	headerLen := b.Len()
+	if err := p.unpackHeader(b); err != nil {
+		return err
+	}
+	p.PayloadReader = &payloadReader{r: r, remaining: int64(remainingLength - headerLen)}
 	return nil
 }
 
+// payloadReader reads a streamed payload (returning io.EOF once the end of the packet is reached)
+type payloadReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+// Read implements io.Reader
+func (p *payloadReader) Read(b []byte) (int, error) {
+	if p.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > p.remaining {
+		b = b[:p.remaining]
+	}
+	n, err := p.r.Read(b)
+	p.remaining -= int64(n)
+	if err == io.EOF && p.remaining > 0 {
+		err = io.ErrUnexpectedEOF // Connection closed before the entire payload was received
+	}
+	return n, err
+}
+
 // Buffers is the implementation of the interface required function for a packet
 func (p *Publish) Buffers() (net.Buffers, error) {
 	var b bytes.Buffer
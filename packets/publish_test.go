@@ -17,6 +17,7 @@ package packets
 
 import (
 	"bytes"
+	"io"
 	"testing"
 )
 
@@ -75,3 +76,69 @@ func TestPublishPackUnpack(t *testing.T) {
 		}
 	}
 }
+
+// TestReadPacketStreamed confirms that large payloads are made available via PayloadReader, and that the following
+// packet can be read once the payload has been consumed.
+func TestReadPacketStreamed(t *testing.T) {
+	for qos := byte(0); qos < 3; qos++ {
+		payload := bytes.Repeat([]byte("0123456789"), 100)
+		ct := "application/octet-stream"
+		var b bytes.Buffer
+		if _, err := (&Publish{
+			PacketID:   10,
+			QoS:        qos,
+			Topic:      "firmware/image",
+			Properties: &Properties{ContentType: ct},
+			Payload:    payload,
+		}).WriteTo(&b); err != nil {
+			t.Fatalf("failed to write PUBLISH: %s", err)
+		}
+		if _, err := (&Publish{QoS: qos, PacketID: 11, Topic: "small", Payload: []byte("small")}).WriteTo(&b); err != nil {
+			t.Fatalf("failed to write PUBLISH: %s", err)
+		}
+
+		cp, err := ReadPacketStreamed(&b, 100)
+		if err != nil {
+			t.Fatalf("QOS%d: failed to read packet: %s", qos, err)
+		}
+		p := cp.Content.(*Publish)
+		if p.Payload != nil || p.PayloadReader == nil {
+			t.Fatalf("QOS%d: payload should be streamed", qos)
+		}
+		if p.Topic != "firmware/image" || p.Properties.ContentType != ct || (qos > 0 && p.PacketID != 10) {
+			t.Fatalf("QOS%d: header not decoded correctly: %s", qos, p)
+		}
+		got, err := io.ReadAll(p.PayloadReader)
+		if err != nil {
+			t.Fatalf("QOS%d: failed to read payload: %s", qos, err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("QOS%d: payload mismatch", qos)
+		}
+
+		cp, err = ReadPacketStreamed(&b, 100)
+		if err != nil {
+			t.Fatalf("QOS%d: failed to read second packet: %s", qos, err)
+		}
+		p = cp.Content.(*Publish)
+		if p.PayloadReader != nil || string(p.Payload) != "small" || p.Topic != "small" {
+			t.Fatalf("QOS%d: second packet not decoded correctly: %s", qos, p)
+		}
+	}
+}
+
+// TestReadPacketStreamedTruncated confirms that an error is returned if the connection closes mid-payload
+func TestReadPacketStreamedTruncated(t *testing.T) {
+	var b bytes.Buffer
+	if _, err := (&Publish{Topic: "test", Payload: make([]byte, 500)}).WriteTo(&b); err != nil {
+		t.Fatalf("failed to write PUBLISH: %s", err)
+	}
+	b.Truncate(b.Len() - 10)
+	cp, err := ReadPacketStreamed(&b, 100)
+	if err != nil {
+		t.Fatalf("failed to read packet: %s", err)
+	}
+	if _, err := io.ReadAll(cp.Content.(*Publish).PayloadReader); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
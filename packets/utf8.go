@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package packets
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// UTF8Validation determines how MQTT UTF-8 Encoded Strings (topics, client identifiers, user properties etc.) are
+// checked (see ValidateUTF8). The packets library does not check strings when packets are read or written; this is
+// left to the user of the library (e.g. paho.ClientConfig.UTF8Validation) so that the policy can differ by connection.
+type UTF8Validation int32
+
+const (
+	// UTF8Strict rejects strings that are not well-formed UTF-8 (including UTF-16 surrogate halves and non-shortest
+	// form encodings) or that contain U+0000, as required by section 1.5.4 of the MQTT v5 specification (default).
+	UTF8Strict UTF8Validation = iota
+	// UTF8Lenient performs no checks (for interoperability with peers that send, or accept, invalid strings)
+	UTF8Lenient
+)
+
+// ErrInvalidUTF8 is matched (via errors.Is) by a *UTF8Error
+var ErrInvalidUTF8 = errors.New("invalid UTF-8 string")
+
+// UTF8Error is returned by ValidateUTF8 when a packet contains a string that is not a valid MQTT UTF-8 Encoded String
+type UTF8Error struct {
+	Field  string // The packet field containing the string (e.g. "Topic", "User" or "Properties.ReasonString")
+	Offset int    // Position, in bytes, of the offending character within the string
+	Reason string // Why the string is invalid
+}
+
+// Error implements error
+func (e *UTF8Error) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("%s: %s at byte %d", ErrInvalidUTF8, e.Reason, e.Offset)
+	}
+	return fmt.Sprintf("%s: %s at byte %d of %s", ErrInvalidUTF8, e.Reason, e.Offset, e.Field)
+}
+
+// Is enables errors.Is(err, ErrInvalidUTF8)
+func (e *UTF8Error) Is(target error) bool { return target == ErrInvalidUTF8 }
+
+// ValidateUTF8 returns a *UTF8Error if any MQTT UTF-8 Encoded String within p (topics, client identifier, user
+// properties etc.) is invalid when checked as per v (nil is always returned for UTF8Lenient). The payload is not
+// checked (even if the Payload Format Indicator is set).
+func ValidateUTF8(p Packet, v UTF8Validation) error {
+	if v == UTF8Lenient {
+		return nil
+	}
+	switch p := p.(type) {
+	case *Connect:
+		if err := validateUTF8Fields("", []string{"ProtocolName", "ClientID", "WillTopic", "Username"},
+			p.ProtocolName, p.ClientID, p.WillTopic, p.Username); err != nil {
+			return err
+		}
+		if err := validateProperties("WillProperties", p.WillProperties); err != nil {
+			return err
+		}
+		return validateProperties("Properties", p.Properties)
+	case *Connack:
+		return validateProperties("Properties", p.Properties)
+	case *Publish:
+		if err := validateUTF8Fields("", []string{"Topic"}, p.Topic); err != nil {
+			return err
+		}
+		return validateProperties("Properties", p.Properties)
+	case *Puback:
+		return validateProperties("Properties", p.Properties)
+	case *Pubrec:
+		return validateProperties("Properties", p.Properties)
+	case *Pubrel:
+		return validateProperties("Properties", p.Properties)
+	case *Pubcomp:
+		return validateProperties("Properties", p.Properties)
+	case *Subscribe:
+		for i, so := range p.Subscriptions {
+			if err := validateUTF8Fields("", []string{fmt.Sprintf("Subscriptions[%d].Topic", i)}, so.Topic); err != nil {
+				return err
+			}
+		}
+		return validateProperties("Properties", p.Properties)
+	case *Suback:
+		return validateProperties("Properties", p.Properties)
+	case *Unsubscribe:
+		for i, t := range p.Topics {
+			if err := validateUTF8Fields("", []string{fmt.Sprintf("Topics[%d]", i)}, t); err != nil {
+				return err
+			}
+		}
+		return validateProperties("Properties", p.Properties)
+	case *Unsuback:
+		return validateProperties("Properties", p.Properties)
+	case *Disconnect:
+		return validateProperties("Properties", p.Properties)
+	case *Auth:
+		return validateProperties("Properties", p.Properties)
+	}
+	return nil // PINGREQ/PINGRESP contain no strings
+}
+
+// validateProperties checks the strings within p (which may be nil); name identifies p in any error
+func validateProperties(name string, p *Properties) error {
+	if p == nil {
+		return nil
+	}
+	if err := validateUTF8Fields(name+".", []string{"ContentType", "ResponseTopic", "AssignedClientID", "ResponseInfo",
+		"AuthMethod", "ServerReference", "ReasonString"}, p.ContentType, p.ResponseTopic, p.AssignedClientID,
+		p.ResponseInfo, p.AuthMethod, p.ServerReference, p.ReasonString); err != nil {
+		return err
+	}
+	for i, u := range p.User {
+		if err := validateUTF8Fields(fmt.Sprintf("%s.User[%d].", name, i), []string{"Key", "Value"}, u.Key, u.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateUTF8Fields checks each of values; if one is invalid, the corresponding entry in names (prefixed by prefix)
+// is recorded in the *UTF8Error returned
+func validateUTF8Fields(prefix string, names []string, values ...string) error {
+	for i, v := range values {
+		if err := validateUTF8(v); err != nil {
+			err.Field = prefix + names[i]
+			return err
+		}
+	}
+	return nil
+}
+
+// validateUTF8 returns a *UTF8Error if s is not a valid MQTT UTF-8 Encoded String
+func validateUTF8(s string) *UTF8Error {
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			if c == 0 {
+				return &UTF8Error{Offset: i, Reason: "U+0000 is not permitted"}
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			return &UTF8Error{Offset: i, Reason: utf8Reason(s[i:])}
+		}
+		i += size
+	}
+	return nil
+}
+
+// utf8Reason describes why the sequence at the start of s is not well-formed UTF-8
+func utf8Reason(s string) string {
+	c := s[0]
+	var next byte
+	if len(s) > 1 {
+		next = s[1]
+	}
+	switch {
+	case c == 0xED && next >= 0xA0 && next <= 0xBF:
+		return "UTF-16 surrogate half"
+	case c == 0xC0 || c == 0xC1, c == 0xE0 && next >= 0x80 && next < 0xA0, c == 0xF0 && next >= 0x80 && next < 0x90:
+		return "non-shortest form encoding"
+	case c >= 0xF5 || (c == 0xF4 && next >= 0x90):
+		return "code point above U+10FFFF"
+	case c < 0xC0:
+		return fmt.Sprintf("unexpected continuation byte %#x", c)
+	}
+	return fmt.Sprintf("incomplete or invalid sequence starting %#x", c)
+}
@@ -81,6 +81,20 @@ func (t *acksTracker) flush(do func([]*packets.Publish)) {
 	t.order = t.order[len(buf):]
 }
 
+// pending returns the packet identifiers of messages that have not been acknowledged (in the order received)
+func (t *acksTracker) pending() []uint16 {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	var ids []uint16
+	for _, v := range t.order {
+		if !v.acknowledged {
+			ids = append(ids, v.pb.PacketID)
+		}
+	}
+	return ids
+}
+
 // reset should be used upon disconnections
 func (t *acksTracker) reset() {
 	t.mx.Lock()
@@ -55,6 +55,10 @@ func TestAcksTracker(t *testing.T) {
 		})
 	})
 
+	t.Run("pending", func(t *testing.T) {
+		require.Equal(t, []uint16{1, 2}, at.pending())
+	})
+
 	t.Run("idempotent-acking", func(t *testing.T) {
 		require.NoError(t, at.markAsAcked(p3))
 		require.NoError(t, at.markAsAcked(p3))
@@ -15,9 +15,20 @@
 
 package paho
 
+import "context"
+
 // Auther is the interface for something that implements the extended authentication
 // flows in MQTT v5
 type Auther interface {
 	Authenticate(*Auth) *Auth // Authenticate will be called when an AUTH packet is received.
 	Authenticated()           // Authenticated will be called when CONNACK is received
 }
+
+// Reauther may be implemented by an Auther to enable scheduled re-authentication (see ClientConfig.ReauthInterval),
+// e.g. where a token used for authentication expires during the session.
+type Reauther interface {
+	// Reauthenticate returns the AUTH packet used to initiate re-authentication; it should include the Authentication
+	// Method and fresh Authentication Data (e.g. a renewed token). The Reason Code is set by the client. If an error is
+	// returned, re-authentication is not attempted until the next interval.
+	Reauthenticate(context.Context) (*Auth, error)
+}
@@ -16,15 +16,19 @@
 package paho
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/eclipse/paho.golang/internal/categorised"
 	"github.com/eclipse/paho.golang/packets"
 	"github.com/eclipse/paho.golang/paho/log"
 	"github.com/eclipse/paho.golang/paho/session"
@@ -35,10 +39,19 @@ const defaultSendAckInterval = 50 * time.Millisecond
 
 var (
 	ErrManualAcknowledgmentDisabled = errors.New("manual acknowledgments disabled")
-	ErrNetworkErrorAfterStored      = errors.New("error after packet added to state")         // Could not send packet but its stored (and response will be sent on chan at some point in the future)
-	ErrConnectionLost               = errors.New("connection lost after request transmitted") // We don't know whether the server received the request or not
+	ErrNetworkErrorAfterStored      = categorised.New("error after packet added to state", ErrDisconnected)         // Could not send packet but its stored (and response will be sent on chan at some point in the future)
+	ErrConnectionLost               = categorised.New("connection lost after request transmitted", ErrDisconnected) // We don't know whether the server received the request or not
 
 	ErrInvalidArguments = errors.New("invalid argument") // If included (errors.Join) in an error, there is a problem with the arguments passed. Retrying on the same connection with the same arguments will not succeed.
+
+	ErrQoSNotSupported    = errors.New("QoS exceeds server maximum QoS")            // Returned (along with ErrInvalidArguments) by Publish if the QoS requested exceeds the Maximum QoS in the CONNACK
+	ErrRetainNotSupported = errors.New("server does not support retained messages") // Returned (along with ErrInvalidArguments) by Publish if retain is requested and Retain Available in the CONNACK is false
+	ErrInvalidTopic       = errors.New("invalid topic name")                        // Returned (along with ErrInvalidArguments) by Publish if the topic is not a valid Topic Name (see ValidatePublishTopic)
+
+	ErrAckTimeout       = categorised.New("acknowledgement not received within AckTimeout", ErrTimeout) // Returned by Publish if the PUBLISH was transmitted but not acknowledged in time (the message remains in the session)
+	ErrPublishCancelled = errors.New("publish cancelled")                                               // Returned by Publish if the message was cancelled via CancelPublish
+	ErrReadTimeout      = categorised.New("no packet received before read deadline", ErrTimeout)        // Passed (wrapped) to OnClientError if ReadDeadline expires
+	ErrStreamNotDrained = errors.New("streamed payload has not been read")                              // Returned by Publish/Subscribe/Unsubscribe, when passed a handler's context, if its streamed payload has not been fully read (the response could not be received)
 )
 
 type (
@@ -48,6 +61,17 @@ type (
 
 		AlreadyHandled bool    // Set to true if a previous callback has returned true (indicating some action has already been taken re the message)
 		Errs           []error // Errors returned by previous handlers (if any).
+
+		ack *ackReason      // Shared by all handlers called for this message (nil if acknowledgement reason cannot be set)
+		ctx context.Context // Done when the client begins shutting down (see Context)
+	}
+
+	// PublishRateLimiter limits the rate at which PUBLISH packets are sent (golang.org/x/time/rate.Limiter satisfies
+	// this interface).
+	PublishRateLimiter interface {
+		// Wait blocks until a PUBLISH may be sent, returning an error if ctx is done first (or the wait would exceed
+		// the context deadline).
+		Wait(ctx context.Context) error
 	}
 
 	// ClientConfig are the user-configurable options for the client, an
@@ -65,11 +89,34 @@ type (
 		Session          session.SessionManager
 		autoCloseSession bool
 
+		// AuthHandler is called when the server continues an enhanced authentication exchange (AUTH with reason code
+		// 0x18). If it is nil and such an AUTH is received, the exchange cannot proceed, so the connection is closed
+		// (OnClientError is called; Connect returns an error if this happens during connection).
 		AuthHandler   Auther
 		PingHandler   Pinger
 		defaultPinger bool
 
-		// Router - new inbound messages will be passed to the `Route(*packets.Publish)` function.
+		// ReauthInterval, if greater than 0 (and AuthHandler implements Reauther), results in the client initiating
+		// re-authentication (AUTH with reason code 0x19) at this interval following each CONNACK; set it
+		// comfortably below the lifetime of the credentials. Sending the AUTH counts as activity for the PingHandler
+		// (so no additional PINGREQ is needed). If the server rejects the new credentials, it will send a DISCONNECT
+		// (passed to OnServerDisconnect; autopaho will reconnect). If the server does not respond within
+		// PacketTimeout, the connection is closed (OnClientError is called). If an exchange (e.g. via Authenticate)
+		// is already in progress when the interval elapses, that attempt is skipped.
+		ReauthInterval time.Duration
+
+		// BuildConnect, if set, is called by Connect with the CONNECT packet, after the standard fields have been
+		// populated from the Connect passed in, immediately before it is sent. This enables any field or property to
+		// be set (e.g. vendor specific User Properties, Request Problem/Response Information); Properties will be
+		// non-nil. Values that affect the client (Keep Alive, Client Identifier, Receive Maximum etc) are read from
+		// the packet after BuildConnect returns. Connect fails (with an error wrapping ErrInvalidArguments) if the
+		// changes would produce a malformed packet, or clear a Client Identifier (which the session is associated
+		// with). Note that autopaho creates a new Client for each connection, so it is called whenever a connection
+		// is (re)established.
+		BuildConnect func(*packets.Connect)
+
+		// Router - new inbound messages will be passed to the `Route(*packets.Publish)` function (or `RouteContext`, with
+		// the context returned by PublishReceived.Context, if the Router implements ContextRouter).
 		//
 		// Depreciated: If a router is provided, it will now be added to the end of the OnPublishReceived
 		// slice (which provides a more flexible approach to handling incoming messages).
@@ -81,8 +128,19 @@ type (
 		// then it should return true. This boolean, and any errors, will be passed to subsequent handlers.
 		OnPublishReceived []func(PublishReceived) (bool, error)
 
+		// MessageChannelSize, if greater than 0, results in inbound PUBLISH messages being delivered to the channel
+		// returned by Messages (which is buffered to this size). This is an alternative to callbacks; if a Router, or
+		// OnPublishReceived callbacks, are also configured then messages are passed to them first (the default Router
+		// is not created). Messages are acknowledged once added to the channel (unless EnableManualAcknowledgment is
+		// set). If the channel is full, no further messages are processed until the application receives from it; the
+		// server will stop sending once Receive Maximum (sent in CONNECT) unacknowledged messages are outstanding.
+		// The channel is closed when the client shuts down. Not compatible with StreamPayloadThreshold (the payload
+		// reader is drained before the application receives the message).
+		MessageChannelSize int
+
 		PacketTimeout time.Duration
-		// OnServerDisconnect is called only when a packets.DISCONNECT is received from server
+		// OnServerDisconnect is called only when a packets.DISCONNECT is received from server. Any properties sent
+		// (Reason String, Server Reference and User Properties) are available via Disconnect.Properties.
 		OnServerDisconnect func(*Disconnect)
 		// OnClientError is for example called on net.Error. Note that this may be called multiple times and may be
 		// called following a successful `Disconnect`. See autopaho.errorHandler for an example.
@@ -93,7 +151,17 @@ type (
 		// Topic Alias Handler extension which will automatically assign
 		// and use topic alias values rather than topic strings.
 		PublishHook func(*Publish)
-		// EnableManualAcknowledgment is used to control the acknowledgment of packets manually.
+		// EnableTopicAliases, if true, results in the client assigning topic aliases to outbound PUBLISH packets (where
+		// the server permits this; i.e. Topic Alias Maximum in CONNACK > 0). The first PUBLISH to a topic will include
+		// both the topic and alias, subsequent PUBLISH packets will include only the alias. Packets that already have
+		// a TopicAlias set are sent unaltered (so mixing manual and automatic aliases is not recommended).
+		EnableTopicAliases bool
+		// TopicAliasEviction determines what happens when all available aliases are in use (only used when
+		// EnableTopicAliases is true). By default, no aliases will be reassigned.
+		TopicAliasEviction TopicAliasEviction
+		// EnableManualAcknowledgment is used to control the acknowledgment of packets manually. QoS 1/2 messages are
+		// not acknowledged until Ack is called (this may be done from any goroutine, after the handlers have returned,
+		// e.g. once the message has been committed elsewhere); use PendingAcks to see which remain outstanding.
 		// BEWARE that the MQTT specs require clients to send acknowledgments in the order in which the corresponding
 		// PUBLISH packets were received.
 		// Consider the following scenario: the client receives packets 1,2,3,4
@@ -103,6 +171,88 @@ type (
 		// SendAcksInterval is used only when EnableManualAcknowledgment is true
 		// it determines how often the client tries to send a batch of acknowledgments in the right order to the server.
 		SendAcksInterval time.Duration
+		// StreamPayloadThreshold, if greater than 0, enables streaming of large inbound PUBLISH payloads. The payload
+		// of a PUBLISH packet larger than this number of bytes will not be buffered; instead Publish.PayloadReader is
+		// set (and Payload will be nil), allowing handlers to read the payload directly from the connection.
+		// No further packets will be read until the payload has been consumed (any data not read by the handlers is
+		// discarded when they return) and the message will not be acknowledged until this point (if
+		// EnableManualAcknowledgment is set then Ack should not be called until the payload has been read).
+		// As a result, a handler must read the whole payload before making a QoS1/2 Publish, Subscribe or Unsubscribe
+		// call that waits for a response (which cannot be read until the payload has been consumed); if the context
+		// passed is derived from PublishReceived.Context, such calls fail immediately with ErrStreamNotDrained (with
+		// any other context, the call will block until it times out, e.g. after PacketTimeout).
+		StreamPayloadThreshold int
+		// Observer, if set, is notified as messages are sent and received (enabling the collection of metrics).
+		Observer Observer
+		// OnBytesRead and OnBytesWritten, if set, are called with a copy of the raw data read from, and written to,
+		// Conn (e.g. to capture the bytes on the wire when diagnosing interoperability issues). OnBytesWritten is
+		// called once for each packet written; OnBytesRead is called for each read from Conn, so a packet may span
+		// several calls (and one call may contain data from more than one packet). These are called synchronously on
+		// the I/O path so must return quickly and must not call back into the Client. If neither is set, Conn is
+		// used directly (there is no overhead).
+		OnBytesRead    func([]byte)
+		OnBytesWritten func([]byte)
+		// AckTimeout, if greater than 0, limits the time that Publish will wait for a QoS1/2 PUBLISH to be fully
+		// acknowledged (PUBACK, or PUBREC and PUBCOMP) after it has been transmitted; ErrAckTimeout is returned if the
+		// acknowledgement does not arrive in time (PacketTimeout and the context passed to Publish also apply). The
+		// message remains in the session, so its packet identifier and quota slot will not be reused until it is
+		// acknowledged (or dropped when the connection is lost). Not used for PublishMethod_AsyncSend.
+		AckTimeout time.Duration
+		// DisconnectOnAckTimeout, if true, results in the connection being closed (and OnClientError called with an
+		// error wrapping ErrAckTimeout) when AckTimeout expires. A missing acknowledgement often indicates that the
+		// connection is broken; autopaho will reconnect, at which point stored messages are retransmitted (and
+		// messages sent with PublishMethod_Blocking_NoQueue released).
+		DisconnectOnAckTimeout bool
+		// PayloadCodec, if set, is used to encode (e.g. compress) the payload of outbound PUBLISH packets, which are
+		// marked with the PayloadEncodingProperty User Property. Inbound messages carrying that marker, with a value
+		// matching the codec's Name, are decoded before being passed to handlers; other messages are passed through
+		// unaltered (enabling interoperation with clients that do not use the codec). Streamed payloads (see
+		// StreamPayloadThreshold) are not decoded.
+		PayloadCodec PayloadCodec
+		// ReadBufferSize, if greater than 0, results in inbound packets being read via a buffer of this size (reducing
+		// the number of reads from Conn, which can improve throughput when many small packets are received).
+		ReadBufferSize int
+		// UTF8Validation determines how the MQTT UTF-8 Encoded Strings (topics, user properties etc.) in packets sent
+		// and received on this connection are checked. With packets.UTF8Strict (the default) strings that the spec
+		// prohibits (e.g. containing U+0000 or UTF-16 surrogate halves) are rejected: requests containing them fail
+		// with an error wrapping ErrInvalidArguments (and packets.ErrInvalidUTF8), and a packet containing one received
+		// from the server is treated as a protocol error (the connection is closed). packets.UTF8Lenient disables these
+		// checks (for interoperability with servers that send, or accept, such strings).
+		UTF8Validation packets.UTF8Validation
+		// ReadDeadline, if set, is called with the keep alive in use before each packet is read from Conn; the read
+		// deadline is set to the duration returned (0 means no deadline). If no packet is received before the deadline
+		// the connection is considered lost (OnClientError is called with an error wrapping ErrReadTimeout). This
+		// enables half-open connections to be detected promptly; see KeepAliveReadDeadline.
+		ReadDeadline ReadDeadlineStrategy
+		// OnRedeliver, if set, is called with the packet identifier of each message retransmitted when a connection is
+		// established with an existing session (i.e. QoS1/2 PUBLISH packets resent with the DUP flag set, and PUBREL
+		// packets for messages where PUBREC had been received), in the order they were sent. It is called from within
+		// Connect, so must not block. Requires a Session that implements session.RedeliveryNotifier (as state.State does).
+		OnRedeliver func(packetID uint16)
+		// PublishRateLimiter, if set, is consulted before each PUBLISH is transmitted (including those sent by autopaho
+		// from its queue, so the rate at which queued messages are sent following reconnection is also limited). The
+		// context passed to Publish applies to the wait; if it is done first, the message is not sent and an error is
+		// returned. Messages retransmitted by the Session upon reconnection are not limited.
+		PublishRateLimiter PublishRateLimiter
+		// SendWindow, if greater than 0, limits the number of QoS1/2 PUBLISH transactions in flight (sent but not yet
+		// fully acknowledged) to the lower of SendWindow and the server's Receive Maximum; Publish blocks until a slot is
+		// available. Requires a Session that implements session.SendWindowLimiter (as state.State does).
+		SendWindow uint16
+		// HandlerDrainTimeout, if greater than 0, limits how long the client waits, when the connection is shut down
+		// (whether by Disconnect, an error, or the server), for an in-progress OnPublishReceived callback (including
+		// Router.Route) to return; the context returned by PublishReceived.Context is cancelled when shutdown begins, so
+		// well-behaved handlers can exit promptly. If the callback does not return in time, an error identifying the
+		// message is logged and shutdown completes (the callback continues running in the background, but the message
+		// will not be acknowledged, as the Session may be in use by a new connection). Messages received but not yet
+		// passed to the callbacks are discarded (they are not acknowledged, so the server will redeliver QoS1/2
+		// messages). If 0 (the default) shutdown waits until all received messages have been handled.
+		HandlerDrainTimeout time.Duration
+
+		// ReusePublish, if true, results in the *Publish passed to the OnPublishReceived callbacks being reused for
+		// subsequent messages (avoiding an allocation per message at high message rates). Callbacks must not retain
+		// the Publish (or its Properties) after returning; copy anything needed later. Ignored if MessageChannelSize
+		// is set (messages sent to the channel are retained by the application).
+		ReusePublish bool
 	}
 	// Client is the struct representing an MQTT client
 	Client struct {
@@ -113,6 +263,10 @@ type (
 		onPublishReceivedTracker []int // Used to track positions in above
 		onPublishReceivedMu      sync.Mutex
 
+		router   Router          // Router messages are passed to (nil if none; see SetRouter)
+		routing  *sync.WaitGroup // tracks calls to Route on router (replaced, along with router, by SetRouter)
+		routerMu sync.RWMutex    // protects router and routing (only held briefly; not whilst Route is called)
+
 		// authResponse is used for handling the MQTTv5 authentication exchange (MUST be buffered)
 		authResponse   chan<- packets.ControlPacket
 		authResponseMu sync.Mutex // protects the above
@@ -127,9 +281,29 @@ type (
 		acksTracker    acksTracker
 		workers        sync.WaitGroup
 		serverProps    CommsProperties
+		connackProps   atomic.Pointer[ServerConnackProperties] // set once CONNACK received (read via ServerProperties)
 		clientProps    CommsProperties
-		debug          log.Logger
-		errors         log.Logger
+		topicAliases   *outboundTopicAliases // nil unless EnableTopicAliases is set (and the server permits aliases)
+		inboundFlow    *inboundFlowControl   // enforces the Receive Maximum sent in CONNECT
+		debug          *log.SwappableLogger  // may be changed at any time via SetDebugLogger
+		errors         *log.SwappableLogger  // may be changed at any time via SetErrorLogger
+
+		cancelled   map[uint16]struct{} // packet identifiers passed to CancelPublish (so Publish can return ErrPublishCancelled)
+		cancelledMu sync.Mutex          // protects the above
+
+		messages  chan *Publish   // nil unless MessageChannelSize > 0 (see Messages)
+		stopping  <-chan struct{} // closed when the client begins shutting down (set in Connect)
+		clientCtx context.Context // done when the client begins shutting down (set in Connect)
+
+		handling atomic.Pointer[Publish] // message currently being passed to the OnPublishReceived callbacks (if any)
+
+		// acksDetached is set (under acksMu) when shutdown completes; acknowledgements requested afterwards (e.g. by a
+		// handler that overran HandlerDrainTimeout) are dropped, as the Session may be in use by a new connection.
+		acksMu       sync.RWMutex
+		acksDetached bool
+
+		noSessionExpiry bool   // true if CONNECT had no (or a zero) Session Expiry Interval (see DisconnectWithOptions)
+		authMethod      string // Authentication Method from the CONNECT (used by Authenticate if none is specified)
 	}
 
 	// CommsProperties is a struct of the communication properties that may
@@ -145,6 +319,17 @@ type (
 		SubIDAvailable       bool
 		SharedSubAvailable   bool
 	}
+
+	// ServerConnackProperties is a snapshot of the values negotiated with the server when the connection was
+	// established. Where the server did not include a property in the CONNACK, the default specified by the MQTT spec
+	// is used.
+	ServerConnackProperties struct {
+		CommsProperties
+		AssignedClientID      string // Client identifier assigned by the server (empty if the client provided one)
+		KeepAlive             uint16 // Keep alive in use (the Server Keep Alive if set, otherwise the value sent in CONNECT)
+		SessionPresent        bool   // Session Present flag from the CONNACK (true if the server resumed an existing session)
+		SessionExpiryInterval uint32 // Session Expiry Interval in use, in seconds (the value in the CONNACK if set, otherwise the value sent in CONNECT)
+	}
 )
 
 // NewClient is used to create a new default instance of an MQTT client.
@@ -172,41 +357,62 @@ func NewClient(conf ClientConfig) *Client {
 			MaximumPacketSize: 0,
 			TopicAliasMaximum: 0,
 		},
+		inboundFlow:       newInboundFlowControl(math.MaxUint16),
 		config:            conf,
 		onPublishReceived: conf.OnPublishReceived,
 		done:              make(chan struct{}),
-		errors:            log.NOOPLogger{},
-		debug:             log.NOOPLogger{},
+		routing:           &sync.WaitGroup{},
+		errors:            log.NewSwappableLogger(nil),
+		debug:             log.NewSwappableLogger(nil),
 	}
 
 	if c.config.Session == nil {
 		c.config.Session = state.NewInMemory()
 		c.config.autoCloseSession = true // We created `Session`, so need to close it when done (so handlers all return)
+		// As we created the session store it should use the same loggers (as these are swappable, later changes apply)
+		c.config.Session.SetDebugLogger(c.debug)
+		c.config.Session.SetErrorLogger(c.errors)
+	}
+	if c.config.OnRedeliver != nil {
+		if rn, ok := c.config.Session.(session.RedeliveryNotifier); ok {
+			rn.SetOnRedeliver(c.config.OnRedeliver)
+		}
+	}
+	if c.config.SendWindow > 0 {
+		if sw, ok := c.config.Session.(session.SendWindowLimiter); ok {
+			sw.SetSendWindow(c.config.SendWindow)
+		}
 	}
 	if c.config.PacketTimeout == 0 {
 		c.config.PacketTimeout = 10 * time.Second
 	}
 
-	if c.config.Router == nil && len(c.onPublishReceived) == 0 {
+	if c.config.Router == nil && len(c.onPublishReceived) == 0 && c.config.MessageChannelSize <= 0 {
 		c.config.Router = NewStandardRouter() // Maintain backwards compatibility (for now!)
 	}
 	if c.config.Router != nil {
-		r := c.config.Router
-		c.onPublishReceived = append(c.onPublishReceived,
-			func(p PublishReceived) (bool, error) {
-				r.Route(p.Packet.Packet())
-				return false, nil
-			})
+		c.router = c.config.Router
+		c.onPublishReceived = append(c.onPublishReceived, c.routePublish)
+	}
+	if c.config.MessageChannelSize > 0 {
+		c.messages = make(chan *Publish, c.config.MessageChannelSize)
 	}
 	c.onPublishReceivedTracker = make([]int, len(c.onPublishReceived)) // Must have the same number of elements as onPublishReceived
 
 	if c.config.PingHandler == nil {
 		c.config.PingHandler = NewDefaultPinger()
+		c.config.PingHandler.SetDebug(c.debug)
 		c.config.defaultPinger = true
 	}
 	if c.config.OnClientError == nil {
 		c.config.OnClientError = func(e error) {}
 	}
+	if c.config.Observer == nil {
+		c.config.Observer = NOOPObserver{}
+	}
+	if c.config.Conn != nil && (c.config.OnBytesRead != nil || c.config.OnBytesWritten != nil) {
+		c.config.Conn = newTapConn(c.config.Conn, c.config.OnBytesRead, c.config.OnBytesWritten)
+	}
 
 	return c
 }
@@ -220,7 +426,7 @@ func NewClient(conf ClientConfig) *Client {
 // along with an error indicating the reason for the failure to connect.
 func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 	if c.config.Conn == nil {
-		return nil, fmt.Errorf("client connection is nil")
+		return nil, fmt.Errorf("%w: client connection is nil", ErrNotConnected)
 	}
 
 	// The connection is in c.config.Conn which is inaccessible to the user.
@@ -240,31 +446,59 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 	done := make(chan struct{})
 	cleanup := func() {
 		cancelFunc()
-		close(c.publishPackets)
+		if c.publishPackets != nil {
+			close(c.publishPackets)
+		}
+		if c.messages != nil {
+			close(c.messages)
+		}
 		_ = c.config.Conn.Close()
 		close(done)
 	}
 
 	c.cancelFunc = cancelFunc
 	c.done = done
+	c.stopping = clientCtx.Done()
+	c.clientCtx = clientCtx
+
+	ccp := cp.Packet()
+	ccp.ProtocolName = "MQTT"
+	ccp.ProtocolVersion = 5
+	if c.config.BuildConnect != nil {
+		if ccp.Properties == nil {
+			ccp.Properties = &packets.Properties{}
+		}
+		c.config.BuildConnect(ccp)
+		if err := validateBuiltConnect(cp, ccp); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+	if err := c.checkUTF8(ccp); err != nil {
+		cleanup()
+		return nil, err
+	}
 
 	var publishPacketsSize uint16 = math.MaxUint16
-	if cp.Properties != nil && cp.Properties.ReceiveMaximum != nil {
-		publishPacketsSize = *cp.Properties.ReceiveMaximum
+	if ccp.Properties != nil && ccp.Properties.ReceiveMaximum != nil {
+		publishPacketsSize = *ccp.Properties.ReceiveMaximum
 	}
 	c.publishPackets = make(chan *packets.Publish, publishPacketsSize)
 
-	keepalive := cp.KeepAlive
-	c.config.ClientID = cp.ClientID
-	if cp.Properties != nil {
-		if cp.Properties.MaximumPacketSize != nil {
-			c.clientProps.MaximumPacketSize = *cp.Properties.MaximumPacketSize
+	keepalive := ccp.KeepAlive
+	c.config.ClientID = ccp.ClientID
+	c.noSessionExpiry = ccp.Properties == nil || ccp.Properties.SessionExpiryInterval == nil || *ccp.Properties.SessionExpiryInterval == 0
+	if ccp.Properties != nil {
+		c.authMethod = ccp.Properties.AuthMethod
+		if ccp.Properties.MaximumPacketSize != nil {
+			c.clientProps.MaximumPacketSize = *ccp.Properties.MaximumPacketSize
 		}
-		if cp.Properties.ReceiveMaximum != nil {
-			c.clientProps.ReceiveMaximum = *cp.Properties.ReceiveMaximum
+		if ccp.Properties.ReceiveMaximum != nil {
+			c.clientProps.ReceiveMaximum = *ccp.Properties.ReceiveMaximum
+			c.inboundFlow = newInboundFlowControl(c.clientProps.ReceiveMaximum)
 		}
-		if cp.Properties.TopicAliasMaximum != nil {
-			c.clientProps.TopicAliasMaximum = *cp.Properties.TopicAliasMaximum
+		if ccp.Properties.TopicAliasMaximum != nil {
+			c.clientProps.TopicAliasMaximum = *ccp.Properties.TopicAliasMaximum
 		}
 	}
 
@@ -272,10 +506,6 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 	connCtx, cf := context.WithTimeout(ctx, c.config.PacketTimeout)
 	defer cf()
 
-	ccp := cp.Packet()
-	ccp.ProtocolName = "MQTT"
-	ccp.ProtocolVersion = 5
-
 	c.debug.Println("sending CONNECT")
 	if _, err := ccp.WriteTo(c.config.Conn); err != nil {
 		cleanup()
@@ -298,7 +528,7 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 		ctxErr := connCtx.Err()
 		c.debug.Println(fmt.Sprintf("terminated due to context waiting for CONNACK: %v", ctxErr))
 		cleanup()
-		return nil, ctxErr
+		return nil, contextError(ctxErr)
 	case err := <-caPacketErr:
 		c.debug.Println(err)
 		cleanup()
@@ -315,7 +545,7 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 			reason = ca.Properties.ReasonString
 		}
 		cleanup()
-		return ca, fmt.Errorf("failed to connect to server: %s", reason)
+		return ca, fmt.Errorf("failed to connect to server: %w", &ReasonCodeError{PacketType: packets.CONNACK, ReasonCode: ca.ReasonCode, ReasonString: reason})
 	}
 
 	if err := c.config.Session.ConAckReceived(c.config.Conn, ccp, caPacket); err != nil {
@@ -327,10 +557,17 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 	// cleanup() must not be called past this point and will be handled by `shutdown`
 	context.AfterFunc(clientCtx, func() { c.shutdown(done) })
 
+	var sessionExpiry uint32
+	if ccp.Properties != nil && ccp.Properties.SessionExpiryInterval != nil {
+		sessionExpiry = *ccp.Properties.SessionExpiryInterval
+	}
 	if ca.Properties != nil {
 		if ca.Properties.ServerKeepAlive != nil {
 			keepalive = *ca.Properties.ServerKeepAlive
 		}
+		if ca.Properties.SessionExpiryInterval != nil {
+			sessionExpiry = *ca.Properties.SessionExpiryInterval
+		}
 		if ca.Properties.AssignedClientID != "" {
 			c.config.ClientID = ca.Properties.AssignedClientID
 		}
@@ -351,6 +588,29 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 		c.serverProps.SubIDAvailable = ca.Properties.SubIDAvailable
 		c.serverProps.SharedSubAvailable = ca.Properties.SharedSubAvailable
 	}
+	scp := &ServerConnackProperties{
+		CommsProperties:       c.serverProps,
+		KeepAlive:             keepalive,
+		SessionPresent:        ca.SessionPresent,
+		SessionExpiryInterval: sessionExpiry,
+	}
+	if ca.Properties != nil {
+		scp.AssignedClientID = ca.Properties.AssignedClientID
+	}
+	c.connackProps.Store(scp)
+	// Topic aliases only remain valid for the life of a network connection (even if the session is resumed), so any
+	// held from a previous connection must be discarded before packets are sent or received.
+	c.topicAliases = nil
+	if c.config.EnableTopicAliases && c.serverProps.TopicAliasMaximum > 0 {
+		c.topicAliases = newOutboundTopicAliases(c.serverProps.TopicAliasMaximum, c.config.TopicAliasEviction)
+		c.topicAliases.debug = c.debug
+	}
+	c.routerMu.RLock()
+	r := c.router
+	c.routerMu.RUnlock()
+	if ar, ok := r.(AliasResetter); ok { // Router may be reused across connections (e.g. by autopaho)
+		ar.ResetAliases()
+	}
 
 	c.debug.Println("received CONNACK, starting PingHandler")
 	c.workers.Add(1)
@@ -370,6 +630,9 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 		// exits when `c.publishPackets` is closed (`c.incoming()` closes this). This is important because
 		// messages may be passed for processing after `c.stop` has been closed.
 		c.routePublishPackets()
+		if c.messages != nil {
+			close(c.messages) // Nothing further will be sent
+		}
 	}()
 
 	c.debug.Println("starting incoming")
@@ -380,6 +643,16 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 		c.incoming(clientCtx)
 	}()
 
+	if _, ok := c.config.AuthHandler.(Reauther); ok && c.config.ReauthInterval > 0 {
+		c.debug.Println("starting re-authentication routine")
+		c.workers.Add(1)
+		go func() {
+			defer c.workers.Done()
+			defer c.debug.Println("returning from re-authentication routine")
+			c.reauthenticate(clientCtx)
+		}()
+	}
+
 	if c.config.EnableManualAcknowledgment {
 		c.debug.Println("starting acking routine")
 
@@ -431,15 +704,102 @@ func (c *Client) Ack(pb *Publish) error {
 	return c.acksTracker.markAsAcked(pb.Packet())
 }
 
+// PendingAcks returns the packet identifiers of QoS 1/2 messages, received on the current connection, that have not
+// yet been passed to Ack (in the order in which they were received). This may be used to detect messages that have not
+// been acknowledged (outstanding messages count towards the Receive Maximum, so the server may stop sending messages
+// if too many are pending). Returns nil if EnableManualAcknowledgment is not set.
+func (c *Client) PendingAcks() []uint16 {
+	if !c.config.EnableManualAcknowledgment {
+		return nil
+	}
+	return c.acksTracker.pending()
+}
+
+// Messages returns a channel that inbound PUBLISH messages are delivered to (nil unless ClientConfig.MessageChannelSize
+// is greater than 0). The channel is closed when the client shuts down, so it may be ranged over. If
+// EnableManualAcknowledgment is set then Ack must be called for each message received.
+func (c *Client) Messages() <-chan *Publish {
+	return c.messages
+}
+
+// ackReason holds the reason code, and string, to be used when acknowledging a message (see SetAckReason)
+type ackReason struct {
+	reasonCode   byte
+	reasonString string
+}
+
+// Context returns a context that is done when the client begins shutting down (the connection has been lost or
+// Disconnect called); long-running handlers should use this to exit promptly (see ClientConfig.HandlerDrainTimeout).
+func (p PublishReceived) Context() context.Context {
+	if p.ctx == nil {
+		return context.Background()
+	}
+	return p.ctx
+}
+
+// SetAckReason sets the Reason Code, and Reason String (may be empty), to be included in the PUBACK or PUBREC sent
+// once all handlers have returned. A reason code of 0x80 or greater (e.g. packets.PubackPayloadFormatInvalid)
+// informs the server that the message could not be processed; no further handling of the message will be attempted.
+// If no handler calls SetAckReason, the message is acknowledged with success (if more than one does, the last call
+// wins). Has no effect for QoS 0 messages, when EnableManualAcknowledgment is set, or if the session does not
+// implement session.ReasonAcker.
+func (p PublishReceived) SetAckReason(reasonCode byte, reasonString string) {
+	if p.ack != nil {
+		p.ack.reasonCode = reasonCode
+		p.ack.reasonString = reasonString
+	}
+}
+
 // ack acknowledges a message (note: called by acksTracker to ensure these are sent in order)
 func (c *Client) ack(pb *packets.Publish) {
-	c.config.Session.Ack(pb)
+	c.ackWithReason(pb, ackReason{})
+}
+
+// ackWithReason acknowledges a message using the reason code and string in r (these are ignored if the session does
+// not implement session.ReasonAcker)
+func (c *Client) ackWithReason(pb *packets.Publish, r ackReason) {
+	c.acksMu.RLock()
+	defer c.acksMu.RUnlock()
+	if c.acksDetached {
+		c.errors.Printf("not acknowledging %d: connection has been shut down (the server will redeliver it)", pb.PacketID)
+		return
+	}
+	ra, reasonSupported := c.config.Session.(session.ReasonAcker)
+	if (r.reasonCode != 0 || r.reasonString != "") && !reasonSupported {
+		c.errors.Printf("session does not support acknowledgement reason codes; acknowledging %d with success", pb.PacketID)
+		r = ackReason{}
+	}
+	// QOS2 messages remain outstanding until the PUBCOMP is sent (unless the PUBREC indicated failure). This is
+	// released before the acknowledgement is sent, as the server may send another message as soon as it is received.
+	if pb.QoS == 1 || r.reasonCode >= 0x80 {
+		c.inboundFlow.release(pb.PacketID)
+	}
+	if r.reasonCode != 0 || r.reasonString != "" {
+		ra.AckWithReason(pb, r.reasonCode, r.reasonString)
+	} else {
+		c.config.Session.Ack(pb)
+	}
 }
 
 // routePublishPackets listens on c.publishPackets and passes received messages to the handlers
 // terminates when publishPackets closed
 func (c *Client) routePublishPackets() {
+	var reuse *Publish // used for every message if ReusePublish is set
+	if c.config.ReusePublish && c.messages == nil {
+		reuse = &Publish{}
+	}
 	for pb := range c.publishPackets {
+		if c.config.HandlerDrainTimeout > 0 {
+			select {
+			case <-c.stopping: // Shutting down; the message will not be handled (or acknowledged)
+				if sp, ok := pb.PayloadReader.(*streamedPayload); ok {
+					sp.discard()
+				}
+				continue
+			default:
+			}
+		}
+
 		// Copy onPublishReceived so lock is only held briefly
 		c.onPublishReceivedMu.Lock()
 		handlers := make([]func(PublishReceived) (bool, error), len(c.onPublishReceived))
@@ -454,22 +814,60 @@ func (c *Client) routePublishPackets() {
 
 		var handled bool
 		var errs []error
-		pkt := PublishFromPacketPublish(pb)
+		var ar ackReason
+		var pkt *Publish
+		if reuse != nil {
+			pkt = PublishFromPacketPublishInto(reuse, pb)
+		} else {
+			pkt = PublishFromPacketPublish(pb)
+		}
+		if c.config.PayloadCodec != nil {
+			c.decodePayload(pkt)
+		}
+		c.config.Observer.OnMessageReceived(pb.QoS)
+		handlerCtx := c.clientCtx
+		if sp, ok := pb.PayloadReader.(*streamedPayload); ok {
+			handlerCtx = context.WithValue(handlerCtx, streamedPayloadKey{}, sp) // enables streamNotDrained to detect deadlocks
+		}
+		c.handling.Store(pkt)
 		for _, h := range handlers {
 			ha, err := h(PublishReceived{
 				Packet:         pkt,
 				Client:         c,
 				AlreadyHandled: handled,
 				Errs:           errs,
+				ack:            &ar,
+				ctx:            handlerCtx,
 			})
 			if ha {
 				handled = true
 			}
 			errs = append(errs, err)
 		}
+		c.handling.Store(nil)
+
+		if c.messages != nil {
+			select {
+			case c.messages <- pkt: // blocks until the application makes room
+			case <-c.stopping:
+				continue // Not delivered, so must not be acknowledged (the server will redeliver QoS1+ messages)
+			}
+		}
+
+		if sp, ok := pb.PayloadReader.(*streamedPayload); ok {
+			sp.discard() // Ensure the payload is consumed (so the next packet can be read) before the message is acknowledged
+			if sp.err != nil {
+				continue // The connection has failed, so the message cannot be acknowledged
+			}
+		}
 
 		if !c.config.EnableManualAcknowledgment {
-			c.ack(pb)
+			select {
+			case <-c.stopping: // The connection is being closed, so the acknowledgement cannot be sent (QoS1+ will be redelivered)
+				continue
+			default:
+			}
+			c.ackWithReason(pb, ar)
 		}
 	}
 }
@@ -484,16 +882,33 @@ func (c *Client) incoming(ctx context.Context) {
 	defer c.debug.Println("client stopping, incoming stopping")
 	defer close(c.publishPackets)
 
+	var r io.Reader = c.config.Conn
+	if c.config.ReadBufferSize > 0 {
+		r = bufio.NewReaderSize(c.config.Conn, c.config.ReadBufferSize)
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
-			recv, err := packets.ReadPacket(c.config.Conn)
+			timeout, err := c.setReadDeadline()
+			if err != nil {
+				go c.error(fmt.Errorf("failed to set read deadline: %w", err))
+				return
+			}
+			recv, err := packets.ReadPacketStreamed(r, c.config.StreamPayloadThreshold)
 			if err != nil {
+				var ne net.Error
+				if timeout > 0 && errors.As(err, &ne) && ne.Timeout() {
+					err = fmt.Errorf("%w (%s): %w", ErrReadTimeout, timeout, err)
+				}
 				go c.error(err)
 				return
 			}
+			if err := packets.ValidateUTF8(recv.Content, c.config.UTF8Validation); err != nil {
+				go c.error(fmt.Errorf("%w: received %s: %w", ErrProtocol, recv.PacketType(), err))
+				return
+			}
 			c.config.PingHandler.PacketReceived()
 			switch recv.Type {
 			case packets.CONNACK:
@@ -517,18 +932,54 @@ func (c *Client) incoming(ctx context.Context) {
 					}
 					c.authResponseMu.Unlock()
 				case packets.AuthContinueAuthentication:
-					if c.config.AuthHandler != nil {
-						if _, err := c.config.AuthHandler.Authenticate(AuthFromPacketAuth(ap)).Packet().WriteTo(c.config.Conn); err != nil {
-							go c.error(err)
-							return
-						}
-						c.config.PingHandler.PacketSent()
+					if c.config.AuthHandler == nil {
+						// The exchange cannot proceed (and the server will not accept other packets until it completes)
+						go c.error(fmt.Errorf("enhanced authentication flow started but no AuthHandler configured"))
+						return
+					}
+					if _, err := c.config.AuthHandler.Authenticate(AuthFromPacketAuth(ap)).Packet().WriteTo(c.config.Conn); err != nil {
+						go c.error(err)
+						return
 					}
+					c.config.PingHandler.PacketSent()
 				}
 			case packets.PUBLISH:
 				pb := recv.Content.(*packets.Publish)
+				var sp *streamedPayload
+				if pb.PayloadReader != nil {
+					// Handlers read the payload directly from the connection, so may take longer than ReadDeadline allows
+					if err := c.clearReadDeadline(); err != nil {
+						go c.error(fmt.Errorf("failed to clear read deadline: %w", err))
+						return
+					}
+					sp = newStreamedPayload(pb.PayloadReader)
+					pb.PayloadReader = sp
+				}
 				if pb.QoS > 0 { // QOS1 or 2 need to be recorded in session state
-					c.config.Session.PacketReceived(recv, c.publishPackets)
+					// Blocking here would prevent acknowledgements (and PINGRESP) being read, so a server that
+					// exceeds the Receive Maximum is treated as a protocol error (section 3.3.4 of the MQTT v5 spec)
+					if !c.inboundFlow.acquire(pb.PacketID) {
+						c.receiveMaximumExceeded()
+						return
+					}
+					if sp == nil {
+						c.config.Session.PacketReceived(recv, c.publishPackets)
+					} else {
+						// The session may not pass the message on (e.g. a duplicate), in which case the payload
+						// must be discarded (so it's passed via a buffered channel).
+						fwd := make(chan *packets.Publish, 1)
+						c.config.Session.PacketReceived(recv, fwd)
+						select {
+						case p := <-fwd:
+							select {
+							case <-ctx.Done():
+								return
+							case c.publishPackets <- p:
+							}
+						default:
+							sp.discard()
+						}
+					}
 				} else {
 					c.debug.Printf("received QoS%d PUBLISH", pb.QoS)
 					select {
@@ -537,8 +988,22 @@ func (c *Client) incoming(ctx context.Context) {
 					case c.publishPackets <- pb:
 					}
 				}
+				if sp != nil { // The payload is read directly from the connection, so must be consumed before continuing
+					select {
+					case <-ctx.Done():
+						return
+					case <-sp.done:
+					}
+					if sp.err != nil {
+						go c.error(fmt.Errorf("failed to read streamed payload: %w", sp.err))
+						return
+					}
+				}
 			case packets.PUBACK, packets.PUBCOMP, packets.SUBACK, packets.UNSUBACK, packets.PUBREC, packets.PUBREL:
 				c.config.Session.PacketReceived(recv, c.publishPackets)
+				if recv.Type == packets.PUBREL { // PUBCOMP has been sent (so QOS2 message is no longer outstanding)
+					c.inboundFlow.release(recv.PacketID())
+				}
 			case packets.DISCONNECT:
 				pd := recv.Content.(*packets.Disconnect)
 				c.debug.Println("received DISCONNECT")
@@ -589,8 +1054,32 @@ func (c *Client) shutdown(done chan<- struct{}) {
 		}
 	}
 	c.debug.Println("session updated, waiting on workers")
-	c.workers.Wait()
+	if c.config.HandlerDrainTimeout > 0 {
+		workersDone := make(chan struct{})
+		go func() {
+			c.workers.Wait()
+			close(workersDone)
+		}()
+		t := time.NewTimer(c.config.HandlerDrainTimeout)
+		select {
+		case <-workersDone:
+			t.Stop()
+		case <-t.C:
+			if p := c.handling.Load(); p != nil {
+				c.errors.Printf("handler for message on %s (packet id %d) did not complete within HandlerDrainTimeout (%s)", p.Topic, p.PacketID, c.config.HandlerDrainTimeout)
+			} else {
+				c.errors.Printf("workers did not complete within HandlerDrainTimeout (%s)", c.config.HandlerDrainTimeout)
+			}
+		}
+	} else {
+		c.workers.Wait()
+	}
 	c.debug.Println("workers done")
+	// Any handler still running must not acknowledge messages via the Session, which may be used by a new connection
+	// once done is closed (acknowledgements in progress complete first; they will fail as the connection is closed).
+	c.acksMu.Lock()
+	c.acksDetached = true
+	c.acksMu.Unlock()
 	close(done)
 }
 
@@ -604,24 +1093,121 @@ func (c *Client) error(e error) {
 	go c.config.OnClientError(e)
 }
 
+// receiveMaximumExceeded is called when the server sends a QOS1/2 PUBLISH that would exceed the Receive Maximum sent
+// in CONNECT; a DISCONNECT with reason code 0x93 (Receive Maximum exceeded) is sent and the connection closed.
+func (c *Client) receiveMaximumExceeded() {
+	d := &Disconnect{ReasonCode: packets.DisconnectReceiveMaximumExceeded}
+	if _, err := d.Packet().WriteTo(c.config.Conn); err != nil {
+		c.debug.Println("failed to send DISCONNECT (Receive Maximum exceeded):", err)
+	}
+	go c.error(fmt.Errorf("%w: server exceeded Receive Maximum of %d", ErrProtocol, c.inboundFlow.max))
+}
+
 func (c *Client) serverDisconnect(d *Disconnect) {
 	c.close()
 	c.debug.Println("calling OnServerDisconnect")
 	go c.config.OnServerDisconnect(d)
 }
 
+// validateBuiltConnect checks that ClientConfig.BuildConnect has not altered ccp (built from cp) in a way that would
+// result in a malformed CONNECT, or break the association between the session and the client identifier.
+func validateBuiltConnect(cp *Connect, ccp *packets.Connect) error {
+	switch {
+	case ccp.ProtocolName != "MQTT" || ccp.ProtocolVersion != 5:
+		return fmt.Errorf("%w: BuildConnect must not change the protocol name or version", ErrInvalidArguments)
+	case cp.ClientID != "" && ccp.ClientID == "":
+		return fmt.Errorf("%w: BuildConnect must not clear the client identifier (the session is associated with it)", ErrInvalidArguments)
+	case ccp.WillFlag && ccp.WillTopic == "":
+		return fmt.Errorf("%w: BuildConnect set WillFlag without a WillTopic", ErrInvalidArguments)
+	case !ccp.PasswordFlag && len(ccp.Password) > 0:
+		return fmt.Errorf("%w: BuildConnect set Password without PasswordFlag", ErrInvalidArguments)
+	case !ccp.UsernameFlag && ccp.Username != "":
+		return fmt.Errorf("%w: BuildConnect set Username without UsernameFlag", ErrInvalidArguments)
+	}
+	return nil
+}
+
+// errAuthInProgress is returned by Authenticate if an authentication exchange is already in progress
+var errAuthInProgress = errors.New("previous authentication is still in progress")
+
+// reauthenticate initiates re-authentication every ReauthInterval until ctx is cancelled (see ClientConfig.ReauthInterval)
+func (c *Client) reauthenticate(ctx context.Context) {
+	t := time.NewTicker(c.config.ReauthInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		a, err := c.config.AuthHandler.(Reauther).Reauthenticate(ctx)
+		if err != nil {
+			c.errors.Printf("failed to obtain re-authentication data: %s", err)
+			continue
+		}
+		if a == nil {
+			continue
+		}
+		a.ReasonCode = packets.AuthReauthenticate
+		authCtx, cancel := context.WithTimeout(ctx, c.config.PacketTimeout)
+		ar, err := c.Authenticate(authCtx, a)
+		cancel()
+		switch {
+		case errors.Is(err, errAuthInProgress):
+			c.debug.Println("re-authentication skipped as an exchange is already in progress")
+		case err != nil:
+			if ctx.Err() != nil {
+				return // shutting down
+			}
+			go c.error(fmt.Errorf("re-authentication failed: %w", err))
+			return
+		case ar.Success:
+			c.debug.Println("re-authentication succeeded")
+		default:
+			c.debug.Printf("re-authentication rejected (reason code %#x)", ar.ReasonCode)
+			return // the server has disconnected
+		}
+	}
+}
+
 // Authenticate is used to initiate a reauthentication of credentials with the
 // server. This function sends the initial Auth packet to start the reauthentication
 // then relies on the client AuthHandler managing any further requests from the
 // server until either a successful Auth packet is passed back, or a Disconnect
 // is received.
+// The Auth should have ReasonCode packets.AuthReauthenticate and the same AuthMethod
+// that was used in the CONNECT (if AuthMethod is empty, the one from the CONNECT is
+// sent). An error wrapping ErrInvalidArguments is returned if the AUTH could not be
+// valid (a reason code other than Continue/Re-authenticate, which a client may not
+// send, or no Authentication Method, in which case the spec does not permit
+// re-authentication). The returned AuthResponse contains the reason code, and
+// properties (including any AuthData and user properties), from the server's
+// terminating packet.
 func (c *Client) Authenticate(ctx context.Context, a *Auth) (*AuthResponse, error) {
+	if a == nil {
+		return nil, fmt.Errorf("%w: Auth must not be nil", ErrInvalidArguments)
+	}
+	if a.ReasonCode != packets.AuthReauthenticate && a.ReasonCode != packets.AuthContinueAuthentication {
+		return nil, fmt.Errorf("%w: a client cannot send AUTH with reason code %#x", ErrInvalidArguments, a.ReasonCode)
+	}
+	ap := a.Packet()
+	if ap.Properties == nil {
+		ap.Properties = &packets.Properties{}
+	}
+	if ap.Properties.AuthMethod == "" {
+		if ap.Properties.AuthMethod = c.authMethod; ap.Properties.AuthMethod == "" {
+			return nil, fmt.Errorf("%w: AuthMethod must be set (CONNECT had no Authentication Method)", ErrInvalidArguments)
+		}
+	}
+	if err := c.checkUTF8(ap); err != nil {
+		return nil, err
+	}
 	c.debug.Println("client initiated reauthentication")
 	authResp := make(chan packets.ControlPacket, 1)
 	c.authResponseMu.Lock()
 	if c.authResponse != nil {
 		c.authResponseMu.Unlock()
-		return nil, fmt.Errorf("previous authentication is still in progress")
+		return nil, errAuthInProgress
 	}
 	c.authResponse = authResp
 	c.authResponseMu.Unlock()
@@ -632,7 +1218,7 @@ func (c *Client) Authenticate(ctx context.Context, a *Auth) (*AuthResponse, erro
 	}()
 
 	c.debug.Println("sending AUTH")
-	if _, err := a.Packet().WriteTo(c.config.Conn); err != nil {
+	if _, err := ap.WriteTo(c.config.Conn); err != nil {
 		return nil, err
 	}
 	c.config.PingHandler.PacketSent()
@@ -642,7 +1228,7 @@ func (c *Client) Authenticate(ctx context.Context, a *Auth) (*AuthResponse, erro
 	case <-ctx.Done():
 		ctxErr := ctx.Err()
 		c.debug.Println(fmt.Sprintf("terminated due to context waiting for AUTH: %v", ctxErr))
-		return nil, ctxErr
+		return nil, contextError(ctxErr)
 	case rp = <-authResp:
 	}
 
@@ -655,14 +1241,20 @@ func (c *Client) Authenticate(ctx context.Context, a *Auth) (*AuthResponse, erro
 		return AuthResponseFromPacketDisconnect(rp.Content.(*packets.Disconnect)), nil
 	}
 
-	return nil, fmt.Errorf("error with Auth, didn't receive Auth or Disconnect")
+	return nil, fmt.Errorf("%w: error with Auth, didn't receive Auth or Disconnect", ErrProtocol)
 }
 
 // Subscribe is used to send a Subscription request to the MQTT server.
 // It is passed a pre-prepared Subscribe packet and blocks waiting for
 // a response Suback, or for the timeout to fire. Any response Suback
 // is returned from the function, along with any errors.
+// Suback.Results pairs each requested topic filter with its reason code
+// (in the order requested); if any subscription is rejected a
+// *SubscribeError is returned (Results.Failed lists the rejected filters).
 func (c *Client) Subscribe(ctx context.Context, s *Subscribe) (*Suback, error) {
+	if err := streamNotDrained(ctx); err != nil {
+		return nil, err
+	}
 	if !c.serverProps.WildcardSubAvailable {
 		for _, sub := range s.Subscriptions {
 			if strings.ContainsAny(sub.Topic, "#+") {
@@ -684,16 +1276,21 @@ func (c *Client) Subscribe(ctx context.Context, s *Subscribe) (*Suback, error) {
 
 	c.debug.Printf("subscribing to %+v", s.Subscriptions)
 
+	start := time.Now()
 	ret := make(chan packets.ControlPacket, 1)
 	sp := s.Packet()
-	if err := c.config.Session.AddToSession(ctx, sp, ret); err != nil {
+	if err := c.checkUTF8(sp); err != nil {
 		return nil, err
 	}
+	if err := c.config.Session.AddToSession(ctx, sp, ret); err != nil {
+		return nil, sessionError(err)
+	}
 
 	// From this point on the message is in store, and ret will receive something regardless of whether we succeed in
 	// writing the packet to the connection or not.
 	if _, err := sp.WriteTo(c.config.Conn); err != nil {
 		// The packet will remain in the session state until `Session` is notified of the disconnection.
+		c.abandonRequest(sp.PacketID)
 		return nil, err
 	}
 	c.config.PingHandler.PacketSent()
@@ -707,7 +1304,8 @@ func (c *Client) Subscribe(ctx context.Context, s *Subscribe) (*Suback, error) {
 	case <-subCtx.Done():
 		ctxErr := subCtx.Err()
 		c.debug.Println(fmt.Sprintf("terminated due to context waiting for SUBACK: %v", ctxErr))
-		return nil, ctxErr
+		c.abandonRequest(sp.PacketID)
+		return nil, contextError(ctxErr)
 	case sap = <-ret:
 	}
 
@@ -716,27 +1314,22 @@ func (c *Client) Subscribe(ctx context.Context, s *Subscribe) (*Suback, error) {
 	}
 
 	if sap.Type != packets.SUBACK {
-		return nil, fmt.Errorf("received %d instead of Suback", sap.Type)
+		return nil, fmt.Errorf("%w: received %d instead of Suback", ErrProtocol, sap.Type)
 	}
 	c.debug.Println("received SUBACK")
+	c.config.Observer.OnSubscribeAcked(time.Since(start))
 
 	sa := SubackFromPacketSuback(sap.Content.(*packets.Suback))
-	switch {
-	case len(sa.Reasons) == 1:
-		if sa.Reasons[0] >= 0x80 {
-			var reason string
-			c.debug.Println("received an error code in Suback:", sa.Reasons[0])
+	sa.Results = subscribeResults(s, sa)
+	for _, code := range sa.Reasons {
+		if code >= 0x80 {
+			c.debug.Println("received an error code in Suback:", code)
+			se := &SubscribeError{Reasons: sa.Reasons, Results: sa.Results}
 			if sa.Properties != nil {
-				reason = sa.Properties.ReasonString
-			}
-			return sa, fmt.Errorf("failed to subscribe to topic: %s", reason)
-		}
-	default:
-		for _, code := range sa.Reasons {
-			if code >= 0x80 {
-				c.debug.Println("received an error code in Suback:", code)
-				return sa, fmt.Errorf("at least one requested subscription failed")
+				se.ReasonString = sa.Properties.ReasonString
+				se.User = sa.Properties.User
 			}
+			return sa, se
 		}
 	}
 
@@ -748,17 +1341,24 @@ func (c *Client) Subscribe(ctx context.Context, s *Subscribe) (*Suback, error) {
 // a response Unsuback, or for the timeout to fire. Any response Unsuback
 // is returned from the function, along with any errors.
 func (c *Client) Unsubscribe(ctx context.Context, u *Unsubscribe) (*Unsuback, error) {
+	if err := streamNotDrained(ctx); err != nil {
+		return nil, err
+	}
 	c.debug.Printf("unsubscribing from %+v", u.Topics)
 	ret := make(chan packets.ControlPacket, 1)
 	up := u.Packet()
-	if err := c.config.Session.AddToSession(ctx, up, ret); err != nil {
+	if err := c.checkUTF8(up); err != nil {
 		return nil, err
 	}
+	if err := c.config.Session.AddToSession(ctx, up, ret); err != nil {
+		return nil, sessionError(err)
+	}
 
 	// From this point on the message is in store, and ret will receive something regardless of whether we succeed in
 	// writing the packet to the connection or not
 	if _, err := up.WriteTo(c.config.Conn); err != nil {
 		// The packet will remain in the session state until `Session` is notified of the disconnection.
+		c.abandonRequest(up.PacketID)
 		return nil, err
 	}
 	c.config.PingHandler.PacketSent()
@@ -772,7 +1372,8 @@ func (c *Client) Unsubscribe(ctx context.Context, u *Unsubscribe) (*Unsuback, er
 	case <-unsubCtx.Done():
 		ctxErr := unsubCtx.Err()
 		c.debug.Println(fmt.Sprintf("terminated due to context waiting for UNSUBACK: %v", ctxErr))
-		return nil, ctxErr
+		c.abandonRequest(up.PacketID)
+		return nil, contextError(ctxErr)
 	case uap = <-ret:
 	}
 
@@ -781,7 +1382,7 @@ func (c *Client) Unsubscribe(ctx context.Context, u *Unsubscribe) (*Unsuback, er
 	}
 
 	if uap.Type != packets.UNSUBACK {
-		return nil, fmt.Errorf("received %d instead of Unsuback", uap.Type)
+		return nil, fmt.Errorf("%w: received %d instead of Unsuback", ErrProtocol, uap.Type)
 	}
 	c.debug.Println("received SUBACK")
 
@@ -794,13 +1395,17 @@ func (c *Client) Unsubscribe(ctx context.Context, u *Unsubscribe) (*Unsuback, er
 			if ua.Properties != nil {
 				reason = ua.Properties.ReasonString
 			}
-			return ua, fmt.Errorf("failed to unsubscribe from topic: %s", reason)
+			return ua, fmt.Errorf("failed to unsubscribe from topic: %w", &ReasonCodeError{PacketType: packets.UNSUBACK, ReasonCode: ua.Reasons[0], ReasonString: reason})
 		}
 	default:
 		for _, code := range ua.Reasons {
 			if code >= 0x80 {
-				c.debug.Println("received an error code in Suback:", code)
-				return ua, fmt.Errorf("at least one requested unsubscribe failed")
+				c.debug.Println("received an error code in Unsuback:", code)
+				rce := &ReasonCodeError{PacketType: packets.UNSUBACK, ReasonCode: code}
+				if ua.Properties != nil {
+					rce.ReasonString = ua.Properties.ReasonString
+				}
+				return ua, fmt.Errorf("at least one requested unsubscribe failed: %w", rce)
 			}
 		}
 	}
@@ -808,6 +1413,49 @@ func (c *Client) Unsubscribe(ctx context.Context, u *Unsubscribe) (*Unsuback, er
 	return ua, nil
 }
 
+// SubscribeWithHandler subscribes to a single topic filter and registers h with the Router for that filter, keeping
+// the subscription and the local dispatch of messages aligned. The handler is registered before the SUBSCRIBE is sent
+// (so retained messages that the server sends immediately after the SUBACK are not missed) and, if the subscription is
+// not accepted, removed again (via UnregisterHandler, so any other handlers registered for the same filter are also
+// removed); in that case the error will be a *SubscribeError holding the reason code.
+// An error wrapping ErrInvalidArguments is returned if the client has no Router.
+func (c *Client) SubscribeWithHandler(ctx context.Context, o SubscribeOptions, h MessageHandler) (*Suback, error) {
+	if h == nil {
+		return nil, fmt.Errorf("%w: handler must not be nil", ErrInvalidArguments)
+	}
+	c.routerMu.RLock()
+	r := c.router
+	c.routerMu.RUnlock()
+	if r == nil {
+		return nil, fmt.Errorf("%w: no router to register handler with", ErrInvalidArguments)
+	}
+
+	r.RegisterHandler(o.Topic, h)
+	sa, err := c.Subscribe(ctx, &Subscribe{Subscriptions: []SubscribeOptions{o}})
+	if err != nil {
+		r.UnregisterHandler(o.Topic)
+	}
+	return sa, err
+}
+
+// UnsubscribeWithHandler unsubscribes from a single topic filter and, once the server has accepted the request,
+// unregisters the handlers for that filter from the Router (if the request fails, the handlers remain registered
+// because the subscription may still be active).
+func (c *Client) UnsubscribeWithHandler(ctx context.Context, topic string) (*Unsuback, error) {
+	c.routerMu.RLock()
+	r := c.router
+	c.routerMu.RUnlock()
+	if r == nil {
+		return nil, fmt.Errorf("%w: no router to unregister handler from", ErrInvalidArguments)
+	}
+
+	ua, err := c.Unsubscribe(ctx, &Unsubscribe{Topics: []string{topic}})
+	if err == nil {
+		r.UnregisterHandler(topic)
+	}
+	return ua, err
+}
+
 // Publish is used to send a publication to the MQTT server.
 // It is passed a pre-prepared Publish packet and blocks waiting for the appropriate response, or for the timeout to fire.
 // A PublishResponse is returned, which is relevant for QOS1+. For QOS0, a default success response is returned.
@@ -823,6 +1471,10 @@ type PublishMethod int
 const (
 	PublishMethod_Blocking  PublishMethod = iota // by default PublishWithOptions will block until the publish transaction is complete
 	PublishMethod_AsyncSend                      // PublishWithOptions will add the message to the session and then return (no method to check status is provided)
+	// PublishMethod_Blocking_NoQueue blocks until the publish transaction is complete, but the message is not written
+	// to the session store. If the connection is lost before the transaction completes, the message is dropped (it will
+	// not be retransmitted) and ErrConnectionLost returned. Requires a Session that implements session.NoStoreAdder.
+	PublishMethod_Blocking_NoQueue
 )
 
 // PublishOptions enables the behaviour of Publish to be modified
@@ -834,12 +1486,15 @@ type PublishOptions struct {
 // PublishWithOptions is used to send a publication to the MQTT server (with options to customise its behaviour)
 // It is passed a pre-prepared Publish packet and, by default, blocks waiting for the appropriate response, or for the
 // timeout to fire. A PublishResponse is returned, which is relevant for QOS1+. For QOS0, a default success response is returned.
+// QOS0 messages are fire-and-forget; they bypass the session (no packet identifier, quota or storage) and
+// PublishWithOptions returns as soon as the packet has been written to the connection (the server does not
+// acknowledge QOS0 messages, so there is no confirmation that the message was received). Options are ignored for QOS0.
 // Note that a message may still be delivered even if Publish times out (once the message is part of the session state,
 // it may even be delivered following an application restart).
 // Warning: Publish may outlive the connection when QOS1+ (managed in `session_state`)
 func (c *Client) PublishWithOptions(ctx context.Context, p *Publish, o PublishOptions) (*PublishResponse, error) {
 	if p.QoS > c.serverProps.MaximumQoS {
-		return nil, fmt.Errorf("%w: cannot send Publish with QoS %d, server maximum QoS is %d", ErrInvalidArguments, p.QoS, c.serverProps.MaximumQoS)
+		return nil, fmt.Errorf("%w: %w: cannot send Publish with QoS %d, server maximum QoS is %d", ErrInvalidArguments, ErrQoSNotSupported, p.QoS, c.serverProps.MaximumQoS)
 	}
 	if p.Properties != nil && p.Properties.TopicAlias != nil {
 		if c.serverProps.TopicAliasMaximum > 0 && *p.Properties.TopicAlias > c.serverProps.TopicAliasMaximum {
@@ -847,10 +1502,21 @@ func (c *Client) PublishWithOptions(ctx context.Context, p *Publish, o PublishOp
 		}
 	}
 	if !c.serverProps.RetainAvailable && p.Retain {
-		return nil, fmt.Errorf("%w: cannot send Publish with retain flag set, server does not support retained messages", ErrInvalidArguments)
+		return nil, fmt.Errorf("%w: %w: cannot send Publish with retain flag set", ErrInvalidArguments, ErrRetainNotSupported)
 	}
 	if (p.Properties == nil || p.Properties.TopicAlias == nil) && p.Topic == "" {
-		return nil, fmt.Errorf("%w: cannot send a publish with no TopicAlias and no Topic set", ErrInvalidArguments)
+		return nil, fmt.Errorf("%w: %w: cannot send a publish with no TopicAlias and no Topic set", ErrInvalidArguments, ErrInvalidTopic)
+	}
+	if p.Topic != "" {
+		if err := ValidatePublishTopic(p.Topic); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidArguments, err)
+		}
+	}
+
+	if c.config.PublishRateLimiter != nil {
+		if err := c.config.PublishRateLimiter.Wait(ctx); err != nil {
+			return nil, fmt.Errorf("publish rate limiter: %w", err)
+		}
 	}
 
 	if c.config.PublishHook != nil {
@@ -860,15 +1526,24 @@ func (c *Client) PublishWithOptions(ctx context.Context, p *Publish, o PublishOp
 	c.debug.Printf("sending message to %s", p.Topic)
 
 	pb := p.Packet()
+	if err := c.checkUTF8(pb); err != nil {
+		return nil, err
+	}
+	if c.config.PayloadCodec != nil {
+		if err := c.encodePayload(pb); err != nil {
+			return nil, err
+		}
+	}
 
 	switch p.QoS {
 	case 0:
 		c.debug.Println("sending QoS0 message")
-		if _, err := pb.WriteTo(c.config.Conn); err != nil {
+		if _, err := c.writePublish(pb); err != nil {
 			go c.error(err)
-			return nil, err
+			return nil, fmt.Errorf("%w: %w", ErrDisconnected, err)
 		}
 		c.config.PingHandler.PacketSent()
+		c.config.Observer.OnPublishSent(0)
 		return &PublishResponse{}, nil
 	case 1, 2:
 		return c.publishQoS12(ctx, pb, o)
@@ -877,23 +1552,47 @@ func (c *Client) PublishWithOptions(ctx context.Context, p *Publish, o PublishOp
 	return nil, fmt.Errorf("%w: QoS isn't 0, 1 or 2", ErrInvalidArguments)
 }
 
+// writePublish writes a PUBLISH packet to the connection (substituting a topic alias if enabled)
+func (c *Client) writePublish(pb *packets.Publish) (int64, error) {
+	if c.topicAliases != nil {
+		return c.topicAliases.writePublish(pb, c.config.Conn)
+	}
+	return pb.WriteTo(c.config.Conn)
+}
+
 func (c *Client) publishQoS12(ctx context.Context, pb *packets.Publish, o PublishOptions) (*PublishResponse, error) {
+	if err := streamNotDrained(ctx); err != nil {
+		return nil, err
+	}
 	c.debug.Println("sending QoS12 message")
+	start := time.Now()
 	pubCtx, cf := context.WithTimeout(ctx, c.config.PacketTimeout)
 	defer cf()
 
+	addToSession := c.config.Session.AddToSession
+	if o.Method == PublishMethod_Blocking_NoQueue {
+		ns, ok := c.config.Session.(session.NoStoreAdder)
+		if !ok {
+			return nil, fmt.Errorf("%w: session does not support PublishMethod_Blocking_NoQueue", ErrInvalidArguments)
+		}
+		addToSession = ns.AddToSessionNoStore
+	}
+
 	ret := make(chan packets.ControlPacket, 1)
-	if err := c.config.Session.AddToSession(pubCtx, pb, ret); err != nil {
-		return nil, err
+	if err := addToSession(pubCtx, pb, ret); err != nil {
+		return nil, sessionError(err)
 	}
+	c.takeCancelled(pb.PacketID) // Clear any record relating to a previous use of this identifier (e.g. PublishMethod_AsyncSend)
 
 	// From this point on the message is in store, and ret will receive something regardless of whether we succeed in
 	// writing the packet to the connection
-	if _, err := pb.WriteTo(c.config.Conn); err != nil {
+	if _, err := c.writePublish(pb); err != nil {
 		c.debug.Printf("failed to write packet %d to connection: %s", pb.PacketID, err)
 		if o.Method == PublishMethod_AsyncSend {
 			return nil, ErrNetworkErrorAfterStored // Async send, so we don't wait for the response (may add callbacks in the future to enable user to obtain status)
 		}
+	} else {
+		c.config.Observer.OnPublishSent(pb.QoS)
 	}
 	c.config.PingHandler.PacketSent()
 
@@ -901,42 +1600,74 @@ func (c *Client) publishQoS12(ctx context.Context, pb *packets.Publish, o Publis
 		return nil, nil // Async send, so we don't wait for the response (may add callbacks in the future to enable user to obtain status)
 	}
 
+	var ackTimeout <-chan time.Time // nil (blocks forever) if no AckTimeout
+	if c.config.AckTimeout > 0 {
+		t := time.NewTimer(c.config.AckTimeout)
+		defer t.Stop()
+		ackTimeout = t.C
+	}
+
 	var resp packets.ControlPacket
 	select {
 	case <-pubCtx.Done():
 		ctxErr := pubCtx.Err()
 		c.debug.Println(fmt.Sprintf("terminated due to context waiting for Publish ack: %v", ctxErr))
-		return nil, ctxErr
+		if o.Method == PublishMethod_Blocking_NoQueue {
+			// The message is not stored, so would only be retransmitted on this connection; as nobody is waiting for
+			// the outcome, the transaction is cancelled (otherwise it remains in the session and will be delivered).
+			if err := c.CancelPublish(pb.PacketID); err == nil {
+				c.takeCancelled(pb.PacketID) // nobody is waiting on ret
+			}
+		}
+		return nil, contextError(ctxErr)
+	case <-ackTimeout:
+		c.errors.Printf("PUBLISH %d not acknowledged within %s", pb.PacketID, c.config.AckTimeout)
+		if c.config.DisconnectOnAckTimeout {
+			c.error(fmt.Errorf("%w: PUBLISH %d", ErrAckTimeout, pb.PacketID))
+		}
+		return nil, ErrAckTimeout
 	case resp = <-ret:
 	}
 
-	if resp.Type == 0 { // default ControlPacket indicates we are shutting down
-		return nil, errors.New("PUBLISH transmitted but not fully acknowledged at time of shutdown")
+	if resp.Type == 0 { // default ControlPacket indicates we are shutting down (or the message has been dropped)
+		if c.takeCancelled(pb.PacketID) {
+			return nil, ErrPublishCancelled
+		}
+		if o.Method == PublishMethod_Blocking_NoQueue {
+			return nil, ErrConnectionLost
+		}
+		return nil, errShutdown
 	}
 
 	switch pb.QoS {
 	case 1:
 		if resp.Type != packets.PUBACK {
-			return nil, fmt.Errorf("received %d instead of PUBACK", resp.Type)
+			return nil, fmt.Errorf("%w: received %d instead of PUBACK", ErrProtocol, resp.Type)
 		}
 
 		pr := PublishResponseFromPuback(resp.Content.(*packets.Puback))
+		c.config.Observer.OnPublishAcked(pb.QoS, pr.ReasonCode, time.Since(start))
 		if pr.ReasonCode >= 0x80 {
 			c.debug.Println("received an error code in Puback:", pr.ReasonCode)
-			return pr, fmt.Errorf("error publishing: %s", resp.Content.(*packets.Puback).Reason())
+			return pr, publishErrorFromResponse(pr, packets.PUBACK, resp.Content.(*packets.Puback).Reason())
 		}
 		return pr, nil
 	case 2:
 		switch resp.Type {
 		case packets.PUBCOMP:
 			pr := PublishResponseFromPubcomp(resp.Content.(*packets.Pubcomp))
+			c.config.Observer.OnPublishAcked(pb.QoS, pr.ReasonCode, time.Since(start))
 			return pr, nil
 		case packets.PUBREC:
-			c.debug.Printf("received PUBREC for %s (must have errored)", pb.PacketID)
+			c.debug.Printf("received PUBREC for %d (must have errored)", pb.PacketID)
 			pr := PublishResponseFromPubrec(resp.Content.(*packets.Pubrec))
+			c.config.Observer.OnPublishAcked(pb.QoS, pr.ReasonCode, time.Since(start))
+			if pr.ReasonCode >= 0x80 {
+				return pr, publishErrorFromResponse(pr, packets.PUBREC, resp.Content.(*packets.Pubrec).Reason())
+			}
 			return pr, nil
 		default:
-			return nil, fmt.Errorf("received %d instead of PUBCOMP", resp.Type)
+			return nil, fmt.Errorf("%w: received %d instead of PUBCOMP", ErrProtocol, resp.Type)
 		}
 	}
 
@@ -950,10 +1681,14 @@ func (c *Client) expectConnack(packet chan<- *packets.Connack, errs chan<- error
 		errs <- err
 		return
 	}
+	if err := packets.ValidateUTF8(recv.Content, c.config.UTF8Validation); err != nil {
+		errs <- fmt.Errorf("%w: received %s: %w", ErrProtocol, recv.PacketType(), err)
+		return
+	}
 	switch r := recv.Content.(type) {
 	case *packets.Connack:
 		c.debug.Println("received CONNACK")
-		if r.ReasonCode == packets.ConnackSuccess && r.Properties != nil && r.Properties.AuthMethod != "" {
+		if r.ReasonCode == packets.ConnackSuccess && r.Properties != nil && r.Properties.AuthMethod != "" && c.config.AuthHandler != nil {
 			// Successful connack and AuthMethod is defined, must have successfully authed during connect
 			go c.config.AuthHandler.Authenticated()
 		}
@@ -973,7 +1708,7 @@ func (c *Client) expectConnack(packet chan<- *packets.Connack, errs chan<- error
 		// go round again, either another AUTH or CONNACK
 		go c.expectConnack(packet, errs)
 	default:
-		errs <- fmt.Errorf("received unexpected packet %v", recv.Type)
+		errs <- fmt.Errorf("%w: received unexpected packet %v", ErrProtocol, recv.Type)
 	}
 
 }
@@ -991,6 +1726,106 @@ func (c *Client) Disconnect(d *Disconnect) error {
 	return err
 }
 
+// DisconnectWithOptions sends d to the server and closes the network connection (as per Disconnect), after checking
+// that d is valid for a client to send; this enables, for example, the reason code 0x04 (Disconnect with Will Message)
+// to be used to trigger publication of the Will, or the Session Expiry Interval to be changed.
+// An error wrapping ErrInvalidArguments is returned (and the connection is left open) if:
+//   - the reason code is not one a client may send (see section 3.14.2.1 of the MQTT v5 specification),
+//   - a Server Reference is set (this may only be sent by the server), or
+//   - a non-zero Session Expiry Interval is set, but CONNECT had a zero (or no) Session Expiry Interval.
+//
+// If ctx has a deadline, it limits the time spent writing the DISCONNECT.
+func (c *Client) DisconnectWithOptions(ctx context.Context, d *Disconnect) error {
+	if d == nil {
+		return fmt.Errorf("%w: disconnect must not be nil", ErrInvalidArguments)
+	}
+	if !clientDisconnectReason(d.ReasonCode) {
+		return fmt.Errorf("%w: reason code %#02x may not be sent by a client", ErrInvalidArguments, d.ReasonCode)
+	}
+	if d.Properties != nil {
+		if d.Properties.ServerReference != "" {
+			return fmt.Errorf("%w: server reference may not be sent by a client", ErrInvalidArguments)
+		}
+		if c.noSessionExpiry && d.Properties.SessionExpiryInterval != nil && *d.Properties.SessionExpiryInterval != 0 {
+			return fmt.Errorf("%w: session expiry interval cannot be set in DISCONNECT when it was zero in CONNECT", ErrInvalidArguments)
+		}
+	}
+	if err := c.checkUTF8(d.Packet()); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		c.close()
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.config.Conn.SetWriteDeadline(deadline) // connection will be closed, so no need to reset
+	}
+	return c.Disconnect(d)
+}
+
+// checkUTF8 returns an error wrapping ErrInvalidArguments if p, which is about to be sent, contains a string that is
+// not permitted (see ClientConfig.UTF8Validation)
+func (c *Client) checkUTF8(p packets.Packet) error {
+	if err := packets.ValidateUTF8(p, c.config.UTF8Validation); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidArguments, err)
+	}
+	return nil
+}
+
+// routePublish is the OnPublishReceived callback that passes messages to the Router
+func (c *Client) routePublish(p PublishReceived) (bool, error) {
+	// The lock is not held whilst Route is called; handlers may call methods (e.g. SubscribeWithHandler) that take it
+	c.routerMu.RLock()
+	r, routing := c.router, c.routing
+	routing.Add(1)
+	c.routerMu.RUnlock()
+	defer routing.Done()
+
+	if cr, ok := r.(ContextRouter); ok {
+		cr.RouteContext(p.Context(), p.Packet.Packet())
+		return false, nil
+	}
+	r.Route(p.Packet.Packet())
+	return false, nil
+}
+
+// SetRouter replaces the Router that received messages are passed to (ClientConfig.Router); this may be called at
+// any time, including whilst connected. Messages received after SetRouter is called are passed to r; SetRouter then
+// waits until any in-progress calls to Route on the previous Router have returned (so it must not be called from
+// within a MessageHandler), but does not prevent other use of the Client in the meantime.
+// If the client was created without a Router, the callback passing messages to r is added to the end of the
+// OnPublishReceived callbacks.
+// The server will not resend the topic for an inbound topic alias already established on the connection, so, where
+// the previous Router and r both resolve aliases via a StandardRouter (including one wrapped by AsRouter or
+// AsContextRouter), r takes over the alias table of the previous Router (along with its limits; see
+// WithTopicAliasMaximum), and the previous Router is left with an empty table.
+func (c *Client) SetRouter(r Router) error {
+	if r == nil {
+		return fmt.Errorf("%w: router must not be nil", ErrInvalidArguments)
+	}
+	c.routerMu.Lock()
+	old, routing := c.router, c.routing
+	// The alias table is passed on before r is used, so the aliases are available to the first message routed to r
+	oldSR, newSR := standardRouterOf(old), standardRouterOf(r)
+	var aliases *inboundTopicAliases
+	if oldSR != nil && newSR != nil && oldSR != newSR {
+		aliases = oldSR.aliases.Load()
+		newSR.aliases.Store(aliases)
+	}
+	c.router, c.routing = r, &sync.WaitGroup{}
+	c.routerMu.Unlock()
+
+	if old == nil {
+		c.AddOnPublishReceived(c.routePublish)
+		return nil
+	}
+	routing.Wait()
+	if aliases != nil { // The previous Router is no longer in use, so the table need no longer be shared
+		oldSR.aliases.CompareAndSwap(aliases, newInboundTopicAliases(aliases.max, aliases.size))
+	}
+	return nil
+}
+
 // AddOnPublishReceived adds a function that will be called when a PUBLISH is received
 // The new function will be called after any functions already in the list
 // Returns a function that can be called to remove the callback
@@ -1031,25 +1866,138 @@ func (c *Client) ClientID() string {
 	return c.config.ClientID
 }
 
-// SetDebugLogger takes an instance of the paho Logger interface
-// and sets it to be used by the debug log endpoint
-func (c *Client) SetDebugLogger(l log.Logger) {
-	c.debug = l
-	if c.config.autoCloseSession { // If we created the session store then it should use the same logger
-		c.config.Session.SetDebugLogger(l)
+// AssignedClientID returns the client identifier assigned by the server in the CONNACK (empty if the server did not
+// assign one, or Connect has not succeeded). Where an identifier is assigned, ClientID will also return it.
+func (c *Client) AssignedClientID() string {
+	if cp := c.connackProps.Load(); cp != nil {
+		return cp.AssignedClientID
 	}
-	if c.config.defaultPinger { // Debug logger is set after the client is created so need to copy it to pinger
-		c.config.PingHandler.SetDebug(c.debug)
+	return ""
+}
+
+// ServerProperties returns the values negotiated with the server in the CONNACK (nil if Connect has not succeeded).
+// The returned value is a copy, so may be modified by the caller.
+func (c *Client) ServerProperties() *ServerConnackProperties {
+	cp := c.connackProps.Load()
+	if cp == nil {
+		return nil
+	}
+	r := *cp
+	return &r
+}
+
+// TopicAliasStats returns statistics on the use of outbound topic aliases on the connection (the zero value if
+// EnableTopicAliases is not set, the server does not permit aliases, or Connect has not succeeded).
+func (c *Client) TopicAliasStats() TopicAliasStats {
+	if c.topicAliases == nil {
+		return TopicAliasStats{}
+	}
+	return c.topicAliases.stats()
+}
+
+// SessionPresent returns the Session Present flag from the CONNACK; true if the server resumed an existing session (so
+// holds the subscriptions made previously), false if a new session was created or Connect has not succeeded.
+func (c *Client) SessionPresent() bool {
+	if cp := c.connackProps.Load(); cp != nil {
+		return cp.SessionPresent
+	}
+	return false
+}
+
+// InflightPublishes returns information on the QOS1/2 PUBLISH transactions that are in progress (nil if the Session
+// does not implement session.InflightManager).
+func (c *Client) InflightPublishes() []session.InflightInfo {
+	im, ok := c.config.Session.(session.InflightManager)
+	if !ok {
+		return nil
 	}
+	return im.InflightPublishInfo()
+}
+
+// CancelPublish abandons the QOS1/2 PUBLISH transaction with the specified packet identifier (see InflightPublishes);
+// the message will not be retransmitted, and a blocked call to Publish will return ErrPublishCancelled. Note that the
+// server may already have received the message. An error wrapping session.ErrNotInflight is returned if the
+// transaction is not in progress (e.g. the acknowledgement was processed first), or one wrapping ErrInvalidArguments
+// if the Session does not implement session.InflightManager.
+func (c *Client) CancelPublish(packetID uint16) error {
+	im, ok := c.config.Session.(session.InflightManager)
+	if !ok {
+		return fmt.Errorf("%w: session does not support CancelPublish", ErrInvalidArguments)
+	}
+	c.cancelledMu.Lock()
+	if c.cancelled == nil {
+		c.cancelled = make(map[uint16]struct{})
+	}
+	c.cancelled[packetID] = struct{}{} // Must be recorded before the requester is notified
+	c.cancelledMu.Unlock()
+	if err := im.CancelPublish(packetID); err != nil {
+		c.takeCancelled(packetID)
+		return fmt.Errorf("cannot cancel publish %d: %w", packetID, err)
+	}
+	return nil
+}
+
+// ResetLocalSession discards the session state held locally (in-flight QOS1/2 transactions in both directions,
+// including any in a persistent store); blocked calls to Publish will return an error. This is independent of the
+// Clean Start flag in the CONNECT (which determines whether the server discards its session state), so it enables
+// stale local state to be cleared whilst still asking the server to resume the session (or vice versa).
+//
+// The server's response (Session Present in the CONNACK) is authoritative:
+//   - Session Present false (always the case if Clean Start was set): any local state is discarded (so a reset is
+//     not required).
+//   - Session Present true: local state is retained, and outstanding PUBLISH/PUBREL packets retransmitted. If
+//     ResetLocalSession was called the server may still hold transactions the client has forgotten; it will resend
+//     unacknowledged messages (which will be processed as new messages) but messages the client published may have
+//     been delivered (or, for QOS2, identifiers reused before the server releases them), so combining a reset with
+//     Clean Start is recommended unless this is acceptable.
+//
+// It must be called whilst there is no connection (before Connect, or after the connection is lost); an error wrapping
+// session.ErrConnectionActive is returned otherwise. An error wrapping ErrInvalidArguments is returned if the Session
+// does not implement session.Resetter.
+func (c *Client) ResetLocalSession() error {
+	r, ok := c.config.Session.(session.Resetter)
+	if !ok {
+		return fmt.Errorf("%w: session does not support reset", ErrInvalidArguments)
+	}
+	if err := r.Reset(); err != nil {
+		return fmt.Errorf("cannot reset session: %w", err)
+	}
+	return nil
+}
+
+// abandonRequest notifies the session, if it implements session.RequestAbandoner, that nobody is waiting for the
+// response to the SUBSCRIBE or UNSUBSCRIBE with the specified packet identifier (so it is not held indefinitely).
+func (c *Client) abandonRequest(packetID uint16) {
+	ra, ok := c.config.Session.(session.RequestAbandoner)
+	if !ok {
+		return
+	}
+	if err := ra.AbandonRequest(packetID); err != nil && !errors.Is(err, session.ErrNotInflight) {
+		c.errors.Printf("failed to abandon request %d: %s", packetID, err)
+	}
+}
+
+// takeCancelled returns true if CancelPublish has been called for packetID (and clears the record)
+func (c *Client) takeCancelled(packetID uint16) bool {
+	c.cancelledMu.Lock()
+	defer c.cancelledMu.Unlock()
+	_, ok := c.cancelled[packetID]
+	delete(c.cancelled, packetID)
+	return ok
+}
+
+// SetDebugLogger takes an instance of the paho Logger interface
+// and sets it to be used by the debug log endpoint (this is also used by the Session and PingHandler if the client
+// created them). It may be called at any time, including whilst the client is connected.
+func (c *Client) SetDebugLogger(l log.Logger) {
+	c.debug.Set(l)
 }
 
 // SetErrorLogger takes an instance of the paho Logger interface
-// and sets it to be used by the error log endpoint
+// and sets it to be used by the error log endpoint (this is also used by the Session if the client created it). It
+// may be called at any time, including whilst the client is connected.
 func (c *Client) SetErrorLogger(l log.Logger) {
-	c.errors = l
-	if c.config.autoCloseSession { // If we created the session store then it should use the same logger
-		c.config.Session.SetErrorLogger(l)
-	}
+	c.errors.Set(l)
 }
 
 // TerminateConnectionForTest closes the active connection (if any). This function is intended for testing only, it
@@ -16,6 +16,7 @@
 package paho
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -23,13 +24,19 @@ import (
 	"log"
 	"net"
 	"os"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/synctest"
 	"time"
 
 	"github.com/eclipse/paho.golang/internal/basictestserver"
 	"github.com/eclipse/paho.golang/packets"
 	paholog "github.com/eclipse/paho.golang/paho/log"
+	"github.com/eclipse/paho.golang/paho/session"
+	"github.com/eclipse/paho.golang/paho/session/state"
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -71,6 +78,9 @@ func TestClientConnect(t *testing.T) {
 			MaximumQOS:        Byte(1),
 			ReceiveMaximum:    Uint16(12345),
 			TopicAliasMaximum: Uint16(200),
+			RetainAvailable:   Byte(0),
+			AssignedClientID:  "assigned",
+			ServerKeepAlive:   Uint16(20),
 		},
 	})
 	go ts.Run()
@@ -84,6 +94,7 @@ func TestClientConnect(t *testing.T) {
 	require.NotNil(t, c)
 	defer c.close()
 	c.SetDebugLogger(clientLogger)
+	assert.Nil(t, c.ServerProperties())
 
 	cp := &Connect{
 		KeepAlive:  30,
@@ -104,6 +115,230 @@ func TestClientConnect(t *testing.T) {
 	ca, err := c.Connect(context.Background(), cp)
 	require.Nil(t, err)
 	assert.Equal(t, uint8(0), ca.ReasonCode)
+
+	assert.Equal(t, &ServerConnackProperties{
+		CommsProperties: CommsProperties{
+			MaximumPacketSize:    12345,
+			ReceiveMaximum:       12345,
+			TopicAliasMaximum:    200,
+			MaximumQoS:           1,
+			RetainAvailable:      false,
+			WildcardSubAvailable: true,
+			SubIDAvailable:       true,
+			SharedSubAvailable:   true,
+		},
+		AssignedClientID: "assigned",
+		KeepAlive:        20,
+	}, c.ServerProperties())
+}
+
+// TestClientConnectAssignedClientID checks that a client identifier assigned by the server is made available
+// pingCountConn counts PINGREQ packets written to the connection
+type pingCountConn struct {
+	net.Conn
+	pings atomic.Int32
+}
+
+func (c *pingCountConn) Write(b []byte) (int, error) {
+	if len(b) > 0 && b[0] == packets.PINGREQ<<4 {
+		c.pings.Add(1)
+	}
+	return c.Conn.Write(b)
+}
+
+// TestClientServerKeepAlive checks that the Server Keep Alive in the CONNACK overrides the keep alive requested
+func TestClientServerKeepAlive(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+		ts.SetResponse(packets.CONNACK, &packets.Connack{
+			Properties: &packets.Properties{ServerKeepAlive: Uint16(2)},
+		})
+		go ts.Run()
+		defer ts.Stop()
+
+		conn := &pingCountConn{Conn: ts.ClientConn()}
+		c := NewClient(ClientConfig{Conn: conn})
+		require.NotNil(t, c)
+		_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", KeepAlive: 60})
+		require.NoError(t, err)
+		assert.Equal(t, uint16(2), c.ServerProperties().KeepAlive)
+
+		time.Sleep(time.Second) // The first PINGREQ is sent immediately
+		synctest.Wait()
+		require.Equal(t, int32(1), conn.pings.Load())
+		time.Sleep(6 * time.Second) // Then every 2 seconds (not every 60 seconds as requested)
+		synctest.Wait()
+		assert.Equal(t, int32(4), conn.pings.Load())
+		c.close()
+	})
+}
+
+// fakeReauther implements Reauther, counting the number of times Reauthenticate is called
+type fakeReauther struct {
+	calls atomic.Int32
+}
+
+func (f *fakeReauther) Authenticate(*Auth) *Auth { return &Auth{} }
+func (f *fakeReauther) Authenticated()           {}
+func (f *fakeReauther) Reauthenticate(context.Context) (*Auth, error) {
+	n := f.calls.Add(1)
+	return &Auth{Properties: &AuthProperties{AuthMethod: "TOKEN", AuthData: []byte(fmt.Sprintf("token%d", n))}}, nil
+}
+
+// TestClientReauthInterval checks that the client re-authenticates at ReauthInterval (with the AUTH counting as
+// activity, so no PINGREQ is needed) and that a rejection is passed to OnServerDisconnect
+func TestClientReauthInterval(t *testing.T) {
+	for name, response := range map[string]packets.Packet{
+		"Accepted": &packets.Auth{ReasonCode: packets.AuthSuccess, Properties: &packets.Properties{}},
+		"Rejected": &packets.Disconnect{ReasonCode: packets.DisconnectNotAuthorized, Properties: &packets.Properties{}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+				ts.SetResponse(packets.CONNACK, &packets.Connack{Properties: &packets.Properties{}})
+				ts.SetResponse(packets.AUTH, response)
+				go ts.Run()
+				defer ts.Stop()
+
+				disconnected := make(chan *Disconnect, 1)
+				auther := &fakeReauther{}
+				conn := &pingCountConn{Conn: ts.ClientConn()}
+				c := NewClient(ClientConfig{
+					Conn:               conn,
+					AuthHandler:        auther,
+					ReauthInterval:     20 * time.Second,
+					OnServerDisconnect: func(d *Disconnect) { disconnected <- d },
+				})
+				_, err := c.Connect(t.Context(), &Connect{ClientID: "testClient", KeepAlive: 30})
+				require.NoError(t, err)
+				defer c.close()
+
+				time.Sleep(50 * time.Second)
+				synctest.Wait()
+				if name == "Rejected" {
+					require.Equal(t, int32(1), auther.calls.Load())
+					select {
+					case d := <-disconnected:
+						assert.Equal(t, byte(packets.DisconnectNotAuthorized), d.ReasonCode)
+					default:
+						t.Fatal("expected OnServerDisconnect to be called")
+					}
+					return
+				}
+				assert.Equal(t, int32(2), auther.calls.Load()) // At 20s and 40s
+				assert.Equal(t, int32(1), conn.pings.Load())   // Only the initial PINGREQ (the AUTH packets count as activity)
+				assert.Empty(t, disconnected)
+			})
+		})
+	}
+}
+
+// TestClientBuildConnect checks that changes made by BuildConnect are sent to the server, and that changes breaking
+// invariants are rejected
+func TestClientBuildConnect(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	received := make(chan *packets.Connect, 1)
+	go func() {
+		cp, err := packets.ReadPacket(serverConn)
+		if err != nil {
+			return
+		}
+		received <- cp.Content.(*packets.Connect)
+		_, _ = packets.NewControlPacket(packets.CONNACK).WriteTo(serverConn)
+	}()
+
+	c := NewClient(ClientConfig{
+		Conn: packets.NewThreadSafeConn(clientConn),
+		BuildConnect: func(cp *packets.Connect) {
+			cp.Properties.User = append(cp.Properties.User, packets.User{Key: "vendor", Value: "x"})
+			cp.Properties.RequestResponseInfo = Byte(1)
+			cp.KeepAlive = 45
+		},
+	})
+	defer c.close()
+	_, err := c.Connect(t.Context(), &Connect{ClientID: "testClient", KeepAlive: 30})
+	require.NoError(t, err)
+	cp := <-received
+	assert.Equal(t, "testClient", cp.ClientID)
+	assert.Equal(t, uint16(45), cp.KeepAlive)
+	assert.Equal(t, []packets.User{{Key: "vendor", Value: "x"}}, cp.Properties.User)
+	require.NotNil(t, cp.Properties.RequestResponseInfo)
+	assert.Equal(t, byte(1), *cp.Properties.RequestResponseInfo)
+
+	// Clearing the client identifier is rejected (before anything is sent)
+	_, clientConn = net.Pipe()
+	c = NewClient(ClientConfig{
+		Conn:         clientConn,
+		BuildConnect: func(cp *packets.Connect) { cp.ClientID = "" },
+	})
+	_, err = c.Connect(t.Context(), &Connect{ClientID: "testClient", KeepAlive: 30})
+	require.ErrorIs(t, err, ErrInvalidArguments)
+}
+
+func TestClientConnectAssignedClientID(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{
+		Properties: &packets.Properties{AssignedClientID: "server-assigned"},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{Conn: ts.ClientConn()})
+	require.NotNil(t, c)
+	defer c.close()
+	c.SetDebugLogger(paholog.NewTestLogger(t, "AssignedClientID:"))
+	assert.Empty(t, c.AssignedClientID())
+
+	ca, err := c.Connect(t.Context(), &Connect{KeepAlive: 30, CleanStart: true})
+	require.NoError(t, err)
+	assert.Equal(t, "server-assigned", ca.Properties.AssignedClientID)
+	assert.Equal(t, "server-assigned", c.AssignedClientID())
+	assert.Equal(t, "server-assigned", c.ClientID())
+}
+
+func TestClientSessionPresent(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{SessionPresent: true, Properties: &packets.Properties{}})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{Conn: ts.ClientConn()})
+	require.NotNil(t, c)
+	defer c.close()
+	assert.False(t, c.SessionPresent())
+
+	ca, err := c.Connect(t.Context(), &Connect{ClientID: "testClient", KeepAlive: 30})
+	require.NoError(t, err)
+	assert.True(t, ca.SessionPresent)
+	assert.True(t, c.SessionPresent())
+	assert.True(t, c.ServerProperties().SessionPresent)
+}
+
+// TestClientConnectResetsTopicAliases checks that an inbound topic alias from a previous connection is not reused
+func TestClientConnectResetsTopicAliases(t *testing.T) {
+	var stale, unknown int
+	r := NewStandardRouter()
+	r.RegisterHandler("stale/topic", func(*Publish) { stale++ })
+	r.DefaultHandler(func(*Publish) { unknown++ })
+	alias := uint16(1)
+	r.Route(&packets.Publish{Topic: "stale/topic", Properties: &packets.Properties{TopicAlias: &alias}}) // previous connection
+	require.Equal(t, 1, stale)
+
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0, SessionPresent: true})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{Conn: ts.ClientConn(), Router: r})
+	require.NotNil(t, c)
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", KeepAlive: 30})
+	require.NoError(t, err)
+	defer c.close()
+
+	r.Route(&packets.Publish{Properties: &packets.Properties{TopicAlias: &alias}})
+	assert.Equal(t, 1, stale, "alias from previous connection should not be used")
+	assert.Equal(t, 1, unknown)
 }
 
 func TestClientSubscribe(t *testing.T) {
@@ -232,90 +467,939 @@ func TestClientPublishQoS0(t *testing.T) {
 	time.Sleep(10 * time.Millisecond)
 }
 
-func TestClientPublishQoS1(t *testing.T) {
-	clientLogger := paholog.NewTestLogger(t, "ClientPublishQoS1:")
+func TestClientPublishQoS1(t *testing.T) {
+	clientLogger := paholog.NewTestLogger(t, "ClientPublishQoS1:")
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.PUBACK, &packets.Puback{
+		ReasonCode: packets.PubackSuccess,
+		Properties: &packets.Properties{},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{
+		Conn: ts.ClientConn(),
+	})
+	require.NotNil(t, c)
+	defer c.close()
+	c.SetDebugLogger(clientLogger)
+
+	clientCtx := basicClientInitialisation(t.Context(), c)
+	c.publishPackets = make(chan *packets.Publish)
+	c.workers.Add(2)
+	go func() {
+		defer c.workers.Done()
+		c.incoming(clientCtx)
+	}()
+	go func() {
+		defer c.workers.Done()
+		c.config.PingHandler.Run(clientCtx, c.config.Conn, 30)
+	}()
+	c.config.Session.ConAckReceived(c.config.Conn, &packets.Connect{}, &packets.Connack{})
+
+	p := &Publish{
+		Topic:   "test/1",
+		QoS:     1,
+		Payload: []byte("test payload"),
+	}
+
+	pa, err := c.Publish(context.Background(), p)
+	require.Nil(t, err)
+	assert.Equal(t, uint8(0), pa.ReasonCode)
+}
+
+// countingLimiter is a PublishRateLimiter that counts calls to Wait (blocking until ctx is done if block is set)
+type countingLimiter struct {
+	calls atomic.Int32
+	block bool
+}
+
+func (l *countingLimiter) Wait(ctx context.Context) error {
+	l.calls.Add(1)
+	if l.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func TestClientPublishRateLimiter(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.PUBACK, &packets.Puback{
+		ReasonCode: packets.PubackSuccess,
+		Properties: &packets.Properties{},
+	})
+	ts.SetResponse(packets.PUBREC, &packets.Pubrec{
+		ReasonCode: packets.PubrecSuccess,
+		Properties: &packets.Properties{},
+	})
+	ts.SetResponse(packets.PUBCOMP, &packets.Pubcomp{
+		ReasonCode: packets.PubcompSuccess,
+		Properties: &packets.Properties{},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	limiter := &countingLimiter{}
+	c := NewClient(ClientConfig{
+		Conn:               ts.ClientConn(),
+		PublishRateLimiter: limiter,
+	})
+	require.NotNil(t, c)
+	defer c.close()
+	c.SetDebugLogger(paholog.NewTestLogger(t, "ClientPublishRateLimiter:"))
+
+	clientCtx := basicClientInitialisation(t.Context(), c)
+	c.publishPackets = make(chan *packets.Publish)
+	c.workers.Add(1)
+	go func() {
+		defer c.workers.Done()
+		c.incoming(clientCtx)
+	}()
+	c.config.Session.ConAckReceived(c.config.Conn, &packets.Connect{}, &packets.Connack{})
+
+	for _, qos := range []byte{0, 1, 2} {
+		_, err := c.Publish(t.Context(), &Publish{Topic: "test/1", QoS: qos, Payload: []byte("test payload")})
+		require.NoError(t, err)
+		assert.Equal(t, int32(qos)+1, limiter.calls.Load(), "limiter should be consulted for each publish")
+	}
+
+	// The wait is abandoned when the context is done, and the message is not sent
+	limiter.block = true
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	_, err := c.Publish(ctx, &Publish{Topic: "test/1", QoS: 1, Payload: []byte("not sent")})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, int32(4), limiter.calls.Load())
+	assert.Empty(t, c.InflightPublishes(), "message should not have been added to the session")
+}
+
+func TestClientPublishQoS2(t *testing.T) {
+	clientLogger := paholog.NewTestLogger(t, "ClientPublishQoS2:")
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.PUBREC, &packets.Pubrec{
+		ReasonCode: packets.PubrecSuccess,
+		Properties: &packets.Properties{},
+	})
+	ts.SetResponse(packets.PUBCOMP, &packets.Pubcomp{
+		ReasonCode: packets.PubcompSuccess,
+		Properties: &packets.Properties{},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{
+		Conn: ts.ClientConn(),
+	})
+	require.NotNil(t, c)
+	defer c.close()
+	c.SetDebugLogger(clientLogger)
+
+	clientCtx := basicClientInitialisation(t.Context(), c)
+	c.publishPackets = make(chan *packets.Publish)
+	c.workers.Add(2)
+	go func() {
+		defer c.workers.Done()
+		c.incoming(clientCtx)
+	}()
+	go func() {
+		defer c.workers.Done()
+		c.config.PingHandler.Run(clientCtx, c.config.Conn, 30)
+	}()
+	c.config.Session.ConAckReceived(c.config.Conn, &packets.Connect{}, &packets.Connack{})
+
+	p := &Publish{
+		Topic:   "test/2",
+		QoS:     2,
+		Payload: []byte("test payload"),
+	}
+
+	pr, err := c.Publish(context.Background(), p)
+	require.Nil(t, err)
+	assert.Equal(t, uint8(0), pr.ReasonCode)
+}
+
+// TestClientPublishNoQueue checks that a message published with PublishMethod_Blocking_NoQueue is not retained when
+// the connection is lost mid-flight (and that an error is returned).
+func TestClientPublishNoQueue(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0})
+	go ts.Run() // Server will not respond to the PUBLISH
+	defer ts.Stop()
+
+	sess := state.NewInMemory()
+	defer sess.Close()
+	c := NewClient(ClientConfig{
+		Conn:    ts.ClientConn(),
+		Session: sess,
+	})
+	require.NotNil(t, c)
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", KeepAlive: 30})
+	require.NoError(t, err)
+
+	pubErr := make(chan error, 1)
+	go func() {
+		_, err := c.PublishWithOptions(context.Background(), &Publish{Topic: "test/1", QoS: 1, Payload: []byte("test")},
+			PublishOptions{Method: PublishMethod_Blocking_NoQueue})
+		pubErr <- err
+	}()
+	require.Eventually(t, func() bool { return sess.InflightPublishes() == 1 }, time.Second, time.Millisecond)
+
+	c.close() // Connection lost
+	select {
+	case err := <-pubErr:
+		assert.ErrorIs(t, err, ErrConnectionLost)
+	case <-time.After(time.Second):
+		t.Fatal("publish did not return following connection loss")
+	}
+	assert.Equal(t, 0, sess.InflightPublishes())
+}
+
+func TestClientAckTimeout(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0})
+	go ts.Run() // Server will not respond to the PUBLISH
+	defer ts.Stop()
+
+	clientErr := make(chan error, 1)
+	c := NewClient(ClientConfig{
+		Conn:          ts.ClientConn(),
+		AckTimeout:    50 * time.Millisecond,
+		OnClientError: func(err error) { clientErr <- err },
+	})
+	require.NotNil(t, c)
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", KeepAlive: 30})
+	require.NoError(t, err)
+
+	_, err = c.Publish(context.Background(), &Publish{Topic: "test/1", QoS: 1, Payload: []byte("test")})
+	assert.ErrorIs(t, err, ErrAckTimeout)
+	select {
+	case err := <-clientErr:
+		t.Fatalf("unexpected client error: %s", err)
+	default:
+	}
+
+	// The connection should remain usable
+	_, err = c.Publish(context.Background(), &Publish{Topic: "test/1", QoS: 0, Payload: []byte("test")})
+	assert.NoError(t, err)
+	require.NoError(t, c.Disconnect(&Disconnect{}))
+}
+
+func TestClientDisconnectOnAckTimeout(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0})
+	go ts.Run() // Server will not respond to the PUBLISH
+	defer ts.Stop()
+
+	sess := state.NewInMemory()
+	defer sess.Close()
+	clientErr := make(chan error, 10)
+	c := NewClient(ClientConfig{
+		Conn:                   ts.ClientConn(),
+		Session:                sess,
+		AckTimeout:             50 * time.Millisecond,
+		DisconnectOnAckTimeout: true,
+		OnClientError:          func(err error) { clientErr <- err },
+	})
+	require.NotNil(t, c)
+	sessionExpiryInterval := uint32(60) // Session must survive connection loss for messages to be retransmitted
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", KeepAlive: 30,
+		Properties: &ConnectProperties{SessionExpiryInterval: &sessionExpiryInterval}})
+	require.NoError(t, err)
+
+	storedErr := make(chan error, 1)
+	go func() {
+		_, err := c.Publish(context.Background(), &Publish{Topic: "test/1", QoS: 1, Payload: []byte("stored")})
+		storedErr <- err
+	}()
+	require.Eventually(t, func() bool { return sess.InflightPublishes() == 1 }, time.Second, time.Millisecond)
+	_, err = c.PublishWithOptions(context.Background(), &Publish{Topic: "test/1", QoS: 1, Payload: []byte("not stored")},
+		PublishOptions{Method: PublishMethod_Blocking_NoQueue})
+	assert.True(t, errors.Is(err, ErrAckTimeout) || errors.Is(err, ErrConnectionLost), "unexpected error: %v", err)
+	assert.ErrorIs(t, <-storedErr, ErrAckTimeout)
+
+	timeout := time.After(time.Second)
+	for found := false; !found; { // OnClientError may also be called with the resulting read error
+		select {
+		case err := <-clientErr:
+			found = errors.Is(err, ErrAckTimeout)
+		case <-timeout:
+			t.Fatal("OnClientError not called with ErrAckTimeout")
+		}
+	}
+	<-c.Done()
+	// The stored message remains in the session (to be retransmitted upon reconnection); the other is released
+	assert.Equal(t, 1, sess.InflightPublishes())
+}
+
+func TestClientCancelPublish(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0})
+	go ts.Run() // Server will not respond to the PUBLISH
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{Conn: ts.ClientConn()})
+	require.NotNil(t, c)
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", KeepAlive: 30})
+	require.NoError(t, err)
+	defer c.close()
+
+	pubErr := make(chan error, 1)
+	go func() {
+		_, err := c.Publish(context.Background(), &Publish{Topic: "test/1", QoS: 1, Payload: []byte("test")})
+		pubErr <- err
+	}()
+	require.Eventually(t, func() bool { return len(c.InflightPublishes()) == 1 }, time.Second, time.Millisecond)
+	info := c.InflightPublishes()[0]
+	assert.Equal(t, "test/1", info.Topic)
+	assert.Equal(t, byte(1), info.QoS)
+
+	require.NoError(t, c.CancelPublish(info.PacketID))
+	select {
+	case err := <-pubErr:
+		assert.ErrorIs(t, err, ErrPublishCancelled)
+	case <-time.After(time.Second):
+		t.Fatal("publish did not return following cancellation")
+	}
+	assert.ErrorIs(t, c.CancelPublish(info.PacketID), session.ErrNotInflight)
+}
+
+// recordingObserver is an Observer that records the events it is notified of
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) record(format string, a ...any) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, fmt.Sprintf(format, a...))
+}
+
+func (o *recordingObserver) OnPublishSent(qos byte) { o.record("sent %d", qos) }
+func (o *recordingObserver) OnPublishAcked(qos byte, reasonCode byte, _ time.Duration) {
+	o.record("acked %d %d", qos, reasonCode)
+}
+func (o *recordingObserver) OnSubscribeAcked(time.Duration) { o.record("subscribed") }
+func (o *recordingObserver) OnMessageReceived(qos byte)     { o.record("received %d", qos) }
+
+func TestClientObserver(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.PUBACK, &packets.Puback{
+		ReasonCode: packets.PubackSuccess,
+		Properties: &packets.Properties{},
+	})
+	ts.SetResponse(packets.SUBACK, &packets.Suback{
+		Reasons:    []byte{1},
+		Properties: &packets.Properties{},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	var o recordingObserver
+	received := make(chan struct{})
+	c := NewClient(ClientConfig{
+		Conn:     ts.ClientConn(),
+		Observer: &o,
+		OnPublishReceived: []func(PublishReceived) (bool, error){
+			func(PublishReceived) (bool, error) {
+				close(received)
+				return true, nil
+			},
+		},
+	})
+	require.NotNil(t, c)
+	defer c.close()
+
+	clientCtx := basicClientInitialisation(t.Context(), c)
+	c.publishPackets = make(chan *packets.Publish)
+	c.workers.Add(3)
+	go func() {
+		defer c.workers.Done()
+		c.incoming(clientCtx)
+	}()
+	go func() {
+		defer c.workers.Done()
+		c.config.PingHandler.Run(clientCtx, c.config.Conn, 30)
+	}()
+	go func() {
+		defer c.workers.Done()
+		c.routePublishPackets()
+	}()
+	c.config.Session.ConAckReceived(c.config.Conn, &packets.Connect{}, &packets.Connack{})
+
+	_, err := c.Subscribe(context.Background(), &Subscribe{Subscriptions: []SubscribeOptions{{Topic: "test/1", QoS: 1}}})
+	require.NoError(t, err)
+	_, err = c.Publish(context.Background(), &Publish{Topic: "test/0", QoS: 0})
+	require.NoError(t, err)
+	_, err = c.Publish(context.Background(), &Publish{Topic: "test/1", QoS: 1})
+	require.NoError(t, err)
+
+	c.publishPackets <- &packets.Publish{Topic: "test/1", QoS: 0, Properties: &packets.Properties{}}
+	<-received
+
+	assert.Equal(t, []string{"subscribed", "sent 0", "sent 1", "acked 1 0", "received 0"}, o.events)
+}
+
+// TestClientPublishNotSupported checks that a PUBLISH using features the server does not support is rejected locally
+func TestClientPublishNotSupported(t *testing.T) {
+	c := NewClient(ClientConfig{})
+	require.NotNil(t, c)
+	c.serverProps.MaximumQoS = 1
+	c.serverProps.RetainAvailable = false
+
+	_, err := c.Publish(context.Background(), &Publish{Topic: "test/0", QoS: 2})
+	assert.ErrorIs(t, err, ErrQoSNotSupported)
+	assert.ErrorIs(t, err, ErrInvalidArguments)
+
+	_, err = c.Publish(context.Background(), &Publish{Topic: "test/0", QoS: 1, Retain: true})
+	assert.ErrorIs(t, err, ErrRetainNotSupported)
+	assert.ErrorIs(t, err, ErrInvalidArguments)
+}
+
+// TestClientPublishInvalidTopic checks that a PUBLISH with an invalid Topic Name is rejected locally
+func TestClientPublishInvalidTopic(t *testing.T) {
+	c := NewClient(ClientConfig{})
+	require.NotNil(t, c)
+
+	for _, topic := range []string{"", "a/+", "a/#", "a\x00b", strings.Repeat("a", 65536)} {
+		_, err := c.Publish(context.Background(), &Publish{Topic: topic, QoS: 1})
+		assert.ErrorIs(t, err, ErrInvalidTopic)
+		assert.ErrorIs(t, err, ErrInvalidArguments)
+	}
+}
+
+func TestClientPublishError(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0})
+	ts.SetResponse(packets.PUBACK, &packets.Puback{
+		ReasonCode: packets.PubackNotAuthorized,
+		Properties: &packets.Properties{
+			ReasonString: "not permitted to publish to test/1",
+			User:         []packets.User{{Key: "policy", Value: "readonly"}},
+		},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{Conn: ts.ClientConn()})
+	require.NotNil(t, c)
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", KeepAlive: 30})
+	require.NoError(t, err)
+	defer c.close()
+
+	pr, err := c.Publish(context.Background(), &Publish{Topic: "test/1", QoS: 1, Payload: []byte("test")})
+	require.NotNil(t, pr)
+	var pe *PublishError
+	require.ErrorAs(t, err, &pe)
+	assert.Equal(t, byte(packets.PubackNotAuthorized), pe.ReasonCode)
+	assert.Equal(t, "not permitted to publish to test/1", pe.ReasonString)
+	assert.Equal(t, "readonly", pe.User.Get("policy"))
+	assert.Contains(t, err.Error(), "not permitted to publish to test/1")
+	var rce *ReasonCodeError
+	require.ErrorAs(t, err, &rce)
+	assert.Equal(t, byte(packets.PUBACK), rce.PacketType)
+	assert.Equal(t, byte(packets.PubackNotAuthorized), rce.ReasonCode)
+	assert.False(t, rce.Retryable())
+}
+
+func TestClientSubscribeError(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0})
+	ts.SetResponse(packets.SUBACK, &packets.Suback{
+		Reasons: []byte{1, packets.SubackTopicFilterinvalid},
+		Properties: &packets.Properties{
+			ReasonString: "invalid filter",
+			User:         []packets.User{{Key: "filter", Value: "test/#/2"}},
+		},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{Conn: ts.ClientConn()})
+	require.NotNil(t, c)
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", KeepAlive: 30})
+	require.NoError(t, err)
+	defer c.close()
+
+	sa, err := c.Subscribe(context.Background(), &Subscribe{
+		Subscriptions: []SubscribeOptions{
+			{Topic: "test/1", QoS: 1},
+			{Topic: "test/#/2", QoS: 1},
+		},
+	})
+	require.NotNil(t, sa)
+	var se *SubscribeError
+	require.ErrorAs(t, err, &se)
+	assert.Equal(t, []byte{1, packets.SubackTopicFilterinvalid}, se.Reasons)
+	assert.Equal(t, "invalid filter", se.ReasonString)
+	assert.Equal(t, "test/#/2", se.User.Get("filter"))
+	var rce *ReasonCodeError
+	require.ErrorAs(t, err, &rce)
+	assert.Equal(t, byte(packets.SUBACK), rce.PacketType)
+	assert.Equal(t, byte(packets.SubackTopicFilterinvalid), rce.ReasonCode)
+}
+
+func TestClientSubscribeWithHandler(t *testing.T) {
+	for name, tc := range map[string]struct {
+		reason     byte
+		registered bool
+	}{
+		"accepted": {reason: 1, registered: true},
+		"rejected": {reason: packets.SubackNotauthorized},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+			ts.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0})
+			ts.SetResponse(packets.SUBACK, &packets.Suback{Reasons: []byte{tc.reason}, Properties: &packets.Properties{}})
+			ts.SetResponse(packets.UNSUBACK, &packets.Unsuback{Reasons: []byte{0}, Properties: &packets.Properties{}})
+			go ts.Run()
+			defer ts.Stop()
+
+			r := NewStandardRouter()
+			c := NewClient(ClientConfig{Conn: ts.ClientConn(), Router: r})
+			require.NotNil(t, c)
+			_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", KeepAlive: 30})
+			require.NoError(t, err)
+			defer c.close()
+
+			received := make(chan *Publish, 1)
+			sa, err := c.SubscribeWithHandler(context.Background(), SubscribeOptions{Topic: "test/#", QoS: 1}, func(p *Publish) { received <- p })
+			require.NotNil(t, sa)
+			assert.Equal(t, []byte{tc.reason}, sa.Reasons)
+			if !tc.registered {
+				var se *SubscribeError
+				require.ErrorAs(t, err, &se)
+				assert.Equal(t, []byte{tc.reason}, se.Reasons)
+				assert.Empty(t, r.Subscriptions())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, map[string]int{"test/#": 1}, r.Subscriptions())
+
+			require.NoError(t, ts.SendPacket(&packets.Publish{Topic: "test/1", Payload: []byte("hello")}))
+			select {
+			case p := <-received:
+				assert.Equal(t, "test/1", p.Topic)
+			case <-time.After(time.Second):
+				t.Fatal("message not passed to handler")
+			}
+
+			_, err = c.UnsubscribeWithHandler(context.Background(), "test/#")
+			require.NoError(t, err)
+			assert.Empty(t, r.Subscriptions())
+		})
+	}
+
+	t.Run("noRouter", func(t *testing.T) {
+		c := NewClient(ClientConfig{OnPublishReceived: []func(PublishReceived) (bool, error){func(PublishReceived) (bool, error) { return true, nil }}})
+		_, err := c.SubscribeWithHandler(context.Background(), SubscribeOptions{Topic: "test"}, func(*Publish) {})
+		assert.ErrorIs(t, err, ErrInvalidArguments)
+		_, err = c.UnsubscribeWithHandler(context.Background(), "test")
+		assert.ErrorIs(t, err, ErrInvalidArguments)
+	})
+}
+
+// TestClientRouteContext checks that handlers registered via RegisterContextHandler are passed a context that is done
+// once the client shuts down
+func TestClientRouteContext(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0})
+	go ts.Run()
+	defer ts.Stop()
+
+	r := NewStandardRouter()
+	ctxs := make(chan context.Context, 1)
+	r.RegisterContextHandler("test/#", func(ctx context.Context, _ *Publish) { ctxs <- ctx })
+	c := NewClient(ClientConfig{Conn: ts.ClientConn(), Router: r})
+	require.NotNil(t, c)
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", KeepAlive: 30})
+	require.NoError(t, err)
+
+	require.NoError(t, ts.SendPacket(&packets.Publish{Topic: "test/1", Properties: &packets.Properties{}}))
+	var ctx context.Context
+	select {
+	case ctx = <-ctxs:
+	case <-time.After(time.Second):
+		t.Fatal("message not passed to context handler")
+	}
+	assert.NoError(t, ctx.Err())
+
+	_ = c.Disconnect(&Disconnect{})
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context should be done once the client has disconnected")
+	}
+}
+
+func TestClientSubscribeResults(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0})
+	ts.SetResponse(packets.SUBACK, &packets.Suback{
+		Reasons:    []byte{0, packets.SubackNotauthorized, 2},
+		Properties: &packets.Properties{ReasonString: "not permitted"},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{Conn: ts.ClientConn()})
+	require.NotNil(t, c)
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", KeepAlive: 30})
+	require.NoError(t, err)
+	defer c.close()
+
+	sa, err := c.Subscribe(context.Background(), &Subscribe{
+		Subscriptions: []SubscribeOptions{
+			{Topic: "test/1", QoS: 0},
+			{Topic: "secret/#", QoS: 1},
+			{Topic: "test/2", QoS: 2},
+		},
+	})
+	require.NotNil(t, sa)
+	expected := SubscribeResults{
+		{Topic: "test/1", ReasonCode: 0, ReasonString: "not permitted"},
+		{Topic: "secret/#", ReasonCode: packets.SubackNotauthorized, ReasonString: "not permitted"},
+		{Topic: "test/2", ReasonCode: 2, ReasonString: "not permitted"},
+	}
+	assert.Equal(t, expected, sa.Results)
+	assert.Equal(t, SubscribeResults{expected[1]}, sa.Results.Failed())
+
+	var se *SubscribeError
+	require.ErrorAs(t, err, &se)
+	assert.Equal(t, SubscribeResults{expected[1]}, se.Results.Failed())
+}
+
+// TestClientSubscribeContextCancelled checks that, when the server does not respond, Subscribe and Unsubscribe return
+// the context error and the request is abandoned (so the packet identifier is not held indefinitely)
+func TestClientSubscribeContextCancelled(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0}) // SUBACK/UNSUBACK will never be sent
+	go ts.Run()
+	defer ts.Stop()
+
+	sess := state.NewInMemory()
+	c := NewClient(ClientConfig{Conn: ts.ClientConn(), Session: sess})
+	require.NotNil(t, c)
+	sessionExpiry := uint32(60) // session outlives the connection
+	_, err := c.Connect(context.Background(), &Connect{
+		ClientID:   "testClient",
+		KeepAlive:  30,
+		Properties: &ConnectProperties{SessionExpiryInterval: &sessionExpiry},
+	})
+	require.NoError(t, err)
+	defer c.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = c.Subscribe(ctx, &Subscribe{Subscriptions: []SubscribeOptions{{Topic: "test", QoS: 1}}})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = c.Unsubscribe(ctx, &Unsubscribe{Topics: []string{"test"}})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Both requests (packet identifiers 1 and 2) should have been abandoned
+	assert.ErrorIs(t, sess.AbandonRequest(1), session.ErrNotInflight)
+	assert.ErrorIs(t, sess.AbandonRequest(2), session.ErrNotInflight)
+
+	// A PublishMethod_Blocking_NoQueue publish is not retransmitted, so should be cancelled (the identifier remains
+	// reserved until the PUBACK arrives or the connection drops)
+	pubCtx, pubCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer pubCancel()
+	_, err = c.PublishWithOptions(pubCtx, &Publish{Topic: "test", QoS: 1}, PublishOptions{Method: PublishMethod_Blocking_NoQueue})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	info := sess.InflightPublishInfo()
+	require.Len(t, info, 1)
+	assert.True(t, info[0].Cancelled)
+}
+
+// TestClientMessages checks that inbound messages are delivered via Messages and acknowledged once the application
+// has made room in the channel
+func TestClientMessages(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{Conn: ts.ClientConn(), MessageChannelSize: 1})
+	require.NotNil(t, c)
+	assert.Nil(t, c.config.Router, "default router should not be created")
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", KeepAlive: 30})
+	require.NoError(t, err)
+
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, ts.SendPacket(&packets.Publish{PacketID: uint16(i), Topic: fmt.Sprintf("test/%d", i), QoS: 1}))
+	}
+	// The first message fills the channel, so the second cannot be delivered (and is not acknowledged)
+	assert.Eventually(t, func() bool { return len(ts.ReceivedPubacks()) == 1 }, time.Second, 10*time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	assert.Len(t, ts.ReceivedPubacks(), 1)
+
+	for i := 1; i <= 3; i++ {
+		select {
+		case p := <-c.Messages():
+			assert.Equal(t, fmt.Sprintf("test/%d", i), p.Topic)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout awaiting message %d", i)
+		}
+	}
+	assert.Eventually(t, func() bool { return len(ts.ReceivedPubacks()) == 3 }, time.Second, 10*time.Millisecond)
+
+	c.close()
+	select {
+	case _, ok := <-c.Messages():
+		assert.False(t, ok, "channel should be closed when the client shuts down")
+	case <-time.After(time.Second):
+		t.Fatal("timeout awaiting channel closure")
+	}
+}
+
+// reverseCodec is a PayloadCodec that reverses the payload
+type reverseCodec struct{}
+
+func (reverseCodec) Name() string { return "reverse" }
+func (reverseCodec) Encode(b []byte) ([]byte, error) {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r, nil
+}
+func (c reverseCodec) Decode(b []byte) ([]byte, error) { return c.Encode(b) }
+
+// TestClientPayloadCodec checks that outbound payloads are encoded (and marked) and that only inbound payloads
+// carrying the marker are decoded
+func TestClientPayloadCodec(t *testing.T) {
+	c := NewClient(ClientConfig{PayloadCodec: reverseCodec{}})
+
+	pb := (&Publish{Topic: "test", Payload: []byte("abc")}).Packet()
+	require.NoError(t, c.encodePayload(pb))
+	assert.Equal(t, "cba", string(pb.Payload))
+	require.NotNil(t, pb.Properties)
+	assert.Equal(t, []packets.User{{Key: PayloadEncodingProperty, Value: "reverse"}}, pb.Properties.User)
+
+	// Payloads already marked are not encoded again
+	require.NoError(t, c.encodePayload(pb))
+	assert.Equal(t, "cba", string(pb.Payload))
+	assert.Len(t, pb.Properties.User, 1)
+
+	p := PublishFromPacketPublish(pb)
+	c.decodePayload(p)
+	assert.Equal(t, "abc", string(p.Payload))
+
+	for _, user := range []UserProperties{nil, {{Key: PayloadEncodingProperty, Value: "gzip"}}} {
+		p = &Publish{Topic: "test", Payload: []byte("abc"), Properties: &PublishProperties{User: user}}
+		c.decodePayload(p)
+		assert.Equal(t, "abc", string(p.Payload), "unmarked message should not be decoded")
+	}
+}
+
+// TestClientReceivePayloadCodec checks that an inbound message carrying the codec marker is decoded before being
+// passed to handlers
+func TestClientReceivePayloadCodec(t *testing.T) {
 	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
-	ts.SetResponse(packets.PUBACK, &packets.Puback{
-		ReasonCode: packets.PubackSuccess,
-		Properties: &packets.Properties{},
-	})
+	ts.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0})
 	go ts.Run()
 	defer ts.Stop()
 
+	received := make(chan string, 2)
 	c := NewClient(ClientConfig{
-		Conn: ts.ClientConn(),
+		Conn:         ts.ClientConn(),
+		PayloadCodec: reverseCodec{},
+		OnPublishReceived: []func(PublishReceived) (bool, error){
+			func(pr PublishReceived) (bool, error) {
+				received <- string(pr.Packet.Payload)
+				return true, nil
+			}},
 	})
 	require.NotNil(t, c)
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", KeepAlive: 30})
+	require.NoError(t, err)
 	defer c.close()
-	c.SetDebugLogger(clientLogger)
 
-	clientCtx := basicClientInitialisation(t.Context(), c)
-	c.publishPackets = make(chan *packets.Publish)
-	c.workers.Add(2)
-	go func() {
-		defer c.workers.Done()
-		c.incoming(clientCtx)
-	}()
-	go func() {
-		defer c.workers.Done()
-		c.config.PingHandler.Run(clientCtx, c.config.Conn, 30)
-	}()
-	c.config.Session.ConAckReceived(c.config.Conn, &packets.Connect{}, &packets.Connack{})
+	require.NoError(t, ts.SendPacket(&packets.Publish{Topic: "test", Payload: []byte("cba"), Properties: &packets.Properties{
+		User: []packets.User{{Key: PayloadEncodingProperty, Value: "reverse"}},
+	}}))
+	require.NoError(t, ts.SendPacket(&packets.Publish{Topic: "test", Payload: []byte("plain"), Properties: &packets.Properties{}}))
+	for _, want := range []string{"abc", "plain"} {
+		select {
+		case got := <-received:
+			assert.Equal(t, want, got)
+		case <-time.After(time.Second):
+			t.Fatal("timeout awaiting message")
+		}
+	}
+}
 
-	p := &Publish{
-		Topic:   "test/1",
-		QoS:     1,
-		Payload: []byte("test payload"),
+// countingLogger is a Logger that counts the number of lines logged
+type countingLogger struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (l *countingLogger) Println(...interface{})        { l.inc() }
+func (l *countingLogger) Printf(string, ...interface{}) { l.inc() }
+func (l *countingLogger) inc()                          { l.mu.Lock(); l.n++; l.mu.Unlock() }
+func (l *countingLogger) count() int                    { l.mu.Lock(); defer l.mu.Unlock(); return l.n }
+
+// TestClientHandlerDrainTimeout checks that shutdown waits for an in-progress handler for up to HandlerDrainTimeout,
+// and that messages not yet passed to the handlers are discarded
+func TestClientHandlerDrainTimeout(t *testing.T) {
+	const drainTimeout = 5 * time.Second
+	for _, wellBehaved := range []bool{true, false} {
+		t.Run(fmt.Sprintf("wellBehaved=%t", wellBehaved), func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+				ts.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0})
+				go ts.Run()
+				defer ts.Stop()
+
+				var calls atomic.Int32
+				started := make(chan struct{})
+				release := make(chan struct{})
+				defer close(release)
+				c := NewClient(ClientConfig{
+					Conn:                ts.ClientConn(),
+					HandlerDrainTimeout: drainTimeout,
+					OnPublishReceived: []func(PublishReceived) (bool, error){
+						func(pr PublishReceived) (bool, error) {
+							if calls.Add(1) == 1 {
+								close(started)
+							}
+							if wellBehaved {
+								<-pr.Context().Done()
+							} else {
+								<-release
+							}
+							return true, nil
+						}},
+				})
+				require.NotNil(t, c)
+				errLog := &countingLogger{}
+				c.SetErrorLogger(errLog)
+				_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", KeepAlive: 0})
+				require.NoError(t, err)
+
+				for i := range 2 {
+					require.NoError(t, ts.SendPacket(&packets.Publish{PacketID: uint16(i + 1), Topic: "test/1", QoS: 1, Payload: []byte("test")}))
+				}
+				<-started
+				synctest.Wait() // The second message is now queued
+
+				start := time.Now()
+				_ = c.Disconnect(&Disconnect{})
+				elapsed := time.Since(start)
+				if wellBehaved {
+					assert.Less(t, elapsed, drainTimeout)
+					assert.Equal(t, 0, errLog.count())
+				} else {
+					assert.Equal(t, drainTimeout, elapsed)
+					assert.Equal(t, 1, errLog.count())
+				}
+				assert.Equal(t, int32(1), calls.Load(), "queued message should not be passed to handlers")
+			})
+		})
 	}
+}
 
-	pa, err := c.Publish(context.Background(), p)
-	require.Nil(t, err)
-	assert.Equal(t, uint8(0), pa.ReasonCode)
+// TestClientHandlerOverrunReconnect checks that a handler that overruns HandlerDrainTimeout cannot acknowledge its
+// message via the Session once it is in use by a new connection (which would send a stale PUBACK)
+func TestClientHandlerOverrunReconnect(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		sess := state.NewInMemory()
+		defer sess.Close()
+
+		ts1 := basictestserver.New(paholog.NewTestLogger(t, "TestServer1:"))
+		ts1.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0})
+		go ts1.Run()
+		defer ts1.Stop()
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+		handlerDone := make(chan struct{})
+		c1 := NewClient(ClientConfig{
+			Conn:                ts1.ClientConn(),
+			Session:             sess,
+			HandlerDrainTimeout: time.Second,
+			OnPublishReceived: []func(PublishReceived) (bool, error){
+				func(pr PublishReceived) (bool, error) {
+					defer close(handlerDone)
+					close(started)
+					<-release // ignores the context (so overruns HandlerDrainTimeout)
+					return true, nil
+				}},
+		})
+		require.NotNil(t, c1)
+		_, err := c1.Connect(context.Background(), &Connect{ClientID: "testClient", KeepAlive: 0, Properties: &ConnectProperties{SessionExpiryInterval: Uint32(600)}})
+		require.NoError(t, err)
+		require.NoError(t, ts1.SendPacket(&packets.Publish{PacketID: 5, Topic: "test/1", QoS: 1, Payload: []byte("test")}))
+		<-started
+		_ = c1.Disconnect(&Disconnect{})
+		<-c1.Done()
+
+		// Reconnect, resuming the session, whilst the handler is still running
+		ts2 := basictestserver.New(paholog.NewTestLogger(t, "TestServer2:"))
+		ts2.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0, SessionPresent: true})
+		go ts2.Run()
+		defer ts2.Stop()
+		c2 := NewClient(ClientConfig{Conn: ts2.ClientConn(), Session: sess})
+		require.NotNil(t, c2)
+		defer c2.close()
+		_, err = c2.Connect(context.Background(), &Connect{ClientID: "testClient", KeepAlive: 0, Properties: &ConnectProperties{SessionExpiryInterval: Uint32(600)}})
+		require.NoError(t, err)
+
+		close(release)
+		<-handlerDone
+		// An acknowledgement that raced the shutdown (e.g. the handler returned as HandlerDrainTimeout expired) must
+		// also be dropped
+		c1.ack(&packets.Publish{PacketID: 5, QoS: 1, Topic: "test/1"})
+		time.Sleep(time.Second)
+		synctest.Wait()
+		assert.Empty(t, ts2.ReceivedPubacks(), "PUBACK from abandoned handler sent on new connection")
+	})
 }
 
-func TestClientPublishQoS2(t *testing.T) {
-	clientLogger := paholog.NewTestLogger(t, "ClientPublishQoS2:")
+// TestClientSetLoggerWhileConnected checks that loggers can be swapped whilst the client is in use (run with -race)
+func TestClientSetLoggerWhileConnected(t *testing.T) {
 	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
-	ts.SetResponse(packets.PUBREC, &packets.Pubrec{
-		ReasonCode: packets.PubrecSuccess,
-		Properties: &packets.Properties{},
-	})
-	ts.SetResponse(packets.PUBCOMP, &packets.Pubcomp{
-		ReasonCode: packets.PubcompSuccess,
-		Properties: &packets.Properties{},
-	})
+	ts.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0})
 	go ts.Run()
 	defer ts.Stop()
 
-	c := NewClient(ClientConfig{
-		Conn: ts.ClientConn(),
-	})
+	c := NewClient(ClientConfig{Conn: ts.ClientConn()})
 	require.NotNil(t, c)
-	defer c.close()
-	c.SetDebugLogger(clientLogger)
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", KeepAlive: 30})
+	require.NoError(t, err)
 
-	clientCtx := basicClientInitialisation(t.Context(), c)
-	c.publishPackets = make(chan *packets.Publish)
-	c.workers.Add(2)
-	go func() {
-		defer c.workers.Done()
-		c.incoming(clientCtx)
-	}()
+	var wg sync.WaitGroup
+	wg.Add(1)
 	go func() {
-		defer c.workers.Done()
-		c.config.PingHandler.Run(clientCtx, c.config.Conn, 30)
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			_, err := c.Publish(context.Background(), &Publish{Topic: "test/0", Payload: []byte("test")})
+			assert.NoError(t, err)
+		}
 	}()
-	c.config.Session.ConAckReceived(c.config.Conn, &packets.Connect{}, &packets.Connack{})
 
-	p := &Publish{
-		Topic:   "test/2",
-		QoS:     2,
-		Payload: []byte("test payload"),
+	first, second := &countingLogger{}, &countingLogger{}
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			c.SetDebugLogger(first)
+			c.SetErrorLogger(first)
+		} else {
+			c.SetDebugLogger(second)
+			c.SetErrorLogger(second)
+		}
 	}
+	wg.Wait()
 
-	pr, err := c.Publish(context.Background(), p)
-	require.Nil(t, err)
-	assert.Equal(t, uint8(0), pr.ReasonCode)
+	final := &countingLogger{}
+	c.SetDebugLogger(final)
+	c.SetErrorLogger(final)
+	_, err = c.Publish(context.Background(), &Publish{Topic: "test/0", Payload: []byte("test")})
+	require.NoError(t, err)
+	assert.Positive(t, final.count())
+
+	require.NoError(t, c.Disconnect(&Disconnect{}))
 }
 
 func TestClientReceiveQoS0(t *testing.T) {
@@ -543,6 +1627,66 @@ func TestClientReceiveAndAckInOrder(t *testing.T) {
 	)
 }
 
+// TestClientSetAckReason checks that handlers can specify the reason code, and string, sent in the PUBACK/PUBREC
+func TestClientSetAckReason(t *testing.T) {
+	clientLogger := paholog.NewTestLogger(t, "SetAckReason:")
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{
+		ReasonCode:     0,
+		SessionPresent: false,
+		Properties:     &packets.Properties{},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{
+		Conn: ts.ClientConn(),
+		OnPublishReceived: []func(PublishReceived) (bool, error){
+			func(pr PublishReceived) (bool, error) {
+				if pr.Packet.Topic == "bad" {
+					pr.SetAckReason(packets.PubackPayloadFormatInvalid, "bad payload")
+				}
+				return true, nil
+			},
+		},
+	})
+	require.NotNil(t, c)
+	defer c.close()
+	c.SetDebugLogger(clientLogger)
+
+	ca, err := c.Connect(t.Context(), &Connect{
+		KeepAlive:  30,
+		ClientID:   "testClient",
+		CleanStart: true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, uint8(0), ca.ReasonCode)
+
+	for i, topic := range []string{"good", "bad"} {
+		for _, qos := range []byte{1, 2} {
+			require.NoError(t, ts.SendPacket(&packets.Publish{
+				PacketID:   uint16(i*2 + int(qos)),
+				Topic:      topic,
+				Payload:    []byte("payload"),
+				QoS:        qos,
+				Properties: &packets.Properties{},
+			}))
+		}
+	}
+
+	require.Eventually(t, func() bool {
+		return len(ts.ReceivedPubacks()) == 2 && len(ts.ReceivedPubrecs()) == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []packets.Puback{
+		{PacketID: 1, ReasonCode: packets.PubackSuccess, Properties: &packets.Properties{}},
+		{PacketID: 3, ReasonCode: packets.PubackPayloadFormatInvalid, Properties: &packets.Properties{ReasonString: "bad payload"}},
+	}, ts.ReceivedPubacks())
+	assert.Equal(t, []packets.Pubrec{
+		{PacketID: 2, ReasonCode: packets.PubrecSuccess, Properties: &packets.Properties{}},
+		{PacketID: 4, ReasonCode: packets.PubrecPayloadFormatInvalid, Properties: &packets.Properties{ReasonString: "bad payload"}},
+	}, ts.ReceivedPubrecs())
+}
+
 func TestManualAcksInOrder(t *testing.T) {
 	clientLogger := paholog.NewTestLogger(t, "ManualAcksInOrder:")
 	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
@@ -565,73 +1709,288 @@ func TestManualAcksInOrder(t *testing.T) {
 		expectedPacketsCount = 3
 	)
 
-	wg.Add(expectedPacketsCount)
+	wg.Add(expectedPacketsCount)
+	c := NewClient(ClientConfig{
+		Conn: ts.ClientConn(),
+		OnPublishReceived: []func(PublishReceived) (bool, error){
+			func(pr PublishReceived) (bool, error) {
+				defer wg.Done()
+				actualPublishPackets = append(actualPublishPackets, *pr.Packet.Packet())
+				require.NoError(t, pr.Client.Ack(pr.Packet))
+				return true, nil
+			},
+		},
+		EnableManualAcknowledgment: true,
+	})
+	require.NotNil(t, c)
+	defer c.close()
+	c.SetDebugLogger(clientLogger)
+
+	ctx := context.Background()
+	ca, err := c.Connect(ctx, &Connect{
+		KeepAlive:  30,
+		ClientID:   "testClient",
+		CleanStart: true,
+		Properties: &ConnectProperties{
+			ReceiveMaximum: Uint16(200),
+		},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, uint8(0), ca.ReasonCode)
+
+	var expectedPublishPackets []packets.Publish
+	for i := 1; i <= expectedPacketsCount; i++ {
+		p := packets.Publish{
+			PacketID: uint16(i),
+			Topic:    fmt.Sprintf("test/%d", i),
+			Payload:  []byte(fmt.Sprintf("test payload %d", i)),
+			QoS:      1,
+			Properties: &packets.Properties{
+				User: make([]packets.User, 0),
+			},
+		}
+		expectedPublishPackets = append(expectedPublishPackets, p)
+		require.NoError(t, ts.SendPacket(&p))
+	}
+
+	wg.Wait()
+
+	require.Equal(t, expectedPublishPackets, actualPublishPackets)
+	expectedAcks := []packets.Puback{
+		{PacketID: 1, ReasonCode: 0, Properties: &packets.Properties{}},
+		{PacketID: 2, ReasonCode: 0, Properties: &packets.Properties{}},
+		{PacketID: 3, ReasonCode: 0, Properties: &packets.Properties{}},
+	}
+	require.Eventually(t,
+		func() bool {
+			return cmp.Equal(expectedAcks, ts.ReceivedPubacks())
+		},
+		time.Second,
+		10*time.Millisecond,
+		cmp.Diff(expectedAcks, ts.ReceivedPubacks()),
+	)
+
+	// Test QoS 0 packets are ignored
+	require.NoError(t, c.Ack(&Publish{QoS: 0, PacketID: 11233}))
+
+	// Test packets not found
+	require.True(t, errors.Is(c.Ack(&Publish{QoS: 1, PacketID: 123}), ErrPacketNotFound))
+	require.True(t, errors.Is(c.Ack(&Publish{QoS: 2, PacketID: 65535}), ErrPacketNotFound))
+}
+
+// TestReceiveMaximum checks that QOS1+ messages within the ReceiveMaximum are passed to the handlers, and that a
+// server exceeding it results in a DISCONNECT with reason code 0x93 (rather than the client blocking)
+func TestReceiveMaximum(t *testing.T) {
+	clientLogger := paholog.NewTestLogger(t, "ReceiveMaximum:")
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0})
+	go ts.Run()
+	defer ts.Stop()
+
+	received := make(chan *Publish, 3)
+	clientErr := make(chan error, 1)
+	c := NewClient(ClientConfig{
+		Conn: ts.ClientConn(),
+		OnPublishReceived: []func(PublishReceived) (bool, error){
+			func(pr PublishReceived) (bool, error) {
+				received <- pr.Packet // Acknowledgement is delayed (simulating slow processing)
+				return true, nil
+			},
+		},
+		OnClientError:              func(err error) { clientErr <- err },
+		EnableManualAcknowledgment: true,
+		SendAcksInterval:           time.Millisecond,
+	})
+	require.NotNil(t, c)
+	defer c.close()
+	c.SetDebugLogger(clientLogger)
+
+	ca, err := c.Connect(t.Context(), &Connect{
+		KeepAlive:  30,
+		ClientID:   "testClient",
+		CleanStart: true,
+		Properties: &ConnectProperties{
+			ReceiveMaximum: Uint16(2),
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, uint8(0), ca.ReasonCode)
+
+	send := func(id uint16) {
+		require.NoError(t, ts.SendPacket(&packets.Publish{
+			PacketID: id,
+			Topic:    fmt.Sprintf("test/%d", id),
+			Payload:  []byte("test payload"),
+			QoS:      1,
+		}))
+	}
+	receive := func(id uint16) *Publish {
+		select {
+		case p := <-received:
+			assert.Equal(t, id, p.PacketID)
+			return p
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for message %d", id)
+		}
+		return nil
+	}
+
+	send(1)
+	send(2)
+	p1 := receive(1)
+	receive(2)
+
+	// Acknowledging a message permits the server to send another
+	require.NoError(t, c.Ack(p1))
+	require.Eventually(t, func() bool { return len(ts.ReceivedPubacks()) == 1 }, time.Second, time.Millisecond)
+	send(3)
+	receive(3)
+
+	// A redelivery of an outstanding message does not count towards the maximum
+	require.NoError(t, ts.SendPacket(&packets.Publish{PacketID: 3, Topic: "test/3", QoS: 1, Duplicate: true}))
+	receive(3)
+
+	// Two messages are outstanding, so the server may not send another
+	send(4)
+	select {
+	case err := <-clientErr:
+		assert.ErrorIs(t, err, ErrProtocol)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for client error")
+	}
+	require.Eventually(t, func() bool { return ts.ReceivedDisconnect() != nil }, time.Second, time.Millisecond,
+		"DISCONNECT should be sent when Receive Maximum exceeded")
+	d := ts.ReceivedDisconnect()
+	assert.Equal(t, byte(packets.DisconnectReceiveMaximumExceeded), d.ReasonCode)
+	select {
+	case p := <-received:
+		t.Fatalf("message %d exceeding Receive Maximum passed to handler", p.PacketID)
+	default:
+	}
+}
+
+func TestStreamPayload(t *testing.T) {
+	clientLogger := paholog.NewTestLogger(t, "StreamPayload:")
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0})
+	go ts.Run()
+	defer ts.Stop()
+
+	type result struct {
+		topic    string
+		payload  []byte
+		streamed bool
+	}
+	received := make(chan result, 3)
+	c := NewClient(ClientConfig{
+		Conn: ts.ClientConn(),
+		OnPublishReceived: []func(PublishReceived) (bool, error){
+			func(pr PublishReceived) (bool, error) {
+				r := result{topic: pr.Packet.Topic, payload: pr.Packet.Payload}
+				if pr.Packet.PayloadReader != nil {
+					r.streamed = true
+					if pr.Packet.Topic == "large/read" { // Other messages are not read (so should be discarded)
+						var err error
+						if r.payload, err = io.ReadAll(pr.Packet.PayloadReader); err != nil {
+							return false, err
+						}
+					}
+				}
+				received <- r
+				return true, nil
+			},
+		},
+		StreamPayloadThreshold: 1024,
+	})
+	require.NotNil(t, c)
+	defer c.close()
+	c.SetDebugLogger(clientLogger)
+
+	ca, err := c.Connect(t.Context(), &Connect{
+		KeepAlive:  30,
+		ClientID:   "testClient",
+		CleanStart: true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, uint8(0), ca.ReasonCode)
+
+	large := bytes.Repeat([]byte("0123456789"), 1000)
+	require.NoError(t, ts.SendPacket(&packets.Publish{PacketID: 1, Topic: "large/read", Payload: large, QoS: 1}))
+	require.NoError(t, ts.SendPacket(&packets.Publish{PacketID: 2, Topic: "large/ignore", Payload: large, QoS: 1}))
+	require.NoError(t, ts.SendPacket(&packets.Publish{PacketID: 3, Topic: "small", Payload: []byte("small"), QoS: 1}))
+
+	want := []result{
+		{topic: "large/read", payload: large, streamed: true},
+		{topic: "large/ignore", streamed: true},
+		{topic: "small", payload: []byte("small")},
+	}
+	for _, w := range want {
+		select {
+		case r := <-received:
+			assert.Equal(t, w, r)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for message on %s", w.topic)
+		}
+	}
+	require.Eventually(t, func() bool { return len(ts.ReceivedPubacks()) == 3 }, time.Second, 10*time.Millisecond)
+}
+
+func TestStreamPayloadPublishFromHandler(t *testing.T) {
+	clientLogger := paholog.NewTestLogger(t, "StreamPayloadPublish:")
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0})
+	ts.SetResponse(packets.PUBACK, &packets.Puback{ReasonCode: packets.PubackSuccess})
+	go ts.Run()
+	defer ts.Stop()
+
+	type result struct {
+		beforeRead error // Error from Publish before the payload was read
+		afterRead  error // Error from Publish after the payload was read
+		payload    []byte
+	}
+	received := make(chan result, 1)
 	c := NewClient(ClientConfig{
 		Conn: ts.ClientConn(),
 		OnPublishReceived: []func(PublishReceived) (bool, error){
 			func(pr PublishReceived) (bool, error) {
-				defer wg.Done()
-				actualPublishPackets = append(actualPublishPackets, *pr.Packet.Packet())
-				require.NoError(t, pr.Client.Ack(pr.Packet))
+				var r result
+				pub := &Publish{Topic: "reply", QoS: 1, Payload: []byte("reply")}
+				_, r.beforeRead = pr.Client.Publish(pr.Context(), pub) // would deadlock if not rejected
+				var err error
+				if r.payload, err = io.ReadAll(pr.Packet.PayloadReader); err != nil {
+					return false, err
+				}
+				_, r.afterRead = pr.Client.Publish(pr.Context(), pub)
+				received <- r
 				return true, nil
 			},
 		},
-		EnableManualAcknowledgment: true,
+		StreamPayloadThreshold: 1024,
 	})
 	require.NotNil(t, c)
 	defer c.close()
 	c.SetDebugLogger(clientLogger)
 
-	ctx := context.Background()
-	ca, err := c.Connect(ctx, &Connect{
+	ca, err := c.Connect(t.Context(), &Connect{
 		KeepAlive:  30,
 		ClientID:   "testClient",
 		CleanStart: true,
-		Properties: &ConnectProperties{
-			ReceiveMaximum: Uint16(200),
-		},
 	})
-	require.Nil(t, err)
+	require.NoError(t, err)
 	assert.Equal(t, uint8(0), ca.ReasonCode)
 
-	var expectedPublishPackets []packets.Publish
-	for i := 1; i <= expectedPacketsCount; i++ {
-		p := packets.Publish{
-			PacketID: uint16(i),
-			Topic:    fmt.Sprintf("test/%d", i),
-			Payload:  []byte(fmt.Sprintf("test payload %d", i)),
-			QoS:      1,
-			Properties: &packets.Properties{
-				User: make([]packets.User, 0),
-			},
-		}
-		expectedPublishPackets = append(expectedPublishPackets, p)
-		require.NoError(t, ts.SendPacket(&p))
-	}
-
-	wg.Wait()
+	large := bytes.Repeat([]byte("0123456789"), 1000)
+	require.NoError(t, ts.SendPacket(&packets.Publish{PacketID: 1, Topic: "large", Payload: large, QoS: 1}))
 
-	require.Equal(t, expectedPublishPackets, actualPublishPackets)
-	expectedAcks := []packets.Puback{
-		{PacketID: 1, ReasonCode: 0, Properties: &packets.Properties{}},
-		{PacketID: 2, ReasonCode: 0, Properties: &packets.Properties{}},
-		{PacketID: 3, ReasonCode: 0, Properties: &packets.Properties{}},
+	select {
+	case r := <-received:
+		assert.ErrorIs(t, r.beforeRead, ErrStreamNotDrained)
+		assert.NoError(t, r.afterRead)
+		assert.Equal(t, large, r.payload)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for message")
 	}
-	require.Eventually(t,
-		func() bool {
-			return cmp.Equal(expectedAcks, ts.ReceivedPubacks())
-		},
-		time.Second,
-		10*time.Millisecond,
-		cmp.Diff(expectedAcks, ts.ReceivedPubacks()),
-	)
-
-	// Test QoS 0 packets are ignored
-	require.NoError(t, c.Ack(&Publish{QoS: 0, PacketID: 11233}))
-
-	// Test packets not found
-	require.True(t, errors.Is(c.Ack(&Publish{QoS: 1, PacketID: 123}), ErrPacketNotFound))
-	require.True(t, errors.Is(c.Ack(&Publish{QoS: 2, PacketID: 65535}), ErrPacketNotFound))
+	require.Eventually(t, func() bool { return len(ts.ReceivedPubacks()) == 1 }, time.Second, 10*time.Millisecond)
 }
 
 func TestReceiveServerDisconnect(t *testing.T) {
@@ -717,6 +2076,170 @@ func TestReceiveServerDisconnectNoProps(t *testing.T) {
 	}
 }
 
+// TestReceiveServerDisconnectProperties checks that the Reason String, Server Reference and User Properties in a
+// DISCONNECT are passed to OnServerDisconnect.
+func TestReceiveServerDisconnectProperties(t *testing.T) {
+	clientLogger := paholog.NewTestLogger(t, "ServerDisconnectProperties:")
+	rChan := make(chan *Disconnect, 1)
+	conn, clientConn := net.Pipe()
+
+	c := NewClient(ClientConfig{
+		Conn:               packets.NewThreadSafeConn(clientConn),
+		OnServerDisconnect: func(d *Disconnect) { rChan <- d },
+	})
+	require.NotNil(t, c)
+	defer c.close()
+	c.SetDebugLogger(clientLogger)
+
+	clientCtx := basicClientInitialisation(t.Context(), c)
+	c.publishPackets = make(chan *packets.Publish)
+	c.workers.Add(1)
+	go func() {
+		defer c.workers.Done()
+		c.incoming(clientCtx)
+	}()
+	c.config.Session.ConAckReceived(c.config.Conn, &packets.Connect{}, &packets.Connack{})
+
+	go func() {
+		_, _ = (&packets.Disconnect{
+			ReasonCode: packets.DisconnectUseAnotherServer,
+			Properties: &packets.Properties{
+				ReasonString:    "maintenance",
+				ServerReference: "other.example.com:1883",
+				User:            []packets.User{{Key: "region", Value: "eu"}},
+			},
+		}).WriteTo(conn)
+	}()
+	require.False(t, waitTimeout(&c.workers, time.Second))
+
+	select {
+	case d := <-rChan:
+		assert.Equal(t, byte(packets.DisconnectUseAnotherServer), d.ReasonCode)
+		require.NotNil(t, d.Properties)
+		assert.Equal(t, "maintenance", d.Properties.ReasonString)
+		assert.Equal(t, "other.example.com:1883", d.Properties.ServerReference)
+		assert.Equal(t, UserProperties{{Key: "region", Value: "eu"}}, d.Properties.User)
+	case <-time.After(time.Second):
+		t.Fatalf("Expected OnServerDisconnect to be called")
+	}
+}
+
+// TestReceiveServerDisconnectAbbreviated checks that DISCONNECT packets that omit the properties (and reason code)
+// are passed to OnServerDisconnect with the correct reason code.
+func TestReceiveServerDisconnectAbbreviated(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		reason byte
+	}{
+		{name: "NoProps", packet: []byte{0xe0, 0x01, 0x8e}, reason: packets.DisconnectSessionTakenOver},
+		{name: "NoReasonCode", packet: []byte{0xe0, 0x00}, reason: packets.DisconnectNormalDisconnection},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientLogger := paholog.NewTestLogger(t, "ServerDisconnectAbbreviated:")
+			rChan := make(chan byte, 1)
+			conn, clientConn := net.Pipe()
+
+			c := NewClient(ClientConfig{
+				Conn: packets.NewThreadSafeConn(clientConn),
+				OnServerDisconnect: func(d *Disconnect) {
+					rChan <- d.ReasonCode
+				},
+			})
+			require.NotNil(t, c)
+			defer c.close()
+			c.SetDebugLogger(clientLogger)
+
+			clientCtx := basicClientInitialisation(t.Context(), c)
+			c.publishPackets = make(chan *packets.Publish)
+			c.workers.Add(1)
+			go func() {
+				defer c.workers.Done()
+				c.incoming(clientCtx)
+			}()
+			c.config.Session.ConAckReceived(c.config.Conn, &packets.Connect{}, &packets.Connack{})
+
+			_, err := conn.Write(tt.packet)
+			require.NoError(t, err)
+			require.False(t, waitTimeout(&c.workers, time.Second))
+
+			select {
+			case rc := <-rChan:
+				assert.Equal(t, tt.reason, rc)
+			case <-time.After(time.Second):
+				t.Fatalf("Expected OnServerDisconnect to be called")
+			}
+		})
+	}
+}
+
+func TestKeepAliveReadDeadline(t *testing.T) {
+	s := KeepAliveReadDeadline(2 * time.Second)
+	assert.Equal(t, time.Duration(0), s(0))
+	assert.Equal(t, 32*time.Second, s(30))
+}
+
+// TestClientReadDeadline checks that the read deadline is extended as packets are received, and that the connection
+// is considered lost if the deadline expires.
+func TestClientReadDeadline(t *testing.T) {
+	clientLogger := paholog.NewTestLogger(t, "ReadDeadline:")
+	errChan := make(chan error, 1)
+	conn, clientConn := net.Pipe()
+
+	const timeout = 100 * time.Millisecond
+	var keepAlive atomic.Int32
+	keepAlive.Store(-1)
+	c := NewClient(ClientConfig{
+		Conn:           packets.NewThreadSafeConn(clientConn),
+		ReadBufferSize: 64,
+		ReadDeadline: func(ka uint16) time.Duration {
+			keepAlive.Store(int32(ka))
+			return timeout
+		},
+		OnClientError: func(err error) {
+			select {
+			case errChan <- err:
+			default:
+			}
+		},
+	})
+	require.NotNil(t, c)
+	defer c.close()
+	c.SetDebugLogger(clientLogger)
+	c.connackProps.Store(&ServerConnackProperties{KeepAlive: 5})
+
+	clientCtx := basicClientInitialisation(t.Context(), c)
+	c.publishPackets = make(chan *packets.Publish)
+	c.workers.Add(1)
+	go func() {
+		defer c.workers.Done()
+		c.incoming(clientCtx)
+	}()
+	c.config.Session.ConAckReceived(c.config.Conn, &packets.Connect{}, &packets.Connack{})
+
+	// Each packet received should reset the deadline (so the total time exceeds timeout without error)
+	for range 4 {
+		time.Sleep(timeout / 2)
+		_, err := packets.NewControlPacket(packets.PINGRESP).WriteTo(conn)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(5), keepAlive.Load())
+	select {
+	case err := <-errChan:
+		t.Fatalf("unexpected error: %s", err)
+	default:
+	}
+
+	select {
+	case err := <-errChan:
+		assert.ErrorIs(t, err, ErrReadTimeout)
+	case <-time.After(10 * timeout):
+		t.Fatalf("expected read deadline to expire")
+	}
+	require.False(t, waitTimeout(&c.workers, time.Second))
+}
+
 func TestAuthenticate(t *testing.T) {
 	t.Run("Success", func(t *testing.T) {
 		testAuthenticate(t, true, &packets.Auth{
@@ -729,9 +2252,71 @@ func TestAuthenticate(t *testing.T) {
 			ReasonCode: packets.DisconnectNotAuthorized,
 		})
 	})
+
+	t.Run("ResponseProperties", func(t *testing.T) {
+		ar := testAuthenticate(t, true, &packets.Auth{
+			ReasonCode: packets.AuthSuccess,
+			Properties: &packets.Properties{
+				AuthMethod: "TEST",
+				AuthData:   []byte("server data"),
+				User:       []packets.User{{Key: "k", Value: "v"}},
+			},
+		})
+		require.NotNil(t, ar.Properties)
+		assert.Equal(t, "TEST", ar.Properties.AuthMethod)
+		assert.Equal(t, []byte("server data"), ar.Properties.AuthData)
+		assert.Equal(t, "v", ar.Properties.User.Get("k"))
+	})
+
+	t.Run("InvalidArguments", func(t *testing.T) {
+		c := NewClient(ClientConfig{})
+		_, err := c.Authenticate(t.Context(), nil)
+		assert.ErrorIs(t, err, ErrInvalidArguments)
+		// No AuthMethod specified, or in the CONNECT
+		_, err = c.Authenticate(t.Context(), &Auth{ReasonCode: packets.AuthReauthenticate})
+		assert.ErrorIs(t, err, ErrInvalidArguments)
+		// Success (0x00) may only be sent by the server
+		_, err = c.Authenticate(t.Context(), &Auth{Properties: &AuthProperties{AuthMethod: "TEST"}})
+		assert.ErrorIs(t, err, ErrInvalidArguments)
+	})
+
+	t.Run("ConnectAuthMethod", func(t *testing.T) {
+		ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+		ts.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: packets.ConnackSuccess})
+		ts.SetResponse(packets.AUTH, &packets.Auth{ReasonCode: packets.AuthSuccess})
+		go ts.Run()
+		defer ts.Stop()
+
+		c := NewClient(ClientConfig{
+			Conn:        ts.ClientConn(),
+			AuthHandler: &fakeAuth{},
+		})
+		require.NotNil(t, c)
+		defer c.close()
+		c.SetDebugLogger(paholog.NewTestLogger(t, "ConnectAuthMethod:"))
+
+		_, err := c.Connect(t.Context(), &Connect{
+			ClientID:   "testClient",
+			CleanStart: true,
+			Properties: &ConnectProperties{AuthMethod: "TEST"},
+		})
+		require.NoError(t, err)
+
+		// If AuthMethod is not specified, the one from the CONNECT should be used
+		ar, err := c.Authenticate(t.Context(), &Auth{
+			ReasonCode: packets.AuthReauthenticate,
+			Properties: &AuthProperties{AuthData: []byte("secret data")},
+		})
+		require.NoError(t, err)
+		assert.True(t, ar.Success)
+		sent := ts.ReceivedAuth()
+		require.NotNil(t, sent)
+		assert.Equal(t, "TEST", sent.Properties.AuthMethod)
+		assert.Equal(t, []byte("secret data"), sent.Properties.AuthData)
+	})
 }
 
-func testAuthenticate(t *testing.T, wantSucces bool, response packets.Packet) {
+func testAuthenticate(t *testing.T, wantSucces bool, response packets.Packet) *AuthResponse {
 	t.Helper()
 	clientLogger := paholog.NewTestLogger(t, t.Name()+":")
 	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
@@ -773,6 +2358,7 @@ func testAuthenticate(t *testing.T, wantSucces bool, response packets.Packet) {
 	assert.Equal(t, wantSucces, ar.Success)
 
 	time.Sleep(10 * time.Millisecond)
+	return ar
 }
 
 type TestAuth struct {
@@ -1097,7 +2683,97 @@ func (f *fakeAuth) Authenticate(a *Auth) *Auth {
 
 func (f *fakeAuth) Authenticated() {}
 
-// TestAddOnPublishReceived checks we can add and remove onPublishReceived callbacks
+// TestClientSetRouter checks that the Router can be replaced
+func TestClientSetRouter(t *testing.T) {
+	route := func(c *Client) {
+		c.onPublishReceivedMu.Lock()
+		handlers := slices.Clone(c.onPublishReceived)
+		c.onPublishReceivedMu.Unlock()
+		for _, f := range handlers {
+			f(PublishReceived{Packet: &Publish{Topic: "test", Properties: &PublishProperties{}}})
+		}
+	}
+
+	// Client created without a Router
+	var oneCount, twoCount atomic.Int32
+	c := NewClient(ClientConfig{OnPublishReceived: []func(PublishReceived) (bool, error){
+		func(PublishReceived) (bool, error) { return false, nil },
+	}})
+	require.ErrorIs(t, c.SetRouter(nil), ErrInvalidArguments)
+	require.NoError(t, c.SetRouter(NewStandardRouterWithDefault(func(*Publish) { oneCount.Add(1) })))
+	route(c)
+	require.Equal(t, int32(1), oneCount.Load())
+
+	// An in-progress Route must complete before SetRouter returns
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	c = NewClient(ClientConfig{Router: NewStandardRouterWithDefault(func(*Publish) {
+		oneCount.Add(1)
+		close(entered)
+		<-release
+	})})
+	go route(c)
+	<-entered
+	swapped := make(chan struct{})
+	go func() {
+		_ = c.SetRouter(NewStandardRouterWithDefault(func(*Publish) { twoCount.Add(1) }))
+		close(swapped)
+	}()
+	select {
+	case <-swapped:
+		t.Fatal("SetRouter returned whilst Route in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// Whilst SetRouter waits, messages are passed to the new Router, and the Client remains usable
+	route(c)
+	require.Equal(t, int32(1), twoCount.Load())
+	require.NoError(t, c.SetRouter(NewStandardRouterWithDefault(func(*Publish) { twoCount.Add(1) })))
+	close(release)
+	<-swapped
+	route(c)
+	require.Equal(t, int32(2), oneCount.Load())
+	require.Equal(t, int32(2), twoCount.Load())
+}
+
+// TestClientSetRouterAliases checks that inbound topic aliases are passed to the new Router
+func TestClientSetRouterAliases(t *testing.T) {
+	route := func(c *Client, topic string, alias uint16) {
+		c.onPublishReceivedMu.Lock()
+		handlers := slices.Clone(c.onPublishReceived)
+		c.onPublishReceivedMu.Unlock()
+		for _, f := range handlers {
+			f(PublishReceived{Packet: &Publish{Topic: topic, Properties: &PublishProperties{TopicAlias: &alias}}})
+		}
+	}
+
+	var oneCount, twoCount atomic.Int32
+	one := NewStandardRouter(WithTopicAliasMaximum(10, 0))
+	one.RegisterHandler("a/b", func(*Publish) { oneCount.Add(1) })
+	c := NewClient(ClientConfig{Router: one})
+	route(c, "a/b", 1)
+	require.Equal(t, int32(1), oneCount.Load())
+
+	two := NewStandardRouter()
+	two.RegisterHandler("a/b", func(*Publish) { twoCount.Add(1) })
+	require.NoError(t, c.SetRouter(AsRouter(two))) // the alias table is also passed through adapters
+	route(c, "", 1)
+	require.Equal(t, int32(1), twoCount.Load(), "alias established with previous Router should be resolved")
+	require.Equal(t, uint16(10), two.aliases.Load().max, "limits should be passed with the aliases")
+
+	// The previous Router no longer shares the table
+	_, ok := one.aliases.Load().get(1)
+	require.False(t, ok)
+	one.aliases.Load().set(2, "c/d")
+	_, ok = two.aliases.Load().get(2)
+	require.False(t, ok)
+
+	// Aliases reset upon connection are not resurrected
+	two.ResetAliases()
+	require.NoError(t, c.SetRouter(one))
+	route(c, "", 1)
+	require.Equal(t, int32(1), oneCount.Load())
+}
+
 func TestAddOnPublishReceived(t *testing.T) {
 	callAll := func(c *Client) {
 		for _, f := range c.onPublishReceived {
@@ -1163,6 +2839,40 @@ func TestAddOnPublishReceived(t *testing.T) {
 	require.Equal(t, 1, testThree, "Expected 1")
 }
 
+// discardConn is a net.Conn that discards anything written to it (other methods must not be called)
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) { return len(b), nil }
+
+// BenchmarkClientPublishQoS0 measures the rate at which QOS0 messages can be published (these bypass the session, so
+// parallel publishers should not contend for packet identifiers or quota)
+func BenchmarkClientPublishQoS0(b *testing.B) {
+	c := NewClient(ClientConfig{Conn: discardConn{}})
+	p := &Publish{Topic: "test/telemetry", QoS: 0, Payload: []byte("telemetry payload")}
+
+	b.Run("serial", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := c.Publish(context.Background(), p); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := c.Publish(context.Background(), p); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
+
 // basicClientInitialisation initialises a Client that will be used without calling Connect
 // performs the least configuration possible such that calling `close()` will cleanly shutdown
 // Should only be used if `client.Connect()` will not be called.
@@ -1174,3 +2884,304 @@ func basicClientInitialisation(ctx context.Context, c *Client) context.Context {
 	context.AfterFunc(ctx, func() { c.shutdown(done) })
 	return ctx
 }
+
+// TestClientReusePublish checks that, with ReusePublish set, the same Publish is passed to OnPublishReceived for each
+// message (populated with that message's values)
+func TestClientReusePublish(t *testing.T) {
+	type received struct {
+		p     *Publish
+		topic string
+		user  UserProperties
+	}
+	var got []received
+	c := NewClient(ClientConfig{
+		ReusePublish: true,
+		OnPublishReceived: []func(PublishReceived) (bool, error){
+			func(pr PublishReceived) (bool, error) {
+				got = append(got, received{p: pr.Packet, topic: pr.Packet.Topic, user: slices.Clone(pr.Packet.Properties.User)})
+				return true, nil
+			},
+		},
+	})
+	c.publishPackets = make(chan *packets.Publish, 2)
+	c.publishPackets <- &packets.Publish{Topic: "one", Properties: &packets.Properties{User: []packets.User{{Key: "k", Value: "1"}}}}
+	c.publishPackets <- &packets.Publish{Topic: "two", Properties: &packets.Properties{}}
+	close(c.publishPackets)
+	c.routePublishPackets()
+
+	require.Len(t, got, 2)
+	assert.Same(t, got[0].p, got[1].p)
+	assert.Equal(t, "one", got[0].topic)
+	assert.Equal(t, UserProperties{{Key: "k", Value: "1"}}, got[0].user)
+	assert.Equal(t, "two", got[1].topic)
+	assert.Empty(t, got[1].user)
+}
+
+// TestDisconnectWithOptions checks that the DISCONNECT sent matches that requested, and that invalid requests are
+// rejected without closing the connection
+func TestDisconnectWithOptions(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	var raw bytes.Buffer
+	received := make(chan *packets.ControlPacket, 1)
+	go func() { // Acknowledge the CONNECT and capture the DISCONNECT (and its encoding)
+		r := io.TeeReader(serverConn, &raw)
+		for {
+			raw.Reset()
+			cp, err := packets.ReadPacket(r)
+			if err != nil {
+				close(received)
+				return
+			}
+			switch cp.Type {
+			case packets.CONNECT:
+				if _, err := (&packets.Connack{}).WriteTo(serverConn); err != nil {
+					close(received)
+					return
+				}
+			case packets.DISCONNECT:
+				received <- cp
+				return
+			}
+		}
+	}()
+
+	c := NewClient(ClientConfig{Conn: packets.NewThreadSafeConn(clientConn)})
+	require.NotNil(t, c)
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", CleanStart: true,
+		Properties: &ConnectProperties{SessionExpiryInterval: Uint32(60)}})
+	require.NoError(t, err)
+
+	for name, d := range map[string]*Disconnect{
+		"nil":             nil,
+		"serverReason":    {ReasonCode: packets.DisconnectServerShuttingDown},
+		"serverReference": {Properties: &DisconnectProperties{ServerReference: "b.example.com"}},
+	} {
+		assert.ErrorIs(t, c.DisconnectWithOptions(context.Background(), d), ErrInvalidArguments, name)
+	}
+	select {
+	case <-c.Done():
+		t.Fatal("connection should remain open after invalid request")
+	default:
+	}
+
+	d := &Disconnect{
+		ReasonCode: packets.DisconnectDisconnectWithWillMessage,
+		Properties: &DisconnectProperties{
+			SessionExpiryInterval: Uint32(3600),
+			ReasonString:          "going away",
+			User:                  UserProperties{{Key: "k", Value: "v"}},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, c.DisconnectWithOptions(ctx, d))
+	<-c.Done()
+
+	cp, ok := <-received
+	require.True(t, ok, "DISCONNECT not received")
+	var expected bytes.Buffer
+	_, err = d.Packet().WriteTo(&expected)
+	require.NoError(t, err)
+	assert.Equal(t, expected.Bytes(), raw.Bytes())
+	sent := cp.Content.(*packets.Disconnect)
+	assert.Equal(t, byte(packets.DisconnectDisconnectWithWillMessage), sent.ReasonCode)
+	require.NotNil(t, sent.Properties)
+	assert.Equal(t, uint32(3600), *sent.Properties.SessionExpiryInterval)
+	assert.Equal(t, "going away", sent.Properties.ReasonString)
+	assert.Equal(t, []packets.User{{Key: "k", Value: "v"}}, sent.Properties.User)
+}
+
+// TestDisconnectWithOptionsSessionExpiry checks that a Session Expiry Interval cannot be set in DISCONNECT when it was
+// zero in CONNECT
+func TestDisconnectWithOptionsSessionExpiry(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{Conn: ts.ClientConn()})
+	require.NotNil(t, c)
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", KeepAlive: 30, CleanStart: true})
+	require.NoError(t, err)
+
+	err = c.DisconnectWithOptions(context.Background(), &Disconnect{Properties: &DisconnectProperties{SessionExpiryInterval: Uint32(60)}})
+	assert.ErrorIs(t, err, ErrInvalidArguments)
+	require.NoError(t, c.DisconnectWithOptions(context.Background(), &Disconnect{Properties: &DisconnectProperties{SessionExpiryInterval: Uint32(0)}}))
+	<-c.Done()
+}
+
+// TestClientBytesHooks checks that OnBytesRead and OnBytesWritten are passed the raw data (one packet per write)
+func TestClientBytesHooks(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0, Properties: &packets.Properties{ReasonString: "welcome"}})
+	go ts.Run()
+	defer ts.Stop()
+
+	var mu sync.Mutex
+	var read bytes.Buffer
+	var written [][]byte
+	c := NewClient(ClientConfig{
+		Conn: ts.ClientConn(),
+		OnBytesRead: func(b []byte) {
+			mu.Lock()
+			read.Write(b)
+			mu.Unlock()
+		},
+		OnBytesWritten: func(b []byte) {
+			mu.Lock()
+			written = append(written, b)
+			mu.Unlock()
+		},
+	})
+	require.NotNil(t, c)
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+	_, err = c.Publish(context.Background(), &Publish{Topic: "test/tap", Payload: []byte("payload")})
+	require.NoError(t, err)
+	require.NoError(t, c.Disconnect(&Disconnect{}))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, written, 3)
+	for i, pt := range []byte{packets.CONNECT, packets.PUBLISH, packets.DISCONNECT} {
+		r := bytes.NewReader(written[i])
+		cp, err := packets.ReadPacket(r)
+		require.NoError(t, err)
+		assert.Equal(t, pt, cp.Type)
+		assert.Zero(t, r.Len(), "each write should contain exactly one packet")
+		if pt == packets.PUBLISH {
+			assert.Equal(t, "test/tap", cp.Content.(*packets.Publish).Topic)
+			assert.Equal(t, []byte("payload"), cp.Content.(*packets.Publish).Payload)
+		}
+	}
+	cp, err := packets.ReadPacket(&read)
+	require.NoError(t, err)
+	require.Equal(t, packets.CONNACK, cp.Type)
+	assert.Equal(t, "welcome", cp.Content.(*packets.Connack).Properties.ReasonString)
+}
+
+// TestManualAckDeferred checks that, with EnableManualAcknowledgment, no PUBACK is sent until Ack is called (after the
+// handler has returned, from another goroutine) and that a duplicate delivery is acknowledged once
+func TestManualAckDeferred(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{})
+	go ts.Run()
+	defer ts.Stop()
+
+	received := make(chan *Publish, 2)
+	c := NewClient(ClientConfig{
+		Conn: ts.ClientConn(),
+		OnPublishReceived: []func(PublishReceived) (bool, error){
+			func(pr PublishReceived) (bool, error) {
+				received <- pr.Packet // acknowledged later
+				return true, nil
+			},
+		},
+		EnableManualAcknowledgment: true,
+		SendAcksInterval:           time.Millisecond,
+	})
+	require.NotNil(t, c)
+	defer c.close()
+	_, err := c.Connect(context.Background(), &Connect{KeepAlive: 30, ClientID: "testClient", CleanStart: true})
+	require.NoError(t, err)
+	assert.Empty(t, c.PendingAcks())
+
+	p := &packets.Publish{PacketID: 7, Topic: "test/ack", QoS: 1, Payload: []byte("payload")}
+	require.NoError(t, ts.SendPacket(p))
+	p.Duplicate = true
+	require.NoError(t, ts.SendPacket(p)) // redelivery (e.g. sent before the server saw our PUBACK)
+	first, dup := <-received, <-received
+	assert.Equal(t, uint16(7), first.PacketID)
+	assert.Equal(t, byte(1), first.QoS)
+	assert.Equal(t, uint16(7), dup.PacketID)
+
+	time.Sleep(50 * time.Millisecond) // many SendAcksInterval periods
+	assert.Empty(t, ts.ReceivedPubacks(), "PUBACK sent before Ack called")
+	assert.Equal(t, []uint16{7}, c.PendingAcks())
+
+	ackErr := make(chan error)
+	go func() { ackErr <- c.Ack(first) }()
+	require.NoError(t, <-ackErr)
+	require.Eventually(t, func() bool { return len(ts.ReceivedPubacks()) > 0 }, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond) // ensure no further PUBACK is sent
+	assert.Equal(t, []packets.Puback{{PacketID: 7, Properties: &packets.Properties{}}}, ts.ReceivedPubacks())
+	assert.Empty(t, c.PendingAcks())
+}
+
+func TestClientUTF8Validation(t *testing.T) {
+	const invalid = "ab\xed\xa0\x80" // UTF-16 surrogate half
+	badProps := func() *packets.Properties {
+		return &packets.Properties{User: []packets.User{{Key: "k", Value: invalid}}}
+	}
+
+	// Each client applies its own setting (so connections to different servers may use different policies)
+	run := func(t *testing.T, v packets.UTF8Validation) (received chan *Publish, clientErr chan error, c *Client, ts *basictestserver.TestServer) {
+		ts = basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+		ts.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0})
+		go ts.Run()
+		t.Cleanup(ts.Stop)
+
+		received = make(chan *Publish, 1)
+		clientErr = make(chan error, 1)
+		c = NewClient(ClientConfig{
+			Conn:           ts.ClientConn(),
+			UTF8Validation: v,
+			OnPublishReceived: []func(PublishReceived) (bool, error){
+				func(pr PublishReceived) (bool, error) {
+					received <- pr.Packet
+					return true, nil
+				},
+			},
+			OnClientError: func(err error) { clientErr <- err },
+		})
+		require.NotNil(t, c)
+		t.Cleanup(c.close)
+		c.SetDebugLogger(paholog.NewTestLogger(t, "UTF8Validation:"))
+		_, err := c.Connect(t.Context(), &Connect{ClientID: "testClient", KeepAlive: 30})
+		require.NoError(t, err)
+		return received, clientErr, c, ts
+	}
+
+	t.Run("Strict", func(t *testing.T) {
+		_, clientErr, c, ts := run(t, packets.UTF8Strict)
+
+		_, err := c.Publish(t.Context(), &Publish{Topic: "test", Properties: &PublishProperties{
+			User: UserProperties{{Key: "k", Value: invalid}},
+		}})
+		assert.ErrorIs(t, err, ErrInvalidArguments)
+		assert.ErrorIs(t, err, packets.ErrInvalidUTF8)
+		_, err = c.Subscribe(t.Context(), &Subscribe{Subscriptions: []SubscribeOptions{{Topic: invalid}}})
+		assert.ErrorIs(t, err, packets.ErrInvalidUTF8)
+
+		// An invalid string from the server is a protocol error (the client may close the connection before the write
+		// completes, so the error from SendPacket is ignored)
+		_ = ts.SendPacket(&packets.Publish{Topic: "test", Properties: badProps()})
+		select {
+		case err := <-clientErr:
+			assert.ErrorIs(t, err, ErrProtocol)
+			assert.ErrorIs(t, err, packets.ErrInvalidUTF8)
+		case <-time.After(time.Second):
+			t.Fatal("expected client error")
+		}
+	})
+
+	t.Run("Lenient", func(t *testing.T) {
+		received, clientErr, c, ts := run(t, packets.UTF8Lenient)
+
+		_, err := c.Publish(t.Context(), &Publish{Topic: "test", Properties: &PublishProperties{
+			User: UserProperties{{Key: "k", Value: invalid}},
+		}})
+		assert.NoError(t, err)
+
+		require.NoError(t, ts.SendPacket(&packets.Publish{Topic: "test", Properties: badProps()}))
+		select {
+		case p := <-received:
+			assert.Equal(t, invalid, p.Properties.User.Get("k"))
+		case err := <-clientErr:
+			t.Fatalf("unexpected client error: %s", err)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for message")
+		}
+	})
+}
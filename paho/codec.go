@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"fmt"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+// PayloadEncodingProperty is the User Property used to mark a PUBLISH whose payload has been encoded by a
+// PayloadCodec; its value is the codec's Name.
+const PayloadEncodingProperty = "content-encoding"
+
+// PayloadCodec encodes (e.g. compresses) outbound payloads and decodes inbound payloads (see ClientConfig.PayloadCodec).
+type PayloadCodec interface {
+	Name() string                  // Identifies the encoding (sent as the value of the PayloadEncodingProperty User Property)
+	Encode([]byte) ([]byte, error) // Encode an outbound payload
+	Decode([]byte) ([]byte, error) // Decode an inbound payload
+}
+
+// encodePayload encodes the payload of pb using the configured codec and adds the PayloadEncodingProperty marker.
+// Messages that already carry the marker (i.e. the application has encoded the payload itself) are not altered.
+func (c *Client) encodePayload(pb *packets.Publish) error {
+	if pb.Properties == nil {
+		pb.Properties = &packets.Properties{}
+	}
+	for _, u := range pb.Properties.User {
+		if u.Key == PayloadEncodingProperty {
+			return nil
+		}
+	}
+	encoded, err := c.config.PayloadCodec.Encode(pb.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode payload (%s): %w", c.config.PayloadCodec.Name(), err)
+	}
+	pb.Payload = encoded
+	pb.Properties.User = append(pb.Properties.User, packets.User{Key: PayloadEncodingProperty, Value: c.config.PayloadCodec.Name()})
+	return nil
+}
+
+// decodePayload decodes the payload of p if it carries the PayloadEncodingProperty marker for the configured codec.
+// If decoding fails, the message is passed on unaltered (so the handler can detect this via the marker).
+func (c *Client) decodePayload(p *Publish) {
+	if p.PayloadReader != nil || p.Properties == nil || p.Properties.User.Get(PayloadEncodingProperty) != c.config.PayloadCodec.Name() {
+		return
+	}
+	decoded, err := c.config.PayloadCodec.Decode(p.Payload)
+	if err != nil {
+		c.errors.Printf("failed to decode payload of message on %s (%s): %s", p.Topic, c.config.PayloadCodec.Name(), err)
+		return
+	}
+	p.Payload = decoded
+}
@@ -83,25 +83,35 @@ type AuthResponse struct {
 // AuthResponseFromPacketAuth takes a packets library Auth and
 // returns a paho library AuthResponse
 func AuthResponseFromPacketAuth(a *packets.Auth) *AuthResponse {
-	return &AuthResponse{
+	v := &AuthResponse{
 		Success:    true,
 		ReasonCode: a.ReasonCode,
-		Properties: &AuthProperties{
+	}
+	if a.Properties != nil {
+		v.Properties = &AuthProperties{
+			AuthMethod:   a.Properties.AuthMethod,
+			AuthData:     a.Properties.AuthData,
 			ReasonString: a.Properties.ReasonString,
 			User:         UserPropertiesFromPacketUser(a.Properties.User),
-		},
+		}
 	}
+
+	return v
 }
 
 // AuthResponseFromPacketDisconnect takes a packets library Disconnect and
 // returns a paho library AuthResponse
 func AuthResponseFromPacketDisconnect(d *packets.Disconnect) *AuthResponse {
-	return &AuthResponse{
+	v := &AuthResponse{
 		Success:    false,
 		ReasonCode: d.ReasonCode,
-		Properties: &AuthProperties{
+	}
+	if d.Properties != nil {
+		v.Properties = &AuthProperties{
 			ReasonString: d.Properties.ReasonString,
 			User:         UserPropertiesFromPacketUser(d.Properties.User),
-		},
+		}
 	}
+
+	return v
 }
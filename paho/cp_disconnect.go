@@ -38,6 +38,10 @@ type (
 // Properties struct and completes the properties of the Disconnect on
 // which it is called
 func (d *Disconnect) InitProperties(p *packets.Properties) {
+	if p == nil {
+		d.Properties = &DisconnectProperties{}
+		return
+	}
 	d.Properties = &DisconnectProperties{
 		SessionExpiryInterval: p.SessionExpiryInterval,
 		ServerReference:       p.ServerReference,
@@ -71,3 +75,25 @@ func (d *Disconnect) Packet() *packets.Disconnect {
 
 	return v
 }
+
+// clientDisconnectReason returns true if code is a DISCONNECT reason code that a client may send
+func clientDisconnectReason(code byte) bool {
+	switch code {
+	case packets.DisconnectNormalDisconnection,
+		packets.DisconnectDisconnectWithWillMessage,
+		packets.DisconnectUnspecifiedError,
+		packets.DisconnectMalformedPacket,
+		packets.DisconnectProtocolError,
+		packets.DisconnectImplementationSpecificError,
+		packets.DisconnectTopicNameInvalid,
+		packets.DisconnectReceiveMaximumExceeded,
+		packets.DisconnectTopicAliasInvalid,
+		packets.DisconnectPacketTooLarge,
+		packets.DisconnectMessageRateTooHigh,
+		packets.DisconnectQuotaExceeded,
+		packets.DisconnectAdministrativeAction,
+		packets.DisconnectPayloadFormatInvalid:
+		return true
+	}
+	return false
+}
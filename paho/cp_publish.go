@@ -16,8 +16,13 @@
 package paho
 
 import (
-	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/eclipse/paho.golang/packets"
 )
@@ -28,10 +33,14 @@ type (
 		PacketID   uint16
 		QoS        byte
 		duplicate  bool // private because this should only ever be set in paho/session
-		Retain     bool
+		Retain     bool // On received messages, set if sent because a subscription was made (or, with RetainAsPublished, if the publisher set it); see RetainedTracker
 		Topic      string
 		Properties *PublishProperties
 		Payload    []byte
+
+		// PayloadReader is set (and Payload is nil) when the payload is being streamed from the connection (see
+		// ClientConfig.StreamPayloadThreshold). It is only valid until the handler returns.
+		PayloadReader io.Reader
 	}
 
 	// PublishProperties is a struct of the properties that can be set
@@ -45,6 +54,10 @@ type (
 		SubscriptionIdentifier *int
 		TopicAlias             *uint16
 		User                   UserProperties
+
+		// SubscriptionIdentifiers holds all subscription identifiers received with the message (a message matching
+		// multiple subscriptions may carry more than one)
+		SubscriptionIdentifiers []int
 	}
 )
 
@@ -61,6 +74,8 @@ func (p *Publish) InitProperties(prop *packets.Properties) {
 		TopicAlias:             prop.TopicAlias,
 		SubscriptionIdentifier: prop.SubscriptionIdentifier,
 		User:                   UserPropertiesFromPacketUser(prop.User),
+
+		SubscriptionIdentifiers: prop.SubscriptionIdentifiers,
 	}
 }
 
@@ -74,18 +89,72 @@ func PublishFromPacketPublish(p *packets.Publish) *Publish {
 		Retain:    p.Retain,
 		Topic:     p.Topic,
 		Payload:   p.Payload,
+
+		PayloadReader: p.PayloadReader,
 	}
 	v.InitProperties(p.Properties)
 
 	return v
 }
 
+// PublishFromPacketPublishInto is equivalent to PublishFromPacketPublish but populates dst (reusing dst.Properties,
+// and the capacity of dst.Properties.User, where possible) rather than allocating a new Publish; dst is returned.
+// This reduces allocations when handling high message rates, but the caller must ensure that nothing retains dst
+// (or its Properties) once it is reused.
+func PublishFromPacketPublishInto(dst *Publish, p *packets.Publish) *Publish {
+	props := dst.Properties
+	*dst = Publish{
+		PacketID:  p.PacketID,
+		QoS:       p.QoS,
+		duplicate: p.Duplicate,
+		Retain:    p.Retain,
+		Topic:     p.Topic,
+		Payload:   p.Payload,
+
+		PayloadReader: p.PayloadReader,
+	}
+	if props == nil {
+		dst.InitProperties(p.Properties)
+		return dst
+	}
+	user := props.User[:0]
+	for _, u := range p.Properties.User {
+		user = append(user, UserProperty{u.Key, u.Value})
+	}
+	*props = PublishProperties{
+		PayloadFormat:          p.Properties.PayloadFormat,
+		MessageExpiry:          p.Properties.MessageExpiry,
+		ContentType:            p.Properties.ContentType,
+		ResponseTopic:          p.Properties.ResponseTopic,
+		CorrelationData:        p.Properties.CorrelationData,
+		TopicAlias:             p.Properties.TopicAlias,
+		SubscriptionIdentifier: p.Properties.SubscriptionIdentifier,
+		User:                   user,
+
+		SubscriptionIdentifiers: p.Properties.SubscriptionIdentifiers,
+	}
+	dst.Properties = props
+	return dst
+}
+
 // Duplicate returns true if the duplicate flag is set (the server sets this if the message has
 // been sent previously; this does not necessarily mean the client has previously processed the message).
 func (p *Publish) Duplicate() bool {
 	return p.duplicate
 }
 
+// ExpiryContext returns a context derived from parent with a deadline at which the message will expire (received
+// plus the Message Expiry Interval; the server reduces the interval by the time the message spent waiting on the
+// server, so received should be the time the message was received from the server). A handler that respects the
+// returned context will therefore not continue processing a message beyond its expiry. If the message has no Message
+// Expiry Interval the returned context has no deadline (beyond any on parent).
+func (p *Publish) ExpiryContext(parent context.Context, received time.Time) (context.Context, context.CancelFunc) {
+	if p.Properties == nil || p.Properties.MessageExpiry == nil {
+		return context.WithCancel(parent)
+	}
+	return context.WithDeadline(parent, received.Add(time.Duration(*p.Properties.MessageExpiry)*time.Second))
+}
+
 // Packet returns a packets library Publish from the paho Publish
 // on which it is called
 func (p *Publish) Packet() *packets.Publish {
@@ -113,38 +182,124 @@ func (p *Publish) Packet() *packets.Publish {
 	return v
 }
 
-func (p *Publish) String() string {
-	if p == nil {
-		return "Publish==nil"
+// PublishSummary describes a Publish in a form suitable for logging; the payload is represented by its length, and
+// the correlation data by its presence, so potentially large or sensitive data is not logged unless a payload preview
+// is requested (see Publish.Summary).
+type PublishSummary struct {
+	Topic           string                `json:"topic"`
+	QoS             byte                  `json:"qos"`
+	Retain          bool                  `json:"retain"`
+	Duplicate       bool                  `json:"duplicate,omitempty"`
+	PacketID        uint16                `json:"packet_id,omitempty"`
+	PayloadLength   int                   `json:"payload_length"`
+	PayloadStreamed bool                  `json:"payload_streamed,omitempty"` // Payload is being read from the connection (length unknown)
+	PayloadPreview  string                `json:"payload_preview,omitempty"`
+	ContentType     string                `json:"content_type,omitempty"`
+	ResponseTopic   string                `json:"response_topic,omitempty"`
+	CorrelationData bool                  `json:"correlation_data,omitempty"`
+	User            []SummaryUserProperty `json:"user_properties,omitempty"`
+}
+
+// SummaryUserProperty is a User Property within a PublishSummary
+type SummaryUserProperty struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Summary returns a PublishSummary describing the message. If previewLen is greater than 0, up to previewLen bytes of
+// the payload are included in PayloadPreview (followed by "..." if the payload is longer).
+func (p *Publish) Summary(previewLen int) PublishSummary {
+	s := PublishSummary{
+		Topic:           p.Topic,
+		QoS:             p.QoS,
+		Retain:          p.Retain,
+		Duplicate:       p.duplicate,
+		PacketID:        p.PacketID,
+		PayloadLength:   len(p.Payload),
+		PayloadStreamed: p.PayloadReader != nil,
+	}
+	if previewLen > 0 && len(p.Payload) > 0 {
+		if len(p.Payload) > previewLen {
+			s.PayloadPreview = string(p.Payload[:previewLen]) + "..."
+		} else {
+			s.PayloadPreview = string(p.Payload)
+		}
+	}
+	if p.Properties != nil {
+		s.ContentType = p.Properties.ContentType
+		s.ResponseTopic = p.Properties.ResponseTopic
+		s.CorrelationData = len(p.Properties.CorrelationData) > 0
+		for _, u := range p.Properties.User {
+			s.User = append(s.User, SummaryUserProperty{Key: u.Key, Value: u.Value})
+		}
 	}
-	var b bytes.Buffer
+	return s
+}
 
-	fmt.Fprintf(&b, "topic: %s  qos: %d  retain: %t\n", p.Topic, p.QoS, p.Retain)
-	if p.Properties.PayloadFormat != nil {
-		fmt.Fprintf(&b, "PayloadFormat: %v\n", p.Properties.PayloadFormat)
+// String implements fmt.Stringer, returning a single line describing the summary
+func (s PublishSummary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "topic: %q qos: %d retain: %t", s.Topic, s.QoS, s.Retain)
+	if s.Duplicate {
+		b.WriteString(" duplicate: true")
 	}
-	if p.Properties.MessageExpiry != nil {
-		fmt.Fprintf(&b, "MessageExpiry: %v\n", p.Properties.MessageExpiry)
+	if s.PacketID != 0 {
+		fmt.Fprintf(&b, " packet_id: %d", s.PacketID)
 	}
-	if p.Properties.ContentType != "" {
-		fmt.Fprintf(&b, "ContentType: %v\n", p.Properties.ContentType)
+	if s.PayloadStreamed {
+		b.WriteString(" payload: streamed")
+	} else {
+		fmt.Fprintf(&b, " payload_length: %d", s.PayloadLength)
 	}
-	if p.Properties.ResponseTopic != "" {
-		fmt.Fprintf(&b, "ResponseTopic: %v\n", p.Properties.ResponseTopic)
+	if s.ContentType != "" {
+		fmt.Fprintf(&b, " content_type: %q", s.ContentType)
 	}
-	if p.Properties.CorrelationData != nil {
-		fmt.Fprintf(&b, "CorrelationData: %v\n", p.Properties.CorrelationData)
+	if s.ResponseTopic != "" {
+		fmt.Fprintf(&b, " response_topic: %q", s.ResponseTopic)
 	}
-	if p.Properties.TopicAlias != nil {
-		fmt.Fprintf(&b, "TopicAlias: %d\n", p.Properties.TopicAlias)
+	if s.CorrelationData {
+		b.WriteString(" correlation_data: true")
 	}
-	if p.Properties.SubscriptionIdentifier != nil {
-		fmt.Fprintf(&b, "SubscriptionIdentifier: %v\n", p.Properties.SubscriptionIdentifier)
+	for _, u := range s.User {
+		fmt.Fprintf(&b, " user: %q=%q", u.Key, u.Value)
 	}
-	for _, v := range p.Properties.User {
-		fmt.Fprintf(&b, "User: %s : %s\n", v.Key, v.Value)
+	if s.PayloadPreview != "" {
+		fmt.Fprintf(&b, " payload_preview: %q", s.PayloadPreview)
 	}
-	b.WriteString(string(p.Payload))
-
 	return b.String()
 }
+
+// String implements fmt.Stringer; it returns a single line describing the message (the payload itself is not
+// included; use Summary to obtain a preview).
+func (p *Publish) String() string {
+	if p == nil {
+		return "Publish==nil"
+	}
+	return p.Summary(0).String()
+}
+
+// MarshalJSON implements json.Marshaler, encoding the message as a PublishSummary (without a payload preview) so that
+// a Publish can be passed directly to structured loggers. Use Summary to include a preview of the payload.
+func (p *Publish) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.Summary(0))
+}
+
+// ValidatePublishTopic returns an error wrapping ErrInvalidTopic if topic is not a valid MQTT Topic Name: it must not
+// be empty, contain wildcard characters ('+' or '#') or U+0000, be invalid UTF-8, or exceed 65535 bytes. Publish
+// performs this check (other than for an empty topic where a Topic Alias is used); a server will generally close the
+// connection upon receiving an invalid Topic Name.
+func ValidatePublishTopic(topic string) error {
+	switch {
+	case topic == "":
+		return fmt.Errorf("%w: topic is empty", ErrInvalidTopic)
+	case len(topic) > 65535:
+		return fmt.Errorf("%w: topic is %d bytes (maximum 65535)", ErrInvalidTopic, len(topic))
+	case strings.ContainsAny(topic, "+#"):
+		return fmt.Errorf("%w: %q contains a wildcard character", ErrInvalidTopic, topic)
+	case strings.ContainsRune(topic, 0):
+		return fmt.Errorf("%w: %q contains a null character", ErrInvalidTopic, topic)
+	case !utf8.ValidString(topic):
+		return fmt.Errorf("%w: %q is not valid UTF-8", ErrInvalidTopic, topic)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishString(t *testing.T) {
+	// Without properties
+	p := &Publish{Topic: "a/b", QoS: 1, PacketID: 7, Payload: []byte("secret payload")}
+	assert.Equal(t, `topic: "a/b" qos: 1 retain: false packet_id: 7 payload_length: 14`, p.String())
+	assert.Equal(t, p.String(), fmt.Sprint(p))
+	assert.NotContains(t, p.String(), "secret", "payload should not be logged by default")
+
+	j, err := json.Marshal(p)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"topic":"a/b","qos":1,"retain":false,"packet_id":7,"payload_length":14}`, string(j))
+
+	// With properties (and a payload preview)
+	p = &Publish{
+		Topic:   "c",
+		Retain:  true,
+		Payload: []byte("hello world"),
+		Properties: &PublishProperties{
+			ContentType:     "text/plain",
+			ResponseTopic:   "reply",
+			CorrelationData: []byte{1, 2, 3},
+			User:            UserProperties{{Key: "k", Value: "v"}, {Key: "k", Value: "v2"}},
+		},
+	}
+	assert.Equal(t, `topic: "c" qos: 0 retain: true payload_length: 11 content_type: "text/plain" response_topic: "reply" correlation_data: true user: "k"="v" user: "k"="v2"`, p.String())
+	assert.Equal(t, p.String()+` payload_preview: "hello..."`, p.Summary(5).String())
+	assert.Equal(t, "hello world", p.Summary(100).PayloadPreview)
+
+	j, err = json.Marshal(p)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"topic":"c","qos":0,"retain":true,"payload_length":11,"content_type":"text/plain",
+		"response_topic":"reply","correlation_data":true,"user_properties":[{"key":"k","value":"v"},{"key":"k","value":"v2"}]}`, string(j))
+	j, err = json.Marshal(p.Summary(5))
+	require.NoError(t, err)
+	assert.Contains(t, string(j), `"payload_preview":"hello..."`)
+
+	assert.Equal(t, "Publish==nil", (*Publish)(nil).String())
+}
+
+func TestPublishExpiryContext(t *testing.T) {
+	received := time.Now().Add(-2 * time.Second) // Message has been waiting for 2 seconds
+	expiry := uint32(10)
+	p := &Publish{Topic: "a/b", Properties: &PublishProperties{MessageExpiry: &expiry}}
+	ctx, cancel := p.ExpiryContext(context.Background(), received)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	require.True(t, ok)
+	assert.Equal(t, received.Add(10*time.Second), deadline)
+
+	// The parent deadline applies if earlier
+	parent, parentCancel := context.WithDeadline(context.Background(), received.Add(time.Second))
+	defer parentCancel()
+	ctx, cancel = p.ExpiryContext(parent, received)
+	defer cancel()
+	deadline, _ = ctx.Deadline()
+	assert.Equal(t, received.Add(time.Second), deadline)
+
+	// No expiry, so no deadline
+	p = &Publish{Topic: "a/b", Properties: &PublishProperties{}}
+	ctx, cancel = p.ExpiryContext(context.Background(), received)
+	defer cancel()
+	_, ok = ctx.Deadline()
+	assert.False(t, ok)
+	cancel()
+	assert.Error(t, ctx.Err())
+}
+
+// benchPacket returns a packet representative of a typical inbound message
+func benchPacket() *packets.Publish {
+	return &packets.Publish{
+		PacketID: 1,
+		QoS:      1,
+		Topic:    "sensors/building1/floor2/temperature",
+		Payload:  []byte(`{"value":21.5}`),
+		Properties: &packets.Properties{
+			ContentType: "application/json",
+			User:        []packets.User{{Key: "source", Value: "gw1"}, {Key: "seq", Value: "1"}},
+		},
+	}
+}
+
+func TestPublishFromPacketPublishInto(t *testing.T) {
+	pb := benchPacket()
+	dst := &Publish{}
+	assert.Equal(t, PublishFromPacketPublish(pb), PublishFromPacketPublishInto(dst, pb))
+
+	// Properties (and the User slice) are reused, and values from the previous message are not retained
+	props, user := dst.Properties, dst.Properties.User
+	pb2 := &packets.Publish{Topic: "other", Properties: &packets.Properties{User: []packets.User{{Key: "k", Value: "v"}}}}
+	PublishFromPacketPublishInto(dst, pb2)
+	assert.Equal(t, PublishFromPacketPublish(pb2), dst)
+	assert.Same(t, props, dst.Properties)
+	assert.Same(t, &user[0], &dst.Properties.User[0])
+}
+
+// TestPublishRetainRoundTrip checks that the Retain flag survives encoding, decoding, routing and conversion back to
+// a packet
+func TestPublishRetainRoundTrip(t *testing.T) {
+	for _, retain := range []bool{true, false} {
+		var buf bytes.Buffer
+		_, err := (&Publish{Topic: "a/b", QoS: 1, PacketID: 1, Retain: retain}).Packet().WriteTo(&buf)
+		require.NoError(t, err)
+		cp, err := packets.ReadPacket(&buf)
+		require.NoError(t, err)
+		pb := cp.Content.(*packets.Publish)
+		assert.Equal(t, retain, pb.Retain)
+
+		var routed *Publish
+		r := NewStandardRouter()
+		r.RegisterHandler("a/#", func(p *Publish) { routed = p })
+		r.Route(pb)
+		require.NotNil(t, routed)
+		assert.Equal(t, retain, routed.Retain)
+		assert.Equal(t, retain, routed.Packet().Retain)
+		assert.Equal(t, retain, PublishFromPacketPublishInto(&Publish{}, pb).Retain)
+	}
+}
+
+func TestValidatePublishTopic(t *testing.T) {
+	tests := []struct {
+		name  string
+		topic string
+		valid bool
+	}{
+		{"simple", "a/b/c", true},
+		{"empty levels", "/a//b/", true},
+		{"maximum length", strings.Repeat("a", 65535), true},
+		{"multibyte", "caf\u00e9/\u4e2d", true},
+		{"empty", "", false},
+		{"single level wildcard", "a/+/c", false},
+		{"multi level wildcard", "a/#", false},
+		{"wildcard within level", "a/b+", false},
+		{"null", "a/\x00", false},
+		{"over length", strings.Repeat("a", 65536), false},
+		{"over length multibyte", strings.Repeat("\u00e9", 32768), false}, // 65536 bytes
+		{"invalid UTF-8", "a/\xff", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidatePublishTopic(tt.topic)
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrInvalidTopic)
+			}
+		})
+	}
+}
+
+func BenchmarkPublishFromPacketPublish(b *testing.B) {
+	pb := benchPacket()
+	b.ReportAllocs()
+	for b.Loop() {
+		_ = PublishFromPacketPublish(pb)
+	}
+}
+
+func BenchmarkPublishFromPacketPublishInto(b *testing.B) {
+	pb := benchPacket()
+	dst := &Publish{}
+	b.ReportAllocs()
+	for b.Loop() {
+		_ = PublishFromPacketPublishInto(dst, pb)
+	}
+}
@@ -15,7 +15,11 @@
 
 package paho
 
-import "github.com/eclipse/paho.golang/packets"
+import (
+	"fmt"
+
+	"github.com/eclipse/paho.golang/packets"
+)
 
 type (
 	// PublishResponse is a generic representation of a response
@@ -33,6 +37,44 @@ type (
 	}
 )
 
+// PublishError is returned by Publish when the server rejects a QoS1/2 PUBLISH (the PUBACK or PUBREC reason code is
+// 0x80 or greater). It holds the reason code along with any Reason String and User Properties the server provided;
+// use errors.As to retrieve it.
+type PublishError struct {
+	ReasonCode   byte
+	ReasonString string // Human-readable explanation from the server (may be empty)
+	User         UserProperties
+	description  string // Description of ReasonCode (from the packets library)
+	packetType   byte   // Type of the packet carrying ReasonCode (PUBACK or PUBREC)
+}
+
+// Error implements error
+func (e *PublishError) Error() string {
+	if e.ReasonString != "" {
+		return fmt.Sprintf("error publishing: %s (reason code %#x; server: %q)", e.description, e.ReasonCode, e.ReasonString)
+	}
+	return fmt.Sprintf("error publishing: %s (reason code %#x)", e.description, e.ReasonCode)
+}
+
+// As enables errors.As(err, **ReasonCodeError)
+func (e *PublishError) As(target any) bool {
+	if t, ok := target.(**ReasonCodeError); ok {
+		*t = &ReasonCodeError{PacketType: e.packetType, ReasonCode: e.ReasonCode, ReasonString: e.ReasonString}
+		return true
+	}
+	return false
+}
+
+// publishErrorFromResponse creates a PublishError from the response to a PUBLISH
+func publishErrorFromResponse(pr *PublishResponse, packetType byte, description string) *PublishError {
+	e := &PublishError{ReasonCode: pr.ReasonCode, description: description, packetType: packetType}
+	if pr.Properties != nil {
+		e.ReasonString = pr.Properties.ReasonString
+		e.User = pr.Properties.User
+	}
+	return e
+}
+
 // PublishResponseFromPuback takes a packets library Puback and
 // returns a paho library PublishResponse
 func PublishResponseFromPuback(pa *packets.Puback) *PublishResponse {
@@ -15,13 +15,18 @@
 
 package paho
 
-import "github.com/eclipse/paho.golang/packets"
+import (
+	"fmt"
+
+	"github.com/eclipse/paho.golang/packets"
+)
 
 type (
 	// Suback is a representation of an MQTT suback packet
 	Suback struct {
 		Properties *SubackProperties
 		Reasons    []byte
+		Results    SubscribeResults // Set by Client.Subscribe; pairs each requested topic filter with its reason code
 	}
 
 	// SubackProperties is a struct of the properties that can be set
@@ -30,8 +35,87 @@ type (
 		ReasonString string
 		User         UserProperties
 	}
+
+	// SubscribeResult pairs a topic filter passed to Subscribe with the outcome reported by the server in the SUBACK
+	SubscribeResult struct {
+		Topic        string
+		ReasonCode   byte   // The granted QoS (0-2) if successful, otherwise a reason code of 0x80 or greater
+		ReasonString string // Reason String from the SUBACK (applies to the SUBACK as a whole; may be empty)
+	}
+
+	// SubscribeResults holds a SubscribeResult for each requested subscription (in the order requested)
+	SubscribeResults []SubscribeResult
 )
 
+// Failed returns true if the server rejected the subscription
+func (r SubscribeResult) Failed() bool {
+	return r.ReasonCode >= 0x80
+}
+
+// Failed returns the results for subscriptions that the server rejected (nil if all succeeded)
+func (r SubscribeResults) Failed() SubscribeResults {
+	var failed SubscribeResults
+	for _, sr := range r {
+		if sr.Failed() {
+			failed = append(failed, sr)
+		}
+	}
+	return failed
+}
+
+// subscribeResults pairs the subscriptions requested in s with the reason codes in sa. If the server returned the
+// wrong number of reason codes (a protocol error), only those that can be paired are returned.
+func subscribeResults(s *Subscribe, sa *Suback) SubscribeResults {
+	n := min(len(s.Subscriptions), len(sa.Reasons))
+	results := make(SubscribeResults, n)
+	for i := range n {
+		results[i] = SubscribeResult{Topic: s.Subscriptions[i].Topic, ReasonCode: sa.Reasons[i]}
+		if sa.Properties != nil {
+			results[i].ReasonString = sa.Properties.ReasonString
+		}
+	}
+	return results
+}
+
+// SubscribeError is returned by Subscribe when the server rejects one or more of the requested subscriptions (the
+// SUBACK contains a reason code of 0x80 or greater). It holds the reason codes along with any Reason String and User
+// Properties the server provided; use errors.As to retrieve it.
+type SubscribeError struct {
+	Reasons      []byte // Reason codes from the SUBACK (one per subscription, in the order requested)
+	ReasonString string // Human-readable explanation from the server (may be empty)
+	User         UserProperties
+	Results      SubscribeResults // Requested topic filters paired with their reason codes (see Failed)
+}
+
+// Error implements error
+func (e *SubscribeError) Error() string {
+	var msg string
+	if len(e.Reasons) == 1 {
+		msg = fmt.Sprintf("failed to subscribe to topic (reason code %#x)", e.Reasons[0])
+	} else {
+		msg = fmt.Sprintf("at least one requested subscription failed (reason codes %#v)", e.Reasons)
+	}
+	if e.ReasonString != "" {
+		msg += fmt.Sprintf(": %s", e.ReasonString)
+	}
+	return msg
+}
+
+// As enables errors.As(err, **ReasonCodeError); ReasonCode will be the first failing reason code
+func (e *SubscribeError) As(target any) bool {
+	t, ok := target.(**ReasonCodeError)
+	if !ok {
+		return false
+	}
+	for _, code := range e.Reasons {
+		if code >= 0x80 {
+			*t = &ReasonCodeError{PacketType: packets.SUBACK, ReasonCode: code, ReasonString: e.ReasonString}
+			return true
+		}
+	}
+	return false
+}
+
 // Packet returns a packets library Suback from the paho Suback
 // on which it is called
 func (s *Suback) Packet() *packets.Suback {
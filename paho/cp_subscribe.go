@@ -15,7 +15,12 @@
 
 package paho
 
-import "github.com/eclipse/paho.golang/packets"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/eclipse/paho.golang/packets"
+)
 
 type (
 	// Subscribe is a representation of a MQTT subscribe packet
@@ -34,6 +39,20 @@ type (
 	}
 )
 
+// SharedSubscription returns the topic filter for a shared subscription ($share/{group}/{filter}) for use in
+// SubscribeOptions.Topic; the same string may be passed to StandardRouter.RegisterHandler (the router ignores the
+// $share/{group}/ prefix when matching inbound messages). An error wrapping ErrInvalidArguments is returned if group
+// is empty or contains "/", "+" or "#", or filter is empty.
+func SharedSubscription(group, filter string) (string, error) {
+	if group == "" || strings.ContainsAny(group, "/+#") {
+		return "", fmt.Errorf("%w: invalid shared subscription group %q", ErrInvalidArguments, group)
+	}
+	if filter == "" {
+		return "", fmt.Errorf("%w: shared subscription filter must not be empty", ErrInvalidArguments)
+	}
+	return "$share/" + group + "/" + filter, nil
+}
+
 // SubscribeProperties is a struct of the properties that can be set
 // for a Subscribe packet
 type SubscribeProperties struct {
@@ -0,0 +1,62 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"time"
+)
+
+// ReadDeadlineStrategy returns the maximum time to wait for the next packet to arrive, given the keep alive (in
+// seconds) in use on the connection. A return value of 0 means that reads will not time out.
+type ReadDeadlineStrategy func(keepAlive uint16) time.Duration
+
+// KeepAliveReadDeadline returns a ReadDeadlineStrategy allowing keep alive plus grace between packets. DefaultPinger
+// sends a PINGREQ if no packet has been received within the keep alive period, so a healthy connection will receive
+// a PINGRESP (if nothing else) within this time; grace should allow for the round trip. Reads will not time out if
+// keep alive is 0 (disabled).
+func KeepAliveReadDeadline(grace time.Duration) ReadDeadlineStrategy {
+	return func(keepAlive uint16) time.Duration {
+		if keepAlive == 0 {
+			return 0
+		}
+		return time.Duration(keepAlive)*time.Second + grace
+	}
+}
+
+// setReadDeadline sets the deadline for the next read from the connection (if ReadDeadline is configured), returning
+// the timeout applied (0 if none)
+func (c *Client) setReadDeadline() (time.Duration, error) {
+	if c.config.ReadDeadline == nil {
+		return 0, nil
+	}
+	var keepAlive uint16
+	if p := c.connackProps.Load(); p != nil {
+		keepAlive = p.KeepAlive
+	}
+	timeout := c.config.ReadDeadline(keepAlive)
+	if timeout <= 0 {
+		return 0, c.config.Conn.SetReadDeadline(time.Time{})
+	}
+	return timeout, c.config.Conn.SetReadDeadline(time.Now().Add(timeout))
+}
+
+// clearReadDeadline removes any deadline set by setReadDeadline
+func (c *Client) clearReadDeadline() error {
+	if c.config.ReadDeadline == nil {
+		return nil
+	}
+	return c.config.Conn.SetReadDeadline(time.Time{})
+}
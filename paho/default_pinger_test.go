@@ -261,6 +261,129 @@ func TestDefaultPingerPacketReceiveOnly(t *testing.T) {
 	})
 }
 
+// TestDefaultPingerOutboundOnlyNoResponse - If packets are being sent, but nothing is received, then the pinger must
+// detect the lack of a PINGRESP (outbound traffic must not suppress the liveness check)
+func TestDefaultPingerOutboundOnlyNoResponse(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		var wg sync.WaitGroup
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		// Buffered connection, so PINGREQ's will be written, but never responded to
+		fakeClientConn, fakeServerConn := testserver.NewConnPair()
+		defer fakeServerConn.Close()
+
+		pinger := NewDefaultPinger()
+		pinger.SetDebug(paholog.NewTestLogger(t, "DefaultPinger:"))
+
+		var pingErr error
+		var duration time.Duration
+		startTime := time.Now()
+		wg.Go(func() {
+			pingErr = pinger.Run(ctx, fakeClientConn, 3)
+			duration = time.Since(startTime)
+			cancel()
+		})
+
+		wg.Go(func() {
+			for ctx.Err() == nil {
+				pinger.PacketSent()
+				time.Sleep(time.Millisecond)
+			}
+		})
+
+		wg.Wait()
+		require.EqualError(t, pingErr, "PINGRESP timed out")
+		require.Equal(t, 3*time.Second, duration, "Expected timeout one keepalive after the initial PINGREQ")
+	})
+}
+
+// TestDefaultPingerInboundSatisfiesPing - receipt of any packet after a PINGREQ demonstrates the connection is alive
+func TestDefaultPingerInboundSatisfiesPing(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		var wg sync.WaitGroup
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		fakeClientConn, fakeServerConn := testserver.NewConnPair()
+		context.AfterFunc(ctx, func() {
+			fakeServerConn.Close()
+		})
+
+		pinger := NewDefaultPinger()
+		pinger.SetDebug(paholog.NewTestLogger(t, "DefaultPinger:"))
+
+		var pingErr error
+		wg.Go(func() {
+			pingErr = pinger.Run(ctx, fakeClientConn, 3)
+		})
+
+		// Server responds to PINGREQ with another packet (not PINGRESP)
+		pingCount := 0
+		wg.Go(func() {
+			for {
+				recv, err := packets.ReadPacket(fakeServerConn)
+				if err != nil {
+					return
+				}
+				if recv.Type == packets.PINGREQ {
+					pingCount++
+					pinger.PacketReceived()
+				}
+			}
+		})
+
+		wg.Wait()
+		require.NoError(t, pingErr)
+		require.Equal(t, 4, pingCount, "Expected 4 pings") // 0,3,6,9 seconds
+	})
+}
+
+// TestDefaultPingerKeepAliveTiming - when there is no other traffic, a PINGREQ should be sent exactly once every
+// keepalive interval (synctest provides a fake clock, so timings are deterministic)
+func TestDefaultPingerKeepAliveTiming(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		var wg sync.WaitGroup
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		fakeClientConn, fakeServerConn := testserver.NewConnPair()
+		context.AfterFunc(ctx, func() {
+			fakeServerConn.Close()
+		})
+
+		pinger := NewDefaultPinger()
+		pinger.SetDebug(paholog.NewTestLogger(t, "DefaultPinger:"))
+
+		startTime := time.Now()
+		var pingErr error
+		wg.Go(func() {
+			pingErr = pinger.Run(ctx, fakeClientConn, 3)
+		})
+
+		var pingTimes []time.Duration
+		wg.Go(func() {
+			for {
+				recv, err := packets.ReadPacket(fakeServerConn)
+				if err != nil {
+					return
+				}
+				if recv.Type == packets.PINGREQ {
+					pingTimes = append(pingTimes, time.Since(startTime))
+					pinger.PingResp()
+				}
+			}
+		})
+
+		wg.Wait()
+		require.NoError(t, pingErr)
+		require.Equal(t, []time.Duration{0, 3 * time.Second, 6 * time.Second, 9 * time.Second}, pingTimes)
+	})
+}
+
 func TestDefaultPingerStartStop(t *testing.T) {
 	t.Parallel()
 	fakeServerConn, fakeClientConn := net.Pipe()
@@ -384,3 +507,35 @@ func TestDefaultPingerContextCancelled(t *testing.T) {
 		t.Error("expected DefaultPinger to exit when context is cancelled")
 	}
 }
+
+func TestDefaultPingerStatus(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		fakeServerConn, fakeClientConn := testserver.NewConnPair()
+		defer fakeServerConn.Close()
+
+		pinger := NewDefaultPinger()
+		assert.Equal(t, PingerStatus{}, pinger.Status())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- pinger.Run(ctx, fakeClientConn, 10) }()
+		synctest.Wait() // first PINGREQ is sent immediately
+
+		s := pinger.Status()
+		assert.True(t, s.PingOutstanding)
+		assert.Equal(t, time.Now(), s.LastPingSent)
+
+		time.Sleep(time.Second)
+		pinger.PingResp()
+		pinger.PacketSent()
+		s = pinger.Status()
+		assert.False(t, s.PingOutstanding)
+		assert.Equal(t, time.Now(), s.LastPingResponse)
+		assert.Equal(t, time.Now(), s.LastPacketSent)
+		assert.True(t, s.LastPacketReceived.IsZero())
+
+		cancel()
+		require.NoError(t, <-done)
+	})
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/eclipse/paho.golang/internal/categorised"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho/session"
+)
+
+// Error categories
+//
+// Errors returned by Connect, Publish, Subscribe and Unsubscribe (and by the equivalent autopaho functions) may be
+// tested against the following categories using errors.Is, allowing callers to decide how to respond without
+// resorting to string matching:
+//
+//   - ErrNotConnected - the request was not sent because there is no connection (e.g. the session has no connection,
+//     or autopaho's ConnectionDownError). Retry once a connection is available.
+//   - ErrDisconnected - the connection was lost (or closed) after the request was sent (ErrConnectionLost,
+//     ErrNetworkErrorAfterStored, shutdown with a QoS1/2 PUBLISH outstanding, autopaho's DisconnectError). The
+//     outcome is unknown; a QoS1/2 PUBLISH remains in the session and will be retransmitted on reconnect.
+//   - ErrTimeout - no response was received in time (ErrAckTimeout, ErrReadTimeout, PacketTimeout or a context
+//     deadline expiring; in the latter case the error also matches context.DeadlineExceeded).
+//   - ErrQueueFull - there was no capacity to accept the request (session.ErrPacketIdentifiersExhausted, autopaho's
+//     QueueFullError). Retry later.
+//   - ErrProtocol - the server sent something unexpected (e.g. a packet of the wrong type in response to a request).
+//     This is not retryable on the current connection.
+//
+// Where the server rejects a request with a reason code of 0x80 or greater, the error will satisfy
+// errors.As(err, **ReasonCodeError) (CONNACK, PUBACK, PUBREC, SUBACK, UNSUBACK and, via autopaho's DisconnectError,
+// DISCONNECT). Whether such an error is worth retrying depends upon the reason code (see ReasonCodeError.Retryable).
+// Errors wrapping ErrInvalidArguments indicate a problem with the request itself (retrying will not help).
+var (
+	ErrNotConnected = errors.New("not connected")
+	ErrDisconnected = errors.New("disconnected")
+	ErrTimeout      = errors.New("timeout")
+	ErrQueueFull    = errors.New("queue full")
+	ErrProtocol     = errors.New("protocol error")
+)
+
+// ReasonCodeError describes a request rejected by the server via a reason code of 0x80 or greater. Use errors.As to
+// retrieve it from errors returned by Connect, Publish, Subscribe and Unsubscribe.
+type ReasonCodeError struct {
+	PacketType   byte   // Type of the packet that carried the reason code (e.g. packets.PUBACK)
+	ReasonCode   byte   // The first failing reason code (for SUBACK/UNSUBACK)
+	ReasonString string // Human-readable explanation from the server (may be empty)
+}
+
+// Error implements error
+func (e *ReasonCodeError) Error() string {
+	var name string
+	if e.PacketType <= packets.AUTH {
+		name = (&packets.ControlPacket{FixedHeader: packets.FixedHeader{Type: e.PacketType}}).PacketType()
+	}
+	if e.ReasonString != "" {
+		return fmt.Sprintf("%s reason code %#x: %s", name, e.ReasonCode, e.ReasonString)
+	}
+	return fmt.Sprintf("%s reason code %#x", name, e.ReasonCode)
+}
+
+// Retryable returns true if the reason code indicates a transient condition on the server (so the same request may
+// succeed later); other codes (e.g. Not Authorized, Topic Name Invalid) will fail again if retried unchanged.
+func (e *ReasonCodeError) Retryable() bool {
+	switch e.ReasonCode {
+	case 0x80, // Unspecified error
+		0x88, // Server unavailable
+		0x89, // Server busy
+		0x8B, // Server shutting down
+		0x93, // Receive Maximum exceeded
+		0x96, // Message rate too high
+		0x97, // Quota exceeded
+		0x9C, // Use another server
+		0x9D, // Server moved
+		0x9F: // Connection rate exceeded
+		return true
+	}
+	return false
+}
+
+// errShutdown is returned by Publish if the client shuts down before a QoS1/2 PUBLISH is acknowledged
+var errShutdown = categorised.New("PUBLISH transmitted but not fully acknowledged at time of shutdown", ErrDisconnected)
+
+// contextError categorises an error from a context used to wait for a response; a deadline is reported as ErrTimeout
+// (the returned error will still match context.DeadlineExceeded).
+func contextError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return err
+}
+
+// sessionError categorises an error returned by the session when adding a request
+func sessionError(err error) error {
+	switch {
+	case errors.Is(err, session.ErrNoConnection):
+		return fmt.Errorf("%w: %w", ErrNotConnected, err)
+	case errors.Is(err, session.ErrPacketIdentifiersExhausted):
+		return fmt.Errorf("%w: %w", ErrQueueFull, err)
+	}
+	return contextError(err)
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/eclipse/paho.golang/internal/basictestserver"
+	"github.com/eclipse/paho.golang/packets"
+	paholog "github.com/eclipse/paho.golang/paho/log"
+	"github.com/eclipse/paho.golang/paho/session"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestErrorCategories checks that the pre-existing errors match the expected category (and only that category)
+func TestErrorCategories(t *testing.T) {
+	categories := []error{ErrNotConnected, ErrDisconnected, ErrTimeout, ErrQueueFull, ErrProtocol}
+	tests := []struct {
+		name     string
+		err      error
+		category error
+	}{
+		{"ErrConnectionLost", ErrConnectionLost, ErrDisconnected},
+		{"ErrNetworkErrorAfterStored", ErrNetworkErrorAfterStored, ErrDisconnected},
+		{"shutdown", errShutdown, ErrDisconnected},
+		{"ErrAckTimeout", ErrAckTimeout, ErrTimeout},
+		{"ErrReadTimeout", ErrReadTimeout, ErrTimeout},
+		{"deadline", contextError(context.DeadlineExceeded), ErrTimeout},
+		{"noConnection", sessionError(session.ErrNoConnection), ErrNotConnected},
+		{"idsExhausted", sessionError(session.ErrPacketIdentifiersExhausted), ErrQueueFull},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, c := range categories {
+				assert.Equal(t, c == tt.category, errors.Is(tt.err, c), "errors.Is(%v, %v)", tt.err, c)
+			}
+		})
+	}
+
+	// Errors are wrapped, so the original error remains detectable
+	assert.ErrorIs(t, contextError(context.DeadlineExceeded), context.DeadlineExceeded)
+	assert.ErrorIs(t, sessionError(session.ErrNoConnection), session.ErrNoConnection)
+	assert.NotErrorIs(t, contextError(context.Canceled), ErrTimeout)
+}
+
+// TestConnectReasonCodeError checks that a CONNACK rejection can be retrieved as a ReasonCodeError
+func TestConnectReasonCodeError(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{
+		ReasonCode: packets.ConnackServerBusy,
+		Properties: &packets.Properties{ReasonString: "try later"},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{Conn: ts.ClientConn()})
+	require.NotNil(t, c)
+	ca, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", KeepAlive: 30})
+	require.NotNil(t, ca)
+	var rce *ReasonCodeError
+	require.ErrorAs(t, err, &rce)
+	assert.Equal(t, byte(packets.CONNACK), rce.PacketType)
+	assert.Equal(t, byte(packets.ConnackServerBusy), rce.ReasonCode)
+	assert.Equal(t, "try later", rce.ReasonString)
+	assert.True(t, rce.Retryable())
+	assert.Equal(t, "failed to connect to server: CONNACK reason code 0x89: try later", err.Error())
+}
+
+// TestUnsubscribeReasonCodeError checks that an UNSUBACK rejection can be retrieved as a ReasonCodeError
+func TestUnsubscribeReasonCodeError(t *testing.T) {
+	ts := basictestserver.New(paholog.NewTestLogger(t, "TestServer:"))
+	ts.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0})
+	ts.SetResponse(packets.UNSUBACK, &packets.Unsuback{
+		Reasons:    []byte{0, packets.UnsubackNotAuthorized},
+		Properties: &packets.Properties{ReasonString: "denied"},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{Conn: ts.ClientConn()})
+	require.NotNil(t, c)
+	_, err := c.Connect(context.Background(), &Connect{ClientID: "testClient", KeepAlive: 30})
+	require.NoError(t, err)
+	defer c.close()
+
+	ua, err := c.Unsubscribe(context.Background(), &Unsubscribe{Topics: []string{"test/1", "test/2"}})
+	require.NotNil(t, ua)
+	var rce *ReasonCodeError
+	require.ErrorAs(t, err, &rce)
+	assert.Equal(t, byte(packets.UNSUBACK), rce.PacketType)
+	assert.Equal(t, byte(packets.UnsubackNotAuthorized), rce.ReasonCode)
+	assert.Equal(t, "denied", rce.ReasonString)
+}
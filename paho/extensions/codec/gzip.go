@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+// Package codec provides implementations of paho.PayloadCodec.
+//
+// Other encodings (e.g. zstd, which requires a third-party library) may be used by implementing paho.PayloadCodec;
+// Name should return the value registered for the Content-Encoding HTTP header where one exists (e.g. "zstd").
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+var _ paho.PayloadCodec = (*Gzip)(nil)
+
+// DefaultMaxDecodedSize is the maximum size, in bytes, of a payload decoded by Gzip unless SetMaxDecodedSize is called
+const DefaultMaxDecodedSize = 16 << 20
+
+// ErrDecodedTooLarge is returned by Gzip.Decode if the decoded payload would exceed the maximum size (this protects
+// against small messages that decompress to a very large size)
+var ErrDecodedTooLarge = errors.New("decoded payload exceeds maximum size")
+
+// Gzip is a paho.PayloadCodec that compresses payloads using gzip
+type Gzip struct {
+	level          int
+	maxDecodedSize int64
+	writers        sync.Pool // *gzip.Writer (these are relatively expensive to create)
+}
+
+// NewGzip creates a Gzip codec using the specified compression level (e.g. gzip.DefaultCompression)
+func NewGzip(level int) (*Gzip, error) {
+	if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil { // validate the level
+		return nil, err
+	}
+	return &Gzip{level: level, maxDecodedSize: DefaultMaxDecodedSize}, nil
+}
+
+// SetMaxDecodedSize sets the maximum size, in bytes, of a decoded payload (n <= 0 restores DefaultMaxDecodedSize).
+// Payloads received from the network are untrusted, so this should be set no larger than the application requires.
+// It must be called before the codec is used.
+func (g *Gzip) SetMaxDecodedSize(n int64) {
+	if n <= 0 {
+		n = DefaultMaxDecodedSize
+	}
+	g.maxDecodedSize = n
+}
+
+// Name implements paho.PayloadCodec
+func (g *Gzip) Name() string {
+	return "gzip"
+}
+
+// Encode implements paho.PayloadCodec
+func (g *Gzip) Encode(payload []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w, _ := g.writers.Get().(*gzip.Writer)
+	if w == nil {
+		var err error
+		if w, err = gzip.NewWriterLevel(&b, g.level); err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(&b)
+	}
+	defer g.writers.Put(w)
+	if _, err := w.Write(payload); err != nil {
+		return nil, fmt.Errorf("gzip write failed: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("gzip close failed: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+// Decode implements paho.PayloadCodec. An error wrapping ErrDecodedTooLarge is returned if the decoded payload would
+// exceed the maximum size (see SetMaxDecodedSize).
+func (g *Gzip) Decode(payload []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("gzip header invalid: %w", err)
+	}
+	defer r.Close()
+	decoded, err := io.ReadAll(io.LimitReader(r, g.maxDecodedSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("gzip read failed: %w", err)
+	}
+	if int64(len(decoded)) > g.maxDecodedSize {
+		return nil, fmt.Errorf("%w (%d bytes)", ErrDecodedTooLarge, g.maxDecodedSize)
+	}
+	return decoded, nil
+}
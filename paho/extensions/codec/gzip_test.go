@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"testing"
+)
+
+func TestGzip(t *testing.T) {
+	g, err := NewGzip(gzip.BestCompression)
+	if err != nil {
+		t.Fatalf("NewGzip failed: %s", err)
+	}
+	payload := bytes.Repeat([]byte(`{"temperature":21.5,"humidity":40}`), 50)
+	for i := 0; i < 2; i++ { // second iteration reuses the pooled writer
+		encoded, err := g.Encode(payload)
+		if err != nil {
+			t.Fatalf("Encode failed: %s", err)
+		}
+		if len(encoded) >= len(payload) {
+			t.Fatalf("expected payload to be compressed (%d >= %d bytes)", len(encoded), len(payload))
+		}
+		decoded, err := g.Decode(encoded)
+		if err != nil {
+			t.Fatalf("Decode failed: %s", err)
+		}
+		if !bytes.Equal(decoded, payload) {
+			t.Fatal("decoded payload does not match original")
+		}
+	}
+	if _, err = g.Decode([]byte("not gzip")); err == nil {
+		t.Fatal("expected error decoding invalid data")
+	}
+	if _, err = NewGzip(42); err == nil {
+		t.Fatal("expected error with invalid compression level")
+	}
+}
+
+func TestGzipMaxDecodedSize(t *testing.T) {
+	g, err := NewGzip(gzip.BestCompression)
+	if err != nil {
+		t.Fatalf("NewGzip failed: %s", err)
+	}
+	// 64MiB of zeros compresses to a few tens of KiB (a decompression bomb)
+	bomb, err := g.Encode(make([]byte, 64<<20))
+	if err != nil {
+		t.Fatalf("Encode failed: %s", err)
+	}
+	if _, err = g.Decode(bomb); !errors.Is(err, ErrDecodedTooLarge) {
+		t.Fatalf("expected ErrDecodedTooLarge with default limit, got %v", err)
+	}
+
+	g.SetMaxDecodedSize(100)
+	payload := bytes.Repeat([]byte("a"), 100)
+	encoded, err := g.Encode(payload)
+	if err != nil {
+		t.Fatalf("Encode failed: %s", err)
+	}
+	if decoded, err := g.Decode(encoded); err != nil || !bytes.Equal(decoded, payload) {
+		t.Fatalf("payload at limit should decode (err: %v)", err)
+	}
+	if encoded, err = g.Encode(append(payload, 'a')); err != nil {
+		t.Fatalf("Encode failed: %s", err)
+	}
+	if _, err = g.Decode(encoded); !errors.Is(err, ErrDecodedTooLarge) {
+		t.Fatalf("expected ErrDecodedTooLarge for payload one byte over limit, got %v", err)
+	}
+}
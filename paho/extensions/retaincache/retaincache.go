@@ -0,0 +1,215 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+// Package retaincache maintains a local cache of the most recent message received on each topic, so that the last
+// known value (e.g. for display on a dashboard) can be queried synchronously.
+//
+// Messages are added to the cache by a handler (Cache.Handle, or a handler wrapped with Cache.Wrap) registered with
+// the router, e.g.
+//
+//	cache := retaincache.New(retaincache.WithMaxSize(1000), retaincache.WithExpiry())
+//	router.RegisterHandler("sensors/#", cache.Wrap(handler))
+//	...
+//	if p, ok := cache.Get("sensors/kitchen/temp"); ok { ... }
+//
+// By default, only messages with the Retain flag set are cached (note that the server only sets this on messages sent
+// because a subscription was made, unless the subscription sets RetainAsPublished); use WithAllMessages to cache every
+// message. Messages whose payload is being streamed (see paho.ClientConfig.StreamPayloadThreshold) are not cached.
+package retaincache
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// Cache holds the most recent message received on each topic; create with New
+type Cache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element // topic -> element in lru (Value is *entry)
+	lru     *list.List               // least recently updated entry at the front
+
+	maxSize     int  // 0 = unbounded
+	allMessages bool // cache messages without the Retain flag set
+	expiry      bool // honour the Message Expiry Interval
+}
+
+// entry is a cached message
+type entry struct {
+	p       *paho.Publish
+	expires time.Time // zero if the message does not expire
+}
+
+// Option configures a Cache (pass to New)
+type Option func(*Cache)
+
+// WithMaxSize limits the cache to n topics; when a message is received on a new topic and the cache is full, the
+// topic that was least recently updated is evicted (n <= 0 means unbounded, the default).
+func WithMaxSize(n int) Option {
+	return func(c *Cache) {
+		c.maxSize = max(n, 0)
+	}
+}
+
+// WithAllMessages results in all messages being cached (by default only messages with the Retain flag set are cached)
+func WithAllMessages() Option {
+	return func(c *Cache) {
+		c.allMessages = true
+	}
+}
+
+// WithExpiry results in messages being evicted once their Message Expiry Interval (measured from when the message was
+// received) has passed. Messages without a Message Expiry Interval do not expire.
+func WithExpiry() Option {
+	return func(c *Cache) {
+		c.expiry = true
+	}
+}
+
+// New returns a Cache ready for use
+func New(opts ...Option) *Cache {
+	c := &Cache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// Handle adds p to the cache (replacing any message previously cached for p.Topic); it is a paho.MessageHandler so
+// may be registered directly with the router. A message with the Retain flag set and an empty payload removes the
+// topic from the cache (this is how a retained message is deleted).
+//
+// A copy of p is cached, so the handler may safely be used with paho.WithPublishReuse.
+func (c *Cache) Handle(p *paho.Publish) {
+	if p.PayloadReader != nil || (!p.Retain && !c.allMessages) {
+		return
+	}
+	if p.Retain && len(p.Payload) == 0 {
+		c.Delete(p.Topic)
+		return
+	}
+	e := &entry{p: clonePublish(p)}
+	if c.expiry && p.Properties != nil && p.Properties.MessageExpiry != nil {
+		e.expires = time.Now().Add(time.Duration(*p.Properties.MessageExpiry) * time.Second)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[p.Topic]; ok {
+		el.Value = e
+		c.lru.MoveToBack(el)
+		return
+	}
+	c.entries[p.Topic] = c.lru.PushBack(e)
+	if c.maxSize > 0 && c.lru.Len() > c.maxSize {
+		c.remove(c.lru.Front())
+	}
+}
+
+// Wrap returns a paho.MessageHandler that adds messages to the cache before passing them to h
+func (c *Cache) Wrap(h paho.MessageHandler) paho.MessageHandler {
+	return func(p *paho.Publish) {
+		c.Handle(p)
+		h(p)
+	}
+}
+
+// Get returns the most recent message cached for topic (an exact topic name, not a filter). The returned Publish is
+// shared, so must not be modified.
+func (c *Cache) Get(topic string) (*paho.Publish, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[topic]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if e.expired(time.Now()) {
+		c.remove(el)
+		return nil, false
+	}
+	return e.p, true
+}
+
+// Range calls f for each cached message (least recently updated first) until f returns false. f is called with a
+// snapshot of the cache, so may call other Cache methods. The Publish passed to f must not be modified.
+func (c *Cache) Range(f func(topic string, p *paho.Publish) bool) {
+	now := time.Now()
+	c.mu.Lock()
+	snapshot := make([]*paho.Publish, 0, c.lru.Len())
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if e := el.Value.(*entry); e.expired(now) {
+			c.remove(el)
+		} else {
+			snapshot = append(snapshot, e.p)
+		}
+		el = next
+	}
+	c.mu.Unlock()
+
+	for _, p := range snapshot {
+		if !f(p.Topic, p) {
+			return
+		}
+	}
+}
+
+// Len returns the number of topics in the cache (which may include messages that have expired but not yet been evicted)
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Delete removes topic from the cache
+func (c *Cache) Delete(topic string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[topic]; ok {
+		c.remove(el)
+	}
+}
+
+// remove removes el from the cache; the caller must hold c.mu
+func (c *Cache) remove(el *list.Element) {
+	delete(c.entries, el.Value.(*entry).p.Topic)
+	c.lru.Remove(el)
+}
+
+// expired returns true if e has expired at now
+func (e *entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// clonePublish returns a copy of p that shares no memory with it
+func clonePublish(p *paho.Publish) *paho.Publish {
+	c := *p
+	c.Payload = bytes.Clone(p.Payload)
+	if p.Properties != nil {
+		props := *p.Properties
+		props.CorrelationData = bytes.Clone(props.CorrelationData)
+		props.User = append(paho.UserProperties(nil), props.User...)
+		props.SubscriptionIdentifiers = append([]int(nil), props.SubscriptionIdentifiers...)
+		c.Properties = &props
+	}
+	return &c
+}
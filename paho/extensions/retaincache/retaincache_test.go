@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package retaincache
+
+import (
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func retained(topic, payload string) *paho.Publish {
+	return &paho.Publish{Topic: topic, Retain: true, Payload: []byte(payload)}
+}
+
+// topics returns the topics in c (in the order passed to Range)
+func topics(c *Cache) []string {
+	var t []string
+	c.Range(func(topic string, _ *paho.Publish) bool {
+		t = append(t, topic)
+		return true
+	})
+	return t
+}
+
+func TestCacheOverwrite(t *testing.T) {
+	c := New()
+	c.Handle(retained("a/b", "1"))
+	c.Handle(retained("a/c", "2"))
+	c.Handle(retained("a/b", "3"))
+
+	p, ok := c.Get("a/b")
+	require.True(t, ok)
+	assert.Equal(t, []byte("3"), p.Payload)
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, []string{"a/c", "a/b"}, topics(c))
+
+	_, ok = c.Get("a/+")
+	assert.False(t, ok, "Get takes a topic, not a filter")
+
+	// An empty retained message deletes the retained message
+	c.Handle(retained("a/b", ""))
+	_, ok = c.Get("a/b")
+	assert.False(t, ok)
+	assert.Equal(t, []string{"a/c"}, topics(c))
+}
+
+func TestCacheCopiesMessage(t *testing.T) {
+	c := New()
+	p := retained("a/b", "1")
+	p.Properties = &paho.PublishProperties{User: paho.UserProperties{{Key: "k", Value: "v"}}}
+	c.Handle(p)
+	p.Payload[0] = 'x' // as would happen with WithPublishReuse
+	p.Properties.User[0].Value = "x"
+
+	cached, ok := c.Get("a/b")
+	require.True(t, ok)
+	assert.Equal(t, []byte("1"), cached.Payload)
+	assert.Equal(t, "v", cached.Properties.User.Get("k"))
+}
+
+func TestCacheNonRetained(t *testing.T) {
+	c := New()
+	c.Handle(&paho.Publish{Topic: "a/b", Payload: []byte("1")})
+	assert.Equal(t, 0, c.Len())
+
+	c = New(WithAllMessages())
+	c.Handle(&paho.Publish{Topic: "a/b", Payload: []byte("1")})
+	c.Handle(&paho.Publish{Topic: "a/c"}) // an empty message that is not retained is a valid value
+	assert.Equal(t, []string{"a/b", "a/c"}, topics(c))
+}
+
+func TestCacheWrap(t *testing.T) {
+	c := New()
+	var got *paho.Publish
+	h := c.Wrap(func(p *paho.Publish) {
+		_, ok := c.Get(p.Topic)
+		assert.True(t, ok, "message should be cached before handler called")
+		got = p
+	})
+	p := retained("a/b", "1")
+	h(p)
+	assert.Same(t, p, got)
+}
+
+func TestCacheMaxSize(t *testing.T) {
+	c := New(WithMaxSize(2))
+	c.Handle(retained("a", "1"))
+	c.Handle(retained("b", "2"))
+	c.Handle(retained("a", "3")) // a is now the most recently updated
+	c.Handle(retained("c", "4")) // so b is evicted
+
+	assert.Equal(t, []string{"a", "c"}, topics(c))
+	_, ok := c.Get("b")
+	assert.False(t, ok)
+}
+
+func TestCacheExpiry(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		expiring := func(topic string, seconds uint32) *paho.Publish {
+			p := retained(topic, "v")
+			p.Properties = &paho.PublishProperties{MessageExpiry: &seconds}
+			return p
+		}
+
+		c := New(WithExpiry())
+		c.Handle(expiring("a", 10))
+		c.Handle(expiring("b", 20))
+		c.Handle(retained("c", "v")) // no expiry
+
+		time.Sleep(10 * time.Second)
+		_, ok := c.Get("a")
+		assert.False(t, ok, "a should have expired")
+		assert.Equal(t, []string{"b", "c"}, topics(c))
+
+		c.Handle(expiring("b", 20)) // updating a message restarts its expiry
+		time.Sleep(15 * time.Second)
+		assert.Equal(t, []string{"c", "b"}, topics(c))
+		time.Sleep(5 * time.Second)
+		assert.Equal(t, []string{"c"}, topics(c))
+		assert.Equal(t, 1, c.Len(), "Range should evict expired messages")
+
+		// Without WithExpiry the Message Expiry Interval is ignored
+		c = New()
+		c.Handle(expiring("a", 10))
+		time.Sleep(time.Minute)
+		_, ok = c.Get("a")
+		assert.True(t, ok)
+	})
+}
+
+func TestCacheRangeStop(t *testing.T) {
+	c := New()
+	c.Handle(retained("a", "1"))
+	c.Handle(retained("b", "2"))
+	var n int
+	c.Range(func(topic string, p *paho.Publish) bool {
+		n++
+		c.Delete(topic) // calling Cache methods from f must not deadlock
+		return false
+	})
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"b"}, topics(c))
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package rpc_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/extensions/rpc"
+	"github.com/eclipse/paho.golang/paho/pahotest"
+)
+
+// connect returns a client connected to the broker (handler is called for each message received)
+func connect(ctx context.Context, b *pahotest.Broker, clientID string, handler func(paho.PublishReceived) (bool, error)) (*paho.Client, error) {
+	conn, err := b.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := paho.NewClient(paho.ClientConfig{
+		Conn:              conn,
+		OnPublishReceived: []func(paho.PublishReceived) (bool, error){handler},
+	})
+	if _, err = c.Connect(ctx, &paho.Connect{ClientID: clientID, KeepAlive: 30, CleanStart: true}); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// responder subscribes to `rpc/request` and responds to each request with the payload in upper case
+func responder(ctx context.Context, b *pahotest.Broker) (*paho.Client, error) {
+	c, err := connect(ctx, b, "responder", func(pr paho.PublishReceived) (bool, error) {
+		req := pr.Packet
+		if req.Properties == nil || req.Properties.ResponseTopic == "" {
+			return false, nil
+		}
+		go func() { // Respond asynchronously, so the handler returns promptly
+			_, _ = pr.Client.Publish(ctx, &paho.Publish{
+				Topic:      req.Properties.ResponseTopic,
+				QoS:        1,
+				Properties: &paho.PublishProperties{CorrelationData: req.Properties.CorrelationData},
+				Payload:    []byte(strings.ToUpper(string(req.Payload))),
+			})
+		}()
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.Subscribe(ctx, &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{{Topic: "rpc/request", QoS: 1}}})
+	return c, err
+}
+
+func ExampleHandler() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b := pahotest.NewBroker(nil) // In-memory broker; in a real application the clients would connect to a server
+	defer b.Close()
+
+	resp, err := responder(ctx, b)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Disconnect(&paho.Disconnect{})
+
+	c, err := connect(ctx, b, "requester", func(paho.PublishReceived) (bool, error) { return false, nil })
+	if err != nil {
+		panic(err)
+	}
+	defer c.Disconnect(&paho.Disconnect{})
+	h, err := rpc.NewHandler(ctx, c)
+	if err != nil {
+		panic(err)
+	}
+
+	// Request waits for the response
+	r, err := h.Request(ctx, &paho.Publish{Topic: "rpc/request", QoS: 1, Payload: []byte("hello")})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(r.Payload))
+
+	// Go returns a Call that resolves when the response arrives (enabling multiple concurrent requests)
+	var calls []*rpc.Call
+	for _, w := range []string{"one", "two", "three"} {
+		call, err := h.Go(ctx, &paho.Publish{Topic: "rpc/request", QoS: 1, Payload: []byte(w)})
+		if err != nil {
+			panic(err)
+		}
+		calls = append(calls, call)
+	}
+	for _, call := range calls {
+		r, err := call.Result(ctx)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(string(r.Payload))
+	}
+
+	// Output:
+	// HELLO
+	// ONE
+	// TWO
+	// THREE
+}
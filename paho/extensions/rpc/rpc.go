@@ -13,13 +13,19 @@
  *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
  */
 
+// Package rpc implements the MQTT v5 request/response pattern: requests are published with the Response Topic and
+// Correlation Data properties set, and responses (published by the responder to the Response Topic, with the same
+// Correlation Data) are matched to the outstanding request.
 package rpc
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"strconv"
 	"sync"
-	"time"
+	"sync/atomic"
 
 	"github.com/eclipse/paho.golang/paho"
 )
@@ -28,19 +34,55 @@ import (
 // MQTT v5 client
 type Handler struct {
 	sync.Mutex
-	c          *paho.Client
-	correlData map[string]chan *paho.Publish
+	c             *paho.Client
+	correlData    map[string]*Call
+	responseTopic string
+
+	correlPrefix string        // Random prefix, so correlation data is not reused across Handler instances
+	correlSeq    atomic.Uint64 // Combined with correlPrefix to generate unique correlation data
+}
+
+// Call represents an outstanding request; it is resolved when the matching response is received, or the context
+// passed to Go is done.
+type Call struct {
+	done chan struct{}
+	stop func() bool // Stops the context.AfterFunc registered by Go (nil if not registered)
+	resp *paho.Publish
+	err  error
+}
+
+// Done returns a channel that is closed when the Call has been resolved.
+func (c *Call) Done() <-chan struct{} {
+	return c.done
 }
 
+// Result waits until the Call is resolved (or ctx is done), returning the response or an error (the error from the
+// context passed to Go if it was done before the response arrived).
+func (c *Call) Result(ctx context.Context) (*paho.Publish, error) {
+	select {
+	case <-c.done:
+		return c.resp, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// NewHandler subscribes to the response topic (`<ClientID>/responses`) and returns a Handler that can be used to make
+// requests. The client must be connected (if the server assigned the client identifier, it will be used).
 func NewHandler(ctx context.Context, c *paho.Client) (*Handler, error) {
+	prefix := make([]byte, 8)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, fmt.Errorf("failed to generate correlation data prefix: %w", err)
+	}
 	h := &Handler{
-		c:          c,
-		correlData: make(map[string]chan *paho.Publish),
+		c:             c,
+		correlData:    make(map[string]*Call),
+		responseTopic: fmt.Sprintf("%s/responses", c.ClientID()),
+		correlPrefix:  hex.EncodeToString(prefix) + "-",
 	}
 
-	responseTopic := fmt.Sprintf("%s/responses", c.ClientID())
 	c.AddOnPublishReceived(func(pr paho.PublishReceived) (bool, error) {
-		if pr.Packet.Topic == responseTopic {
+		if pr.Packet.Topic == h.responseTopic {
 			h.responseHandler(pr.Packet)
 			return true, nil
 		}
@@ -49,7 +91,7 @@ func NewHandler(ctx context.Context, c *paho.Client) (*Handler, error) {
 
 	_, err := c.Subscribe(ctx, &paho.Subscribe{
 		Subscriptions: []paho.SubscribeOptions{
-			{Topic: fmt.Sprintf("%s/responses", c.ClientID()), QoS: 1},
+			{Topic: h.responseTopic, QoS: 1},
 		},
 	})
 	if err != nil {
@@ -59,71 +101,74 @@ func NewHandler(ctx context.Context, c *paho.Client) (*Handler, error) {
 	return h, nil
 }
 
-func (h *Handler) addCorrelID(cID string, r chan *paho.Publish) {
-	h.Lock()
-	defer h.Unlock()
-
-	h.correlData[cID] = r
+// ResponseTopic returns the topic on which responses are received
+func (h *Handler) ResponseTopic() string {
+	return h.responseTopic
 }
 
-func (h *Handler) getCorrelIDChan(cID string) chan *paho.Publish {
+// resolve removes the request with the specified correlation data, resolving its Call. Returns false if there is
+// no such request (e.g. it has already been resolved).
+func (h *Handler) resolve(cID string, resp *paho.Publish, err error) bool {
 	h.Lock()
-	defer h.Unlock()
-
-	rChan := h.correlData[cID]
+	call, ok := h.correlData[cID]
 	delete(h.correlData, cID)
-
-	return rChan
+	h.Unlock()
+	if !ok {
+		return false
+	}
+	if call.stop != nil {
+		call.stop()
+	}
+	call.resp, call.err = resp, err
+	close(call.done)
+	return true
 }
 
-func (h *Handler) removeCorrelID(cID string) {
-	h.Lock()
-	defer h.Unlock()
-
-	delete(h.correlData, cID)
+// Request publishes pb as a request and waits for the response (or for ctx to be done).
+func (h *Handler) Request(ctx context.Context, pb *paho.Publish) (*paho.Publish, error) {
+	call, err := h.Go(ctx, pb)
+	if err != nil {
+		return nil, err
+	}
+	<-call.Done() // Go ensures that the call is resolved when ctx is done
+	return call.resp, call.err
 }
 
-func (h *Handler) Request(ctx context.Context, pb *paho.Publish) (*paho.Publish, error) {
-	cID := fmt.Sprintf("%d", time.Now().UnixNano())
-	rChan := make(chan *paho.Publish, 1) // Buffered to prevent goroutine leak when context cancelled
+// Go publishes pb as a request (setting its Response Topic and Correlation Data properties) and returns a Call
+// that will be resolved when the response is received. If ctx is done first, the Call is resolved with the
+// context error (any response subsequently received is discarded). Many requests may be outstanding concurrently.
+func (h *Handler) Go(ctx context.Context, pb *paho.Publish) (*Call, error) {
+	cID := h.correlPrefix + strconv.FormatUint(h.correlSeq.Add(1), 10)
+	call := &Call{done: make(chan struct{})}
 
-	h.addCorrelID(cID, rChan)
-	// Ensure the correlation entry is always removed. responseHandler only
-	// removes it when a matching response arrives, so without this a request
-	// that times out, is cancelled, or fails to publish leaks a map entry.
-	defer h.removeCorrelID(cID)
+	h.Lock()
+	h.correlData[cID] = call
+	h.Unlock()
 
 	if pb.Properties == nil {
 		pb.Properties = &paho.PublishProperties{}
 	}
 
 	pb.Properties.CorrelationData = []byte(cID)
-	pb.Properties.ResponseTopic = fmt.Sprintf("%s/responses", h.c.ClientID())
+	pb.Properties.ResponseTopic = h.responseTopic
 	pb.Retain = false
 
-	_, err := h.c.Publish(ctx, pb)
-	if err != nil {
+	if _, err := h.c.Publish(ctx, pb); err != nil {
+		h.resolve(cID, nil, err) // Ensure the correlation entry is removed
 		return nil, err
 	}
-
-	select {
-	case resp := <-rChan:
-		return resp, nil
-	case <-ctx.Done():
-		return nil, ctx.Err()
+	// The correlation entry is removed when a matching response arrives, or when ctx is done (whichever comes first)
+	h.Lock()
+	if _, ok := h.correlData[cID]; ok { // The response may already have been received
+		call.stop = context.AfterFunc(ctx, func() { h.resolve(cID, nil, ctx.Err()) })
 	}
-
+	h.Unlock()
+	return call, nil
 }
 
 func (h *Handler) responseHandler(pb *paho.Publish) {
 	if pb.Properties == nil || pb.Properties.CorrelationData == nil {
 		return
 	}
-
-	rChan := h.getCorrelIDChan(string(pb.Properties.CorrelationData))
-	if rChan == nil {
-		return
-	}
-
-	rChan <- pb
+	h.resolve(string(pb.Properties.CorrelationData), pb, nil)
 }
@@ -65,3 +65,57 @@ func TestRequestCleansUpCorrelDataOnTimeout(t *testing.T) {
 	h.Unlock()
 	require.Equal(t, 0, n, "correlData entry must be removed after a timed-out request (issue #313)")
 }
+
+// TestGoResolvedOnContextDone checks that a Call is resolved, and its correlation data removed, when the context
+// passed to Go is done before a response arrives.
+func TestGoResolvedOnContextDone(t *testing.T) {
+	ts := basictestserver.New(paholog.NOOPLogger{})
+	ts.SetResponse(packets.CONNACK, &packets.Connack{ReasonCode: 0, Properties: &packets.Properties{}})
+	ts.SetResponse(packets.SUBACK, &packets.Suback{Reasons: []byte{1}, Properties: &packets.Properties{}})
+	ts.SetResponse(packets.PUBACK, &packets.Puback{Properties: &packets.Properties{}})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := paho.NewClient(paho.ClientConfig{
+		Conn:     ts.ClientConn(),
+		ClientID: "testRPC",
+	})
+	_, err := c.Connect(context.Background(), &paho.Connect{
+		ClientID:   "testRPC",
+		KeepAlive:  30,
+		CleanStart: true,
+	})
+	require.NoError(t, err)
+
+	h, err := NewHandler(context.Background(), c)
+	require.NoError(t, err)
+	require.Equal(t, "testRPC/responses", h.ResponseTopic())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pub1, pub2 := &paho.Publish{Topic: "test/request", QoS: 1}, &paho.Publish{Topic: "test/request", QoS: 1}
+	call1, err := h.Go(ctx, pub1)
+	require.NoError(t, err)
+	call2, err := h.Go(context.Background(), pub2)
+	require.NoError(t, err)
+	require.NotEqual(t, pub1.Properties.CorrelationData, pub2.Properties.CorrelationData)
+
+	cancel()
+	select {
+	case <-call1.Done():
+	case <-time.After(time.Second):
+		t.Fatal("call not resolved when context cancelled")
+	}
+	_, err = call1.Result(context.Background())
+	require.ErrorIs(t, err, context.Canceled)
+
+	// The second request is unaffected, and is resolved by the matching response
+	h.responseHandler(&paho.Publish{Properties: &paho.PublishProperties{CorrelationData: pub2.Properties.CorrelationData}, Payload: []byte("resp")})
+	resp, err := call2.Result(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []byte("resp"), resp.Payload)
+
+	h.Lock()
+	n := len(h.correlData)
+	h.Unlock()
+	require.Equal(t, 0, n)
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package tracing_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/extensions/tracing"
+	"github.com/eclipse/paho.golang/paho/pahotest"
+)
+
+type requestIDKey struct{}
+
+// requestIDPropagator is a minimal tracing.Propagator that carries a request identifier; a real application would
+// use an adapted OpenTelemetry propagator (see the package documentation).
+type requestIDPropagator struct{}
+
+func (requestIDPropagator) Inject(ctx context.Context, c tracing.Carrier) {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		c.Set("traceparent", id)
+	}
+}
+
+func (requestIDPropagator) Extract(ctx context.Context, c tracing.Carrier) context.Context {
+	if id := c.Get("traceparent"); id != "" {
+		return context.WithValue(ctx, requestIDKey{}, id)
+	}
+	return ctx
+}
+
+func Example() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b := pahotest.NewBroker(nil) // In-memory broker; in a real application the clients would connect to a server
+	defer b.Close()
+
+	spanEnded := make(chan struct{})
+	tr := tracing.New(requestIDPropagator{}, tracing.WithSpanStarter(
+		func(ctx context.Context, p *paho.Publish) (context.Context, func()) {
+			fmt.Println("span started for", p.Topic, "parent", ctx.Value(requestIDKey{}))
+			return ctx, func() { fmt.Println("span ended"); close(spanEnded) }
+		}))
+
+	// Subscriber: the handler receives the context extracted from the message
+	router := paho.NewStandardRouter()
+	router.RegisterContextHandler("orders/#", tr.Handler(func(ctx context.Context, p *paho.Publish) {
+		fmt.Println("received", string(p.Payload), "request", ctx.Value(requestIDKey{}))
+	}))
+	conn, err := b.Connect(ctx)
+	if err != nil {
+		panic(err)
+	}
+	sub := paho.NewClient(paho.ClientConfig{Conn: conn, Router: router})
+	if _, err = sub.Connect(ctx, &paho.Connect{ClientID: "subscriber", KeepAlive: 30, CleanStart: true}); err != nil {
+		panic(err)
+	}
+	defer sub.Disconnect(&paho.Disconnect{})
+	if _, err = sub.Subscribe(ctx, &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{{Topic: "orders/#", QoS: 1}}}); err != nil {
+		panic(err)
+	}
+
+	// Publisher: the trace context in ctx is added to the message
+	if conn, err = b.Connect(ctx); err != nil {
+		panic(err)
+	}
+	pub := paho.NewClient(paho.ClientConfig{Conn: conn})
+	if _, err = pub.Connect(ctx, &paho.Connect{ClientID: "publisher", KeepAlive: 30, CleanStart: true}); err != nil {
+		panic(err)
+	}
+	defer pub.Disconnect(&paho.Disconnect{})
+	reqCtx := context.WithValue(ctx, requestIDKey{}, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	if _, err = tr.Publish(reqCtx, pub, &paho.Publish{Topic: "orders/new", QoS: 1, Payload: []byte("order 1")}); err != nil {
+		panic(err)
+	}
+	<-spanEnded
+
+	// Output:
+	// span started for orders/new parent 00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01
+	// received order 1 request 00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01
+	// span ended
+}
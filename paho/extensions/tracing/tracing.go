@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+// Package tracing propagates trace context (e.g. the W3C `traceparent` and `tracestate` headers) between services
+// communicating via MQTT, using MQTT v5 User Properties as the carrier.
+//
+// To avoid a dependency on any particular tracing library, a small Propagator interface is used. The method set of
+// Carrier matches OpenTelemetry's propagation.TextMapCarrier, so a propagation.TextMapPropagator can be adapted with:
+//
+//	type otelPropagator struct{ propagation.TextMapPropagator }
+//
+//	func (p otelPropagator) Inject(ctx context.Context, c tracing.Carrier) { p.TextMapPropagator.Inject(ctx, c) }
+//	func (p otelPropagator) Extract(ctx context.Context, c tracing.Carrier) context.Context {
+//		return p.TextMapPropagator.Extract(ctx, c)
+//	}
+//
+// and a child span started for each message received with:
+//
+//	tracing.WithSpanStarter(func(ctx context.Context, p *paho.Publish) (context.Context, func()) {
+//		ctx, span := tracer.Start(ctx, p.Topic+" receive", trace.WithSpanKind(trace.SpanKindConsumer))
+//		return ctx, func() { span.End() }
+//	})
+package tracing
+
+import (
+	"context"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// Carrier provides access to the User Properties of a message (same method set as OpenTelemetry's
+// propagation.TextMapCarrier)
+type Carrier interface {
+	Get(key string) string        // Returns the value of the first User Property named key ("" if none)
+	Set(key string, value string) // Sets the User Property key to value (replacing any existing value)
+	Keys() []string               // Returns the names of all User Properties
+}
+
+// Propagator injects trace context from a context.Context into a Carrier, and extracts it again
+type Propagator interface {
+	Inject(ctx context.Context, carrier Carrier)
+	Extract(ctx context.Context, carrier Carrier) context.Context
+}
+
+// SpanStarter is called (by the handler returned from Tracer.Handler) with the context extracted from a received
+// message. It should start a span (a child of any span in ctx) and return a context containing it along with a
+// function that ends the span (called once the handler returns).
+type SpanStarter func(ctx context.Context, p *paho.Publish) (context.Context, func())
+
+// Publisher is implemented by paho.Client and autopaho.ConnectionManager
+type Publisher interface {
+	Publish(ctx context.Context, p *paho.Publish) (*paho.PublishResponse, error)
+}
+
+// Tracer propagates trace context through messages; create with New
+type Tracer struct {
+	propagator Propagator
+	startSpan  SpanStarter
+}
+
+// Option configures a Tracer (pass to New)
+type Option func(*Tracer)
+
+// WithSpanStarter results in a span being started (via s) for each message passed to a handler returned by
+// Tracer.Handler. Without this option the extracted context is passed to the handler unaltered.
+func WithSpanStarter(s SpanStarter) Option {
+	return func(t *Tracer) {
+		t.startSpan = s
+	}
+}
+
+// New creates a Tracer that uses p to inject and extract trace context
+func New(p Propagator, opts ...Option) *Tracer {
+	t := &Tracer{propagator: p}
+	for _, o := range opts {
+		o(t)
+	}
+	return t
+}
+
+// Inject adds the trace context from ctx to the User Properties of p (p.Properties is created if nil). p is modified;
+// see Publish for an alternative that leaves the message passed to it unaltered.
+func (t *Tracer) Inject(ctx context.Context, p *paho.Publish) {
+	if p.Properties == nil {
+		p.Properties = &paho.PublishProperties{}
+	}
+	t.propagator.Inject(ctx, (*userPropertiesCarrier)(&p.Properties.User))
+}
+
+// Extract returns a context, derived from ctx, containing the trace context carried in the User Properties of p
+func (t *Tracer) Extract(ctx context.Context, p *paho.Publish) context.Context {
+	var up paho.UserProperties
+	if p.Properties != nil {
+		up = p.Properties.User
+	}
+	return t.propagator.Extract(ctx, (*userPropertiesCarrier)(&up))
+}
+
+// Publish publishes a copy of p, with the trace context from ctx added to its User Properties, via pub
+func (t *Tracer) Publish(ctx context.Context, pub Publisher, p *paho.Publish) (*paho.PublishResponse, error) {
+	cp := *p
+	if p.Properties != nil {
+		props := *p.Properties
+		props.User = append(paho.UserProperties(nil), props.User...)
+		cp.Properties = &props
+	}
+	t.Inject(ctx, &cp)
+	return pub.Publish(ctx, &cp)
+}
+
+// Handler returns a paho.MessageContextHandler (for use with StandardRouter.RegisterContextHandler) that extracts the
+// trace context from each message, starts a span (see WithSpanStarter) and then calls h with the resulting context.
+func (t *Tracer) Handler(h paho.MessageContextHandler) paho.MessageContextHandler {
+	return func(ctx context.Context, p *paho.Publish) {
+		ctx = t.Extract(ctx, p)
+		if t.startSpan != nil {
+			var end func()
+			ctx, end = t.startSpan(ctx, p)
+			if end != nil {
+				defer end()
+			}
+		}
+		h(ctx, p)
+	}
+}
+
+// userPropertiesCarrier implements Carrier for paho.UserProperties
+type userPropertiesCarrier paho.UserProperties
+
+// Get implements Carrier
+func (u *userPropertiesCarrier) Get(key string) string {
+	return paho.UserProperties(*u).Get(key)
+}
+
+// Set implements Carrier; any existing properties named key are replaced
+func (u *userPropertiesCarrier) Set(key, value string) {
+	up := paho.UserProperties(*u)
+	for i := range up {
+		if up[i].Key == key {
+			up[i].Value = value
+			*u = userPropertiesCarrier(removeKey(up, key, i+1))
+			return
+		}
+	}
+	*u = userPropertiesCarrier(append(up, paho.UserProperty{Key: key, Value: value}))
+}
+
+// Keys implements Carrier
+func (u *userPropertiesCarrier) Keys() []string {
+	keys := make([]string, 0, len(*u))
+	for _, p := range *u {
+		keys = append(keys, p.Key)
+	}
+	return keys
+}
+
+// removeKey removes properties named key from up[from:]
+func removeKey(up paho.UserProperties, key string, from int) paho.UserProperties {
+	out := up[:from]
+	for _, p := range up[from:] {
+		if p.Key != key {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package tracing
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+type ctxKey struct{}
+
+// testPropagator carries a trace identifier (held in the context under ctxKey) in the `traceparent` property
+type testPropagator struct{}
+
+func (testPropagator) Inject(ctx context.Context, c Carrier) {
+	if id, ok := ctx.Value(ctxKey{}).(string); ok {
+		c.Set("traceparent", id)
+	}
+}
+
+func (testPropagator) Extract(ctx context.Context, c Carrier) context.Context {
+	if id := c.Get("traceparent"); id != "" {
+		return context.WithValue(ctx, ctxKey{}, id)
+	}
+	return ctx
+}
+
+type publisherFunc func(context.Context, *paho.Publish) (*paho.PublishResponse, error)
+
+func (f publisherFunc) Publish(ctx context.Context, p *paho.Publish) (*paho.PublishResponse, error) {
+	return f(ctx, p)
+}
+
+func TestInjectExtract(t *testing.T) {
+	tr := New(testPropagator{})
+	ctx := context.WithValue(context.Background(), ctxKey{}, "trace-1")
+
+	p := &paho.Publish{Topic: "a"}
+	tr.Inject(ctx, p)
+	if p.Properties == nil || !reflect.DeepEqual(p.Properties.User, paho.UserProperties{{Key: "traceparent", Value: "trace-1"}}) {
+		t.Fatalf("unexpected properties after Inject: %+v", p.Properties)
+	}
+
+	// An existing value is replaced (along with any duplicates) and other properties retained
+	p.Properties.User = paho.UserProperties{{Key: "traceparent", Value: "old"}, {Key: "k", Value: "v"}, {Key: "traceparent", Value: "old2"}}
+	tr.Inject(ctx, p)
+	if !reflect.DeepEqual(p.Properties.User, paho.UserProperties{{Key: "traceparent", Value: "trace-1"}, {Key: "k", Value: "v"}}) {
+		t.Fatalf("unexpected properties after second Inject: %+v", p.Properties.User)
+	}
+
+	if id := tr.Extract(context.Background(), p).Value(ctxKey{}); id != "trace-1" {
+		t.Errorf("expected trace-1 to be extracted, got %v", id)
+	}
+	if id := tr.Extract(context.Background(), &paho.Publish{Topic: "a"}).Value(ctxKey{}); id != nil {
+		t.Errorf("expected nothing to be extracted, got %v", id)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	tr := New(testPropagator{})
+	ctx := context.WithValue(context.Background(), ctxKey{}, "trace-1")
+
+	orig := &paho.Publish{Topic: "a", Properties: &paho.PublishProperties{User: paho.UserProperties{{Key: "k", Value: "v"}}}}
+	var sent *paho.Publish
+	if _, err := tr.Publish(ctx, publisherFunc(func(_ context.Context, p *paho.Publish) (*paho.PublishResponse, error) {
+		sent = p
+		return &paho.PublishResponse{}, nil
+	}), orig); err != nil {
+		t.Fatalf("Publish failed: %s", err)
+	}
+	if !reflect.DeepEqual(sent.Properties.User, paho.UserProperties{{Key: "k", Value: "v"}, {Key: "traceparent", Value: "trace-1"}}) {
+		t.Errorf("unexpected properties published: %+v", sent.Properties.User)
+	}
+	if !reflect.DeepEqual(orig.Properties.User, paho.UserProperties{{Key: "k", Value: "v"}}) {
+		t.Errorf("original message should not be modified: %+v", orig.Properties.User)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var calls []string
+	tr := New(testPropagator{}, WithSpanStarter(func(ctx context.Context, p *paho.Publish) (context.Context, func()) {
+		parent, _ := ctx.Value(ctxKey{}).(string)
+		calls = append(calls, "start span (parent "+parent+") for "+p.Topic)
+		return context.WithValue(ctx, ctxKey{}, "child-of-"+parent), func() { calls = append(calls, "end span") }
+	}))
+
+	r := paho.NewStandardRouter()
+	r.RegisterContextHandler("a/#", tr.Handler(func(ctx context.Context, p *paho.Publish) {
+		id, _ := ctx.Value(ctxKey{}).(string)
+		calls = append(calls, "handler "+id)
+	}))
+	if err := r.RouteMessage(context.Background(), &paho.Publish{
+		Topic:      "a/b",
+		Properties: &paho.PublishProperties{User: paho.UserProperties{{Key: "traceparent", Value: "trace-1"}}},
+	}); err != nil {
+		t.Fatalf("RouteMessage failed: %s", err)
+	}
+	expected := []string{"start span (parent trace-1) for a/b", "handler child-of-trace-1", "end span"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected %v, got %v", expected, calls)
+	}
+}
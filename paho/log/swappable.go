@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package log
+
+import "sync/atomic"
+
+// SwappableLogger is a Logger that passes calls on to another Logger which may be replaced at any time (including
+// whilst other goroutines are logging). This enables the logger in use by a running client to be changed.
+// The zero value is ready to use (and discards all output until Set is called).
+type SwappableLogger struct {
+	l atomic.Pointer[Logger]
+}
+
+// NewSwappableLogger returns a SwappableLogger that initially passes calls to l (NOOPLogger if l is nil)
+func NewSwappableLogger(l Logger) *SwappableLogger {
+	s := &SwappableLogger{}
+	s.Set(l)
+	return s
+}
+
+// Set replaces the Logger that calls are passed to (nil is equivalent to NOOPLogger)
+func (s *SwappableLogger) Set(l Logger) {
+	if l == nil {
+		l = NOOPLogger{}
+	}
+	s.l.Store(&l)
+}
+
+// logger returns the Logger that calls should be passed to (NOOPLogger if Set has not been called)
+func (s *SwappableLogger) logger() Logger {
+	if l := s.l.Load(); l != nil {
+		return *l
+	}
+	return NOOPLogger{}
+}
+
+// Println implements Logger
+func (s *SwappableLogger) Println(v ...interface{}) {
+	s.logger().Println(v...)
+}
+
+// Printf implements Logger
+func (s *SwappableLogger) Printf(format string, v ...interface{}) {
+	s.logger().Printf(format, v...)
+}
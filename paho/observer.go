@@ -0,0 +1,44 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import "time"
+
+// Observer is notified as messages pass through the client, enabling metrics (counters, latency histograms etc.) to
+// be collected. Functions are called synchronously, so must return quickly and must not call back into the Client.
+type Observer interface {
+	// OnPublishSent is called when a PUBLISH has been written to the connection
+	OnPublishSent(qos byte)
+
+	// OnPublishAcked is called when the final response (PUBACK, PUBREC with an error, or PUBCOMP) to a QOS1/2 PUBLISH
+	// is received; latency is the time since Publish was called. This is not called for PublishMethod_AsyncSend.
+	OnPublishAcked(qos byte, reasonCode byte, latency time.Duration)
+
+	// OnSubscribeAcked is called when a SUBACK is received; latency is the time since Subscribe was called.
+	OnSubscribeAcked(latency time.Duration)
+
+	// OnMessageReceived is called when a PUBLISH received from the server is passed to the handlers (duplicate QOS2
+	// messages that are not passed on will not be included).
+	OnMessageReceived(qos byte)
+}
+
+// NOOPObserver implements Observer but does nothing
+type NOOPObserver struct{}
+
+func (NOOPObserver) OnPublishSent(byte)                       {}
+func (NOOPObserver) OnPublishAcked(byte, byte, time.Duration) {}
+func (NOOPObserver) OnSubscribeAcked(time.Duration)           {}
+func (NOOPObserver) OnMessageReceived(byte)                   {}
@@ -0,0 +1,337 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+// Package pahotest provides an in-memory MQTT v5 broker for use in tests.
+//
+// The Broker speaks enough of MQTT v5 to accept connections, acknowledge SUBSCRIBE, UNSUBSCRIBE and PUBLISH packets
+// (at all QoS levels), deliver messages to matching subscribers (including retained and will messages) and detect
+// keep alive expiry. It can also be scripted to disconnect clients, drop connections, delay responses and discard
+// packets in either direction (e.g. to simulate a lost PUBACK), enabling reconnection, QoS flows and timeouts to be
+// tested deterministically (it works within a testing/synctest bubble, provided the Broker is created within it).
+//
+// Limitations include:
+//   - Sessions are not retained (SessionPresent is always false, and messages are not retransmitted on reconnection)
+//   - Shared subscriptions, and enhanced authentication, are not supported
+//   - Packet sizes, Receive Maximum, and most other negotiated limits are not enforced
+//   - Encoding/decoding relies on the paho `packets` package (so it is not independently tested)
+//
+// Example (with autopaho):
+//
+//	b := pahotest.NewBroker(nil)
+//	defer b.Close()
+//	cfg := autopaho.ClientConfig{
+//		ServerUrls: []*url.URL{u}, // Any URL (it is not used)
+//		AttemptConnection: func(ctx context.Context, _ autopaho.ClientConfig, _ *url.URL) (net.Conn, error) {
+//			return b.Connect(ctx)
+//		},
+//		...
+//	}
+package pahotest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/internal/testserver"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho/log"
+)
+
+var (
+	ErrClosed             = errors.New("broker closed")        // Returned by Connect after Close has been called
+	ErrClientNotConnected = errors.New("client not connected") // Returned when a client identifier is not connected
+)
+
+// PacketFilter is called with the client identifier, and packet, when a packet is received from, or is about to be
+// sent to, a client. Returning false results in the packet being discarded (as if it was lost in transit).
+type PacketFilter func(clientID string, cp *packets.ControlPacket) bool
+
+// Broker is an in-memory MQTT server; create one with NewBroker.
+type Broker struct {
+	logger log.Logger
+
+	mu            sync.Mutex
+	conns         map[*conn]struct{}          // All open connections (including those awaiting CONNECT)
+	clients       map[string]*conn            // Connected clients (keyed by client identifier)
+	retained      map[string]*packets.Publish // Retained messages (keyed by topic)
+	assignedIDs   int                         // Used to generate client identifiers when the client does not provide one
+	closed        bool
+	connackFn     func(*packets.Connect, *packets.Connack)
+	receiveFilter PacketFilter
+	sendFilter    PacketFilter
+	responseDelay time.Duration
+
+	wg sync.WaitGroup // Tracks connection goroutines
+}
+
+// NewBroker creates a Broker. Debug information will be written to logger (which may be nil).
+func NewBroker(logger log.Logger) *Broker {
+	if logger == nil {
+		logger = log.NOOPLogger{}
+	}
+	return &Broker{
+		logger:   logger,
+		conns:    make(map[*conn]struct{}),
+		clients:  make(map[string]*conn),
+		retained: make(map[string]*packets.Publish),
+	}
+}
+
+// SetConnackFn sets a function that will be called before each CONNACK is sent; it may modify the CONNACK (e.g. set
+// a failure reason code, or properties such as TopicAliasMaximum).
+func (b *Broker) SetConnackFn(fn func(*packets.Connect, *packets.Connack)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.connackFn = fn
+}
+
+// SetReceiveFilter sets a PacketFilter that is called for each packet received (after CONNECT). Packets it rejects
+// are ignored (so no response will be sent).
+func (b *Broker) SetReceiveFilter(fn PacketFilter) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.receiveFilter = fn
+}
+
+// SetSendFilter sets a PacketFilter that is called before each packet (other than CONNACK) is sent to a client.
+// Packets it rejects are not sent (e.g. rejecting PUBACK packets simulates lost acknowledgements, and rejecting
+// PINGRESP packets a failed connection).
+func (b *Broker) SetSendFilter(fn PacketFilter) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sendFilter = fn
+}
+
+// SetResponseDelay sets a delay that is applied before each packet is sent to a client (0 to disable).
+func (b *Broker) SetResponseDelay(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.responseDelay = d
+}
+
+// Connect establishes a new in-memory connection to the broker, returning the client end (ready to be passed to
+// paho.ClientConfig.Conn, or returned from autopaho.ClientConfig.AttemptConnection). The connection will be closed
+// if ctx is cancelled before the client sends CONNECT.
+func (b *Broker) Connect(ctx context.Context) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	userConn, ourConn := testserver.NewConnPair()
+	if err := b.ServeConn(ctx, ourConn); err != nil {
+		return nil, err
+	}
+	// net.Conn implementations are generally not safe for concurrent writes
+	return packets.NewThreadSafeConn(userConn), nil
+}
+
+// ServeConn serves an MQTT client connected via nc (e.g. a connection accepted from a net.Listener). It returns
+// immediately (the connection is handled in the background and closed when done). The connection will be closed if
+// ctx is cancelled before the client sends CONNECT.
+func (b *Broker) ServeConn(ctx context.Context, nc net.Conn) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		_ = nc.Close()
+		return ErrClosed
+	}
+	c := newConn(b, nc)
+	b.conns[c] = struct{}{}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		c.serve(ctx)
+		b.mu.Lock()
+		delete(b.conns, c)
+		b.mu.Unlock()
+	}()
+	return nil
+}
+
+// Clients returns the identifiers of the connected clients
+func (b *Broker) Clients() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ids := make([]string, 0, len(b.clients))
+	for id := range b.clients {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Connected returns true if a client with the specified identifier is connected
+func (b *Broker) Connected(clientID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.clients[clientID]
+	return ok
+}
+
+// Disconnect sends a DISCONNECT, with the specified reason code, to the client and then closes the connection.
+func (b *Broker) Disconnect(clientID string, reasonCode byte) error {
+	c := b.client(clientID)
+	if c == nil {
+		return ErrClientNotConnected
+	}
+	c.disconnect(reasonCode)
+	return nil
+}
+
+// SendDisconnect sends d (which may include properties such as a Server Reference) to the client and then closes
+// the connection.
+func (b *Broker) SendDisconnect(clientID string, d *packets.Disconnect) error {
+	c := b.client(clientID)
+	if c == nil {
+		return ErrClientNotConnected
+	}
+	cp := packets.NewControlPacket(packets.DISCONNECT)
+	cp.Content = d
+	c.queue(outgoing{cp: cp, closeAfter: true})
+	return nil
+}
+
+// DropConnection closes the connection to the client without sending a DISCONNECT (simulating a network failure).
+// The client's will message, if any, is published.
+func (b *Broker) DropConnection(clientID string) error {
+	c := b.client(clientID)
+	if c == nil {
+		return ErrClientNotConnected
+	}
+	c.close()
+	return nil
+}
+
+// Publish delivers p to all clients with matching subscriptions (as if it had been published by a client); if
+// p.Retain is set then it is also retained (or, if the payload is empty, any retained message is cleared).
+func (b *Broker) Publish(p *packets.Publish) {
+	b.route(p, nil)
+}
+
+// Close disconnects all clients (without sending DISCONNECT) and waits for the connections to shut down. The Broker
+// cannot be used after Close is called.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	b.closed = true
+	conns := make([]*conn, 0, len(b.conns))
+	for c := range b.conns {
+		conns = append(conns, c)
+	}
+	b.mu.Unlock()
+	for _, c := range conns {
+		c.close()
+	}
+	b.wg.Wait()
+}
+
+// client returns the connection for the specified client identifier (nil if not connected)
+func (b *Broker) client(clientID string) *conn {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.clients[clientID]
+}
+
+// register records c as the connection for clientID, returning the connection it replaces (if any)
+func (b *Broker) register(clientID string, c *conn) (*conn, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+	old := b.clients[clientID]
+	b.clients[clientID] = c
+	return old, nil
+}
+
+// unregister removes c (if it is still the connection for its client identifier)
+func (b *Broker) unregister(c *conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.clients[c.clientID] == c {
+		delete(b.clients, c.clientID)
+	}
+}
+
+// assignClientID generates a client identifier for a client that did not provide one
+func (b *Broker) assignClientID() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.assignedIDs++
+	return fmt.Sprintf("pahotest-%d", b.assignedIDs)
+}
+
+// route retains p (if required) and delivers it to matching subscribers (from is the publishing connection, which
+// is nil for messages originating within the broker).
+func (b *Broker) route(p *packets.Publish, from *conn) {
+	b.mu.Lock()
+	if p.Retain {
+		if len(p.Payload) == 0 {
+			delete(b.retained, p.Topic)
+		} else {
+			b.retained[p.Topic] = p
+		}
+	}
+	conns := make([]*conn, 0, len(b.clients))
+	for _, c := range b.clients {
+		conns = append(conns, c)
+	}
+	b.mu.Unlock()
+
+	for _, c := range conns {
+		c.deliver(p, c == from, false)
+	}
+}
+
+// retainedMatching returns the retained messages with topics matching filter
+func (b *Broker) retainedMatching(filter string) []*packets.Publish {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ps []*packets.Publish
+	for topic, p := range b.retained {
+		if match(filter, topic) {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+// filters returns the current packet filters and delay
+func (b *Broker) filters() (receive, send PacketFilter, delay time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.receiveFilter, b.sendFilter, b.responseDelay
+}
+
+// match returns true if topic matches filter (which may include wildcards)
+func match(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	// Wildcards at the start of a filter do not match topics beginning with $ [MQTT-4.7.2-1]
+	if strings.HasPrefix(topic, "$") && (f[0] == "+" || f[0] == "#") {
+		return false
+	}
+	for i, level := range f {
+		if level == "#" {
+			return true // Also matches the parent level (e.g. `a/#` matches `a`)
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
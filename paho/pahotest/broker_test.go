@@ -0,0 +1,225 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package pahotest_test
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	paholog "github.com/eclipse/paho.golang/paho/log"
+	"github.com/eclipse/paho.golang/paho/pahotest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connect creates a paho.Client connected to b; messages received are sent to the returned channel
+func connect(t *testing.T, b *pahotest.Broker, cfg paho.ClientConfig, cp *paho.Connect) (*paho.Client, <-chan *paho.Publish) {
+	t.Helper()
+	conn, err := b.Connect(t.Context())
+	require.NoError(t, err)
+	msgs := make(chan *paho.Publish, 10)
+	cfg.Conn = conn
+	cfg.OnPublishReceived = []func(paho.PublishReceived) (bool, error){
+		func(pr paho.PublishReceived) (bool, error) {
+			msgs <- pr.Packet
+			return true, nil
+		},
+	}
+	c := paho.NewClient(cfg)
+	c.SetDebugLogger(paholog.NewTestLogger(t, cp.ClientID+":"))
+	ca, err := c.Connect(t.Context(), cp)
+	require.NoError(t, err)
+	require.Equal(t, byte(0), ca.ReasonCode)
+	t.Cleanup(func() { _ = c.Disconnect(&paho.Disconnect{}) })
+	return c, msgs
+}
+
+// receive waits for a message on msgs
+func receive(t *testing.T, msgs <-chan *paho.Publish) *paho.Publish {
+	t.Helper()
+	select {
+	case m := <-msgs:
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("timeout awaiting message")
+	}
+	return nil
+}
+
+func TestBrokerPubSub(t *testing.T) {
+	b := pahotest.NewBroker(paholog.NewTestLogger(t, "broker:"))
+	defer b.Close()
+
+	sub, subMsgs := connect(t, b, paho.ClientConfig{}, &paho.Connect{ClientID: "sub", KeepAlive: 30})
+	pub, pubMsgs := connect(t, b, paho.ClientConfig{}, &paho.Connect{ClientID: "pub", KeepAlive: 30, CleanStart: true,
+		WillMessage: &paho.WillMessage{Topic: "will", Payload: []byte("gone"), QoS: 1}})
+	assert.ElementsMatch(t, []string{"sub", "pub"}, b.Clients())
+
+	sa, err := sub.Subscribe(t.Context(), &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{
+		{Topic: "a/+", QoS: 1},
+		{Topic: "will", QoS: 2},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1, 2}, sa.Reasons)
+	assert.False(t, sub.ServerProperties().SharedSubAvailable)
+	_, err = pub.Subscribe(t.Context(), &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{{Topic: "a/#", QoS: 2, NoLocal: true}}})
+	require.NoError(t, err)
+
+	for _, qos := range []byte{0, 1, 2} {
+		_, err = pub.Publish(t.Context(), &paho.Publish{Topic: "a/b", QoS: qos, Payload: []byte{qos}})
+		require.NoError(t, err)
+		m := receive(t, subMsgs)
+		assert.Equal(t, "a/b", m.Topic)
+		assert.Equal(t, min(qos, 1), m.QoS) // Limited by subscription QoS
+		assert.Equal(t, []byte{qos}, m.Payload)
+	}
+	_, err = pub.Publish(t.Context(), &paho.Publish{Topic: "c", QoS: 1, Payload: []byte("no subscribers")})
+	require.NoError(t, err)
+
+	// Retained messages are delivered when a subscription is made
+	_, err = pub.Publish(t.Context(), &paho.Publish{Topic: "r/1", QoS: 1, Retain: true, Payload: []byte("retained")})
+	require.NoError(t, err)
+	_, err = sub.Subscribe(t.Context(), &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{{Topic: "r/#", QoS: 1}}})
+	require.NoError(t, err)
+	m := receive(t, subMsgs)
+	assert.Equal(t, "r/1", m.Topic)
+	assert.True(t, m.Retain)
+
+	// The will is published if the connection is lost
+	require.NoError(t, b.DropConnection("pub"))
+	m = receive(t, subMsgs)
+	assert.Equal(t, "will", m.Topic)
+	assert.Equal(t, []byte("gone"), m.Payload)
+
+	assert.Len(t, pubMsgs, 0, "NoLocal subscription should not receive own messages")
+	assert.Len(t, subMsgs, 0, "unexpected message")
+	assert.Equal(t, pahotest.ErrClientNotConnected, b.DropConnection("pub"))
+}
+
+// TestBrokerScripting checks the broker's fault injection options
+func TestBrokerScripting(t *testing.T) {
+	b := pahotest.NewBroker(paholog.NewTestLogger(t, "broker:"))
+	defer b.Close()
+	b.SetConnackFn(func(cp *packets.Connect, ca *packets.Connack) {
+		if cp.ClientID == "rejected" {
+			ca.ReasonCode = packets.ConnackNotAuthorized
+		}
+	})
+
+	conn, err := b.Connect(t.Context())
+	require.NoError(t, err)
+	ca, err := paho.NewClient(paho.ClientConfig{Conn: conn}).Connect(t.Context(), &paho.Connect{ClientID: "rejected"})
+	require.Error(t, err)
+	require.NotNil(t, ca)
+	assert.Equal(t, byte(packets.ConnackNotAuthorized), ca.ReasonCode)
+
+	// Server assigned client identifier
+	disconnected := make(chan byte, 1)
+	c, msgs := connect(t, b, paho.ClientConfig{
+		AckTimeout: 50 * time.Millisecond,
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			disconnected <- d.ReasonCode
+		},
+	}, &paho.Connect{KeepAlive: 30})
+	clientID := c.ServerProperties().AssignedClientID
+	require.NotEmpty(t, clientID)
+	assert.True(t, b.Connected(clientID))
+
+	// Lost PUBACK
+	b.SetSendFilter(func(_ string, cp *packets.ControlPacket) bool {
+		return cp.Type != packets.PUBACK
+	})
+	_, err = c.Publish(t.Context(), &paho.Publish{Topic: "a", QoS: 1, Payload: []byte("lost ack")})
+	assert.ErrorIs(t, err, paho.ErrAckTimeout)
+	b.SetSendFilter(nil)
+
+	// Slow responses
+	b.SetResponseDelay(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	_, err = c.Subscribe(ctx, &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{{Topic: "a", QoS: 1}}})
+	cancel()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	b.SetResponseDelay(0)
+
+	// Messages from the broker
+	_, err = c.Subscribe(t.Context(), &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{{Topic: "b", QoS: 1}}})
+	require.NoError(t, err)
+	b.Publish(&packets.Publish{Topic: "b", QoS: 1, Payload: []byte("from broker"), Properties: &packets.Properties{}})
+	assert.Equal(t, []byte("from broker"), receive(t, msgs).Payload)
+
+	// Server initiated disconnect
+	require.NoError(t, b.Disconnect(clientID, packets.DisconnectServerShuttingDown))
+	select {
+	case rc := <-disconnected:
+		assert.Equal(t, byte(packets.DisconnectServerShuttingDown), rc)
+	case <-time.After(time.Second):
+		t.Fatal("timeout awaiting DISCONNECT")
+	}
+	require.Eventually(t, func() bool { return !b.Connected(clientID) }, time.Second, time.Millisecond)
+}
+
+// TestBrokerAutopaho checks that autopaho reconnects, and keep alive failures are detected, when using the broker
+func TestBrokerAutopaho(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		b := pahotest.NewBroker(paholog.NewTestLogger(t, "broker:"))
+		defer b.Close()
+
+		server, _ := url.Parse("mqtt://127.0.0.1:1883")
+		connUp := make(chan struct{}, 1)
+		logger := paholog.NewTestLogger(t, "autopaho:")
+		cm, err := autopaho.NewConnection(t.Context(), autopaho.ClientConfig{
+			ServerUrls:       []*url.URL{server},
+			KeepAlive:        10,
+			ReconnectBackoff: autopaho.NewConstantBackoff(time.Second),
+			AttemptConnection: func(ctx context.Context, _ autopaho.ClientConfig, _ *url.URL) (net.Conn, error) {
+				return b.Connect(ctx)
+			},
+			OnConnectionUp: func(*autopaho.ConnectionManager, *paho.Connack) { connUp <- struct{}{} },
+			Debug:          logger,
+			PahoDebug:      logger,
+			ClientConfig:   paho.ClientConfig{ClientID: "auto"},
+		})
+		require.NoError(t, err)
+		awaitConnUp := func() {
+			t.Helper()
+			select {
+			case <-connUp:
+			case <-time.After(time.Minute):
+				t.Fatal("timeout awaiting connection")
+			}
+		}
+		awaitConnUp()
+
+		require.NoError(t, b.DropConnection("auto"))
+		awaitConnUp()
+
+		// Discarding PINGRESP simulates a half-open connection; the client should detect this and reconnect
+		b.SetSendFilter(func(_ string, cp *packets.ControlPacket) bool { return cp.Type != packets.PINGRESP })
+		start := time.Now()
+		awaitConnUp()
+		assert.GreaterOrEqual(t, time.Since(start), 10*time.Second) // No PINGREQ is needed until keep alive has elapsed
+
+		require.NoError(t, cm.Disconnect(t.Context()))
+		<-cm.Done()
+	})
+}
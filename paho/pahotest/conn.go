@@ -0,0 +1,438 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package pahotest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+const (
+	outgoingChanSize        = 100 // Size of chan for outgoing packets (enables multiple packets to be in flight)
+	midInitial       uint16 = 300 // Server side packet identifiers start here (which makes logs easier to follow)
+)
+
+// subscription holds the details of a single subscription
+type subscription struct {
+	options packets.SubOptions
+	subID   *int // Subscription Identifier (if any)
+}
+
+// outgoing is a packet queued for transmission to the client
+type outgoing struct {
+	cp         *packets.ControlPacket
+	closeAfter bool // if true the connection will be closed once the packet has been sent
+}
+
+// conn manages a single client connection
+type conn struct {
+	b         *Broker
+	nc        net.Conn
+	out       chan outgoing
+	done      chan struct{} // closed when the connection is being shut down
+	closeOnce sync.Once
+
+	// The following are set when CONNECT is processed (and are not modified thereafter)
+	clientID  string
+	keepAlive uint16
+
+	mu            sync.Mutex
+	subscriptions map[string]subscription // Keyed by topic filter
+	inflight      map[uint16]byte         // Server originated PUBLISH awaiting acknowledgement (value is QoS)
+	received      map[uint16]struct{}     // Client originated QoS2 PUBLISH awaiting PUBREL
+	topicAliases  map[uint16]string       // Inbound topic aliases
+	lastMID       uint16
+	will          *packets.Publish // nil if there is no will (or it has been discarded)
+}
+
+// newConn creates a conn for nc
+func newConn(b *Broker, nc net.Conn) *conn {
+	return &conn{
+		b:             b,
+		nc:            nc,
+		out:           make(chan outgoing, outgoingChanSize),
+		done:          make(chan struct{}),
+		subscriptions: make(map[string]subscription),
+		inflight:      make(map[uint16]byte),
+		received:      make(map[uint16]struct{}),
+		topicAliases:  make(map[uint16]string),
+		lastMID:       midInitial,
+	}
+}
+
+// serve handles the connection until it is closed
+func (c *conn) serve(ctx context.Context) {
+	defer c.close()
+	stop := context.AfterFunc(ctx, c.close)
+	cp, err := packets.ReadPacket(c.nc)
+	stop() // ctx only applies until the CONNECT is received
+	if err != nil {
+		c.b.logger.Printf("failed to read CONNECT: %s", err)
+		return
+	}
+	cc, ok := cp.Content.(*packets.Connect)
+	if !ok {
+		c.b.logger.Printf("received %s before CONNECT", cp.PacketType())
+		return
+	}
+	if !c.connect(cc) {
+		return
+	}
+
+	go c.write()
+	err = c.read()
+	c.b.unregister(c)
+	c.close()
+	c.mu.Lock()
+	will := c.will
+	c.will = nil
+	c.mu.Unlock()
+	if will != nil {
+		c.b.logger.Printf("%s: connection lost (%s), publishing will", c.clientID, err)
+		c.b.route(will, c)
+	} else {
+		c.b.logger.Printf("%s: connection closed (%s)", c.clientID, err)
+	}
+}
+
+// connect processes the CONNECT packet, returning false if the connection should be closed
+func (c *conn) connect(cc *packets.Connect) bool {
+	ca := &packets.Connack{Properties: &packets.Properties{SharedSubAvailable: new(byte)}}
+	c.clientID = cc.ClientID
+	if c.clientID == "" {
+		c.clientID = c.b.assignClientID()
+		ca.Properties.AssignedClientID = c.clientID
+	}
+	c.keepAlive = cc.KeepAlive
+	if cc.WillFlag {
+		c.will = &packets.Publish{
+			Topic:      cc.WillTopic,
+			QoS:        cc.WillQOS,
+			Retain:     cc.WillRetain,
+			Payload:    cc.WillMessage,
+			Properties: cc.WillProperties,
+		}
+		if c.will.Properties == nil {
+			c.will.Properties = &packets.Properties{}
+		}
+	}
+
+	c.b.mu.Lock()
+	connackFn := c.b.connackFn
+	c.b.mu.Unlock()
+	if connackFn != nil {
+		connackFn(cc, ca)
+	}
+	if ca.ReasonCode >= 0x80 {
+		c.b.logger.Printf("%s: rejecting connection (reason %d)", c.clientID, ca.ReasonCode)
+		_, _ = ca.WriteTo(c.nc)
+		return false
+	}
+
+	old, err := c.b.register(c.clientID, c)
+	if err != nil {
+		return false
+	}
+	if old != nil { // A new connection with the same client identifier takes over the session
+		old.disconnect(packets.DisconnectSessionTakenOver)
+	}
+	c.b.logger.Printf("%s: connected", c.clientID)
+	if _, err := ca.WriteTo(c.nc); err != nil {
+		c.b.logger.Printf("%s: failed to send CONNACK: %s", c.clientID, err)
+		return false
+	}
+	return true
+}
+
+// read processes inbound packets until an error occurs (or the client disconnects)
+func (c *conn) read() error {
+	for {
+		if c.keepAlive > 0 { // The server may close the connection after one and a half times keep alive [MQTT-3.1.2-22]
+			_ = c.nc.SetReadDeadline(time.Now().Add(time.Duration(c.keepAlive) * time.Second * 3 / 2))
+		}
+		cp, err := packets.ReadPacket(c.nc)
+		if err != nil {
+			return err
+		}
+		if receiveFilter, _, _ := c.b.filters(); receiveFilter != nil && !receiveFilter(c.clientID, cp) {
+			c.b.logger.Printf("%s: discarding received %s", c.clientID, cp.PacketType())
+			continue
+		}
+		if err := c.handle(cp); err != nil {
+			return err
+		}
+	}
+}
+
+// handle processes a single inbound packet
+func (c *conn) handle(cp *packets.ControlPacket) error {
+	switch p := cp.Content.(type) {
+	case *packets.Publish:
+		return c.handlePublish(p)
+	case *packets.Puback:
+		c.mu.Lock()
+		delete(c.inflight, p.PacketID)
+		c.mu.Unlock()
+	case *packets.Pubrec:
+		if p.ReasonCode >= 0x80 { // Exchange complete
+			c.mu.Lock()
+			delete(c.inflight, p.PacketID)
+			c.mu.Unlock()
+			return nil
+		}
+		c.send(packets.PUBREL, &packets.Pubrel{PacketID: p.PacketID, Properties: &packets.Properties{}})
+	case *packets.Pubrel:
+		c.mu.Lock()
+		delete(c.received, p.PacketID)
+		c.mu.Unlock()
+		c.send(packets.PUBCOMP, &packets.Pubcomp{PacketID: p.PacketID, Properties: &packets.Properties{}})
+	case *packets.Pubcomp:
+		c.mu.Lock()
+		delete(c.inflight, p.PacketID)
+		c.mu.Unlock()
+	case *packets.Subscribe:
+		c.handleSubscribe(p)
+	case *packets.Unsubscribe:
+		ua := &packets.Unsuback{PacketID: p.PacketID, Properties: &packets.Properties{}}
+		c.mu.Lock()
+		for _, topic := range p.Topics {
+			if _, ok := c.subscriptions[topic]; ok {
+				delete(c.subscriptions, topic)
+				ua.Reasons = append(ua.Reasons, packets.UnsubackSuccess)
+			} else {
+				ua.Reasons = append(ua.Reasons, packets.UnsubackNoSubscriptionFound)
+			}
+		}
+		c.mu.Unlock()
+		c.send(packets.UNSUBACK, ua)
+	case *packets.Pingreq:
+		c.send(packets.PINGRESP, &packets.Pingresp{})
+	case *packets.Disconnect:
+		if p.ReasonCode != packets.DisconnectDisconnectWithWillMessage {
+			c.mu.Lock()
+			c.will = nil
+			c.mu.Unlock()
+		}
+		return errors.New("DISCONNECT received")
+	default:
+		c.disconnect(packets.DisconnectProtocolError)
+		return fmt.Errorf("unsupported packet received: %s", cp.PacketType())
+	}
+	return nil
+}
+
+// handlePublish processes a PUBLISH received from the client
+func (c *conn) handlePublish(p *packets.Publish) error {
+	if p.Properties != nil && p.Properties.TopicAlias != nil {
+		c.mu.Lock()
+		if p.Topic != "" {
+			c.topicAliases[*p.Properties.TopicAlias] = p.Topic
+		} else {
+			p.Topic = c.topicAliases[*p.Properties.TopicAlias]
+		}
+		c.mu.Unlock()
+		if p.Topic == "" {
+			c.disconnect(packets.DisconnectTopicAliasInvalid)
+			return errors.New("unknown topic alias")
+		}
+	}
+
+	switch p.QoS {
+	case 0:
+		c.b.route(p, c)
+	case 1:
+		c.b.route(p, c)
+		c.send(packets.PUBACK, &packets.Puback{PacketID: p.PacketID, Properties: &packets.Properties{}})
+	case 2:
+		c.mu.Lock()
+		_, duplicate := c.received[p.PacketID]
+		c.received[p.PacketID] = struct{}{}
+		c.mu.Unlock()
+		if !duplicate { // Only deliver once (the client may resend before receiving the PUBREC)
+			c.b.route(p, c)
+		}
+		c.send(packets.PUBREC, &packets.Pubrec{PacketID: p.PacketID, Properties: &packets.Properties{}})
+	default:
+		c.disconnect(packets.DisconnectMalformedPacket)
+		return fmt.Errorf("invalid QoS %d", p.QoS)
+	}
+	return nil
+}
+
+// handleSubscribe processes a SUBSCRIBE received from the client
+func (c *conn) handleSubscribe(p *packets.Subscribe) {
+	var subID *int
+	if p.Properties != nil {
+		subID = p.Properties.SubscriptionIdentifier
+	}
+	sa := &packets.Suback{PacketID: p.PacketID, Properties: &packets.Properties{}}
+	var retained []*packets.Publish
+	c.mu.Lock()
+	for _, s := range p.Subscriptions {
+		if strings.HasPrefix(s.Topic, "$share/") {
+			sa.Reasons = append(sa.Reasons, packets.SubackSharedSubscriptionnotsupported)
+			continue
+		}
+		qos := min(s.QoS, 2)
+		_, existed := c.subscriptions[s.Topic]
+		c.subscriptions[s.Topic] = subscription{options: s, subID: subID}
+		sa.Reasons = append(sa.Reasons, qos)
+		if s.RetainHandling == 0 || (s.RetainHandling == 1 && !existed) {
+			retained = append(retained, c.b.retainedMatching(s.Topic)...)
+		}
+	}
+	c.mu.Unlock()
+	c.send(packets.SUBACK, sa)
+	for _, r := range retained {
+		c.deliver(r, false, true)
+	}
+}
+
+// deliver sends p to the client if it matches any of its subscriptions (local is true if this client published p,
+// isRetained is true if p is being sent because a subscription was made)
+func (c *conn) deliver(p *packets.Publish, local, isRetained bool) {
+	c.mu.Lock()
+	var (
+		matched bool
+		qos     byte
+		retain  bool
+		subIDs  []int
+	)
+	for filter, s := range c.subscriptions {
+		if (local && s.options.NoLocal) || !match(filter, p.Topic) {
+			continue
+		}
+		matched = true
+		qos = max(qos, min(p.QoS, s.options.QoS))
+		retain = retain || s.options.RetainAsPublished
+		if s.subID != nil {
+			subIDs = append(subIDs, *s.subID)
+		}
+	}
+	if !matched {
+		c.mu.Unlock()
+		return
+	}
+
+	props := packets.Properties{}
+	if p.Properties != nil {
+		props = *p.Properties
+	}
+	props.TopicAlias = nil
+	props.SubscriptionIdentifier = nil
+	props.SubscriptionIdentifiers = nil
+	if len(subIDs) > 0 {
+		props.SubscriptionIdentifier = &subIDs[0] // packets only supports sending a single identifier
+	}
+	op := &packets.Publish{
+		Topic:      p.Topic,
+		QoS:        qos,
+		Retain:     p.Retain && (retain || isRetained), // [MQTT-3.3.1-9], [MQTT-3.3.1-12], [MQTT-3.3.1-13]
+		Payload:    p.Payload,
+		Properties: &props,
+	}
+	if qos > 0 {
+		op.PacketID = c.nextMID()
+		if op.PacketID == 0 {
+			c.mu.Unlock()
+			c.b.logger.Printf("%s: no packet identifiers available; message discarded", c.clientID)
+			return
+		}
+		c.inflight[op.PacketID] = qos
+	}
+	c.mu.Unlock()
+	c.send(packets.PUBLISH, op)
+}
+
+// nextMID allocates a packet identifier for a server originated PUBLISH (0 if none available). c.mu must be held.
+func (c *conn) nextMID() uint16 {
+	for i := 0; i < 65535; i++ {
+		c.lastMID++
+		if c.lastMID == 0 {
+			c.lastMID = 1
+		}
+		if _, ok := c.inflight[c.lastMID]; !ok {
+			return c.lastMID
+		}
+	}
+	return 0
+}
+
+// send queues p, a packet of type t, for transmission to the client
+func (c *conn) send(t byte, p packets.Packet) {
+	cp := packets.NewControlPacket(t) // Sets the fixed header flags
+	cp.Content = p
+	c.queue(outgoing{cp: cp})
+}
+
+// queue adds o to the outbound queue (it is discarded if the connection is closed)
+func (c *conn) queue(o outgoing) {
+	select {
+	case c.out <- o:
+	case <-c.done:
+	}
+}
+
+// disconnect sends a DISCONNECT with the specified reason code and then closes the connection
+func (c *conn) disconnect(reasonCode byte) {
+	cp := packets.NewControlPacket(packets.DISCONNECT)
+	cp.Content.(*packets.Disconnect).ReasonCode = reasonCode
+	c.queue(outgoing{cp: cp, closeAfter: true})
+}
+
+// write transmits queued packets until the connection is closed
+func (c *conn) write() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case o := <-c.out:
+			_, sendFilter, delay := c.b.filters()
+			if delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-c.done:
+					return
+				}
+			}
+			if sendFilter == nil || o.closeAfter || sendFilter(c.clientID, o.cp) {
+				c.b.logger.Printf("%s: sending %s", c.clientID, o.cp.PacketType())
+				_, _ = o.cp.WriteTo(c.nc) // Errors will be picked up by read
+			} else {
+				c.b.logger.Printf("%s: discarding %s", c.clientID, o.cp.PacketType())
+			}
+			if o.closeAfter {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// close closes the connection (it is safe to call this multiple times)
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		_ = c.nc.Close()
+	})
+}
@@ -47,10 +47,30 @@ type Pinger interface {
 	SetDebug(log.Logger)
 }
 
+// PingerStatus is a snapshot of the state of a Pinger (see PingerStatusReporter); times are zero if the event has not
+// occurred.
+type PingerStatus struct {
+	LastPacketSent     time.Time
+	LastPacketReceived time.Time
+	LastPingSent       time.Time
+	LastPingResponse   time.Time
+	PingOutstanding    bool // A PINGREQ has been sent and nothing has been received from the server since
+}
+
+// PingerStatusReporter may be implemented by a Pinger that is able to report its state (e.g. for health checks).
+type PingerStatusReporter interface {
+	Status() PingerStatus
+}
+
 // DefaultPinger is the default implementation of Pinger.
+//
+// A PINGREQ is sent whenever no packet has been both sent, and received, within the keepalive interval. Once a PINGREQ
+// has been sent, the server has one keepalive interval in which to respond (with a PINGRESP or any other packet); if it
+// fails to do so Run returns an error (which will result in the connection being closed).
 type DefaultPinger struct {
 	lastPacketSent     time.Time
 	lastPacketReceived time.Time
+	lastPingSent       time.Time
 	lastPingResponse   time.Time
 
 	debug log.Logger
@@ -93,7 +113,9 @@ func (p *DefaultPinger) Run(ctx context.Context, conn net.Conn, keepAlive uint16
 	timer := time.NewTimer(0) // Immediately send first pingreq
 	// If timer is not stopped, it cannot be garbage collected until it fires.
 	defer timer.Stop()
-	var lastPingSent time.Time
+	p.mu.Lock()
+	p.lastPingSent = time.Time{} // Any previous ping relates to an earlier connection
+	p.mu.Unlock()
 	// errCh should be buffered, so that the goroutine sending the error does not block if the context is cancelled
 	errCh := make(chan error, 1)
 	for {
@@ -102,11 +124,13 @@ func (p *DefaultPinger) Run(ctx context.Context, conn net.Conn, keepAlive uint16
 			return nil
 		case t := <-timer.C:
 			p.mu.Lock()
-			lastPingResponse := p.lastPingResponse
+			lastPingSent := p.lastPingSent
+			pingOutstanding := p.pingOutstanding()
 			// The MQTT Spec only requires that a ping be sent if no control packets have been SENT within the keepalive
 			// period (MQTT-3.1.2-20). Only sending PING in that one case can cause issues if the only activity is
 			// outgoing messages, a half-open connection should result in a TCP timeout but this can take a long time
 			//(issue #288). To address this we PING if we have not both sent, and received, packets within keepAlive.
+			// This means that outbound traffic alone can never delay the liveness check.
 			var pingDue time.Time
 			if p.lastPacketSent.Before(p.lastPacketReceived) {
 				pingDue = p.lastPacketSent.Add(interval)
@@ -115,17 +139,25 @@ func (p *DefaultPinger) Run(ctx context.Context, conn net.Conn, keepAlive uint16
 			}
 			p.mu.Unlock()
 
-			if !lastPingSent.IsZero() && lastPingSent.After(lastPingResponse) {
-				p.debug.Printf("DefaultPinger PINGRESP timeout")
-				return fmt.Errorf("PINGRESP timed out")
+			if pingOutstanding {
+				// The server has one keepalive interval to respond to the PINGREQ regardless of any outbound traffic
+				respDue := lastPingSent.Add(interval)
+				if !t.Before(respDue) {
+					p.debug.Printf("DefaultPinger PINGRESP timeout")
+					return fmt.Errorf("PINGRESP timed out")
+				}
+				timer.Reset(respDue.Sub(t))
+				continue
 			}
 
 			if t.Before(pingDue) {
-				// A Control Packet has been sent since we last checked, meaning the ping can be delayed
+				// A Control Packet has been sent and received since we last checked, meaning the ping can be delayed
 				timer.Reset(pingDue.Sub(t))
 				continue
 			}
-			lastPingSent = time.Now()
+			p.mu.Lock()
+			p.lastPingSent = time.Now()
+			p.mu.Unlock()
 			go func() {
 				// WriteTo may not complete within KeepAlive period due to slow/unstable network.
 				// For instance, if a huge message is sent over a very slow link at the same time as PINGREQ packet,
@@ -161,6 +193,27 @@ func (p *DefaultPinger) PingResp() {
 	p.lastPingResponse = time.Now()
 }
 
+// Status implements PingerStatusReporter
+func (p *DefaultPinger) Status() PingerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PingerStatus{
+		LastPacketSent:     p.lastPacketSent,
+		LastPacketReceived: p.lastPacketReceived,
+		LastPingSent:       p.lastPingSent,
+		LastPingResponse:   p.lastPingResponse,
+		PingOutstanding:    p.pingOutstanding(),
+	}
+}
+
+// pingOutstanding returns true if a ping is outstanding; this is the case until something (generally a PINGRESP) is
+// received from the server. p.mu must be held.
+func (p *DefaultPinger) pingOutstanding() bool {
+	return !p.lastPingSent.IsZero() &&
+		p.lastPingSent.After(p.lastPingResponse) &&
+		p.lastPingSent.After(p.lastPacketReceived)
+}
+
 func (p *DefaultPinger) SetDebug(debug log.Logger) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
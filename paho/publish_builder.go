@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"fmt"
+	"time"
+)
+
+// PublishBuilder simplifies the creation of a Publish with MQTT v5 properties. Create with NewPublish, configure
+// using the With... methods, and then call Build to obtain the Publish. e.g.
+//
+//	p, err := paho.NewPublish("sensors/temp", payload).WithQoS(1).WithContentType("application/json").
+//		WithUserProperty("unit", "C").WithMessageExpiry(time.Minute).Build()
+type PublishBuilder struct {
+	publish    Publish
+	properties PublishProperties
+	err        error // first error encountered (returned by Build)
+}
+
+// NewPublish creates a PublishBuilder for a message that will publish payload to topic
+func NewPublish(topic string, payload []byte) *PublishBuilder {
+	b := &PublishBuilder{publish: Publish{Topic: topic, Payload: payload}}
+	if err := ValidatePublishTopic(topic); err != nil {
+		b.setErr(fmt.Errorf("%w: %w", ErrInvalidArguments, err))
+	}
+	return b
+}
+
+// WithQoS sets the QoS of the message
+func (b *PublishBuilder) WithQoS(qos byte) *PublishBuilder {
+	if qos > 2 {
+		b.setErr(fmt.Errorf("%w: QoS %d is invalid", ErrInvalidArguments, qos))
+	}
+	b.publish.QoS = qos
+	return b
+}
+
+// WithRetain sets the retain flag of the message
+func (b *PublishBuilder) WithRetain(retain bool) *PublishBuilder {
+	b.publish.Retain = retain
+	return b
+}
+
+// WithMessageExpiry sets the Message Expiry Interval of the message (rounded up to a whole number of seconds)
+func (b *PublishBuilder) WithMessageExpiry(d time.Duration) *PublishBuilder {
+	v, err := durationSeconds("message expiry", d)
+	if err != nil {
+		b.setErr(err)
+	}
+	b.properties.MessageExpiry = v
+	return b
+}
+
+// WithContentType sets the Content Type of the message
+func (b *PublishBuilder) WithContentType(contentType string) *PublishBuilder {
+	b.properties.ContentType = contentType
+	return b
+}
+
+// WithPayloadFormat sets the Payload Format Indicator of the message (1 indicates UTF-8 encoded character data)
+func (b *PublishBuilder) WithPayloadFormat(format byte) *PublishBuilder {
+	if format > 1 {
+		b.setErr(fmt.Errorf("%w: payload format %d is invalid", ErrInvalidArguments, format))
+	}
+	b.properties.PayloadFormat = &format
+	return b
+}
+
+// WithResponseTopic sets the Response Topic of the message
+func (b *PublishBuilder) WithResponseTopic(topic string) *PublishBuilder {
+	if err := ValidatePublishTopic(topic); err != nil {
+		b.setErr(fmt.Errorf("%w: response topic: %w", ErrInvalidArguments, err))
+	}
+	b.properties.ResponseTopic = topic
+	return b
+}
+
+// WithCorrelationData sets the Correlation Data of the message
+func (b *PublishBuilder) WithCorrelationData(data []byte) *PublishBuilder {
+	b.properties.CorrelationData = data
+	return b
+}
+
+// WithUserProperty adds a User Property to the message
+func (b *PublishBuilder) WithUserProperty(key, value string) *PublishBuilder {
+	b.properties.User.Add(key, value)
+	return b
+}
+
+// Build returns the Publish. An error (wrapping ErrInvalidArguments) will be returned if any of the values provided
+// are invalid. Each call returns a new Publish (so the builder may be used as a template).
+func (b *PublishBuilder) Build() (*Publish, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	p, props := b.publish, b.properties
+	props.User = append(UserProperties(nil), props.User...)
+	p.Properties = &props
+	return &p, nil
+}
+
+// setErr records err unless an error has already been recorded
+func (b *PublishBuilder) setErr(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
@@ -0,0 +1,91 @@
+package paho
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+func TestPublishBuilder(t *testing.T) {
+	p, err := NewPublish("sensors/temp", []byte("21.5")).
+		WithQoS(1).
+		WithRetain(true).
+		WithContentType("application/json").
+		WithPayloadFormat(1).
+		WithUserProperty("unit", "C").
+		WithUserProperty("unit", "F").
+		WithMessageExpiry(90*time.Second + time.Millisecond).
+		WithResponseTopic("sensors/reply").
+		WithCorrelationData([]byte("abc")).
+		Build()
+	require.NoError(t, err)
+
+	// Confirm that each property makes it onto the wire
+	pp := p.Packet()
+	pp.PacketID = 1
+	var buf bytes.Buffer
+	_, err = pp.WriteTo(&buf)
+	require.NoError(t, err)
+	cp, err := packets.ReadPacket(&buf)
+	require.NoError(t, err)
+	rp, ok := cp.Content.(*packets.Publish)
+	require.True(t, ok)
+
+	assert.Equal(t, "sensors/temp", rp.Topic)
+	assert.Equal(t, []byte("21.5"), rp.Payload)
+	assert.Equal(t, byte(1), rp.QoS)
+	assert.True(t, rp.Retain)
+	require.NotNil(t, rp.Properties)
+	assert.Equal(t, "application/json", rp.Properties.ContentType)
+	require.NotNil(t, rp.Properties.PayloadFormat)
+	assert.Equal(t, byte(1), *rp.Properties.PayloadFormat)
+	require.NotNil(t, rp.Properties.MessageExpiry)
+	assert.Equal(t, uint32(91), *rp.Properties.MessageExpiry)
+	assert.Equal(t, "sensors/reply", rp.Properties.ResponseTopic)
+	assert.Equal(t, []byte("abc"), rp.Properties.CorrelationData)
+	assert.Equal(t, []packets.User{{Key: "unit", Value: "C"}, {Key: "unit", Value: "F"}}, rp.Properties.User)
+}
+
+func TestPublishBuilderTemplate(t *testing.T) {
+	b := NewPublish("a/b", nil).WithUserProperty("k", "1")
+	p1, err := b.Build()
+	require.NoError(t, err)
+	p2, err := b.WithUserProperty("k", "2").Build()
+	require.NoError(t, err)
+	assert.Equal(t, UserProperties{{Key: "k", Value: "1"}}, p1.Properties.User)
+	assert.Equal(t, UserProperties{{Key: "k", Value: "1"}, {Key: "k", Value: "2"}}, p2.Properties.User)
+	assert.NotSame(t, p1.Properties, p2.Properties)
+}
+
+func TestPublishBuilderErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		b    *PublishBuilder
+	}{
+		{"emptyTopic", NewPublish("", nil)},
+		{"wildcardTopic", NewPublish("a/#", nil)},
+		{"qos", NewPublish("a", nil).WithQoS(3)},
+		{"payloadFormat", NewPublish("a", nil).WithPayloadFormat(2)},
+		{"negativeExpiry", NewPublish("a", nil).WithMessageExpiry(-time.Second)},
+		{"expiryTooLarge", NewPublish("a", nil).WithMessageExpiry((math.MaxUint32 + 1) * time.Second)},
+		{"responseTopic", NewPublish("a", nil).WithResponseTopic("reply/+")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := tt.b.Build()
+			assert.Nil(t, p)
+			assert.ErrorIs(t, err, ErrInvalidArguments)
+		})
+	}
+
+	// The maximum expiry is accepted
+	p, err := NewPublish("a", nil).WithMessageExpiry(math.MaxUint32 * time.Second).Build()
+	require.NoError(t, err)
+	assert.Equal(t, uint32(math.MaxUint32), *p.Properties.MessageExpiry)
+}
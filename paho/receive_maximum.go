@@ -0,0 +1,54 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import "sync"
+
+// inboundFlowControl tracks the Receive Maximum that the client sends in CONNECT. A QOS1/2 PUBLISH received from the
+// server is outstanding until the PUBACK (QOS1) or PUBCOMP (QOS2) has been sent; the server must not send a message
+// that would take the number outstanding above the maximum (acquire reports this, so the client can disconnect).
+type inboundFlowControl struct {
+	mu          sync.Mutex
+	max         int
+	outstanding map[uint16]struct{} // Packet IDs of messages that are outstanding
+}
+
+// newInboundFlowControl creates an inboundFlowControl that permits up to max outstanding messages
+func newInboundFlowControl(max uint16) *inboundFlowControl {
+	return &inboundFlowControl{
+		max:         int(max),
+		outstanding: make(map[uint16]struct{}),
+	}
+}
+
+// acquire records that the message with packetID is outstanding, returning false (without recording it) if this
+// would exceed the maximum. A message that is already outstanding (e.g. a duplicate) will not be counted twice.
+func (f *inboundFlowControl) acquire(packetID uint16) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.outstanding[packetID]; !ok && len(f.outstanding) >= f.max {
+		return false
+	}
+	f.outstanding[packetID] = struct{}{}
+	return true
+}
+
+// release records that the message with packetID is no longer outstanding
+func (f *inboundFlowControl) release(packetID uint16) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.outstanding, packetID)
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import "sync"
+
+// RetainedTracker helps applications that need to know when the initial burst of retained messages, sent by the
+// server when a subscription is made (with Retain Handling 0 or 1), has been received, so they can move from a "sync"
+// to a "live" mode. Handlers are wrapped (see Wrap) and, for each topic filter, messages received with the Retain flag
+// set are counted separately from those without it; the filter is considered live once the first message without
+// the Retain flag is received (or MarkLive is called).
+//
+// Limitations: MQTT provides no "end of retained messages" signal, so if no live message arrives the filter will not
+// become live on its own (applications may call MarkLive, e.g. after a quiet period or once the SUBACK has been
+// processed and a timeout has expired). The Retain flag only distinguishes retained messages reliably if the
+// subscription does not set RetainAsPublished (in which case live messages published with Retain set will also have
+// the flag set). Retained messages sent after the subscription is made (e.g. on a later SUBSCRIBE for the same
+// filter, or when the session is resumed) are not distinguished from the initial burst; call Reset when resubscribing.
+type RetainedTracker struct {
+	mu      sync.Mutex
+	filters map[string]*RetainedStatus
+	onLive  func(filter string)
+}
+
+// RetainedStatus summarises the messages received for a topic filter tracked by a RetainedTracker
+type RetainedStatus struct {
+	Retained int  // Number of messages received with the Retain flag set
+	Live     int  // Number of messages received without the Retain flag set
+	IsLive   bool // true once a message without the Retain flag has been received (or MarkLive called)
+}
+
+// NewRetainedTracker returns a RetainedTracker ready for use. If onLive is not nil, it will be called when a filter
+// becomes live (before the first live message is passed to the handler).
+func NewRetainedTracker(onLive func(filter string)) *RetainedTracker {
+	return &RetainedTracker{
+		filters: make(map[string]*RetainedStatus),
+		onLive:  onLive,
+	}
+}
+
+// Wrap returns a MessageHandler that records messages for filter before passing them to h. The returned handler should
+// be registered for filter (e.g. via RegisterHandler or SubscribeWithHandler).
+func (t *RetainedTracker) Wrap(filter string, h MessageHandler) MessageHandler {
+	t.mu.Lock()
+	if _, ok := t.filters[filter]; !ok {
+		t.filters[filter] = &RetainedStatus{}
+	}
+	t.mu.Unlock()
+
+	return func(p *Publish) {
+		if t.received(filter, p.Retain) && t.onLive != nil {
+			t.onLive(filter)
+		}
+		h(p)
+	}
+}
+
+// received records a message for filter, returning true if this resulted in filter becoming live
+func (t *RetainedTracker) received(filter string, retained bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.filters[filter]
+	if !ok {
+		s = &RetainedStatus{}
+		t.filters[filter] = s
+	}
+	if retained {
+		s.Retained++
+		return false
+	}
+	s.Live++
+	if s.IsLive {
+		return false
+	}
+	s.IsLive = true
+	return true
+}
+
+// Status returns the current status of filter (the zero value if nothing is known about filter)
+func (t *RetainedTracker) Status(filter string) RetainedStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s, ok := t.filters[filter]; ok {
+		return *s
+	}
+	return RetainedStatus{}
+}
+
+// MarkLive marks filter as live (e.g. because no messages have been received for a period); onLive is called if
+// filter was not already live.
+func (t *RetainedTracker) MarkLive(filter string) {
+	t.mu.Lock()
+	s, ok := t.filters[filter]
+	if !ok {
+		s = &RetainedStatus{}
+		t.filters[filter] = s
+	}
+	wasLive := s.IsLive
+	s.IsLive = true
+	t.mu.Unlock()
+
+	if !wasLive && t.onLive != nil {
+		t.onLive(filter)
+	}
+}
+
+// Reset clears the status of filter, so it is treated as being in the initial sync (call this when resubscribing)
+func (t *RetainedTracker) Reset(filter string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.filters[filter] = &RetainedStatus{}
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"testing"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetainedTracker(t *testing.T) {
+	var live []string
+	var handled []bool // Whether the filter was live when each message was handled
+	tr := NewRetainedTracker(func(filter string) { live = append(live, filter) })
+	r := NewStandardRouter()
+	r.RegisterHandler("a/#", tr.Wrap("a/#", func(p *Publish) { handled = append(handled, tr.Status("a/#").IsLive) }))
+	r.RegisterHandler("b/#", tr.Wrap("b/#", func(*Publish) {}))
+
+	r.Route(&packets.Publish{Topic: "a/1", Retain: true, Properties: &packets.Properties{}})
+	r.Route(&packets.Publish{Topic: "a/2", Retain: true, Properties: &packets.Properties{}})
+	assert.Equal(t, RetainedStatus{Retained: 2}, tr.Status("a/#"))
+	assert.Empty(t, live)
+
+	r.Route(&packets.Publish{Topic: "a/1", Properties: &packets.Properties{}})
+	r.Route(&packets.Publish{Topic: "a/1", Properties: &packets.Properties{}})
+	assert.Equal(t, RetainedStatus{Retained: 2, Live: 2, IsLive: true}, tr.Status("a/#"))
+	assert.Equal(t, []string{"a/#"}, live)
+	assert.Equal(t, []bool{false, false, true, true}, handled)
+
+	// No live messages for b/#, so it only becomes live when marked as such
+	r.Route(&packets.Publish{Topic: "b/1", Retain: true, Properties: &packets.Properties{}})
+	assert.False(t, tr.Status("b/#").IsLive)
+	tr.MarkLive("b/#")
+	tr.MarkLive("b/#")
+	assert.Equal(t, RetainedStatus{Retained: 1, IsLive: true}, tr.Status("b/#"))
+	assert.Equal(t, []string{"a/#", "b/#"}, live)
+
+	tr.Reset("a/#")
+	assert.Equal(t, RetainedStatus{}, tr.Status("a/#"))
+	assert.Equal(t, RetainedStatus{}, tr.Status("unknown"))
+}
@@ -16,9 +16,14 @@
 package paho
 
 import (
+	"context"
+	"fmt"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 
+	"github.com/eclipse/paho.golang/internal/categorised"
 	"github.com/eclipse/paho.golang/packets"
 	"github.com/eclipse/paho.golang/paho/log"
 )
@@ -30,6 +35,16 @@ import (
 // paho instance that triggered them (due to potential deadlocks).
 type MessageHandler func(*Publish)
 
+// RawMessageHandler is a type for a function that is invoked by a StandardRouter with the packets library Publish as
+// received (see RegisterRawHandler); this provides access to details that are lost when converting to a Publish. The
+// same restrictions as for MessageHandler apply, and the packet must not be modified.
+type RawMessageHandler func(*packets.Publish)
+
+// MessageContextHandler is a type for a function that is invoked by a StandardRouter, along with a context, when it
+// has received a Publish (see RegisterContextHandler). When messages are received from the server, the context is done
+// when the client begins shutting down (see PublishReceived.Context). The same restrictions as for MessageHandler apply.
+type MessageContextHandler func(context.Context, *Publish)
+
 // Router is an interface of the functions for a struct that is
 // used to handle invoking MessageHandlers depending on the
 // the topic the message was published on.
@@ -46,23 +61,251 @@ type Router interface {
 	SetDebugLogger(log.Logger)
 }
 
+// AliasResetter may be implemented by a Router that caches inbound topic aliases; ResetAliases will be called when a
+// new network connection is established (topic aliases do not survive the connection, even if the session is resumed).
+type AliasResetter interface {
+	ResetAliases()
+}
+
+// aliasHolder is implemented by Routers that resolve inbound topic aliases using a StandardRouter (including the
+// adapters returned by AsRouter and AsContextRouter); this enables SetRouter to pass the aliases to a new Router.
+type aliasHolder interface {
+	standardRouter() *StandardRouter // nil if there is no StandardRouter
+}
+
+// standardRouterOf returns the StandardRouter that r uses to resolve topic aliases (nil if there is none)
+func standardRouterOf(r Router) *StandardRouter {
+	if h, ok := r.(aliasHolder); ok {
+		return h.standardRouter()
+	}
+	return nil
+}
+
+// ContextRouter may be implemented by a Router that is able to pass a context to handlers; the Client will call
+// RouteContext, rather than Route, with the context returned by PublishReceived.Context. AsContextRouter and AsRouter
+// adapt between Router and ContextRouter.
+type ContextRouter interface {
+	RouteContext(context.Context, *packets.Publish)
+}
+
+// MessageRouter may be implemented by a Router that is able to route a Publish that was not received from the server
+// (e.g. when reprocessing persisted messages).
+type MessageRouter interface {
+	RouteMessage(context.Context, *Publish) error
+}
+
 // StandardRouter is a library provided implementation of a Router that
-// allows for unique and multiple MessageHandlers per topic
+// allows for unique and multiple MessageHandlers per topic.
+// Where multiple handlers match a message, they are called in the order in which they were registered (regardless of
+// the topic filter they were registered with). By default, a handler registered (via separate calls) for overlapping
+// filters, e.g. `a/#` and `a/b`, will be called once for each matching filter; use RegisterHandlerForFilters, or
+// WithDedupHandlers and RegisterHandlerWithToken, if it should be called once per message.
+// Handlers are selected from a snapshot of those registered, and called without any lock held; registering or
+// unregistering a handler (which may be done from within a handler) does not wait for running handlers, and affects
+// subsequent messages only.
 type StandardRouter struct {
-	sync.RWMutex
+	sync.RWMutex                                     // held (write) whilst the handlers are changed; Route does not lock
+	table        atomic.Pointer[routeTable]          // registered handlers (replaced, never modified, when handlers change)
+	aliases      atomic.Pointer[inboundTopicAliases] // replaced when passed to another Router (see Client.SetRouter)
+	debug        *log.SwappableLogger
+	ordered      *topicDispatcher     // if not nil, handlers are called via this (see WithPerTopicOrdering)
+	pool         *workerPool          // if not nil, handlers are called via this (see WithWorkerPool)
+	dropWhenFull bool                 // if true, messages are dropped if pool's queue is full (see WithDropWhenQueueFull)
+	reuse        bool                 // if true, Route obtains messages from publishPool (see WithPublishReuse)
+	invalidTopic InvalidTopicHandler  // if not nil, messages whose topic cannot be determined are passed to this
+	dedup        bool                 // if true, handlers sharing a token are called once per message (see WithDedupHandlers)
+	limit        chan struct{}        // if not nil, a slot must be acquired before handlers are called (see WithMaxConcurrency)
+	limitMode    ConcurrencyLimitMode // determines when a slot in limit is acquired
+	lastToken    HandlerToken         // last token allocated (see NewHandlerToken)
+}
+
+// routeTable holds the handlers registered with a StandardRouter. A routeTable is never modified once stored in
+// StandardRouter.table; changes are made to a copy (see StandardRouter.update), so Route can select handlers without
+// locking, and registration is not blocked by handlers that are slow to return.
+type routeTable struct {
 	defaultHandler MessageHandler
-	subscriptions  map[string][]MessageHandler
-	aliases        map[uint16]string
-	debug          log.Logger
+	globalBefore   []MessageHandler         // handlers called for every message, before other handlers (see RegisterGlobalHandler)
+	globalAfter    []MessageHandler         // handlers called for every message, after other handlers (see RegisterGlobalHandler)
+	routes         []route                  // handlers registered by topic filter (in the order registered)
+	idHandlers     map[int][]MessageHandler // handlers keyed by subscription identifier (see RegisterHandlerWithID)
+	panicHandler   PanicHandler             // if not nil, panics in handlers will be recovered and passed to this
+}
+
+// clone returns a copy of t that may be modified without affecting t
+func (t *routeTable) clone() *routeTable {
+	c := *t
+	c.globalBefore = slices.Clip(t.globalBefore) // clipped so append copies
+	c.globalAfter = slices.Clip(t.globalAfter)
+	c.routes = slices.Clone(t.routes) // cloned as slices.DeleteFunc modifies in place
+	c.idHandlers = make(map[int][]MessageHandler, len(t.idHandlers))
+	for id, h := range t.idHandlers {
+		c.idHandlers[id] = slices.Clip(h)
+	}
+	return &c
+}
+
+// publishPool holds Publish structs for reuse by Route (see WithPublishReuse)
+var publishPool = sync.Pool{New: func() any { return &Publish{} }}
+
+// route holds a handler registered for a topic filter
+type route struct {
+	filter  string
+	handler MessageHandler
+	raw     RawMessageHandler     // used in place of handler if not nil
+	ctx     MessageContextHandler // used in place of handler if not nil
+	token   HandlerToken          // identifies the handler (0 if not known)
+	grouped bool                  // true if registered via RegisterHandlerForFilters (called once per token regardless of dedup)
+}
+
+// HandlerToken identifies a handler registered with a StandardRouter (see NewHandlerToken). As Go functions cannot be
+// compared, tokens are used to determine whether routes registered via separate calls relate to the same handler.
+type HandlerToken uint64
+
+// GlobalHandlerOrder determines whether a handler registered via RegisterGlobalHandler is called before or after the
+// handlers selected for the message
+type GlobalHandlerOrder int
+
+const (
+	GlobalHandlerBefore GlobalHandlerOrder = iota // Called before the handlers selected by topic/subscription identifier
+	GlobalHandlerAfter                            // Called after the handlers selected by topic/subscription identifier
+)
+
+// PanicHandler is a type for a function that is invoked by a StandardRouter when a MessageHandler panics
+// (see SetPanicHandler). recovered is the value returned by recover() and p the message being handled.
+type PanicHandler func(recovered any, p *Publish)
+
+// ErrUnresolvedTopic is passed (wrapped) to an InvalidTopicHandler when a PUBLISH has an empty topic and either no topic
+// alias, or an alias that is not known (or not permitted); this is a protocol error.
+var ErrUnresolvedTopic = categorised.New("PUBLISH has an empty topic and no known topic alias", ErrProtocol)
+
+// InvalidTopicHandler is a type for a function that is invoked by a StandardRouter when the topic of a received PUBLISH
+// cannot be determined (see WithInvalidTopicHandler). err wraps ErrUnresolvedTopic (and so matches ErrProtocol).
+type InvalidTopicHandler func(p *Publish, err error)
+
+// StandardRouterOption is a function that configures a StandardRouter (pass to NewStandardRouter)
+type StandardRouterOption func(*StandardRouter)
+
+// WithPerTopicOrdering results in handlers being called in separate goroutines. Messages on the same topic will be
+// passed to the handlers one at a time, in the order received, but messages on different topics will be processed
+// concurrently (up to a maximum of workers topics at a time).
+// Note: Route will generally return before the handlers have been called; this means that (unless manual
+// acknowledgment is enabled) messages may be acknowledged before they have been processed.
+// Cannot be combined with WithWorkerPool (the last of these options passed to NewStandardRouter will apply).
+func WithPerTopicOrdering(workers int) StandardRouterOption {
+	return func(r *StandardRouter) {
+		r.ordered = newTopicDispatcher(workers)
+		r.pool = nil
+	}
+}
+
+// WithWorkerPool results in handlers being called by a pool of up to size goroutines. Route adds each message to a
+// queue (holding up to queueDepth messages) and returns; if the queue is full Route will block until space is
+// available (applying backpressure, as no further packets will be read from the connection) unless
+// WithDropWhenQueueFull is also passed, in which case the message is discarded (see DroppedMessages).
+// Note: Messages are processed concurrently so handlers may be called in a different order to that in which the
+// messages were received (even for messages on the same topic; use WithPerTopicOrdering if this is an issue). As Route
+// will generally return before the handlers have been called, messages may be acknowledged before they have been
+// processed (unless manual acknowledgment is enabled).
+// Cannot be combined with WithPerTopicOrdering (the last of these options passed to NewStandardRouter will apply).
+func WithWorkerPool(size int, queueDepth int) StandardRouterOption {
+	return func(r *StandardRouter) {
+		r.pool = newWorkerPool(size, queueDepth)
+		r.ordered = nil
+	}
+}
+
+// WithDropWhenQueueFull results in messages being discarded, rather than Route blocking, when the WithWorkerPool queue
+// is full (no effect unless WithWorkerPool is also passed). DroppedMessages returns the number of messages discarded.
+func WithDropWhenQueueFull() StandardRouterOption {
+	return func(r *StandardRouter) {
+		r.dropWhenFull = true
+	}
+}
+
+// WithPublishReuse results in Route taking the *Publish passed to handlers from a sync.Pool, and returning it to the
+// pool once the handlers have returned (avoiding an allocation per message at high message rates). Handlers must not
+// retain the Publish (or its Properties) after returning; copy anything needed later. No effect if combined with
+// WithPerTopicOrdering or WithWorkerPool (as handlers are called after Route has returned).
+func WithPublishReuse() StandardRouterOption {
+	return func(r *StandardRouter) {
+		r.reuse = true
+	}
+}
+
+// WithTopicAliasMaximum limits the topic aliases accepted from the server; this should match the Topic Alias Maximum
+// sent in CONNECT. An alias greater than max is a protocol error (it will be logged and ignored). cacheSize limits the
+// number of aliases held (0 = max); when the limit is reached, the least recently used alias is evicted (so a later
+// message using only the evicted alias cannot be matched to its topic).
+func WithTopicAliasMaximum(max uint16, cacheSize int) StandardRouterOption {
+	return func(r *StandardRouter) {
+		if cacheSize <= 0 {
+			cacheSize = int(max)
+		}
+		r.aliases.Store(newInboundTopicAliases(max, cacheSize))
+	}
+}
+
+// WithInvalidTopicHandler results in messages received with an empty topic, and no known topic alias, being passed to
+// h (and not to any other handler). Without this option such messages are logged and passed to the default handler
+// (if any). As this is a protocol error the connection should generally be closed with reason code 0x82 (Protocol
+// Error); h is called from Route (which is called by the Client whilst processing incoming packets) so must do this
+// asynchronously, e.g. `go c.Disconnect(&paho.Disconnect{ReasonCode: packets.DisconnectProtocolError})`.
+func WithInvalidTopicHandler(h InvalidTopicHandler) StandardRouterOption {
+	return func(r *StandardRouter) {
+		r.invalidTopic = h
+	}
+}
+
+// WithDedupHandlers, if enabled, results in handlers registered with the same HandlerToken (see
+// RegisterHandlerWithToken) being called at most once for each message, even if the message matches several of the
+// filters they were registered with. Without this option (the default), a handler is called once for each matching
+// registration (other than those made via RegisterHandlerForFilters, which are always deduplicated). Handlers
+// registered without a token (e.g. via RegisterHandler) are not deduplicated, as Go functions cannot be compared.
+func WithDedupHandlers(enabled bool) StandardRouterOption {
+	return func(r *StandardRouter) {
+		r.dedup = enabled
+	}
+}
+
+// ConcurrencyLimitMode determines what happens, when WithMaxConcurrency is used, if the limit has been reached
+type ConcurrencyLimitMode int
+
+const (
+	// ConcurrencyLimitBlock results in Route blocking until a handler completes (applying backpressure, as no further
+	// packets will be read from the connection whilst Route is blocked)
+	ConcurrencyLimitBlock ConcurrencyLimitMode = iota
+	// ConcurrencyLimitQueue results in messages remaining queued (within the WithPerTopicOrdering dispatcher or the
+	// WithWorkerPool queue) until a handler completes; Route does not wait (other than as configured for those
+	// options). Without WithPerTopicOrdering or WithWorkerPool, this is equivalent to ConcurrencyLimitBlock.
+	ConcurrencyLimitQueue
+)
+
+// WithMaxConcurrency limits the number of messages being processed by handlers at any time, across all topics, to n
+// (the handlers for each message are called sequentially, so this is also the maximum number of handlers executing
+// concurrently). mode determines the behaviour when the limit is reached. This complements WithPerTopicOrdering and
+// WithWorkerPool, providing a global limit regardless of how handlers are called (including where Route is itself
+// called concurrently). n < 1 removes the limit.
+func WithMaxConcurrency(n int, mode ConcurrencyLimitMode) StandardRouterOption {
+	return func(r *StandardRouter) {
+		r.limit = nil
+		if n > 0 {
+			r.limit = make(chan struct{}, n)
+		}
+		r.limitMode = mode
+	}
 }
 
 // NewStandardRouter instantiates and returns an instance of a StandardRouter
-func NewStandardRouter() *StandardRouter {
-	return &StandardRouter{
-		subscriptions: make(map[string][]MessageHandler),
-		aliases:       make(map[uint16]string),
-		debug:         log.NOOPLogger{},
+func NewStandardRouter(opts ...StandardRouterOption) *StandardRouter {
+	r := &StandardRouter{
+		debug: log.NewSwappableLogger(nil),
 	}
+	r.aliases.Store(newInboundTopicAliases(0, 0))
+	r.table.Store(&routeTable{idHandlers: make(map[int][]MessageHandler)})
+	for _, o := range opts {
+		o(r)
+	}
+	return r
 }
 
 // NewStandardRouterWithDefault instantiates and returns an instance of a StandardRouter
@@ -74,80 +317,455 @@ func NewStandardRouterWithDefault(h MessageHandler) *StandardRouter {
 	return r
 }
 
+// update applies f to a copy of the current routeTable, which then replaces it (routes already in progress continue to
+// use the previous table)
+func (r *StandardRouter) update(f func(t *routeTable)) {
+	r.Lock()
+	defer r.Unlock()
+
+	t := r.table.Load().clone()
+	f(t)
+	r.table.Store(t)
+}
+
 // RegisterHandler is the library provided StandardRouter's
 // implementation of the required interface function()
 func (r *StandardRouter) RegisterHandler(topic string, h MessageHandler) {
 	r.debug.Println("registering handler for:", topic)
+	r.update(func(t *routeTable) {
+		t.routes = append(t.routes, route{filter: topic, handler: h})
+	})
+}
+
+// RegisterHandlerForFilters registers h for each of filters in a single call. Unlike calling RegisterHandler for each
+// filter, h will be called at most once for each message, even if the message matches several of the filters (e.g.
+// `sensors/#` and `sensors/+/temp`); it is called in the position of the first matching filter. UnregisterHandler
+// removes h for the filter passed to it (h remains registered for the other filters).
+func (r *StandardRouter) RegisterHandlerForFilters(filters []string, h MessageHandler) {
+	r.debug.Println("registering handler for:", strings.Join(filters, ", "))
+	token := r.NewHandlerToken()
+	r.update(func(t *routeTable) {
+		for _, f := range filters {
+			t.routes = append(t.routes, route{filter: f, handler: h, token: token, grouped: true})
+		}
+	})
+}
+
+// NewHandlerToken returns a token, unique within r, that can be passed to RegisterHandlerWithToken
+func (r *StandardRouter) NewHandlerToken() HandlerToken {
 	r.Lock()
 	defer r.Unlock()
 
-	r.subscriptions[topic] = append(r.subscriptions[topic], h)
+	r.lastToken++
+	return r.lastToken
+}
+
+// RegisterHandlerWithToken registers h for topic in the same way as RegisterHandler, recording token (obtained from
+// NewHandlerToken) as its identity. Registering the same handler for several filters using the same token, along with
+// WithDedupHandlers, ensures the handler is called at most once per message. Handlers may be removed by filter
+// (UnregisterHandler) or by token (UnregisterHandlerWithToken).
+func (r *StandardRouter) RegisterHandlerWithToken(topic string, token HandlerToken, h MessageHandler) {
+	r.debug.Printf("registering handler for: %s (token %d)", topic, token)
+	r.update(func(t *routeTable) {
+		t.routes = append(t.routes, route{filter: topic, handler: h, token: token})
+	})
+}
+
+// UnregisterHandlerWithToken removes all routes registered with token (via RegisterHandlerWithToken)
+func (r *StandardRouter) UnregisterHandlerWithToken(token HandlerToken) {
+	r.debug.Println("unregistering handlers with token:", token)
+	r.update(func(t *routeTable) {
+		t.routes = slices.DeleteFunc(t.routes, func(rt route) bool { return rt.token == token })
+	})
+}
+
+// RegisterRawHandler registers a handler that will be passed the packets library Publish (as received from the server)
+// for messages matching topic. Raw handlers are matched, and called, in the same way as those registered via
+// RegisterHandler (they are removed by UnregisterHandler). Note that where the server used a topic alias, the packet's
+// Topic may be empty (the topic is resolved for matching purposes, but the packet is passed unaltered). Messages passed
+// to RouteMessage are converted using Publish.Packet.
+func (r *StandardRouter) RegisterRawHandler(topic string, h RawMessageHandler) {
+	r.debug.Println("registering raw handler for:", topic)
+	r.update(func(t *routeTable) {
+		t.routes = append(t.routes, route{filter: topic, raw: h})
+	})
+}
+
+// RegisterContextHandler registers a handler that will be passed the context supplied to RouteContext (or
+// RouteMessage) along with messages matching topic. Context handlers are matched, and called, in the same way as those
+// registered via RegisterHandler (they are removed by UnregisterHandler). Only handlers registered this way receive
+// the context; handlers registered via RegisterHandler, RegisterRawHandler, RegisterHandlerWithID,
+// RegisterGlobalHandler and DefaultHandler do not (Route passes context.Background()).
+func (r *StandardRouter) RegisterContextHandler(topic string, h MessageContextHandler) {
+	r.debug.Println("registering context handler for:", topic)
+	r.update(func(t *routeTable) {
+		t.routes = append(t.routes, route{filter: topic, ctx: h})
+	})
 }
 
 // UnregisterHandler is the library provided StandardRouter's
 // implementation of the required interface function()
 func (r *StandardRouter) UnregisterHandler(topic string) {
 	r.debug.Println("unregistering handler for:", topic)
-	r.Lock()
-	defer r.Unlock()
+	r.update(func(t *routeTable) {
+		t.routes = slices.DeleteFunc(t.routes, func(rt route) bool { return rt.filter == topic })
+	})
+}
+
+// Subscriptions returns the topic filters for which handlers are registered, along with the number of handlers
+// registered for each (handlers registered via RegisterHandlerWithID and the default handler are not included).
+func (r *StandardRouter) Subscriptions() map[string]int {
+	subs := make(map[string]int)
+	for _, rt := range r.table.Load().routes {
+		subs[rt.filter]++
+	}
+	return subs
+}
+
+// RegisterGlobalHandler registers a handler that will be called for every message routed, regardless of whether any
+// other handler matched (e.g. for audit logging). order determines whether it is called before or after the other
+// handlers; global handlers with the same order are called in the order registered.
+// Global handlers do not count as a match, so the default handler (see DefaultHandler) will still be called when no
+// handler registered by topic or subscription identifier matches. Unlike middleware wrapping a MessageHandler, global
+// handlers are called for messages that no other handler matches.
+func (r *StandardRouter) RegisterGlobalHandler(h MessageHandler, order GlobalHandlerOrder) {
+	r.debug.Println("registering global handler")
+	r.update(func(t *routeTable) {
+		if order == GlobalHandlerAfter {
+			t.globalAfter = append(t.globalAfter, h)
+		} else {
+			t.globalBefore = append(t.globalBefore, h)
+		}
+	})
+}
 
-	delete(r.subscriptions, topic)
+// UnregisterGlobalHandlers removes all handlers registered via RegisterGlobalHandler
+func (r *StandardRouter) UnregisterGlobalHandlers() {
+	r.debug.Println("unregistering global handlers")
+	r.update(func(t *routeTable) {
+		t.globalBefore = nil
+		t.globalAfter = nil
+	})
+}
+
+// RegisterHandlerWithID registers a handler that will be called for messages carrying the subscription identifier id
+// (set SubscribeProperties.SubscriptionIdentifier when subscribing). Where a message carries an identifier with a
+// registered handler, handlers registered by topic will not be called; this avoids overlapping filters all firing.
+// Messages without a registered identifier are routed by topic as usual.
+func (r *StandardRouter) RegisterHandlerWithID(id int, h MessageHandler) {
+	r.debug.Println("registering handler for subscription identifier:", id)
+	r.update(func(t *routeTable) {
+		t.idHandlers[id] = append(t.idHandlers[id], h)
+	})
+}
+
+// UnregisterHandlerWithID removes the handlers registered for subscription identifier id
+func (r *StandardRouter) UnregisterHandlerWithID(id int) {
+	r.debug.Println("unregistering handler for subscription identifier:", id)
+	r.update(func(t *routeTable) {
+		delete(t.idHandlers, id)
+	})
 }
 
 // Route is the library provided StandardRouter's implementation
 // of the required interface function()
 func (r *StandardRouter) Route(pb *packets.Publish) {
-	r.debug.Println("routing message for:", pb.Topic)
-	r.RLock()
-	defer r.RUnlock()
+	r.RouteContext(context.Background(), pb)
+}
 
-	m := PublishFromPacketPublish(pb)
+// RouteContext is equivalent to Route but passes ctx to handlers registered via RegisterContextHandler (implements
+// ContextRouter). With WithPerTopicOrdering or WithWorkerPool, ctx may be done by the time handlers are called.
+func (r *StandardRouter) RouteContext(ctx context.Context, pb *packets.Publish) {
+	r.debug.Println("routing message for:", pb.Topic)
+	var m *Publish
+	if r.reuse && r.ordered == nil && r.pool == nil {
+		m = PublishFromPacketPublishInto(publishPool.Get().(*Publish), pb)
+		defer func() {
+			m.Payload, m.PayloadReader = nil, nil // do not hold the payload whilst in the pool
+			publishPool.Put(m)
+		}()
+	} else {
+		m = PublishFromPacketPublish(pb)
+	}
 
-	var topic string
-	if pb.Properties.TopicAlias != nil {
+	topic := m.Topic
+	var invalid error
+	if pb.Properties != nil && pb.Properties.TopicAlias != nil {
 		r.debug.Println("message is using topic aliasing")
-		if pb.Topic != "" {
+		alias := *pb.Properties.TopicAlias
+		aliases := r.aliases.Load()
+		switch {
+		case !aliases.valid(alias):
+			r.debug.Printf("protocol error: topic alias '%d' is outside the permitted range (maximum %d); alias ignored", alias, aliases.max)
+			invalid = fmt.Errorf("%w (topic alias %d is outside the permitted range)", ErrUnresolvedTopic, alias)
+		case pb.Topic != "":
 			// Register new alias
-			r.debug.Printf("registering new topic alias '%d' for topic '%s'", *pb.Properties.TopicAlias, m.Topic)
-			r.aliases[*pb.Properties.TopicAlias] = pb.Topic
+			r.debug.Printf("registering new topic alias '%d' for topic '%s'", alias, m.Topic)
+			if evicted := aliases.set(alias, pb.Topic); evicted != 0 {
+				r.debug.Printf("warning: topic alias cache full; evicted alias '%d'", evicted)
+			}
+		default:
+			if t, ok := aliases.get(alias); ok {
+				r.debug.Printf("aliased topic '%d' translates to '%s'", alias, t)
+				topic = t
+			} else {
+				r.debug.Printf("unknown topic alias '%d'", alias)
+				invalid = fmt.Errorf("%w (unknown topic alias %d)", ErrUnresolvedTopic, alias)
+			}
 		}
-		if t, ok := r.aliases[*pb.Properties.TopicAlias]; ok {
-			r.debug.Printf("aliased topic '%d' translates to '%s'", *pb.Properties.TopicAlias, m.Topic)
-			topic = t
+	}
+	if topic == "" {
+		if invalid == nil {
+			invalid = ErrUnresolvedTopic
 		}
-	} else {
-		topic = m.Topic
+		r.debug.Printf("protocol error: %s", invalid)
+		r.routeInvalidTopic(m, invalid)
+		return
+	}
+	r.dispatch(ctx, topic, m, pb)
+}
+
+// routeInvalidTopic passes m, which was received with no usable topic, to the InvalidTopicHandler or, if there is
+// none, the default handler
+func (r *StandardRouter) routeInvalidTopic(m *Publish, err error) {
+	if r.invalidTopic != nil {
+		r.invalidTopic(m, err)
+		return
+	}
+	if t := r.table.Load(); t.defaultHandler != nil {
+		r.callHandler(t.defaultHandler, m, t.panicHandler)
 	}
+}
+
+// RouteMessage passes m to the handlers in the same way as Route does for messages received from the server; this
+// enables messages from other sources (e.g. replayed from a dead-letter store, or constructed in tests) to be
+// processed by the same handlers. m.Topic must be set (topic aliases are not resolved). If ctx is done, the message is
+// not routed and ctx.Err() returned; otherwise ctx is passed to handlers registered via RegisterContextHandler. Note that, with WithPerTopicOrdering or WithWorkerPool, handlers may not have
+// been called by the time RouteMessage returns.
+func (r *StandardRouter) RouteMessage(ctx context.Context, m *Publish) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if m == nil || m.Topic == "" {
+		return fmt.Errorf("%w: message topic must be set", ErrInvalidArguments)
+	}
+	r.debug.Println("routing message for:", m.Topic)
+	r.dispatch(ctx, m.Topic, m, nil)
+	return nil
+}
 
-	handlerCalled := false
-	for route, handlers := range r.subscriptions {
-		if match(route, topic) {
-			r.debug.Println("found handler for:", route)
-			for _, handler := range handlers {
-				handler(m)
-				handlerCalled = true
+// dispatch passes m (received on topic) to the relevant handlers (along with ctx for context handlers); pb is the
+// packet m was created from (nil if m was not received from the server, in which case raw handlers are passed
+// m.Packet()). Handlers are selected from the current routeTable, so no lock is held whilst they are called (handlers
+// may register or unregister handlers; such changes apply to subsequent messages).
+func (r *StandardRouter) dispatch(ctx context.Context, topic string, m *Publish, pb *packets.Publish) {
+	t := r.table.Load()
+	handlers := r.handlers(t, ctx, topic, m, pb)
+	if len(handlers) == 0 {
+		return
+	}
+	run := func() {
+		for _, handler := range handlers {
+			r.callHandler(handler, m, t.panicHandler)
+		}
+	}
+	async := r.ordered != nil || r.pool != nil
+	if r.limit != nil { // see WithMaxConcurrency
+		unlimited := run
+		if async && r.limitMode == ConcurrencyLimitQueue {
+			run = func() {
+				r.limit <- struct{}{}
+				defer func() { <-r.limit }()
+				unlimited()
+			}
+		} else {
+			r.limit <- struct{}{} // blocks until a slot is available (released once the handlers have been called)
+			run = func() {
+				defer func() { <-r.limit }()
+				unlimited()
 			}
 		}
 	}
+	if r.ordered != nil {
+		r.ordered.dispatch(topic, run)
+		return
+	}
+	if r.pool != nil {
+		if !r.pool.submit(run, r.dropWhenFull) {
+			r.debug.Printf("worker pool queue full; dropped message for %s", topic)
+			if r.limit != nil && r.limitMode == ConcurrencyLimitBlock {
+				<-r.limit // slot acquired above will not be released by run
+			}
+		}
+		return
+	}
+	run()
+}
+
+// handlers returns the handlers, from t, that should be called for a message. If the message carries subscription
+// identifiers for which handlers have been registered (see RegisterHandlerWithID), only those handlers are returned;
+// otherwise handlers are selected by matching the topic. If no handlers are found, the default handler (if set) is
+// returned. Global handlers (see RegisterGlobalHandler) are added before/after the selected handlers.
+func (r *StandardRouter) handlers(t *routeTable, ctx context.Context, topic string, m *Publish, pb *packets.Publish) []MessageHandler {
+	var handlers []MessageHandler
+	props := m.Properties
+	if props != nil && len(t.idHandlers) > 0 {
+		ids := props.SubscriptionIdentifiers
+		if len(ids) == 0 && props.SubscriptionIdentifier != nil {
+			ids = []int{*props.SubscriptionIdentifier}
+		}
+		for _, id := range ids {
+			if h, ok := t.idHandlers[id]; ok {
+				r.debug.Println("found handler for subscription identifier:", id)
+				handlers = append(handlers, h...)
+			}
+		}
+	}
+	if len(handlers) == 0 {
+		var tokens []HandlerToken // tokens of handlers already selected; generally short so a slice is used
+		for _, rt := range t.routes {
+			if match(rt.filter, topic) {
+				if rt.token != 0 && (rt.grouped || r.dedup) {
+					if slices.Contains(tokens, rt.token) {
+						r.debug.Println("handler already selected; skipping duplicate for:", rt.filter)
+						continue
+					}
+					tokens = append(tokens, rt.token)
+				}
+				r.debug.Println("found handler for:", rt.filter)
+				if rt.raw != nil {
+					if pb == nil {
+						pb = m.Packet()
+					}
+					raw, rawPb := rt.raw, pb
+					handlers = append(handlers, func(*Publish) { raw(rawPb) })
+					continue
+				}
+				if rt.ctx != nil {
+					ctxHandler := rt.ctx
+					handlers = append(handlers, func(m *Publish) { ctxHandler(ctx, m) })
+					continue
+				}
+				handlers = append(handlers, rt.handler)
+			}
+		}
+	}
+	if len(handlers) == 0 && t.defaultHandler != nil {
+		handlers = append(handlers, t.defaultHandler)
+	}
+	if len(t.globalBefore) > 0 || len(t.globalAfter) > 0 {
+		handlers = slices.Concat(t.globalBefore, handlers, t.globalAfter)
+	}
+	return handlers
+}
+
+// callHandler calls h, recovering from any panic if panicHandler is not nil
+func (r *StandardRouter) callHandler(h MessageHandler, m *Publish, panicHandler PanicHandler) {
+	if panicHandler != nil {
+		defer func() {
+			if rec := recover(); rec != nil {
+				r.debug.Printf("recovered from panic in handler for %s: %v", m.Topic, rec)
+				panicHandler(rec, m)
+			}
+		}()
+	}
+	h(m)
+}
 
-	if !handlerCalled && r.defaultHandler != nil {
-		r.defaultHandler(m)
+// ResetAliases discards all inbound topic aliases (implements AliasResetter; called by the Client upon connection)
+func (r *StandardRouter) ResetAliases() {
+	r.debug.Println("resetting topic aliases")
+	r.aliases.Load().reset()
+}
+
+// standardRouter implements aliasHolder
+func (r *StandardRouter) standardRouter() *StandardRouter {
+	return r
+}
+
+// DroppedMessages returns the number of messages discarded because the worker pool queue was full (only applicable
+// when WithWorkerPool and WithDropWhenQueueFull are used).
+func (r *StandardRouter) DroppedMessages() uint64 {
+	if r.pool == nil {
+		return 0
 	}
+	return r.pool.dropped.Load()
 }
 
 // SetDebugLogger sets the logger l to be used for printing debug
-// information for the router
+// information for the router (may be called at any time)
 func (r *StandardRouter) SetDebugLogger(l log.Logger) {
-	r.debug = l
+	r.debug.Set(l)
 }
 
 // DefaultHandler sets handler to be called for messages that don't trigger another handler
-// Pass nil to unset.
+// (global handlers, see RegisterGlobalHandler, are not considered). Pass nil to unset.
 func (r *StandardRouter) DefaultHandler(h MessageHandler) {
 	r.debug.Println("registering default handler")
-	r.Lock()
-	defer r.Unlock()
-	r.defaultHandler = h
+	r.update(func(t *routeTable) {
+		t.defaultHandler = h
+	})
+}
+
+// SetPanicHandler sets a handler that will be called if a MessageHandler panics. When set, panics are recovered
+// (so a misbehaving handler will not take down the connection, and other handlers will still be called) and the
+// recovered value passed to h. Pass nil to unset (panics will then propagate, which is the default).
+func (r *StandardRouter) SetPanicHandler(h PanicHandler) {
+	r.update(func(t *routeTable) {
+		t.panicHandler = h
+	})
+}
+
+// topicDispatcher runs functions such that those relating to the same topic are run sequentially (in the order
+// passed to dispatch) whilst those relating to different topics may run concurrently.
+type topicDispatcher struct {
+	mu      sync.Mutex
+	workers chan struct{}       // limits the number of topics being processed concurrently
+	queues  map[string][]func() // queued functions for each topic currently being processed
+}
+
+// newTopicDispatcher creates a topicDispatcher that will process up to workers topics concurrently
+func newTopicDispatcher(workers int) *topicDispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	return &topicDispatcher{
+		workers: make(chan struct{}, workers),
+		queues:  make(map[string][]func()),
+	}
+}
+
+// dispatch arranges for f to be run after any previously dispatched functions for the same topic (does not block).
+func (d *topicDispatcher) dispatch(topic string, f func()) {
+	d.mu.Lock()
+	if q, ok := d.queues[topic]; ok { // A worker is already processing this topic
+		d.queues[topic] = append(q, f)
+		d.mu.Unlock()
+		return
+	}
+	d.queues[topic] = []func(){f}
+	d.mu.Unlock()
+	go d.run(topic)
+}
+
+// run processes the queue for topic until it is empty (waiting for a free worker before starting)
+func (d *topicDispatcher) run(topic string) {
+	d.workers <- struct{}{}
+	for {
+		d.mu.Lock()
+		q := d.queues[topic]
+		if len(q) == 0 {
+			delete(d.queues, topic)
+			d.mu.Unlock()
+			<-d.workers
+			return
+		}
+		f := q[0]
+		q[0] = nil
+		d.queues[topic] = q[1:]
+		d.mu.Unlock()
+		f()
+	}
 }
 
 func match(route, topic string) bool {
@@ -181,11 +799,9 @@ func routeSplit(route string) []string {
 	if len(route) == 0 {
 		return nil
 	}
-	var result []string
-	if strings.HasPrefix(route, "$share") {
-		result = strings.Split(route, "/")[2:]
-	} else {
-		result = strings.Split(route, "/")
+	result := strings.Split(route, "/")
+	if result[0] == "$share" && len(result) > 2 { // $share/{group}/{filter}; only the filter is used for matching
+		result = result[2:]
 	}
 	return result
 }
@@ -206,3 +822,64 @@ func topicSplit(topic string) []string {
 func NewSingleHandlerRouter(h MessageHandler) *StandardRouter {
 	return NewStandardRouterWithDefault(h)
 }
+
+// workerPool runs functions using up to size goroutines; functions are queued (up to the queue capacity) until a
+// goroutine is available. Goroutines are started as required, and exit when the queue is empty.
+type workerPool struct {
+	mu      sync.Mutex
+	size    int // maximum number of goroutines
+	running int // number of goroutines currently running
+	queue   chan func()
+	dropped atomic.Uint64 // number of functions discarded because the queue was full
+}
+
+// newWorkerPool creates a workerPool that will run up to size functions concurrently with up to queueDepth waiting
+func newWorkerPool(size int, queueDepth int) *workerPool {
+	if size < 1 {
+		size = 1
+	}
+	if queueDepth < 1 {
+		queueDepth = 1 // an unbuffered queue would block forever (goroutines are started after a function is queued)
+	}
+	return &workerPool{size: size, queue: make(chan func(), queueDepth)}
+}
+
+// submit queues f to be run by a worker. If the queue is full then submit will block until space is available or,
+// if drop is true, discard f and return false.
+func (p *workerPool) submit(f func(), drop bool) bool {
+	if drop {
+		select {
+		case p.queue <- f:
+		default:
+			p.dropped.Add(1)
+			return false
+		}
+	} else {
+		p.queue <- f
+	}
+	p.mu.Lock()
+	if p.running < p.size {
+		p.running++
+		go p.worker()
+	}
+	p.mu.Unlock()
+	return true
+}
+
+// worker runs queued functions until the queue is empty
+func (p *workerPool) worker() {
+	for {
+		select {
+		case f := <-p.queue:
+			f()
+		default:
+			p.mu.Lock()
+			if len(p.queue) == 0 { // checked whilst holding mu so submit will start a new worker if needed
+				p.running--
+				p.mu.Unlock()
+				return
+			}
+			p.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"context"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho/log"
+)
+
+// The adapters in this file enable code written for one of the router/handler families (Router and MessageHandler,
+// or ContextRouter and MessageContextHandler) to be used with the other, easing incremental migration.
+
+// AsContextHandler returns a MessageContextHandler that calls h (the context is ignored)
+func AsContextHandler(h MessageHandler) MessageContextHandler {
+	return func(_ context.Context, p *Publish) { h(p) }
+}
+
+// AsMessageHandler returns a MessageHandler that calls h with ctx
+func AsMessageHandler(ctx context.Context, h MessageContextHandler) MessageHandler {
+	return func(p *Publish) { h(ctx, p) }
+}
+
+// AsContextRouter returns a ContextRouter that passes messages to r. If r does not implement ContextRouter, the
+// context is ignored (RouteContext calls r.Route). The value returned also implements Router (calls are passed to
+// r), and AliasResetter, so it may be used as ClientConfig.Router.
+func AsContextRouter(r Router) ContextRouter {
+	return &contextRouterAdapter{Router: r}
+}
+
+// contextRouterAdapter implements ContextRouter on top of a Router (see AsContextRouter)
+type contextRouterAdapter struct {
+	Router
+}
+
+// RouteContext implements ContextRouter
+func (a *contextRouterAdapter) RouteContext(ctx context.Context, pb *packets.Publish) {
+	if cr, ok := a.Router.(ContextRouter); ok {
+		cr.RouteContext(ctx, pb)
+		return
+	}
+	a.Router.Route(pb)
+}
+
+// ResetAliases implements AliasResetter (passing the call on to the Router if it supports this)
+func (a *contextRouterAdapter) ResetAliases() {
+	if ar, ok := a.Router.(AliasResetter); ok {
+		ar.ResetAliases()
+	}
+}
+
+// standardRouter implements aliasHolder
+func (a *contextRouterAdapter) standardRouter() *StandardRouter {
+	return standardRouterOf(a.Router)
+}
+
+// AsRouter returns a Router that passes messages to cr; Route calls RouteContext with context.Background() (the
+// value returned also implements ContextRouter, so the Client will pass its context through).
+// RegisterHandler is passed to cr if it implements RegisterHandler(string, MessageHandler) or, with the handler
+// wrapped via AsContextHandler, RegisterContextHandler(string, MessageContextHandler). UnregisterHandler,
+// SetDebugLogger and ResetAliases are passed on if cr implements them. Otherwise these calls are ignored.
+func AsRouter(cr ContextRouter) Router {
+	return &routerAdapter{cr: cr}
+}
+
+// routerAdapter implements Router on top of a ContextRouter (see AsRouter)
+type routerAdapter struct {
+	cr ContextRouter
+}
+
+// RegisterHandler implements Router
+func (a *routerAdapter) RegisterHandler(topic string, h MessageHandler) {
+	switch r := a.cr.(type) {
+	case interface{ RegisterHandler(string, MessageHandler) }:
+		r.RegisterHandler(topic, h)
+	case interface {
+		RegisterContextHandler(string, MessageContextHandler)
+	}:
+		r.RegisterContextHandler(topic, AsContextHandler(h))
+	}
+}
+
+// UnregisterHandler implements Router
+func (a *routerAdapter) UnregisterHandler(topic string) {
+	if r, ok := a.cr.(interface{ UnregisterHandler(string) }); ok {
+		r.UnregisterHandler(topic)
+	}
+}
+
+// Route implements Router
+func (a *routerAdapter) Route(pb *packets.Publish) {
+	a.cr.RouteContext(context.Background(), pb)
+}
+
+// RouteContext implements ContextRouter
+func (a *routerAdapter) RouteContext(ctx context.Context, pb *packets.Publish) {
+	a.cr.RouteContext(ctx, pb)
+}
+
+// SetDebugLogger implements Router
+func (a *routerAdapter) SetDebugLogger(l log.Logger) {
+	if r, ok := a.cr.(interface{ SetDebugLogger(log.Logger) }); ok {
+		r.SetDebugLogger(l)
+	}
+}
+
+// ResetAliases implements AliasResetter
+func (a *routerAdapter) ResetAliases() {
+	if ar, ok := a.cr.(AliasResetter); ok {
+		ar.ResetAliases()
+	}
+}
+
+// standardRouter implements aliasHolder
+func (a *routerAdapter) standardRouter() *StandardRouter {
+	if h, ok := a.cr.(aliasHolder); ok {
+		return h.standardRouter()
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+type adaptKey struct{}
+
+// contextOnlyRouter is a ContextRouter that only supports context handlers (so AsRouter must adapt handlers)
+type contextOnlyRouter struct {
+	handlers map[string]MessageContextHandler
+}
+
+func (r *contextOnlyRouter) RegisterContextHandler(topic string, h MessageContextHandler) {
+	r.handlers[topic] = h
+}
+
+func (r *contextOnlyRouter) RouteContext(ctx context.Context, pb *packets.Publish) {
+	if h, ok := r.handlers[pb.Topic]; ok {
+		h(ctx, PublishFromPacketPublish(pb))
+	}
+}
+
+func Test_asRouter(t *testing.T) {
+	var got []string
+	sr := NewStandardRouter()
+	sr.DefaultHandler(func(p *Publish) { got = append(got, "default:"+p.Topic) })
+	r := AsRouter(sr)
+	r.RegisterHandler("a/#", func(p *Publish) { got = append(got, "a:"+p.Topic) })
+
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{}})
+	r.Route(&packets.Publish{Topic: "x", Properties: &packets.Properties{}})
+	r.UnregisterHandler("a/#")
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{}})
+	if want := []string{"a:a/b", "default:x", "default:a/b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	// The Client calls RouteContext if it is available; the context should reach context handlers
+	var gotCtx context.Context
+	sr.RegisterContextHandler("c", func(ctx context.Context, _ *Publish) { gotCtx = ctx })
+	ctx := context.WithValue(context.Background(), adaptKey{}, "v")
+	r.(ContextRouter).RouteContext(ctx, &packets.Publish{Topic: "c", Properties: &packets.Properties{}})
+	if gotCtx == nil || gotCtx.Value(adaptKey{}) != "v" {
+		t.Errorf("context not passed to handler")
+	}
+	r.Route(&packets.Publish{Topic: "c", Properties: &packets.Properties{}})
+	if gotCtx != context.Background() {
+		t.Errorf("expected Route to pass context.Background()")
+	}
+}
+
+func Test_asRouterContextHandlers(t *testing.T) {
+	cr := &contextOnlyRouter{handlers: make(map[string]MessageContextHandler)}
+	var got []string
+	r := AsRouter(cr)
+	r.RegisterHandler("a", func(p *Publish) { got = append(got, p.Topic) })
+	r.UnregisterHandler("a") // not supported by cr, so ignored
+	r.Route(&packets.Publish{Topic: "a", Properties: &packets.Properties{}})
+	r.Route(&packets.Publish{Topic: "b", Properties: &packets.Properties{}})
+	if want := []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func Test_asContextRouter(t *testing.T) {
+	var got []string
+	sr := NewStandardRouter()
+	sr.DefaultHandler(func(p *Publish) { got = append(got, "default:"+p.Topic) })
+	sr.RegisterHandler("a/#", func(p *Publish) { got = append(got, "a:"+p.Topic) })
+
+	// Embedding the interface hides StandardRouter.RouteContext (so the context must be ignored)
+	cr := AsContextRouter(struct{ Router }{sr})
+	ctx := context.WithValue(context.Background(), adaptKey{}, "v")
+	cr.RouteContext(ctx, &packets.Publish{Topic: "a/b", Properties: &packets.Properties{}})
+	cr.RouteContext(ctx, &packets.Publish{Topic: "x", Properties: &packets.Properties{}})
+	if want := []string{"a:a/b", "default:x"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	// The result remains a Router (so can be passed to the Client)
+	r, ok := cr.(Router)
+	if !ok {
+		t.Fatal("expected AsContextRouter to return a Router")
+	}
+	r.RegisterHandler("b", func(p *Publish) { got = append(got, "b:"+p.Topic) })
+	r.Route(&packets.Publish{Topic: "b", Properties: &packets.Properties{}})
+	if got[len(got)-1] != "b:b" {
+		t.Errorf("expected handler registered via adapter to be called, got %v", got)
+	}
+
+	// If the Router supports a context, it is passed through
+	var gotCtx context.Context
+	sr.RegisterContextHandler("c", func(ctx context.Context, _ *Publish) { gotCtx = ctx })
+	AsContextRouter(sr).RouteContext(ctx, &packets.Publish{Topic: "c", Properties: &packets.Properties{}})
+	if gotCtx == nil || gotCtx.Value(adaptKey{}) != "v" {
+		t.Errorf("context not passed to handler")
+	}
+}
+
+func Test_asHandlers(t *testing.T) {
+	var got []string
+	ch := AsContextHandler(func(p *Publish) { got = append(got, p.Topic) })
+	ch(context.Background(), &Publish{Topic: "a"})
+
+	ctx := context.WithValue(context.Background(), adaptKey{}, "v")
+	mh := AsMessageHandler(ctx, func(ctx context.Context, p *Publish) {
+		got = append(got, p.Topic+":"+ctx.Value(adaptKey{}).(string))
+	})
+	mh(&Publish{Topic: "b"})
+	if want := []string{"a", "b:v"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
@@ -16,8 +16,16 @@
 package paho
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/synctest"
+	"time"
 
 	"github.com/eclipse/paho.golang/packets"
 )
@@ -40,6 +48,9 @@ func Test_match(t *testing.T) {
 		{"hash3", "b/#", "a/b", false},
 		{"hash4", "#", "", true},
 		{"share1", "$share/group1/a/b", "a/b", true},
+		{"share2", "$share/g1/sensors/+/temp", "sensors/a/temp", true},
+		{"share3", "$share/g1/sensors/+/temp", "sensors/a/humidity", false},
+		{"share4", "$shared/a", "a", false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -80,7 +91,11 @@ func Test_routeSplit(t *testing.T) {
 		args args
 		want []string
 	}{
-		// TODO: Add test cases.
+		{"empty", args{""}, nil},
+		{"basic", args{"a/b"}, []string{"a", "b"}},
+		{"share", args{"$share/g1/sensors/+/temp"}, []string{"sensors", "+", "temp"}},
+		{"notShare", args{"$shared/a"}, []string{"$shared", "a"}},
+		{"shareNoFilter", args{"$share"}, []string{"$share"}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -91,6 +106,34 @@ func Test_routeSplit(t *testing.T) {
 	}
 }
 
+func Test_routeSharedSubscription(t *testing.T) {
+	filter, err := SharedSubscription("g1", "sensors/+/temp")
+	if err != nil {
+		t.Fatalf("SharedSubscription() error = %v", err)
+	}
+	if filter != "$share/g1/sensors/+/temp" {
+		t.Errorf("SharedSubscription() = %q, want %q", filter, "$share/g1/sensors/+/temp")
+	}
+
+	for _, group := range []string{"", "g/1", "g+", "g#"} {
+		if _, err := SharedSubscription(group, "sensors/+/temp"); !errors.Is(err, ErrInvalidArguments) {
+			t.Errorf("SharedSubscription(%q) error = %v, want ErrInvalidArguments", group, err)
+		}
+	}
+	if _, err := SharedSubscription("g1", ""); !errors.Is(err, ErrInvalidArguments) {
+		t.Errorf("SharedSubscription() with empty filter error = %v, want ErrInvalidArguments", err)
+	}
+
+	var got []string
+	r := NewStandardRouter()
+	r.RegisterHandler(filter, func(p *Publish) { got = append(got, p.Topic) })
+	r.Route(&packets.Publish{Topic: "sensors/a/temp", Properties: &packets.Properties{}})
+	r.Route(&packets.Publish{Topic: "sensors/a/humidity", Properties: &packets.Properties{}})
+	if !reflect.DeepEqual(got, []string{"sensors/a/temp"}) {
+		t.Errorf("handler called for %v, want [sensors/a/temp]", got)
+	}
+}
+
 func Test_routeDefault(t *testing.T) {
 	var r1Count, r2Count int
 
@@ -127,3 +170,740 @@ func Test_routeDefault(t *testing.T) {
 	}
 
 }
+
+func Test_routePerTopicOrdering(t *testing.T) {
+	var mu sync.Mutex
+	received := make(map[string][]string)
+	blockA := make(chan struct{})
+	bDone := make(chan struct{})
+	allDone := make(chan struct{}, 6)
+
+	r := NewStandardRouter(WithPerTopicOrdering(2))
+	r.RegisterHandler("test/#", func(p *Publish) {
+		if p.Topic == "test/a" {
+			<-blockA // Slow handler for topic a must not prevent processing of topic b
+		}
+		mu.Lock()
+		received[p.Topic] = append(received[p.Topic], string(p.Payload))
+		if p.Topic == "test/b" && len(received[p.Topic]) == 3 {
+			close(bDone)
+		}
+		mu.Unlock()
+		allDone <- struct{}{}
+	})
+
+	for i := 0; i < 3; i++ {
+		for _, topic := range []string{"test/a", "test/b"} {
+			r.Route(&packets.Publish{Topic: topic, Payload: []byte(strconv.Itoa(i)), Properties: &packets.Properties{}})
+		}
+	}
+
+	select {
+	case <-bDone:
+	case <-time.After(time.Second):
+		t.Fatal("messages on test/b should be processed whilst test/a is blocked")
+	}
+	close(blockA)
+	for i := 0; i < 6; i++ {
+		select {
+		case <-allDone:
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for handlers")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{"0", "1", "2"}
+	for _, topic := range []string{"test/a", "test/b"} {
+		if !reflect.DeepEqual(received[topic], expected) {
+			t.Errorf("%s: expected %v, got %v", topic, expected, received[topic])
+		}
+	}
+}
+
+func Test_routeWorkerPool(t *testing.T) {
+	started := make(chan string, 3)
+	release := make(chan struct{})
+	done := make(chan struct{}, 3)
+
+	r := NewStandardRouter(WithWorkerPool(2, 1))
+	r.RegisterHandler("test/#", func(p *Publish) {
+		started <- p.Topic
+		<-release
+		done <- struct{}{}
+	})
+
+	// Two workers, so both messages should be processed concurrently
+	r.Route(&packets.Publish{Topic: "test/a", Properties: &packets.Properties{}})
+	r.Route(&packets.Publish{Topic: "test/b", Properties: &packets.Properties{}})
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatal("handlers should be called concurrently")
+		}
+	}
+
+	// Queue has space for one message; the next Route should block until a worker is free
+	r.Route(&packets.Publish{Topic: "test/c", Properties: &packets.Properties{}})
+	routed := make(chan struct{})
+	go func() {
+		r.Route(&packets.Publish{Topic: "test/d", Properties: &packets.Properties{}})
+		close(routed)
+	}()
+	select {
+	case <-routed:
+		t.Fatal("Route should block whilst the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-routed:
+	case <-time.After(time.Second):
+		t.Fatal("Route should return once space is available in the queue")
+	}
+	if r.DroppedMessages() != 0 {
+		t.Errorf("no messages should be dropped, got %d", r.DroppedMessages())
+	}
+}
+
+func Test_routeWorkerPoolDrop(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var handled []string
+
+	r := NewStandardRouter(WithWorkerPool(1, 1), WithDropWhenQueueFull())
+	r.RegisterHandler("test/#", func(p *Publish) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		mu.Lock()
+		handled = append(handled, p.Topic)
+		mu.Unlock()
+	})
+
+	r.Route(&packets.Publish{Topic: "test/a", Properties: &packets.Properties{}})
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("handler not called")
+	}
+	r.Route(&packets.Publish{Topic: "test/b", Properties: &packets.Properties{}}) // queued
+	r.Route(&packets.Publish{Topic: "test/c", Properties: &packets.Properties{}}) // dropped (queue full)
+	if r.DroppedMessages() != 1 {
+		t.Errorf("expected 1 dropped message, got %d", r.DroppedMessages())
+	}
+	close(release)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		n := len(handled)
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 messages to be handled, got %d", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(handled, []string{"test/a", "test/b"}) {
+		t.Errorf("expected [test/a test/b] to be handled, got %v", handled)
+	}
+}
+
+func Test_routePanicHandler(t *testing.T) {
+	var called int
+	r := NewStandardRouter()
+	r.RegisterHandler("test", func(p *Publish) { panic("handler failed") })
+	r.RegisterHandler("test", func(p *Publish) { called++ })
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("panic should propagate when no panic handler is set")
+			}
+		}()
+		r.Route(&packets.Publish{Topic: "test", Properties: &packets.Properties{}})
+	}()
+
+	var recovered any
+	var recoveredTopic string
+	r.SetPanicHandler(func(rec any, p *Publish) {
+		recovered = rec
+		recoveredTopic = p.Topic
+	})
+	called = 0
+	r.Route(&packets.Publish{Topic: "test", Properties: &packets.Properties{}})
+	if recovered != "handler failed" || recoveredTopic != "test" {
+		t.Errorf("panic handler not called as expected (recovered: %v, topic: %s)", recovered, recoveredTopic)
+	}
+	if called != 1 {
+		t.Errorf("other handlers should still be called following a panic (called %d times)", called)
+	}
+}
+
+func Test_routeSubscriptionIdentifier(t *testing.T) {
+	var wildcard, id1, id2 int
+	r := NewStandardRouter()
+	r.RegisterHandler("a/#", func(p *Publish) { wildcard++ })
+	r.RegisterHandlerWithID(1, func(p *Publish) { id1++ })
+	r.RegisterHandlerWithID(2, func(p *Publish) { id2++ })
+
+	one, three := 1, 3
+	// Single identifier; topic handler should not be called
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{SubscriptionIdentifier: &one}})
+	if wildcard != 0 || id1 != 1 || id2 != 0 {
+		t.Errorf("id handler should have been called (wildcard: %d, id1: %d, id2: %d)", wildcard, id1, id2)
+	}
+
+	// Multiple identifiers
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{SubscriptionIdentifier: &one, SubscriptionIdentifiers: []int{2, 1}}})
+	if wildcard != 0 || id1 != 2 || id2 != 1 {
+		t.Errorf("both id handlers should have been called (wildcard: %d, id1: %d, id2: %d)", wildcard, id1, id2)
+	}
+
+	// Unknown identifier, or no identifier, should fall back to topic matching
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{SubscriptionIdentifier: &three}})
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{}})
+	if wildcard != 2 || id1 != 2 || id2 != 1 {
+		t.Errorf("topic handler should have been called (wildcard: %d, id1: %d, id2: %d)", wildcard, id1, id2)
+	}
+
+	r.UnregisterHandlerWithID(1)
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{SubscriptionIdentifier: &one}})
+	if wildcard != 3 || id1 != 2 {
+		t.Errorf("topic handler should have been called following unregister (wildcard: %d, id1: %d)", wildcard, id1)
+	}
+}
+
+func Test_routeTopicAlias(t *testing.T) {
+	var a, b, c, unknown int
+	r := NewStandardRouter(WithTopicAliasMaximum(3, 2))
+	r.RegisterHandler("a", func(p *Publish) { a++ })
+	r.RegisterHandler("b", func(p *Publish) { b++ })
+	r.RegisterHandler("c", func(p *Publish) { c++ })
+	r.DefaultHandler(func(p *Publish) { unknown++ })
+
+	route := func(topic string, alias uint16) {
+		r.Route(&packets.Publish{Topic: topic, Properties: &packets.Properties{TopicAlias: &alias}})
+	}
+	route("a", 1)
+	route("b", 2)
+	route("", 1)  // a is now the most recently used
+	route("c", 3) // cache is full so b is evicted
+	route("", 1)
+	route("", 2)
+	route("", 3)
+	if a != 3 || b != 1 || c != 2 || unknown != 1 {
+		t.Errorf("unexpected routing with aliases (a: %d, b: %d, c: %d, unknown: %d)", a, b, c, unknown)
+	}
+
+	// An alias exceeding the maximum should be ignored (the topic, if present, is still used)
+	route("a", 4)
+	route("", 4)
+	if a != 4 || unknown != 2 {
+		t.Errorf("alias above maximum should be ignored (a: %d, unknown: %d)", a, unknown)
+	}
+}
+
+func Test_routeInvalidTopic(t *testing.T) {
+	var handled, unknown int
+	var errs []error
+	r := NewStandardRouter(WithTopicAliasMaximum(3, 0), WithInvalidTopicHandler(func(p *Publish, err error) {
+		if p.Topic != "" || string(p.Payload) != "x" {
+			t.Errorf("unexpected message passed to invalid topic handler: %+v", p)
+		}
+		errs = append(errs, err)
+	}))
+	r.RegisterHandler("#", func(p *Publish) { handled++ })
+	r.DefaultHandler(func(p *Publish) { unknown++ })
+
+	unknownAlias, invalidAlias := uint16(2), uint16(4)
+	r.Route(&packets.Publish{Payload: []byte("x"), Properties: &packets.Properties{TopicAlias: &unknownAlias}})
+	r.Route(&packets.Publish{Payload: []byte("x"), Properties: &packets.Properties{TopicAlias: &invalidAlias}})
+	r.Route(&packets.Publish{Payload: []byte("x"), Properties: &packets.Properties{}})
+	if handled != 0 || unknown != 0 {
+		t.Errorf("messages without a topic should only be passed to the invalid topic handler (handled: %d, unknown: %d)", handled, unknown)
+	}
+	if len(errs) != 3 {
+		t.Fatalf("expected 3 calls to invalid topic handler, got %d", len(errs))
+	}
+	for _, err := range errs {
+		if !errors.Is(err, ErrUnresolvedTopic) || !errors.Is(err, ErrProtocol) {
+			t.Errorf("expected error wrapping ErrUnresolvedTopic and ErrProtocol, got %v", err)
+		}
+	}
+
+	// Without an InvalidTopicHandler, the message is passed to the default handler only
+	r = NewStandardRouter()
+	r.RegisterHandler("#", func(p *Publish) { handled++ })
+	r.DefaultHandler(func(p *Publish) { unknown++ })
+	r.Route(&packets.Publish{Properties: &packets.Properties{TopicAlias: &unknownAlias}})
+	if handled != 0 || unknown != 1 {
+		t.Errorf("message without a topic should be passed to the default handler (handled: %d, unknown: %d)", handled, unknown)
+	}
+}
+
+func Test_routeOrder(t *testing.T) {
+	var calls []string
+	r := NewStandardRouter()
+	for _, filter := range []string{"a/#", "a/b", "+/b", "#", "a/+", "a/b"} {
+		r.RegisterHandler(filter, func(p *Publish) { calls = append(calls, filter) })
+	}
+
+	for range 10 { // map iteration order varies, so repeat to ensure any nondeterminism would be detected
+		calls = nil
+		r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{}})
+		if !reflect.DeepEqual(calls, []string{"a/#", "a/b", "+/b", "#", "a/+", "a/b"}) {
+			t.Fatalf("handlers should be called in registration order, got %v", calls)
+		}
+	}
+
+	r.UnregisterHandler("a/b")
+	calls = nil
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{}})
+	if !reflect.DeepEqual(calls, []string{"a/#", "+/b", "#", "a/+"}) {
+		t.Fatalf("unexpected handlers called following unregister: %v", calls)
+	}
+}
+
+func Test_routeGlobalHandler(t *testing.T) {
+	var calls []string
+	handler := func(name string) MessageHandler {
+		return func(p *Publish) { calls = append(calls, name) }
+	}
+	r := NewStandardRouter()
+	r.RegisterHandler("a/b", handler("specific"))
+	r.DefaultHandler(handler("default"))
+	r.RegisterGlobalHandler(handler("after"), GlobalHandlerAfter)
+	r.RegisterGlobalHandler(handler("before1"), GlobalHandlerBefore)
+	r.RegisterGlobalHandler(handler("before2"), GlobalHandlerBefore)
+
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{}})
+	if !reflect.DeepEqual(calls, []string{"before1", "before2", "specific", "after"}) {
+		t.Fatalf("unexpected handlers called for matched message: %v", calls)
+	}
+
+	// Global handlers do not count as a match, so the default handler is still called
+	calls = nil
+	r.Route(&packets.Publish{Topic: "x/y", Properties: &packets.Properties{}})
+	if !reflect.DeepEqual(calls, []string{"before1", "before2", "default", "after"}) {
+		t.Fatalf("unexpected handlers called for unmatched message: %v", calls)
+	}
+
+	r.DefaultHandler(nil)
+	calls = nil
+	r.Route(&packets.Publish{Topic: "x/y", Properties: &packets.Properties{}})
+	if !reflect.DeepEqual(calls, []string{"before1", "before2", "after"}) {
+		t.Fatalf("global handlers should be called when nothing matches: %v", calls)
+	}
+
+	r.UnregisterGlobalHandlers()
+	calls = nil
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{}})
+	if !reflect.DeepEqual(calls, []string{"specific"}) {
+		t.Fatalf("unexpected handlers called following unregister: %v", calls)
+	}
+}
+
+func Test_routeRawHandler(t *testing.T) {
+	var raw []*packets.Publish
+	var converted int
+	r := NewStandardRouter(WithTopicAliasMaximum(10, 0))
+	r.RegisterRawHandler("a/+", func(pb *packets.Publish) { raw = append(raw, pb) })
+	r.RegisterHandler("a/#", func(*Publish) { converted++ })
+
+	pb := &packets.Publish{Topic: "a/b", Payload: []byte("x"), Properties: &packets.Properties{TopicAlias: Uint16(1)}}
+	r.Route(pb)
+	if len(raw) != 1 || raw[0] != pb || converted != 1 {
+		t.Fatalf("raw handler should receive the packet unaltered (raw: %v, converted: %d)", raw, converted)
+	}
+
+	// Aliased topic is resolved for matching, but the packet is passed unaltered
+	pb = &packets.Publish{Payload: []byte("y"), Properties: &packets.Properties{TopicAlias: Uint16(1)}}
+	r.Route(pb)
+	if len(raw) != 2 || raw[1] != pb || raw[1].Topic != "" || converted != 2 {
+		t.Fatalf("raw handler should receive aliased packet unaltered (raw: %v, converted: %d)", raw, converted)
+	}
+
+	// Not matched
+	r.Route(&packets.Publish{Topic: "a/b/c", Properties: &packets.Properties{}})
+	if len(raw) != 2 || converted != 3 {
+		t.Fatalf("raw handler should not have been called (raw: %v, converted: %d)", raw, converted)
+	}
+
+	// RouteMessage converts the Publish
+	if err := r.RouteMessage(context.Background(), &Publish{Topic: "a/c", Payload: []byte("z")}); err != nil {
+		t.Fatalf("RouteMessage failed: %s", err)
+	}
+	if len(raw) != 3 || raw[2].Topic != "a/c" || string(raw[2].Payload) != "z" {
+		t.Fatalf("raw handler should receive converted message (raw: %v)", raw)
+	}
+
+	r.UnregisterHandler("a/+")
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{}})
+	if len(raw) != 3 {
+		t.Fatal("raw handler should have been unregistered")
+	}
+}
+
+func Test_routerSubscriptions(t *testing.T) {
+	r := NewStandardRouter()
+	if subs := r.Subscriptions(); len(subs) != 0 {
+		t.Fatalf("expected no subscriptions, got %v", subs)
+	}
+	r.RegisterHandler("a/#", func(p *Publish) {})
+	r.RegisterHandler("a/b", func(p *Publish) {})
+	r.RegisterHandler("a/#", func(p *Publish) {})
+	r.RegisterHandlerWithID(1, func(p *Publish) {})
+	if subs := r.Subscriptions(); !reflect.DeepEqual(subs, map[string]int{"a/#": 2, "a/b": 1}) {
+		t.Fatalf("unexpected subscriptions: %v", subs)
+	}
+	r.UnregisterHandler("a/#")
+	if subs := r.Subscriptions(); !reflect.DeepEqual(subs, map[string]int{"a/b": 1}) {
+		t.Fatalf("unexpected subscriptions following unregister: %v", subs)
+	}
+}
+
+func Test_routeMessage(t *testing.T) {
+	var _ MessageRouter = (*StandardRouter)(nil)
+
+	var received []*Publish
+	var idCalls int
+	r := NewStandardRouter()
+	r.RegisterHandler("a/#", func(p *Publish) { received = append(received, p) })
+	r.RegisterHandlerWithID(7, func(p *Publish) { idCalls++ })
+
+	m := &Publish{Topic: "a/b", Payload: []byte("replayed")}
+	if err := r.RouteMessage(context.Background(), m); err != nil {
+		t.Fatalf("RouteMessage failed: %s", err)
+	}
+	if len(received) != 1 || received[0] != m {
+		t.Fatalf("expected handler to receive the message passed in, got %v", received)
+	}
+
+	// Subscription identifiers in the message properties are honoured
+	sid := 7
+	if err := r.RouteMessage(context.Background(), &Publish{Topic: "a/b", Properties: &PublishProperties{SubscriptionIdentifier: &sid}}); err != nil {
+		t.Fatalf("RouteMessage failed: %s", err)
+	}
+	if idCalls != 1 || len(received) != 1 {
+		t.Fatalf("expected only the subscription identifier handler to be called (id calls %d, topic calls %d)", idCalls, len(received))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := r.RouteMessage(ctx, &Publish{Topic: "a/b"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if err := r.RouteMessage(context.Background(), &Publish{}); !errors.Is(err, ErrInvalidArguments) {
+		t.Fatalf("expected ErrInvalidArguments, got %v", err)
+	}
+	if len(received) != 1 {
+		t.Fatalf("message should not have been routed (received %d)", len(received))
+	}
+}
+
+func Test_routePublishReuse(t *testing.T) {
+	var got []string
+	r := NewStandardRouter(WithPublishReuse())
+	r.RegisterHandler("a/#", func(p *Publish) {
+		got = append(got, p.Topic+":"+string(p.Payload))
+	})
+	r.Route(&packets.Publish{Topic: "a/1", Payload: []byte("one"), Properties: &packets.Properties{}})
+	r.Route(&packets.Publish{Topic: "a/2", Payload: []byte("two"), Properties: &packets.Properties{}})
+	if want := []string{"a/1:one", "a/2:two"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+// BenchmarkRoute measures the cost of routing a message to a single handler (run with -benchmem to compare the
+// allocations with, and without, WithPublishReuse)
+func BenchmarkRoute(b *testing.B) {
+	pb := &packets.Publish{
+		QoS:     1,
+		Topic:   "sensors/building1/floor2/temperature",
+		Payload: []byte(`{"value":21.5}`),
+		Properties: &packets.Properties{
+			User: []packets.User{{Key: "source", Value: "gw1"}},
+		},
+	}
+	for name, opts := range map[string][]StandardRouterOption{
+		"Allocate": nil,
+		"Reuse":    {WithPublishReuse()},
+	} {
+		b.Run(name, func(b *testing.B) {
+			r := NewStandardRouter(opts...)
+			r.RegisterHandler("sensors/#", func(*Publish) {})
+			b.ReportAllocs()
+			for b.Loop() {
+				r.Route(pb)
+			}
+		})
+	}
+}
+
+func Test_routeContextHandler(t *testing.T) {
+	type key struct{}
+	var got []context.Context
+	var plain int
+	r := NewStandardRouter()
+	r.RegisterContextHandler("a/#", func(ctx context.Context, p *Publish) {
+		if p.Topic != "a/b" {
+			t.Errorf("unexpected topic %s", p.Topic)
+		}
+		got = append(got, ctx)
+	})
+	r.RegisterHandler("a/#", func(*Publish) { plain++ })
+
+	ctx := context.WithValue(context.Background(), key{}, "v")
+	r.RouteContext(ctx, &packets.Publish{Topic: "a/b", Properties: &packets.Properties{}})
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{}})
+	if err := r.RouteMessage(ctx, &Publish{Topic: "a/b"}); err != nil {
+		t.Fatalf("RouteMessage failed: %s", err)
+	}
+	if len(got) != 3 || plain != 3 {
+		t.Fatalf("expected 3 calls to each handler (context: %d, plain: %d)", len(got), plain)
+	}
+	if got[0].Value(key{}) != "v" || got[1] != context.Background() || got[2].Value(key{}) != "v" {
+		t.Errorf("unexpected contexts passed to handler: %v", got)
+	}
+
+	if subs := r.Subscriptions(); subs["a/#"] != 2 {
+		t.Errorf("context handler should be reported by Subscriptions: %v", subs)
+	}
+	r.UnregisterHandler("a/#")
+	r.RouteContext(ctx, &packets.Publish{Topic: "a/b", Properties: &packets.Properties{}})
+	if len(got) != 3 {
+		t.Errorf("context handler should have been removed by UnregisterHandler")
+	}
+}
+
+func Test_routeHandlerForFilters(t *testing.T) {
+	var calls []string
+	r := NewStandardRouter()
+	r.RegisterHandler("sensors/#", func(p *Publish) { calls = append(calls, "single") })
+	r.RegisterHandlerForFilters([]string{"sensors/#", "sensors/+/temp", "other"}, func(p *Publish) {
+		calls = append(calls, "multi:"+p.Topic)
+	})
+
+	r.Route(&packets.Publish{Topic: "sensors/a/temp", Properties: &packets.Properties{}})
+	if !reflect.DeepEqual(calls, []string{"single", "multi:sensors/a/temp"}) {
+		t.Fatalf("handler for multiple filters should be called once, got %v", calls)
+	}
+
+	calls = nil
+	r.Route(&packets.Publish{Topic: "other", Properties: &packets.Properties{}})
+	if !reflect.DeepEqual(calls, []string{"multi:other"}) {
+		t.Fatalf("unexpected handlers called: %v", calls)
+	}
+
+	// Removing one filter leaves the handler registered for the others
+	r.UnregisterHandler("sensors/#")
+	calls = nil
+	r.Route(&packets.Publish{Topic: "sensors/a/temp", Properties: &packets.Properties{}})
+	r.Route(&packets.Publish{Topic: "sensors/a/humidity", Properties: &packets.Properties{}})
+	if !reflect.DeepEqual(calls, []string{"multi:sensors/a/temp"}) {
+		t.Fatalf("unexpected handlers called following unregister: %v", calls)
+	}
+	if subs := r.Subscriptions(); !reflect.DeepEqual(subs, map[string]int{"sensors/+/temp": 1, "other": 1}) {
+		t.Fatalf("unexpected subscriptions: %v", subs)
+	}
+}
+
+func Test_routeDedupHandlers(t *testing.T) {
+	for _, dedup := range []bool{false, true} {
+		t.Run(fmt.Sprintf("dedup=%t", dedup), func(t *testing.T) {
+			var calls []string
+			r := NewStandardRouter(WithDedupHandlers(dedup))
+			token := r.NewHandlerToken()
+			h := func(p *Publish) { calls = append(calls, "token") }
+			r.RegisterHandlerWithToken("a/#", token, h)
+			r.RegisterHandler("a/b", func(p *Publish) { calls = append(calls, "plain") })
+			r.RegisterHandlerWithToken("a/b", token, h)
+			r.RegisterHandler("a/+", func(p *Publish) { calls = append(calls, "plain") }) // no token so never deduplicated
+
+			r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{}})
+			expected := []string{"token", "plain", "token", "plain"}
+			if dedup {
+				expected = []string{"token", "plain", "plain"}
+			}
+			if !reflect.DeepEqual(calls, expected) {
+				t.Fatalf("expected %v, got %v", expected, calls)
+			}
+
+			// Only one filter matches
+			calls = nil
+			r.Route(&packets.Publish{Topic: "a/c/d", Properties: &packets.Properties{}})
+			if !reflect.DeepEqual(calls, []string{"token"}) {
+				t.Fatalf("unexpected handlers called: %v", calls)
+			}
+
+			r.UnregisterHandlerWithToken(token)
+			calls = nil
+			r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{}})
+			if !reflect.DeepEqual(calls, []string{"plain", "plain"}) {
+				t.Fatalf("unexpected handlers called following unregister: %v", calls)
+			}
+		})
+	}
+}
+
+// Test_routeRegisterWhilstRouting checks that handlers can be changed whilst a handler is running (including from
+// within the handler); changes apply to subsequent messages
+func Test_routeRegisterWhilstRouting(t *testing.T) {
+	r := NewStandardRouter()
+	inHandler := make(chan struct{})
+	release := make(chan struct{})
+	var calls []string
+	r.RegisterHandler("a/#", func(p *Publish) {
+		calls = append(calls, "first:"+p.Topic)
+		if p.Topic == "a/slow" {
+			close(inHandler)
+			<-release
+		}
+		r.RegisterHandler("a/b", func(p *Publish) { calls = append(calls, "added:"+p.Topic) }) // would deadlock if r were locked
+	})
+
+	routed := make(chan struct{})
+	go func() {
+		r.Route(&packets.Publish{Topic: "a/slow", Properties: &packets.Properties{}})
+		close(routed)
+	}()
+	<-inHandler
+	registered := make(chan struct{})
+	go func() {
+		r.RegisterHandler("a/#", func(p *Publish) { calls = append(calls, "second:"+p.Topic) })
+		close(registered)
+	}()
+	select {
+	case <-registered:
+	case <-time.After(time.Second):
+		t.Fatal("RegisterHandler blocked by running handler")
+	}
+	close(release)
+	<-routed
+
+	if !reflect.DeepEqual(calls, []string{"first:a/slow"}) {
+		t.Fatalf("handler registered whilst routing should not be called for that message, got %v", calls)
+	}
+	calls = nil
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{}})
+	if !reflect.DeepEqual(calls, []string{"first:a/b", "second:a/b", "added:a/b"}) {
+		t.Fatalf("unexpected handlers called: %v", calls)
+	}
+}
+
+// BenchmarkRouteConcurrentRegister measures routing whilst handlers are being registered and unregistered
+func BenchmarkRouteConcurrentRegister(b *testing.B) {
+	pb := &packets.Publish{Topic: "sensors/building1/floor2/temperature", Properties: &packets.Properties{}}
+	r := NewStandardRouter()
+	for i := range 100 {
+		r.RegisterHandler("sensors/building"+strconv.Itoa(i)+"/#", func(*Publish) {})
+	}
+	r.RegisterHandler("sensors/#", func(*Publish) {})
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			filter := "other/" + strconv.Itoa(i%10)
+			r.RegisterHandler(filter, func(*Publish) {})
+			r.UnregisterHandler(filter)
+		}
+	}()
+	b.ReportAllocs()
+	b.RunParallel(func(pb2 *testing.PB) {
+		for pb2.Next() {
+			r.Route(pb)
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+// Test_routeMaxConcurrency checks that no more than the configured number of handlers run simultaneously
+func Test_routeMaxConcurrency(t *testing.T) {
+	const limit = 3
+	tests := []struct {
+		name       string
+		opts       []StandardRouterOption
+		concurrent bool // if true, Route is called concurrently (the router does not start goroutines itself)
+		routeBlock bool // if true, Route is expected to block when the limit is reached
+	}{
+		{name: "sync", opts: []StandardRouterOption{WithMaxConcurrency(limit, ConcurrencyLimitBlock)}, concurrent: true, routeBlock: true},
+		{name: "poolBlock", opts: []StandardRouterOption{WithWorkerPool(10, 100), WithMaxConcurrency(limit, ConcurrencyLimitBlock)}, routeBlock: true},
+		{name: "poolQueue", opts: []StandardRouterOption{WithWorkerPool(10, 100), WithMaxConcurrency(limit, ConcurrencyLimitQueue)}},
+		{name: "orderedQueue", opts: []StandardRouterOption{WithPerTopicOrdering(10), WithMaxConcurrency(limit, ConcurrencyLimitQueue)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				var running, maxRunning, handled atomic.Int32
+				r := NewStandardRouter(tt.opts...)
+				r.RegisterHandler("#", func(p *Publish) {
+					n := running.Add(1)
+					for {
+						m := maxRunning.Load()
+						if n <= m || maxRunning.CompareAndSwap(m, n) {
+							break
+						}
+					}
+					time.Sleep(time.Second)
+					running.Add(-1)
+					handled.Add(1)
+				})
+
+				const messages = 10
+				var routed atomic.Int32
+				route := func(i int) {
+					r.Route(&packets.Publish{Topic: "t/" + strconv.Itoa(i), Properties: &packets.Properties{}})
+					routed.Add(1)
+				}
+				if tt.concurrent {
+					for i := range messages {
+						go route(i)
+					}
+				} else {
+					go func() {
+						for i := range messages {
+							route(i)
+						}
+					}()
+				}
+				synctest.Wait()
+				if got := routed.Load(); tt.routeBlock && !tt.concurrent && got != limit {
+					t.Errorf("expected Route to block after %d messages, %d routed", limit, got)
+				} else if tt.concurrent && got != 0 {
+					t.Errorf("expected all Route calls to block, %d returned", got)
+				} else if !tt.routeBlock && got != messages {
+					t.Errorf("expected Route not to block, %d routed", got)
+				}
+
+				time.Sleep(time.Minute)
+				synctest.Wait()
+				if got := handled.Load(); got != messages {
+					t.Fatalf("expected %d messages to be handled, got %d", messages, got)
+				}
+				if got := maxRunning.Load(); got != limit {
+					t.Errorf("expected at most %d handlers running concurrently (and limit reached), got %d", limit, got)
+				}
+			})
+		})
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"time"
 
 	"github.com/eclipse/paho.golang/packets"
 	paholog "github.com/eclipse/paho.golang/paho/log"
@@ -31,6 +32,8 @@ import (
 var (
 	ErrNoConnection               = errors.New("no connection available")       // We are not in-between a call to ConAckReceived and ConnectionLost
 	ErrPacketIdentifiersExhausted = errors.New("all packet identifiers in use") // There are no available Packet IDs
+	ErrNotInflight                = errors.New("no such request in flight")     // Returned by CancelPublish and AbandonRequest
+	ErrConnectionActive           = errors.New("connection active")             // Returned by Reset whilst connected
 )
 
 // Packet provides sufficient functionality to enable a packet to be transmitted with a packet identifier
@@ -81,3 +84,78 @@ type SessionManager interface {
 	// SetDebugLogger enables debug logging via the passed logger (not thread safe)
 	SetDebugLogger(l paholog.Logger)
 }
+
+// NoStoreAdder is an optional interface that a SessionManager may implement to support requests that are not
+// persisted (used by paho.PublishMethod_Blocking_NoQueue).
+type NoStoreAdder interface {
+	// AddToSessionNoStore is equivalent to AddToSession except that the packet will not be written to the store. If the
+	// connection is lost before the transaction completes, the packet is removed from the session (and an empty
+	// ControlPacket sent to `resp`); it will not be retransmitted.
+	AddToSessionNoStore(ctx context.Context, packet Packet, resp chan<- packets.ControlPacket) error
+}
+
+// InflightInfo provides information about a client-initiated PUBLISH transaction that is in progress
+type InflightInfo struct {
+	PacketID  uint16
+	Topic     string        // May be empty (e.g. if a topic alias was used)
+	QoS       byte          // 0 if unknown (e.g. only the PUBREL is held)
+	Age       time.Duration // Time since the message was added to the session (0 if unknown; e.g. loaded from the store)
+	Cancelled bool          // CancelPublish has been called (awaiting the server's acknowledgement to free the identifier)
+}
+
+// Resetter is an optional interface that a SessionManager may implement to enable the local session state to be
+// discarded independently of the Clean Start flag (see paho.Client.ResetLocalSession).
+type Resetter interface {
+	// Reset discards all locally held session state (in-flight transactions in both directions, including those in
+	// the store). Requesters awaiting a response are sent an empty ControlPacket. Returns ErrConnectionActive if
+	// called between ConAckReceived and ConnectionLost.
+	Reset() error
+}
+
+// InflightManager is an optional interface that a SessionManager may implement to enable in-flight publish
+// transactions to be inspected and cancelled.
+type InflightManager interface {
+	// InflightPublishInfo returns information on all client-initiated PUBLISH transactions that are in progress
+	InflightPublishInfo() []InflightInfo
+
+	// CancelPublish abandons the PUBLISH transaction with the specified packet identifier; an empty ControlPacket is
+	// sent to the `resp` channel passed to AddToSession and the message removed from the store (so it will not be
+	// retransmitted). ErrNotInflight is returned if there is no such transaction (e.g. it has just been acknowledged).
+	CancelPublish(packetID uint16) error
+}
+
+// RequestAbandoner is an optional interface that a SessionManager may implement to enable SUBSCRIBE and UNSUBSCRIBE
+// requests to be abandoned when the requester stops waiting for the response (e.g. its context is cancelled).
+type RequestAbandoner interface {
+	// AbandonRequest is called when nobody is waiting for the response to the SUBSCRIBE or UNSUBSCRIBE with the
+	// specified packet identifier. The identifier must be released when the response arrives, or the connection is
+	// lost (it may not be reused whilst the server could still respond). ErrNotInflight is returned if there is no such
+	// request (e.g. the response has just been received).
+	AbandonRequest(packetID uint16) error
+}
+
+// ReasonAcker is an optional interface that a SessionManager may implement to allow the Reason Code, and Reason
+// String, in the PUBACK or PUBREC sent in response to an inbound PUBLISH to be specified.
+type ReasonAcker interface {
+	// AckWithReason is equivalent to Ack except that the acknowledgement will carry the specified reason code and
+	// string (which may be empty). A reason code of 0x80 or greater indicates failure; for QoS 2 this completes the
+	// exchange (the server will not send a PUBREL).
+	AckWithReason(pb *packets.Publish, reasonCode byte, reasonString string) error
+}
+
+// RedeliveryNotifier is an optional interface that a SessionManager may implement to report the messages that are
+// retransmitted when a connection is established with an existing session.
+type RedeliveryNotifier interface {
+	// SetOnRedeliver sets a function that will be called with the packet identifier of each PUBLISH (resent with the
+	// DUP flag set) or PUBREL retransmitted by ConAckReceived, in the order they were sent. fn must not call back into
+	// the SessionManager; nil disables notifications.
+	SetOnRedeliver(fn func(packetID uint16))
+}
+
+// SendWindowLimiter is an optional interface that a SessionManager may implement to allow the number of
+// client-initiated QoS1/2 PUBLISH transactions in flight to be limited below the server's Receive Maximum.
+type SendWindowLimiter interface {
+	// SetSendWindow limits the number of PUBLISH transactions in flight to the lower of n and the Receive Maximum
+	// received in CONNACK (0 means no limit other than Receive Maximum). It applies from the next ConAckReceived.
+	SetSendWindow(n uint16)
+}
@@ -16,10 +16,12 @@
 package state
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"sync"
 	"time"
 
@@ -83,6 +85,14 @@ type (
 		// We also guarantee to always send to the channel (assuming there is a clean shutdown) so that the end user knows
 		// the status of the request.
 		responseChan chan<- packets.ControlPacket
+
+		skipStore bool // true if the packet is not held in the store (it will be dropped if the connection is lost)
+
+		// Information on PUBLISH transactions (see InflightPublishInfo)
+		topic     string
+		qos       byte
+		added     time.Time // zero if unknown
+		cancelled bool      // CancelPublish or AbandonRequest called; awaiting acknowledgement so the identifier can be reused
 	}
 )
 
@@ -107,7 +117,12 @@ type State struct {
 	serverStore   storer          // Used to store session state that survives connection loss
 
 	// The number of messages in flight needs to be limited, as per receive maximum received from the server.
-	inflight *sendQuota
+	inflight   *sendQuota
+	sendWindow uint16 // If non-zero, further limits the number of messages in flight (see SetSendWindow)
+
+	inflightWaiters []chan struct{} // closed when there are no client-initiated PUBLISH transactions in progress
+
+	onRedeliver func(packetID uint16) // called for each packet retransmitted by ConAckReceived (may be nil)
 
 	debug  paholog.Logger
 	errors paholog.Logger
@@ -142,6 +157,7 @@ func (s *State) Close() error {
 		cg.responseChan <- packets.ControlPacket{} // Default control packet indicates that we are shutting down (TODO: better solution?)
 		delete(s.clientPackets, packetID)
 	}
+	s.notifyInflightWaiters()
 	return nil
 }
 
@@ -154,8 +170,18 @@ func (s *State) ConAckReceived(conn io.Writer, cp *packets.Connect, ca *packets.
 	// We could use cp.Properties.SessionExpiryInterval /  ca.Properties.SessionExpiryInterval to clear the session
 	// after the specified time period (if the Session Expiry Interval is absent the value in the CONNECT Packet used)
 	// however, this is not something the generic client can really accomplish (forks may wish to do this!).
+	var redelivered []uint16
+	var onRedeliver func(packetID uint16)
+	defer func() { // Runs after the mutex is released, so the callback cannot deadlock by calling into State
+		if onRedeliver != nil {
+			for _, id := range redelivered {
+				onRedeliver(id)
+			}
+		}
+	}()
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	onRedeliver = s.onRedeliver
 	if s.conn != nil {
 		s.errors.Println("ConAckReceived called whilst connection active (you MUST call ConnectionLost before starting a new connection")
 		_ = s.connectionLost(nil) // assume the connection dropped
@@ -203,10 +229,16 @@ func (s *State) ConAckReceived(conn io.Writer, cp *packets.Connect, ca *packets.
 	if ca.Properties != nil && ca.Properties.ReceiveMaximum != nil {
 		recvMax = *ca.Properties.ReceiveMaximum
 	}
+	if s.sendWindow > 0 && s.sendWindow < recvMax {
+		s.debug.Printf("send window %d is lower than receive maximum %d", s.sendWindow, recvMax)
+		recvMax = s.sendWindow
+	}
 	s.inflight = newSendQuota(recvMax)
 
 	// Now we need to resend any packets in the store; this must happen in order, the simplest approach is to complete
-	// the sending them before returning.
+	// the sending them before returning. The store returns packets in the order they were Put, so PUBLISH packets are
+	// resent in the order they were originally sent, and PUBREL in the order the PUBREC was received
+	// [MQTT-4.6.0-1] [MQTT-4.6.0-4].
 	toResend, err := s.clientStore.List()
 	if err != nil {
 		return fmt.Errorf("failed to load stored message ids: %w", err)
@@ -237,6 +269,9 @@ func (s *State) ConAckReceived(conn io.Writer, cp *packets.Connect, ca *packets.
 		switch p.Type {
 		case packets.PUBLISH:
 			pub := p.Content.(*packets.Publish)
+			if s.messageExpired(id, pub) {
+				continue
+			}
 			pub.Duplicate = true
 		case packets.PUBREL:
 		default:
@@ -257,17 +292,72 @@ func (s *State) ConAckReceived(conn io.Writer, cp *packets.Connect, ca *packets.
 			return fmt.Errorf("failed to retransmit message (%d): %w", id, err)
 		}
 		s.debug.Printf("retransmitted message with identifier %d", id)
+		redelivered = append(redelivered, id)
 		// On initial connection, the packet needs to be added to our record of client-generated packets.
 		if _, ok := s.clientPackets[id]; !ok {
-			s.clientPackets[id] = clientGenerated{
+			cg := clientGenerated{
 				packetType:   p.Type,
 				responseChan: make(chan packets.ControlPacket, 1), // Nothing will wait on this
 			}
+			if pub, ok := p.Content.(*packets.Publish); ok {
+				cg.topic, cg.qos = pub.Topic, pub.QoS
+			}
+			s.clientPackets[id] = cg
 		}
 	}
 	return nil
 }
 
+// messageExpired reduces the Message Expiry Interval of pub (a PUBLISH about to be retransmitted) by the time it has
+// been in the store. If the message has expired, it is removed from the session state (the requester, if known, will
+// receive an error response) and true is returned.
+// The caller must hold a lock on s.mu
+func (s *State) messageExpired(packetID uint16, pub *packets.Publish) bool {
+	if pub.Properties == nil || pub.Properties.MessageExpiry == nil {
+		return false
+	}
+	sa, ok := s.clientStore.(storedAter)
+	if !ok {
+		return false // Store cannot tell us how long the message has been waiting
+	}
+	storedAt, err := sa.StoredAt(packetID)
+	if err != nil {
+		s.errors.Printf("failed to retrieve time packet %d was stored: %s", packetID, err)
+		return false
+	}
+	expiry := time.Duration(*pub.Properties.MessageExpiry) * time.Second
+	if elapsed := max(time.Since(storedAt), 0); elapsed < expiry {
+		remaining := uint32((expiry - elapsed + time.Second - 1) / time.Second) // round up (0 is not a valid interval here)
+		pub.Properties.MessageExpiry = &remaining
+		return false
+	}
+
+	s.debug.Printf("message %d expired whilst awaiting retransmission; discarding", packetID)
+	if err := s.clientStore.Delete(packetID); err != nil {
+		s.errors.Printf("failed to remove expired message %d from store: %s", packetID, err)
+	}
+	if cg, ok := s.clientPackets[packetID]; ok {
+		// There is no reason code for expiry so an error response is synthesised
+		var resp *packets.ControlPacket
+		props := &packets.Properties{ReasonString: "message expired before it could be retransmitted"}
+		if pub.QoS == 1 {
+			resp = packets.NewControlPacket(packets.PUBACK)
+			resp.Content.(*packets.Puback).PacketID = packetID
+			resp.Content.(*packets.Puback).ReasonCode = packets.PubackUnspecifiedError
+			resp.Content.(*packets.Puback).Properties = props
+		} else {
+			resp = packets.NewControlPacket(packets.PUBREC)
+			resp.Content.(*packets.Pubrec).PacketID = packetID
+			resp.Content.(*packets.Pubrec).ReasonCode = packets.PubrecUnspecifiedError
+			resp.Content.(*packets.Pubrec).Properties = props
+		}
+		cg.responseChan <- *resp
+		delete(s.clientPackets, packetID)
+		s.notifyInflightWaiters()
+	}
+	return true
+}
+
 // loadServerSession should be called once, when the first connection is established.
 // It loads the server session state from the store.
 // The caller must hold a lock on s.mu
@@ -332,6 +422,26 @@ func (s *State) connectionLost(dp *packets.Disconnect) error {
 	if dp != nil && dp.Properties != nil && dp.Properties.SessionExpiryInterval != nil {
 		s.sessionExpiryInterval = *dp.Properties.SessionExpiryInterval
 	}
+
+	// Packets that are not in the store cannot be retransmitted, so are dropped (and the requester notified)
+	var dropped bool
+	for id, cg := range s.clientPackets {
+		if !cg.skipStore {
+			continue
+		}
+		s.debug.Printf("dropping packet %d (not stored) due to connection loss", id)
+		cg.responseChan <- packets.ControlPacket{}
+		delete(s.clientPackets, id)
+		if cg.packetType == packets.PUBLISH {
+			if qErr := s.inflight.Release(); qErr != nil {
+				s.errors.Printf("quota release due to connection loss: %s", qErr)
+			}
+		}
+		dropped = true
+	}
+	if dropped {
+		s.notifyInflightWaiters()
+	}
 	// The Client and Server MUST store the Session State after the Network Connection is closed if the Session Expiry
 	// Interval is greater than 0 [MQTT-3.1.2-23]
 	if s.sessionExpiryInterval == 0 {
@@ -352,6 +462,18 @@ func (s *State) connectionLost(dp *packets.Disconnect) error {
 //
 // If the function returns an error, then any actions taken will be rewound prior to return.
 func (s *State) AddToSession(ctx context.Context, packet session.Packet, resp chan<- packets.ControlPacket) error {
+	return s.addToSession(ctx, packet, resp, false)
+}
+
+// AddToSessionNoStore is equivalent to AddToSession except that the packet is not written to the store. If the
+// connection is lost before the transaction completes, the packet is dropped from the session (an empty
+// ControlPacket is sent to resp) rather than being retransmitted. Implements session.NoStoreAdder.
+func (s *State) AddToSessionNoStore(ctx context.Context, packet session.Packet, resp chan<- packets.ControlPacket) error {
+	return s.addToSession(ctx, packet, resp, true)
+}
+
+// addToSession implements AddToSession and AddToSessionNoStore
+func (s *State) addToSession(ctx context.Context, packet session.Packet, resp chan<- packets.ControlPacket, skipStore bool) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	s.mu.Lock() // There may be a delay waiting for semaphore so check for connection before and after
@@ -389,7 +511,7 @@ func (s *State) AddToSession(ctx context.Context, packet session.Packet, resp ch
 	//     its a lot of messages
 	//     receive max often defaults to a fairly low value
 	//     Maximum recieve max is 65535 which matches the number of slots (so would also need a SUB/UNSUB in flight).
-	packetID, err := s.allocateNextPacketId(pt, resp)
+	packetID, err := s.allocateNextPacketId(pt, resp, skipStore)
 	if err != nil {
 		if pt == packets.PUBLISH {
 			if qErr := s.inflight.Release(); qErr != nil {
@@ -399,7 +521,14 @@ func (s *State) AddToSession(ctx context.Context, packet session.Packet, resp ch
 		return err
 	}
 	packet.SetIdentifier(packetID)
-	if pt == packets.PUBLISH {
+	if pub, ok := packet.(*packets.Publish); ok { // Record information for InflightPublishInfo
+		s.mu.Lock()
+		cg := s.clientPackets[packetID]
+		cg.topic, cg.qos, cg.added = pub.Topic, pub.QoS, time.Now()
+		s.clientPackets[packetID] = cg
+		s.mu.Unlock()
+	}
+	if pt == packets.PUBLISH && !skipStore {
 		if err = s.clientStore.Put(packetID, pt, packet); err != nil {
 			s.mu.Lock()
 			delete(s.clientPackets, packetID)
@@ -427,9 +556,12 @@ func (s *State) endClientGenerated(packetID uint16, recv *packets.ControlPacket)
 			if qErr := s.inflight.Release(); qErr != nil {
 				s.errors.Printf("quota release due to %s: %s", recv.PacketType(), qErr)
 			}
-			if err := s.clientStore.Delete(packetID); err != nil {
-				s.errors.Printf("failed to remove message %d from store: %s", packetID, err)
+			if !cg.skipStore {
+				if err := s.clientStore.Delete(packetID); err != nil {
+					s.errors.Printf("failed to remove message %d from store: %s", packetID, err)
+				}
 			}
+			s.notifyInflightWaiters()
 		}
 	} else {
 		s.debug.Println("received a response for a message ID we don't know:", recv.PacketID())
@@ -444,23 +576,29 @@ func (s *State) endClientGenerated(packetID uint16, recv *packets.ControlPacket)
 // user will ensure that all ACK's are completed before the State is applied to a new connection (not doing
 // this may have unpredictable results).
 func (s *State) Ack(pb *packets.Publish) error {
-	return s.ack(pb)
+	return s.ack(pb, packets.PubackSuccess, "")
+}
+
+// AckWithReason implements session.ReasonAcker
+func (s *State) AckWithReason(pb *packets.Publish, reasonCode byte, reasonString string) error {
+	return s.ack(pb, reasonCode, reasonString)
 }
 
 // ack sends an acknowledgment of the `PUBLISH` (which will have been received from the server)
 // `s.mu` must NOT be locked when this is called.
-// Note: Adding properties to the response is not currently supported. If this functionality is added, then it is
-// important to note that QOS2 PUBREC's may be resent if a duplicate `PUBLISH` is received.
+// Note: If a QOS2 PUBREC is resent (because a duplicate `PUBLISH` is received) it will carry the success reason code
+// (a PUBREC with a failure reason code completes the exchange, so is never resent).
 // This function will only return comms related errors (so caller can assume connection has been lost).
-func (s *State) ack(pb *packets.Publish) error {
+func (s *State) ack(pb *packets.Publish, reasonCode byte, reasonString string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	var err error
 	switch pb.QoS {
 	case 1:
 		pa := packets.Puback{
-			Properties: &packets.Properties{},
+			Properties: &packets.Properties{ReasonString: reasonString},
 			PacketID:   pb.PacketID,
+			ReasonCode: reasonCode,
 		}
 		if s.conn != nil {
 			s.debug.Println("sending PUBACK")
@@ -476,8 +614,9 @@ func (s *State) ack(pb *packets.Publish) error {
 		// such messages are duplicates or not (so we are forced to treat them all as if they are new).
 	case 2:
 		pr := packets.Pubrec{
-			Properties: &packets.Properties{},
+			Properties: &packets.Properties{ReasonString: reasonString},
 			PacketID:   pb.PacketID,
+			ReasonCode: reasonCode,
 		}
 		if s.conn != nil {
 			s.debug.Printf("sending PUBREC")
@@ -488,11 +627,18 @@ func (s *State) ack(pb *packets.Publish) error {
 		} else {
 			s.debug.Println("PUBREC not send because connection down")
 		}
+		if reasonCode >= 0x80 {
+			// A PUBREC with a failure reason code completes the exchange (no PUBREL will follow) so there is nothing
+			// to record; a subsequent PUBLISH with the same identifier is a new message.
+			break
+		}
 
 		// We need to record the fact that a PUBREC has been sent so we can detect receipt of a duplicate `PUBLISH`
 		// (which should not be passed to the client app)
 		cp := pr.ToControlPacket()
-		s.serverStore.Put(pb.PacketID, packets.PUBREC, cp)
+		if sErr := s.serverStore.Put(pb.PacketID, packets.PUBREC, cp); sErr != nil {
+			s.errors.Printf("failed to write PUBREC to server store for %d: %s", pb.PacketID, sErr)
+		}
 		s.serverPackets[pb.PacketID] = cp.Type
 	default:
 		err = errors.New("ack called but publish not QOS 1 or 2")
@@ -525,7 +671,7 @@ func (s *State) PacketReceived(recv *packets.ControlPacket, pubChan chan<- *pack
 	case *packets.Pubrec: // Initial response to a QOS2 Publish
 		s.debug.Println("received PUBREC packet with id ", rp.PacketID)
 		s.mu.Lock()
-		_, ok := s.clientPackets[rp.PacketID]
+		cg, ok := s.clientPackets[rp.PacketID]
 		s.mu.Unlock()
 		if !ok {
 			pl := packets.Pubrel{ // Respond with "Packet Identifier not found"
@@ -546,8 +692,10 @@ func (s *State) PacketReceived(recv *packets.ControlPacket, pubChan chan<- *pack
 				}
 				s.debug.Println("sending PUBREL for", rp.PacketID)
 				// Update the store (we should never resend the PUBLISH after receiving a PUBREL)
-				if err := s.clientStore.Put(rp.PacketID, packets.PUBREL, &pl); err != nil {
-					s.errors.Printf("failed to write PUBREL to store for %d: %s", rp.PacketID, err)
+				if !cg.skipStore {
+					if err := s.clientStore.Put(rp.PacketID, packets.PUBREL, &pl); err != nil {
+						s.errors.Printf("failed to write PUBREL to store for %d: %s", rp.PacketID, err)
+					}
 				}
 				if _, err := pl.WriteTo(s.conn); err != nil {
 					s.errors.Printf("failed to send PUBREL for %d: %s", rp.PacketID, err)
@@ -583,11 +731,11 @@ func (s *State) PacketReceived(recv *packets.ControlPacket, pubChan chan<- *pack
 							// The client has already seen this message meaning we do not want to resend it and, instead
 							// immediately acknowledge it.
 							s.mu.Unlock() // mu must be unlocked to call ack
-							return s.ack(rp)
+							return s.ack(rp, packets.PubrecSuccess, "")
 						}
 						s.errors.Printf("received duplicate PUBLISH (%d) but dup flag not set (will assume this overwrites old publish)", rp.PacketID)
 					} else {
-						s.errors.Printf("received PUBLISH (%d) but lastSent type is %d (unexpected!)", lastSent)
+						s.errors.Printf("received PUBLISH (%d) but lastSent type is %d (unexpected!)", rp.PacketID, lastSent)
 					}
 				}
 				s.mu.Unlock()
@@ -633,13 +781,14 @@ func (s *State) PacketReceived(recv *packets.ControlPacket, pubChan chan<- *pack
 
 // allocateNextPacketId assigns the next available packet ID
 // Callers must NOT hold lock on s.mu
-func (s *State) allocateNextPacketId(forPacketType byte, resp chan<- packets.ControlPacket) (uint16, error) {
+func (s *State) allocateNextPacketId(forPacketType byte, resp chan<- packets.ControlPacket, skipStore bool) (uint16, error) {
 	s.mu.Lock() // There may be a delay waiting for semaphore so check for connection before and after
 	defer s.mu.Unlock()
 
 	cg := clientGenerated{
 		packetType:   forPacketType,
 		responseChan: resp,
+		skipStore:    skipStore,
 	}
 
 	// Scan from lastMid to end of range.
@@ -680,6 +829,7 @@ func (s *State) clean() {
 
 	s.serverStore.Reset()
 	s.clientStore.Reset()
+	s.notifyInflightWaiters()
 }
 
 // clean deletes any existing stored session information
@@ -715,6 +865,159 @@ func (s *State) tidy(trigger *packets.ControlPacket) {
 	}
 }
 
+// Reset implements session.Resetter; all session state held locally is discarded (as happens when the server
+// reports that it holds no session). It may only be called whilst the connection is down.
+func (s *State) Reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		return session.ErrConnectionActive
+	}
+	s.debug.Println("resetting local session state")
+	for _, cg := range s.clientPackets {
+		cg.responseChan <- packets.ControlPacket{}
+		if s.inflight != nil && (cg.packetType == packets.PUBLISH || cg.packetType == packets.PUBREL) {
+			if qErr := s.inflight.Release(); qErr != nil {
+				s.errors.Printf("quota release due to reset: %s", qErr)
+			}
+		}
+	}
+	s.clean()
+	return nil
+}
+
+// InflightPublishes returns the number of client-initiated PUBLISH transactions that are in progress (i.e. the
+// PUBLISH has been added to the session but is not yet fully acknowledged).
+func (s *State) InflightPublishes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inflightPublishes()
+}
+
+// InflightPublishInfo returns information on the client-initiated PUBLISH transactions that are in progress (ordered
+// by packet identifier). Implements session.InflightManager.
+func (s *State) InflightPublishInfo() []session.InflightInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var info []session.InflightInfo
+	for id, cg := range s.clientPackets {
+		if cg.packetType != packets.PUBLISH && cg.packetType != packets.PUBREL {
+			continue
+		}
+		i := session.InflightInfo{PacketID: id, Topic: cg.topic, QoS: cg.qos, Cancelled: cg.cancelled}
+		if !cg.added.IsZero() {
+			i.Age = time.Since(cg.added)
+		}
+		info = append(info, i)
+	}
+	slices.SortFunc(info, func(a, b session.InflightInfo) int { return cmp.Compare(a.PacketID, b.PacketID) })
+	return info
+}
+
+// CancelPublish abandons the client-initiated PUBLISH transaction with the specified packet identifier. The requester
+// is sent an empty ControlPacket, and the message removed from the store (so it will not be retransmitted).
+// If the connection is down the packet identifier (and send quota) is released immediately. Otherwise, the PUBLISH may
+// already have been received by the server, so the identifier cannot be reused until the server acknowledges it
+// [MQTT-2.2.1-3]; it remains reserved until the acknowledgement arrives (which will be discarded) or the connection is
+// lost. session.ErrNotInflight is returned if the transaction is not in progress (e.g. the final acknowledgement was
+// processed first). Implements session.InflightManager.
+func (s *State) CancelPublish(packetID uint16) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cg, ok := s.clientPackets[packetID]
+	if !ok || cg.cancelled || (cg.packetType != packets.PUBLISH && cg.packetType != packets.PUBREL) {
+		return session.ErrNotInflight
+	}
+	s.debug.Printf("cancelling publish %d", packetID)
+	cg.responseChan <- packets.ControlPacket{}
+	if !cg.skipStore {
+		if err := s.clientStore.Delete(packetID); err != nil {
+			s.errors.Printf("failed to remove cancelled message %d from store: %s", packetID, err)
+		}
+	}
+	if s.conn == nil {
+		delete(s.clientPackets, packetID)
+		if s.inflight != nil {
+			if qErr := s.inflight.Release(); qErr != nil {
+				s.errors.Printf("quota release due to cancellation: %s", qErr)
+			}
+		}
+		s.notifyInflightWaiters()
+		return nil
+	}
+	// The response to the requester has been sent, so any acknowledgement received is discarded. Setting skipStore
+	// means a PUBREL will not be stored, and the transaction will be dropped if the connection is lost.
+	cg.responseChan = make(chan packets.ControlPacket, 1)
+	cg.skipStore = true
+	cg.cancelled = true
+	s.clientPackets[packetID] = cg
+	return nil
+}
+
+// AbandonRequest is called when the requester is no longer waiting for the response to the SUBSCRIBE or
+// UNSUBSCRIBE with the specified packet identifier (e.g. its context was cancelled). If the connection is down, the
+// identifier is released immediately. Otherwise, the request may already have been received by the server, so the
+// identifier remains reserved until the response arrives (which will be discarded) or the connection is lost
+// [MQTT-2.2.1-3]. Implements session.RequestAbandoner.
+func (s *State) AbandonRequest(packetID uint16) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cg, ok := s.clientPackets[packetID]
+	if !ok || cg.cancelled || (cg.packetType != packets.SUBSCRIBE && cg.packetType != packets.UNSUBSCRIBE) {
+		return session.ErrNotInflight
+	}
+	s.debug.Printf("abandoning request %d", packetID)
+	if s.conn == nil {
+		delete(s.clientPackets, packetID)
+		return nil
+	}
+	// Setting skipStore means the request will be dropped when the connection is lost (regardless of session expiry)
+	cg.responseChan = make(chan packets.ControlPacket, 1)
+	cg.skipStore = true
+	cg.cancelled = true
+	s.clientPackets[packetID] = cg
+	return nil
+}
+
+// WaitForNoInflightPublishes returns a channel that will be closed when there are no client-initiated PUBLISH
+// transactions in progress (this may be useful when shutting down).
+func (s *State) WaitForNoInflightPublishes() chan struct{} {
+	c := make(chan struct{})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inflightPublishes() == 0 {
+		close(c)
+		return c
+	}
+	s.inflightWaiters = append(s.inflightWaiters, c)
+	return c
+}
+
+// inflightPublishes returns the number of client-initiated PUBLISH transactions that are in progress
+// caller is responsible for locking s.mu
+func (s *State) inflightPublishes() int {
+	var count int
+	for _, cg := range s.clientPackets {
+		if cg.packetType == packets.PUBLISH || cg.packetType == packets.PUBREL {
+			count++
+		}
+	}
+	return count
+}
+
+// notifyInflightWaiters closes any channels returned by WaitForNoInflightPublishes if there are no client-initiated
+// PUBLISH transactions in progress.
+// caller is responsible for locking s.mu
+func (s *State) notifyInflightWaiters() {
+	if len(s.inflightWaiters) == 0 || s.inflightPublishes() > 0 {
+		return
+	}
+	for _, c := range s.inflightWaiters {
+		close(c)
+	}
+	s.inflightWaiters = nil
+}
+
 // SetDebugLogger takes an instance of the paho Logger interface
 // and sets it to be used by the debug log endpoint
 func (s *State) SetDebugLogger(l paholog.Logger) {
@@ -727,6 +1030,23 @@ func (s *State) SetErrorLogger(l paholog.Logger) {
 	s.errors = l
 }
 
+// SetSendWindow implements session.SendWindowLimiter; the number of PUBLISH transactions in flight will be limited to
+// the lower of n and the server's Receive Maximum (0 removes the limit). This takes effect when the next connection is
+// established.
+func (s *State) SetSendWindow(n uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sendWindow = n
+}
+
+// SetOnRedeliver implements session.RedeliveryNotifier; fn will be called with the identifier of each packet
+// retransmitted when a connection is established (after ConAckReceived has finished sending them).
+func (s *State) SetOnRedeliver(fn func(packetID uint16)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onRedeliver = fn
+}
+
 // AllocateClientPacketIDForTest is intended for use in tests only. It allocates a packet ID in the client session state
 // This feels like a hack but makes it easier to test packet identifier exhaustion
 func (s *State) AllocateClientPacketIDForTest(packetID uint16, forPacketType byte, resp chan<- packets.ControlPacket) {
@@ -17,6 +17,7 @@ package state
 
 import (
 	"io"
+	"time"
 )
 
 // storer must be implemented by session state stores
@@ -33,3 +34,10 @@ type storer interface {
 	List() ([]uint16, error) // Returns packet IDs in the order they were Put
 	Reset() error            // Clears the store (deleting all messages)
 }
+
+// storedAter may be implemented by session state stores that can report when a packet was stored. This enables the
+// Message Expiry Interval of a PUBLISH to be reduced by the time spent in the store when it is retransmitted (and
+// expired messages to be dropped).
+type storedAter interface {
+	StoredAt(packetID uint16) (time.Time, error) // Returns the time that the packet with the specified ID was Put
+}
@@ -18,12 +18,16 @@ package state
 import (
 	"bytes"
 	"context"
+	"errors"
+	"slices"
 	"testing"
 	"time"
 
 	"github.com/eclipse/paho.golang/internal/testserver"
 	"github.com/eclipse/paho.golang/packets"
 	paholog "github.com/eclipse/paho.golang/paho/log"
+	"github.com/eclipse/paho.golang/paho/session"
+	"github.com/eclipse/paho.golang/paho/store/file"
 	"github.com/eclipse/paho.golang/paho/store/memory"
 )
 
@@ -147,3 +151,669 @@ func TestLoadExistingSession(t *testing.T) {
 		t.Fatalf("expected PUBLISH in the client side state, got %d", sp)
 	}
 }
+
+// storedAtStore wraps a memory store, allowing the time packets were stored to be overridden
+type storedAtStore struct {
+	*memory.Store
+	storedAt time.Time
+}
+
+// StoredAt implements storedAter
+func (s *storedAtStore) StoredAt(uint16) (time.Time, error) {
+	return s.storedAt, nil
+}
+
+// TestMessageExpiryOnRetransmit confirms that the Message Expiry Interval is reduced by the time a PUBLISH has been in
+// the store, and that expired messages are not retransmitted.
+func TestMessageExpiryOnRetransmit(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		storedAgo  time.Duration
+		wantExpiry uint32 // 0 means the message should not be sent
+	}{
+		{name: "reduced", storedAgo: 25 * time.Second, wantExpiry: 35},
+		{name: "expired", storedAgo: 61 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			cs := &storedAtStore{Store: memory.New(), storedAt: time.Now().Add(-tt.storedAgo)}
+			expiry := uint32(60)
+			pcp := packets.NewControlPacket(packets.PUBLISH)
+			cliPacketID := uint16(10)
+			pcp.Content.(*packets.Publish).PacketID = cliPacketID
+			pcp.Content.(*packets.Publish).QoS = 1
+			pcp.Content.(*packets.Publish).Topic = "test"
+			pcp.Content.(*packets.Publish).Properties = &packets.Properties{MessageExpiry: &expiry}
+			if err := cs.Put(cliPacketID, packets.PUBLISH, pcp); err != nil {
+				t.Fatalf("failed to put: %s", err)
+			}
+
+			ts := testserver.New(paholog.NewTestLogger(t, "TestServer:"))
+			var received []*packets.ControlPacket
+			ts.SetPacketReceivedCallback(func(cp *packets.ControlPacket) error {
+				received = append(received, cp)
+				return nil
+			})
+			ts.SetConnectCallback(func(cp *packets.Connect, cap *packets.Connack) {
+				cap.SessionPresent = true
+			})
+			c, tsDone, err := ts.Connect(context.Background())
+			if err != nil {
+				t.Fatalf("failed to start test server: %s", err)
+			}
+
+			ccp := packets.Connect{ProtocolName: "MQTT", ProtocolVersion: 5}
+			if _, err := ccp.WriteTo(c); err != nil {
+				t.Fatalf("failed to send CONNECT packet: %s", err)
+			}
+			cca, err := packets.ReadPacket(c)
+			if err != nil {
+				t.Fatalf("failed to receive CONNACK packet: %s", err)
+			}
+
+			s := New(cs, memory.New())
+			if err := s.ConAckReceived(c, &ccp, cca.Content.(*packets.Connack)); err != nil {
+				t.Fatalf("ConAckReceived falied: %s", err)
+			}
+			if err := c.Close(); err != nil {
+				t.Fatalf("close failed %s", err)
+			}
+			select {
+			case <-tsDone:
+			case <-time.After(time.Second):
+				t.Fatal("test server did not shutdown within expected time")
+			}
+
+			ids, err := cs.List()
+			if err != nil {
+				t.Fatalf("failed to list: %s", err)
+			}
+			if tt.wantExpiry == 0 {
+				if len(received) != 1 { // CONNECT only
+					t.Fatalf("expected expired message not to be sent, got %#v", received)
+				}
+				if len(ids) != 0 || len(s.clientPackets) != 0 {
+					t.Fatalf("expired message should have been removed from the session")
+				}
+				return
+			}
+			if len(received) != 2 {
+				t.Fatalf("expected 2 packets, got %#v", received)
+			}
+			p, ok := received[1].Content.(*packets.Publish)
+			if !ok {
+				t.Fatalf("expected PUBLISH; got %s", received[1].PacketType())
+			}
+			if p.Properties == nil || p.Properties.MessageExpiry == nil || *p.Properties.MessageExpiry != tt.wantExpiry {
+				t.Fatalf("expected message expiry %d, got %v", tt.wantExpiry, p.Properties)
+			}
+			if len(ids) != 1 {
+				t.Fatalf("message should remain in store until acknowledged")
+			}
+		})
+	}
+}
+
+// TestQoS2DuplicateOnReconnect confirms that a QOS2 PUBLISH that is redelivered (with the DUP flag set) after the
+// connection is reestablished is acknowledged (PUBREC resent) without being passed to the application again. This
+// should also be the case when the session is loaded from the store (i.e. following an application restart).
+func TestQoS2DuplicateOnReconnect(t *testing.T) {
+	t.Parallel()
+
+	const packetID = uint16(5)
+	sessionExpiry := uint32(60) // The session must outlive the connection
+	ccp := packets.Connect{
+		ProtocolName:    "MQTT",
+		ProtocolVersion: 5,
+		Properties:      &packets.Properties{SessionExpiryInterval: &sessionExpiry},
+	}
+	newPublish := func(dup bool) *packets.ControlPacket {
+		pcp := packets.NewControlPacket(packets.PUBLISH)
+		pcp.Content.(*packets.Publish).PacketID = packetID
+		pcp.Content.(*packets.Publish).QoS = 2
+		pcp.Content.(*packets.Publish).Topic = "test"
+		pcp.Content.(*packets.Publish).Duplicate = dup
+		return pcp
+	}
+	// expectPUBREC checks that conn holds a single PUBREC for packetID
+	expectPUBREC := func(t *testing.T, conn *bytes.Buffer) {
+		t.Helper()
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			t.Fatalf("failed to read packet: %s", err)
+		}
+		pr, ok := cp.Content.(*packets.Pubrec)
+		if !ok {
+			t.Fatalf("expected PUBREC, got %s", cp.PacketType())
+		}
+		if pr.PacketID != packetID {
+			t.Fatalf("expected PUBREC for %d, got %d", packetID, pr.PacketID)
+		}
+		if conn.Len() != 0 {
+			t.Fatalf("unexpected data following PUBREC")
+		}
+	}
+
+	// Initial connection; message is received and passed to the application which acknowledges it
+	ss := memory.New()
+	s := New(memory.New(), ss)
+	var conn bytes.Buffer
+	if err := s.ConAckReceived(&conn, &ccp, &packets.Connack{}); err != nil {
+		t.Fatalf("ConAckReceived falied: %s", err)
+	}
+	pubChan := make(chan *packets.Publish, 1)
+	if err := s.PacketReceived(newPublish(false), pubChan); err != nil {
+		t.Fatalf("PacketReceived failed: %s", err)
+	}
+	select {
+	case pb := <-pubChan:
+		if err := s.Ack(pb); err != nil {
+			t.Fatalf("Ack failed: %s", err)
+		}
+	default:
+		t.Fatal("PUBLISH was not passed to application")
+	}
+	expectPUBREC(t, &conn)
+
+	// Connection lost before PUBREL received; server redelivers the PUBLISH with the DUP flag set
+	if err := s.ConnectionLost(nil); err != nil {
+		t.Fatalf("ConnectionLost failed: %s", err)
+	}
+	if err := s.ConAckReceived(&conn, &ccp, &packets.Connack{SessionPresent: true}); err != nil {
+		t.Fatalf("ConAckReceived falied: %s", err)
+	}
+	if err := s.PacketReceived(newPublish(true), pubChan); err != nil {
+		t.Fatalf("PacketReceived failed: %s", err)
+	}
+	if len(pubChan) != 0 {
+		t.Fatal("duplicate PUBLISH should not be passed to application")
+	}
+	expectPUBREC(t, &conn)
+
+	// Application restarts (the session is loaded from the store); the server redelivers the PUBLISH again
+	_ = s.ConnectionLost(nil)
+	s = New(memory.New(), ss)
+	if err := s.ConAckReceived(&conn, &ccp, &packets.Connack{SessionPresent: true}); err != nil {
+		t.Fatalf("ConAckReceived falied: %s", err)
+	}
+	if err := s.PacketReceived(newPublish(true), pubChan); err != nil {
+		t.Fatalf("PacketReceived failed: %s", err)
+	}
+	if len(pubChan) != 0 {
+		t.Fatal("duplicate PUBLISH should not be passed to application following restart")
+	}
+	expectPUBREC(t, &conn)
+
+	// Completing the flow should remove the message from the session
+	prl := packets.NewControlPacket(packets.PUBREL)
+	prl.Content.(*packets.Pubrel).PacketID = packetID
+	if err := s.PacketReceived(prl, pubChan); err != nil {
+		t.Fatalf("PacketReceived failed: %s", err)
+	}
+	cp, err := packets.ReadPacket(&conn)
+	if err != nil {
+		t.Fatalf("failed to read packet: %s", err)
+	}
+	if cp.Type != packets.PUBCOMP {
+		t.Fatalf("expected PUBCOMP, got %s", cp.PacketType())
+	}
+	if ids, _ := ss.List(); len(ids) != 0 {
+		t.Fatalf("expected server store to be empty, got %v", ids)
+	}
+}
+
+// TestRedeliverOnReconnect checks that, when the session is resumed, unacknowledged PUBLISH packets are resent with the
+// DUP flag set, and PUBREL resent for messages where PUBREC has been received, in the order they were sent.
+func TestRedeliverOnReconnect(t *testing.T) {
+	t.Parallel()
+
+	sessionExpiry := uint32(60) // The session must outlive the connection
+	ccp := packets.Connect{
+		ProtocolName:    "MQTT",
+		ProtocolVersion: 5,
+		Properties:      &packets.Properties{SessionExpiryInterval: &sessionExpiry},
+	}
+	for name, newStore := range map[string]func(t *testing.T) storer{
+		"memory": func(*testing.T) storer { return memory.New() },
+		"file": func(t *testing.T) storer {
+			fs, err := file.New(t.TempDir(), "client", ".pkt")
+			if err != nil {
+				t.Fatalf("failed to create file store: %s", err)
+			}
+			return fs
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			s := New(newStore(t), memory.New())
+			var redelivered []uint16
+			s.SetOnRedeliver(func(packetID uint16) { redelivered = append(redelivered, packetID) })
+			var conn bytes.Buffer
+			if err := s.ConAckReceived(&conn, &ccp, &packets.Connack{}); err != nil {
+				t.Fatalf("ConAckReceived falied: %s", err)
+			}
+
+			// Three messages are sent; the first and third remain unacknowledged and the second reaches PUBREC
+			var pubs []*packets.Publish
+			for i, qos := range []byte{1, 2, 2} {
+				pub := &packets.Publish{Topic: "test", QoS: qos, Payload: []byte{byte(i)}}
+				if err := s.AddToSession(context.Background(), pub, make(chan packets.ControlPacket, 1)); err != nil {
+					t.Fatalf("AddToSession failed: %s", err)
+				}
+				pubs = append(pubs, pub)
+			}
+			prc := packets.NewControlPacket(packets.PUBREC)
+			prc.Content.(*packets.Pubrec).PacketID = pubs[1].PacketID
+			if err := s.PacketReceived(prc, nil); err != nil {
+				t.Fatalf("PacketReceived failed: %s", err)
+			}
+			if len(redelivered) != 0 {
+				t.Fatalf("OnRedeliver should not be called for the initial connection (got %v)", redelivered)
+			}
+
+			// Connection lost; upon reconnection PUBLISH packets are resent (in order) followed by the PUBREL
+			if err := s.ConnectionLost(nil); err != nil {
+				t.Fatalf("ConnectionLost failed: %s", err)
+			}
+			conn.Reset()
+			if err := s.ConAckReceived(&conn, &ccp, &packets.Connack{SessionPresent: true}); err != nil {
+				t.Fatalf("ConAckReceived falied: %s", err)
+			}
+			for _, want := range []*packets.Publish{pubs[0], pubs[2]} {
+				cp, err := packets.ReadPacket(&conn)
+				if err != nil {
+					t.Fatalf("failed to read packet: %s", err)
+				}
+				pub, ok := cp.Content.(*packets.Publish)
+				if !ok {
+					t.Fatalf("expected PUBLISH, got %s", cp.PacketType())
+				}
+				if pub.PacketID != want.PacketID || !pub.Duplicate || !bytes.Equal(pub.Payload, want.Payload) {
+					t.Fatalf("expected PUBLISH %d with DUP set, got %d (DUP: %t)", want.PacketID, pub.PacketID, pub.Duplicate)
+				}
+			}
+			cp, err := packets.ReadPacket(&conn)
+			if err != nil {
+				t.Fatalf("failed to read packet: %s", err)
+			}
+			if prl, ok := cp.Content.(*packets.Pubrel); !ok || prl.PacketID != pubs[1].PacketID {
+				t.Fatalf("expected PUBREL for %d, got %s", pubs[1].PacketID, cp)
+			}
+			if conn.Len() != 0 {
+				t.Fatalf("unexpected data following PUBREL")
+			}
+			if want := []uint16{pubs[0].PacketID, pubs[2].PacketID, pubs[1].PacketID}; !slices.Equal(redelivered, want) {
+				t.Fatalf("OnRedeliver called with %v, expected %v", redelivered, want)
+			}
+
+			// A clean session means nothing is resent
+			redelivered = nil
+			_ = s.ConnectionLost(nil)
+			conn.Reset()
+			if err := s.ConAckReceived(&conn, &ccp, &packets.Connack{SessionPresent: false}); err != nil {
+				t.Fatalf("ConAckReceived falied: %s", err)
+			}
+			if conn.Len() != 0 || len(redelivered) != 0 {
+				t.Fatalf("nothing should be retransmitted when the session is not present")
+			}
+		})
+	}
+}
+
+// TestAckWithReason checks that a PUBREC with a failure reason code completes the QoS2 exchange (so nothing is stored)
+func TestAckWithReason(t *testing.T) {
+	t.Parallel()
+
+	ss := memory.New()
+	s := New(memory.New(), ss)
+	var conn bytes.Buffer
+	if err := s.ConAckReceived(&conn, &packets.Connect{ProtocolName: "MQTT", ProtocolVersion: 5, Properties: &packets.Properties{}}, &packets.Connack{}); err != nil {
+		t.Fatalf("ConAckReceived falied: %s", err)
+	}
+	newPublish := func() *packets.ControlPacket {
+		pcp := packets.NewControlPacket(packets.PUBLISH)
+		pcp.Content.(*packets.Publish).PacketID = 7
+		pcp.Content.(*packets.Publish).QoS = 2
+		pcp.Content.(*packets.Publish).Topic = "test"
+		return pcp
+	}
+	pubChan := make(chan *packets.Publish, 1)
+	if err := s.PacketReceived(newPublish(), pubChan); err != nil {
+		t.Fatalf("PacketReceived failed: %s", err)
+	}
+	if err := s.AckWithReason(<-pubChan, packets.PubrecPayloadFormatInvalid, "bad payload"); err != nil {
+		t.Fatalf("AckWithReason failed: %s", err)
+	}
+	cp, err := packets.ReadPacket(&conn)
+	if err != nil {
+		t.Fatalf("failed to read packet: %s", err)
+	}
+	pr, ok := cp.Content.(*packets.Pubrec)
+	if !ok {
+		t.Fatalf("expected PUBREC, got %s", cp.PacketType())
+	}
+	if pr.ReasonCode != packets.PubrecPayloadFormatInvalid || pr.Properties.ReasonString != "bad payload" {
+		t.Errorf("unexpected PUBREC reason: %d, %q", pr.ReasonCode, pr.Properties.ReasonString)
+	}
+	if ids, _ := ss.List(); len(ids) != 0 {
+		t.Fatalf("expected server store to be empty, got %v", ids)
+	}
+
+	// The exchange is complete, so a PUBLISH with the same identifier is a new message
+	if err := s.PacketReceived(newPublish(), pubChan); err != nil {
+		t.Fatalf("PacketReceived failed: %s", err)
+	}
+	if len(pubChan) != 1 {
+		t.Fatal("PUBLISH should be passed to application")
+	}
+}
+
+// TestAddToSessionNoStore confirms that packets added via AddToSessionNoStore are not written to the store, and are
+// dropped from the session (releasing quota and notifying the requester) if the connection is lost mid-flight.
+func TestAddToSessionNoStore(t *testing.T) {
+	t.Parallel()
+
+	sessionExpiry := uint32(60) // Session survives the connection; stored messages would be retransmitted
+	ccp := packets.Connect{
+		ProtocolName:    "MQTT",
+		ProtocolVersion: 5,
+		Properties:      &packets.Properties{SessionExpiryInterval: &sessionExpiry},
+	}
+	cs := memory.New()
+	s := New(cs, memory.New())
+	var conn bytes.Buffer
+	if err := s.ConAckReceived(&conn, &ccp, &packets.Connack{}); err != nil {
+		t.Fatalf("ConAckReceived falied: %s", err)
+	}
+
+	// Completed transaction
+	resp := make(chan packets.ControlPacket, 1)
+	pub := &packets.Publish{Topic: "test", QoS: 1}
+	if err := s.AddToSessionNoStore(context.Background(), pub, resp); err != nil {
+		t.Fatalf("AddToSessionNoStore failed: %s", err)
+	}
+	if ids, _ := cs.List(); len(ids) != 0 {
+		t.Fatalf("packet should not have been stored (store holds %v)", ids)
+	}
+	pa := packets.NewControlPacket(packets.PUBACK)
+	pa.Content.(*packets.Puback).PacketID = pub.PacketID
+	if err := s.PacketReceived(pa, nil); err != nil {
+		t.Fatalf("PacketReceived failed: %s", err)
+	}
+	if r := <-resp; r.Type != packets.PUBACK {
+		t.Fatalf("expected PUBACK, got %d", r.Type)
+	}
+
+	// Connection lost mid-flight (QOS2 PUBREC received, awaiting PUBCOMP)
+	resp = make(chan packets.ControlPacket, 1)
+	pub = &packets.Publish{Topic: "test", QoS: 2}
+	if err := s.AddToSessionNoStore(context.Background(), pub, resp); err != nil {
+		t.Fatalf("AddToSessionNoStore failed: %s", err)
+	}
+	pr := packets.NewControlPacket(packets.PUBREC)
+	pr.Content.(*packets.Pubrec).PacketID = pub.PacketID
+	if err := s.PacketReceived(pr, nil); err != nil {
+		t.Fatalf("PacketReceived failed: %s", err)
+	}
+	if ids, _ := cs.List(); len(ids) != 0 {
+		t.Fatalf("PUBREL should not have been stored (store holds %v)", ids)
+	}
+	if n := s.InflightPublishes(); n != 1 {
+		t.Fatalf("expected 1 inflight publish, got %d", n)
+	}
+	if err := s.ConnectionLost(nil); err != nil {
+		t.Fatalf("ConnectionLost failed: %s", err)
+	}
+	select {
+	case r := <-resp:
+		if r.Type != 0 {
+			t.Fatalf("expected empty response, got %d", r.Type)
+		}
+	default:
+		t.Fatal("requester should be notified when the connection is lost")
+	}
+	if n := s.InflightPublishes(); n != 0 {
+		t.Fatalf("expected no inflight publishes, got %d", n)
+	}
+
+	// Nothing should be retransmitted on reconnection
+	conn.Reset()
+	if err := s.ConAckReceived(&conn, &ccp, &packets.Connack{SessionPresent: true}); err != nil {
+		t.Fatalf("ConAckReceived falied: %s", err)
+	}
+	if conn.Len() != 0 {
+		t.Fatalf("nothing should be retransmitted")
+	}
+}
+
+func TestCancelPublish(t *testing.T) {
+	t.Parallel()
+
+	sessionExpiry := uint32(60) // Session survives the connection; stored messages would be retransmitted
+	ccp := packets.Connect{
+		ProtocolName:    "MQTT",
+		ProtocolVersion: 5,
+		Properties:      &packets.Properties{SessionExpiryInterval: &sessionExpiry},
+	}
+	cs := memory.New()
+	s := New(cs, memory.New())
+	var conn bytes.Buffer
+	if err := s.ConAckReceived(&conn, &ccp, &packets.Connack{}); err != nil {
+		t.Fatalf("ConAckReceived falied: %s", err)
+	}
+
+	resp1, resp2 := make(chan packets.ControlPacket, 1), make(chan packets.ControlPacket, 1)
+	pub1, pub2 := &packets.Publish{Topic: "test/1", QoS: 1}, &packets.Publish{Topic: "test/2", QoS: 2}
+	if err := s.AddToSession(context.Background(), pub1, resp1); err != nil {
+		t.Fatalf("AddToSession failed: %s", err)
+	}
+	if err := s.AddToSession(context.Background(), pub2, resp2); err != nil {
+		t.Fatalf("AddToSession failed: %s", err)
+	}
+	info := s.InflightPublishInfo()
+	if len(info) != 2 || info[0].PacketID != pub1.PacketID || info[0].Topic != "test/1" || info[0].QoS != 1 ||
+		info[1].PacketID != pub2.PacketID || info[1].Topic != "test/2" || info[1].QoS != 2 {
+		t.Fatalf("unexpected inflight info: %+v", info)
+	}
+
+	// Cancel whilst connected; requester is notified, but the identifier remains reserved until acknowledged
+	if err := s.CancelPublish(pub1.PacketID); err != nil {
+		t.Fatalf("CancelPublish failed: %s", err)
+	}
+	if r := <-resp1; r.Type != 0 {
+		t.Fatalf("expected empty response, got %d", r.Type)
+	}
+	if err := s.CancelPublish(pub1.PacketID); !errors.Is(err, session.ErrNotInflight) {
+		t.Fatalf("expected ErrNotInflight when cancelling twice, got %v", err)
+	}
+	if ids, _ := cs.List(); len(ids) != 1 || ids[0] != pub2.PacketID {
+		t.Fatalf("cancelled message should have been removed from the store (store holds %v)", ids)
+	}
+	if info := s.InflightPublishInfo(); len(info) != 2 || !info[0].Cancelled {
+		t.Fatalf("cancelled publish should be reported until acknowledged: %+v", info)
+	}
+	pa := packets.NewControlPacket(packets.PUBACK) // Acknowledgement arriving after cancellation is discarded
+	pa.Content.(*packets.Puback).PacketID = pub1.PacketID
+	if err := s.PacketReceived(pa, nil); err != nil {
+		t.Fatalf("PacketReceived failed: %s", err)
+	}
+	select {
+	case r := <-resp1:
+		t.Fatalf("requester should not receive a second response (got %d)", r.Type)
+	default:
+	}
+	if n := s.InflightPublishes(); n != 1 {
+		t.Fatalf("expected 1 inflight publish, got %d", n)
+	}
+
+	// Cancel whilst disconnected; identifier released immediately and nothing retransmitted
+	if err := s.ConnectionLost(nil); err != nil {
+		t.Fatalf("ConnectionLost failed: %s", err)
+	}
+	if err := s.CancelPublish(pub2.PacketID); err != nil {
+		t.Fatalf("CancelPublish failed: %s", err)
+	}
+	if r := <-resp2; r.Type != 0 {
+		t.Fatalf("expected empty response, got %d", r.Type)
+	}
+	if n := s.InflightPublishes(); n != 0 {
+		t.Fatalf("expected no inflight publishes, got %d", n)
+	}
+	conn.Reset()
+	if err := s.ConAckReceived(&conn, &ccp, &packets.Connack{SessionPresent: true}); err != nil {
+		t.Fatalf("ConAckReceived falied: %s", err)
+	}
+	if conn.Len() != 0 {
+		t.Fatalf("nothing should be retransmitted")
+	}
+}
+
+// TestAbandonRequest checks that abandoned SUBSCRIBE/UNSUBSCRIBE requests release their packet identifiers
+func TestAbandonRequest(t *testing.T) {
+	t.Parallel()
+
+	sessionExpiry := uint32(60) // Session survives the connection
+	ccp := packets.Connect{
+		ProtocolName:    "MQTT",
+		ProtocolVersion: 5,
+		Properties:      &packets.Properties{SessionExpiryInterval: &sessionExpiry},
+	}
+	s := New(memory.New(), memory.New())
+	var conn bytes.Buffer
+	if err := s.ConAckReceived(&conn, &ccp, &packets.Connack{}); err != nil {
+		t.Fatalf("ConAckReceived falied: %s", err)
+	}
+	inSession := func(packetID uint16) bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		_, ok := s.clientPackets[packetID]
+		return ok
+	}
+
+	resp1, resp2 := make(chan packets.ControlPacket, 1), make(chan packets.ControlPacket, 1)
+	sub := &packets.Subscribe{Subscriptions: []packets.SubOptions{{Topic: "test"}}}
+	unsub := &packets.Unsubscribe{Topics: []string{"test"}}
+	if err := s.AddToSession(context.Background(), sub, resp1); err != nil {
+		t.Fatalf("AddToSession failed: %s", err)
+	}
+	if err := s.AddToSession(context.Background(), unsub, resp2); err != nil {
+		t.Fatalf("AddToSession failed: %s", err)
+	}
+
+	// Abandoned whilst connected; identifier remains reserved until the response arrives
+	if err := s.AbandonRequest(sub.PacketID); err != nil {
+		t.Fatalf("AbandonRequest failed: %s", err)
+	}
+	if err := s.AbandonRequest(sub.PacketID); !errors.Is(err, session.ErrNotInflight) {
+		t.Fatalf("expected ErrNotInflight when abandoning twice, got %v", err)
+	}
+	if !inSession(sub.PacketID) {
+		t.Fatal("identifier should remain reserved until SUBACK received")
+	}
+	sa := packets.NewControlPacket(packets.SUBACK)
+	sa.Content.(*packets.Suback).PacketID = sub.PacketID
+	if err := s.PacketReceived(sa, nil); err != nil {
+		t.Fatalf("PacketReceived failed: %s", err)
+	}
+	select {
+	case r := <-resp1:
+		t.Fatalf("requester should not receive the response to an abandoned request (got %d)", r.Type)
+	default:
+	}
+	if inSession(sub.PacketID) {
+		t.Fatal("identifier should be released when SUBACK received")
+	}
+
+	// If no response arrives, the identifier is released when the connection is lost (even though the session survives)
+	if err := s.AbandonRequest(unsub.PacketID); err != nil {
+		t.Fatalf("AbandonRequest failed: %s", err)
+	}
+	if err := s.ConnectionLost(nil); err != nil {
+		t.Fatalf("ConnectionLost failed: %s", err)
+	}
+	if inSession(unsub.PacketID) {
+		t.Fatal("identifier should be released when connection lost")
+	}
+
+	if err := s.AbandonRequest(1234); !errors.Is(err, session.ErrNotInflight) {
+		t.Fatalf("expected ErrNotInflight for unknown identifier, got %v", err)
+	}
+}
+
+// TestResetSession checks the interaction between Reset, Clean Start and the Session Present flag in the CONNACK
+func TestResetSession(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name           string
+		cleanStart     bool
+		sessionPresent bool
+		reset          bool
+		retransmit     bool
+	}{
+		{name: "cleanStart", cleanStart: true},
+		{name: "cleanStartReset", cleanStart: true, reset: true},
+		{name: "resumed", sessionPresent: true, retransmit: true},
+		{name: "resumedReset", sessionPresent: true, reset: true},
+		{name: "notPresent"},
+		{name: "notPresentReset", reset: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			sessionExpiry := uint32(60)
+			ccp := packets.Connect{
+				ProtocolName:    "MQTT",
+				ProtocolVersion: 5,
+				Properties:      &packets.Properties{SessionExpiryInterval: &sessionExpiry},
+			}
+			cs := memory.New()
+			s := New(cs, memory.New())
+			var conn bytes.Buffer
+			if err := s.ConAckReceived(&conn, &ccp, &packets.Connack{}); err != nil {
+				t.Fatalf("ConAckReceived falied: %s", err)
+			}
+			resp := make(chan packets.ControlPacket, 1)
+			if err := s.AddToSession(context.Background(), &packets.Publish{Topic: "test", QoS: 1}, resp); err != nil {
+				t.Fatalf("AddToSession failed: %s", err)
+			}
+			if err := s.Reset(); !errors.Is(err, session.ErrConnectionActive) {
+				t.Fatalf("expected ErrConnectionActive when resetting whilst connected, got %v", err)
+			}
+			if err := s.ConnectionLost(nil); err != nil {
+				t.Fatalf("ConnectionLost failed: %s", err)
+			}
+
+			if tt.reset {
+				if err := s.Reset(); err != nil {
+					t.Fatalf("Reset failed: %s", err)
+				}
+				if r := <-resp; r.Type != 0 {
+					t.Fatalf("expected empty response, got %d", r.Type)
+				}
+				if ids, _ := cs.List(); len(ids) != 0 {
+					t.Fatalf("store should be empty after reset (holds %v)", ids)
+				}
+			}
+
+			conn.Reset()
+			ccp.CleanStart = tt.cleanStart
+			if err := s.ConAckReceived(&conn, &ccp, &packets.Connack{SessionPresent: tt.sessionPresent}); err != nil {
+				t.Fatalf("ConAckReceived falied: %s", err)
+			}
+			if retransmitted := conn.Len() != 0; retransmitted != tt.retransmit {
+				t.Fatalf("expected retransmit %t, got %t", tt.retransmit, retransmitted)
+			}
+			want := 0
+			if tt.retransmit {
+				want = 1
+			}
+			if n := s.InflightPublishes(); n != want {
+				t.Fatalf("expected %d inflight publishes, got %d", want, n)
+			}
+		})
+	}
+}
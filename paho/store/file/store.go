@@ -35,8 +35,8 @@ const (
 
 // New creates a file Store. Note that a file is written, read and deleted as part of this process to check that the
 // path is usable.
-// NOTE: Order is maintained using file ModTime, so there may be issues if the interval between messages is less than
-// the file system ModTime resolution.
+// NOTE: Order is maintained using file ModTime; Put ensures that each file has a later ModTime than the previous one,
+// but there may be issues if the file system ModTime resolution is coarse (e.g. FAT).
 func New(path string, prefix string, extension string) (*Store, error) {
 	if len(extension) > 0 && extension[0] != '.' {
 		extension = "." + extension
@@ -73,6 +73,8 @@ type Store struct {
 	path       string
 	prefix     string
 	extension  string
+
+	lastModTime time.Time // ModTime of the most recently Put file (used to maintain order)
 }
 
 // Put stores the packet
@@ -97,6 +99,10 @@ func (s *Store) Put(packetID uint16, packetType byte, w io.WriterTo) error {
 		_ = os.Remove(tmpFn)
 		return fmt.Errorf("failed to close temp file: %w", err)
 	}
+	if err = s.orderModTime(tmpFn); err != nil {
+		_ = os.Remove(tmpFn)
+		return err
+	}
 	if err = os.Rename(tmpFn, s.filePathForId(packetID)); err != nil {
 		_ = os.Remove(tmpFn)
 		return fmt.Errorf("failed to rename temp file: %w", err)
@@ -104,6 +110,25 @@ func (s *Store) Put(packetID uint16, packetType byte, w io.WriterTo) error {
 	return nil
 }
 
+// orderModTime ensures that the ModTime of fn is after that of the previously stored file (packets Put in quick
+// succession may otherwise have the same ModTime, meaning List could return them out of order).
+// caller must lock mutex
+func (s *Store) orderModTime(fn string) error {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return fmt.Errorf("failed to stat temp file: %w", err)
+	}
+	mt := fi.ModTime()
+	if !mt.After(s.lastModTime) {
+		mt = s.lastModTime.Add(time.Microsecond)
+		if err = os.Chtimes(fn, mt, mt); err != nil {
+			return fmt.Errorf("failed to set temp file ModTime: %w", err)
+		}
+	}
+	s.lastModTime = mt
+	return nil
+}
+
 // Get retrieves the requested packet
 // Note that callers MUST close the returned ReadCloser
 func (s *Store) Get(packetID uint16) (io.ReadCloser, error) {
@@ -116,6 +141,17 @@ func (s *Store) Get(packetID uint16) (io.ReadCloser, error) {
 	return f, nil
 }
 
+// StoredAt returns the time that the packet with the specified ID was Put (the file ModTime)
+func (s *Store) StoredAt(packetID uint16) (time.Time, error) {
+	s.Lock()
+	defer s.Unlock()
+	fi, err := os.Stat(s.filePathForId(packetID))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to stat packet file: %w", err)
+	}
+	return fi.ModTime(), nil
+}
+
 // Delete removes the message with the specified store ID
 func (s *Store) Delete(id uint16) error {
 	s.Lock()
@@ -209,10 +245,10 @@ func (s *Store) list() ([]uint16, error) {
 		}
 		ids = append(ids, idAndModTime{uint16(id), info.ModTime()}) // Possible this will truncate id
 	}
-	sort.Slice(ids, func(i, j int) bool {
+	sort.SliceStable(ids, func(i, j int) bool {
 		return ids[i].modTime.Before(ids[j].modTime)
 	})
-	ret := make([]uint16, len(entries))
+	ret := make([]uint16, len(ids))
 	for i := range ids {
 		ret[i] = ids[i].id
 	}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/eclipse/paho.golang/packets"
 )
@@ -31,8 +32,9 @@ var (
 
 // memoryPacket is an element in the memory store
 type memoryPacket struct {
-	c int    // message count (used for ordering; as this is 32 bit min chance of rolling over seems remote)
-	p []byte // the packet we are storing
+	c int       // message count (used for ordering; as this is 32 bit min chance of rolling over seems remote)
+	p []byte    // the packet we are storing
+	t time.Time // when the packet was stored
 }
 
 // New creates a Store
@@ -65,6 +67,7 @@ func (m *Store) Put(packetID uint16, packetType byte, w io.WriterTo) error {
 	m.data[packetID] = memoryPacket{
 		c: m.c,
 		p: buff.Bytes(),
+		t: time.Now(),
 	}
 	m.c++
 	return nil
@@ -80,6 +83,17 @@ func (m *Store) Get(packetID uint16) (io.ReadCloser, error) {
 	return io.NopCloser(bytes.NewReader(d.p)), nil
 }
 
+// StoredAt returns the time that the packet with the specified ID was Put
+func (m *Store) StoredAt(packetID uint16) (time.Time, error) {
+	m.Lock()
+	defer m.Unlock()
+	d, ok := m.data[packetID]
+	if !ok {
+		return time.Time{}, ErrNotInStore
+	}
+	return d.t, nil
+}
+
 // Delete removes the message with the specified store ID
 func (m *Store) Delete(id uint16) error {
 	m.Lock()
@@ -0,0 +1,8 @@
+module github.com/eclipse/paho.golang/paho/store/sqlite
+
+go 1.25.0
+
+require (
+	github.com/eclipse/paho.golang v0.23.0
+	github.com/mattn/go-sqlite3 v1.14.33
+)
@@ -0,0 +1,204 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+// Package sqlite provides a session state store that holds packets in a SQLite database.
+//
+// To avoid forcing a specific driver on users (and the cgo requirement that some drivers bring), the caller opens the
+// database (using any database/sql driver that supports SQLite) and passes the *sql.DB to New. Both the client and
+// server stores may share the same database file (use a different table name for each).
+//
+// Every change is made within a transaction so a crash mid-write will leave the database in a consistent state (SQLite
+// rolls back any incomplete transaction when the database is next opened). Using WAL mode (PRAGMA journal_mode=WAL) and
+// a busy timeout is recommended where the database is shared.
+//
+// The store itself only uses database/sql. It is a separate Go module (github.com/eclipse/paho.golang/paho/store/sqlite)
+// because its tests need a SQLite driver (github.com/mattn/go-sqlite3, which requires cgo); as a separate module, that
+// requirement does not appear in the go.mod of the main module.
+package sqlite
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotInStore       = errors.New("the requested ID was not found in the store")                  // Returned when requested ID not found
+	ErrInvalidTableName = errors.New("table name must only contain letters, digits and underscores") // Returned by New
+)
+
+// validTableName is used to check table names (these are included in SQL statements so cannot be parameterised)
+var validTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// New creates a Store that holds packets in the table specified (which will be created if it does not exist). A
+// second table (with "_corrupt" appended to the name) holds any quarantined packets.
+func New(db *sql.DB, table string) (*Store, error) {
+	if !validTableName.MatchString(table) {
+		return nil, ErrInvalidTableName
+	}
+	s := &Store{
+		db:      db,
+		table:   table,
+		corrupt: table + "_corrupt",
+	}
+
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + s.table + ` (
+		packet_id INTEGER PRIMARY KEY,
+		seq INTEGER NOT NULL,
+		packet_type INTEGER NOT NULL,
+		stored_at INTEGER NOT NULL,
+		packet BLOB NOT NULL)`); err != nil {
+		return nil, fmt.Errorf("failed to create table %s: %w", s.table, err)
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + s.corrupt + ` (
+		packet_id INTEGER NOT NULL,
+		packet_type INTEGER NOT NULL,
+		packet BLOB NOT NULL)`); err != nil {
+		return nil, fmt.Errorf("failed to create table %s: %w", s.corrupt, err)
+	}
+	return s, nil
+}
+
+// Store is an implementation of a Store that stores the data in a SQLite database
+type Store struct {
+	sync.Mutex // Ensures there is only a single writer (SQLite does not support concurrent writes)
+	db         *sql.DB
+	table      string
+	corrupt    string
+}
+
+// Put stores the packet (replacing any existing packet with the same ID)
+func (s *Store) Put(packetID uint16, packetType byte, w io.WriterTo) error {
+	var buf bytes.Buffer
+	if _, err := w.WriteTo(&buf); err != nil {
+		return fmt.Errorf("failed to write packet: %w", err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	return s.transaction(func(tx *sql.Tx) error {
+		// seq maintains the order in which packets were Put (a replaced packet moves to the end)
+		_, err := tx.Exec(`INSERT OR REPLACE INTO `+s.table+` (packet_id, seq, packet_type, stored_at, packet)
+			VALUES (?, (SELECT COALESCE(MAX(seq), 0) + 1 FROM `+s.table+`), ?, ?, ?)`,
+			packetID, packetType, time.Now().UnixNano(), buf.Bytes())
+		return err
+	})
+}
+
+// Get retrieves the packet with the specified ID
+func (s *Store) Get(packetID uint16) (io.ReadCloser, error) {
+	var p []byte
+	err := s.db.QueryRow(`SELECT packet FROM `+s.table+` WHERE packet_id = ?`, packetID).Scan(&p)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotInStore
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read packet %d: %w", packetID, err)
+	}
+	return io.NopCloser(bytes.NewReader(p)), nil
+}
+
+// StoredAt returns the time that the packet with the specified ID was Put
+func (s *Store) StoredAt(packetID uint16) (time.Time, error) {
+	var storedAt int64
+	err := s.db.QueryRow(`SELECT stored_at FROM `+s.table+` WHERE packet_id = ?`, packetID).Scan(&storedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, ErrNotInStore
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read packet %d: %w", packetID, err)
+	}
+	return time.Unix(0, storedAt), nil
+}
+
+// Delete removes the message with the specified store ID
+func (s *Store) Delete(id uint16) error {
+	s.Lock()
+	defer s.Unlock()
+	res, err := s.db.Exec(`DELETE FROM `+s.table+` WHERE packet_id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete packet %d: %w", id, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		// This could be ignored, but reporting it may help reveal other issues
+		return fmt.Errorf("request to delete packet %d; packet not found", id)
+	}
+	return nil
+}
+
+// Quarantine is called if a corrupt packet is detected.
+// The packet is moved into the corrupt table (so it is available for analysis, but will not be resent)
+func (s *Store) Quarantine(id uint16) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`INSERT INTO `+s.corrupt+` (packet_id, packet_type, packet)
+			SELECT packet_id, packet_type, packet FROM `+s.table+` WHERE packet_id = ?`, id); err != nil {
+			return fmt.Errorf("failed to move packet into quarantine: %w", err)
+		}
+		_, err := tx.Exec(`DELETE FROM `+s.table+` WHERE packet_id = ?`, id)
+		return err
+	})
+}
+
+// List returns packet IDs in the order they were Put
+func (s *Store) List() ([]uint16, error) {
+	rows, err := s.db.Query(`SELECT packet_id FROM ` + s.table + ` ORDER BY seq`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list packets: %w", err)
+	}
+	defer rows.Close()
+	var ids []uint16
+	for rows.Next() {
+		var id uint16
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to read packet id: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Reset clears the store (deleting all messages)
+func (s *Store) Reset() error {
+	s.Lock()
+	defer s.Unlock()
+	if _, err := s.db.Exec(`DELETE FROM ` + s.table); err != nil {
+		return fmt.Errorf("failed to reset store: %w", err)
+	}
+	return nil
+}
+
+// transaction runs f within a transaction; the transaction is committed if f returns nil, otherwise it is rolled back
+// caller must hold lock
+func (s *Store) transaction(f func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	if err := f(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+//go:build cgo
+
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package sqlite
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/eclipse/paho.golang/packets"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// openDB opens a SQLite database in a temporary folder
+func openDB(t *testing.T, fn string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", fn+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	return db
+}
+
+// TestSQLiteStore basic tests of the SQLite store
+func TestSQLiteStore(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "session.db")
+	db := openDB(t, fn)
+	s, err := New(db, "client")
+	if err != nil {
+		t.Fatalf("failed to create store: %s", err)
+	}
+
+	ids := []uint16{65535, 2, 10, 32300, 5890}
+	for _, id := range ids {
+		pcp := packets.NewControlPacket(packets.PUBLISH)
+		pcp.Content.(*packets.Publish).PacketID = id
+		pcp.Content.(*packets.Publish).QoS = 1 // ID will only be written for QOS1+
+		pcp.Content.(*packets.Publish).Payload = []byte(fmt.Sprintf("%d", id))
+
+		if err := s.Put(id, packets.PUBLISH, pcp); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+	}
+
+	if err := s.Delete(ids[2]); err != nil {
+		t.Fatalf("failed to delete: %s", err)
+	}
+	if err := s.Delete(ids[2]); err == nil {
+		t.Fatal("deleting missing item should fail")
+	}
+	if _, err := s.Get(8); !errors.Is(err, ErrNotInStore) {
+		t.Fatal("getting missing item should fail")
+	}
+	ids = append(ids[:2], ids[3:]...) // keep our record in sync following delete
+
+	// Replacing a packet (e.g. PUBLISH -> PUBREL) should move it to the end
+	pcp := packets.NewControlPacket(packets.PUBREL)
+	pcp.Content.(*packets.Pubrel).PacketID = ids[0]
+	if err := s.Put(ids[0], packets.PUBREL, pcp); err != nil {
+		t.Fatalf("failed to put: %s", err)
+	}
+	ids = append(ids[1:], ids[0])
+
+	if rp, err := s.Get(32300); err != nil {
+		t.Fatalf("failed to get: %s", err)
+	} else {
+		p, err := packets.ReadPacket(rp)
+		if err != nil {
+			t.Fatalf("error decoding packet: %s", err)
+		}
+		if p.PacketID() != 32300 {
+			t.Fatalf("unexpected packet id returned: %d", p.PacketID())
+		}
+		if payload := p.Content.(*packets.Publish).Payload; !bytes.Equal(payload, []byte("32300")) {
+			t.Fatalf("unexpected payload returned: %s", payload)
+		}
+	}
+
+	// Data should survive the database being closed and reopened
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close database: %s", err)
+	}
+	db = openDB(t, fn)
+	defer db.Close()
+	if s, err = New(db, "client"); err != nil {
+		t.Fatalf("failed to create store: %s", err)
+	}
+
+	rids, err := s.List()
+	if err != nil {
+		t.Fatalf("failed to list: %s", err)
+	}
+	if fmt.Sprint(rids) != fmt.Sprint(ids) {
+		t.Fatalf("List returned %v, expected %v", rids, ids)
+	}
+
+	if err := s.Quarantine(ids[0]); err != nil {
+		t.Fatalf("failed to quarantine: %s", err)
+	}
+	if _, err := s.Get(ids[0]); !errors.Is(err, ErrNotInStore) {
+		t.Fatal("quarantined item should not be in store")
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM client_corrupt`).Scan(&n); err != nil || n != 1 {
+		t.Fatalf("expected 1 quarantined packet, got %d (%v)", n, err)
+	}
+
+	if err := s.Reset(); err != nil {
+		t.Fatalf("failed to reset: %s", err)
+	}
+	if rids, err = s.List(); err != nil || len(rids) != 0 {
+		t.Fatalf("expected empty store after reset, got %v (%v)", rids, err)
+	}
+}
+
+// TestSQLiteStoreTableName checks that invalid table names are rejected
+func TestSQLiteStoreTableName(t *testing.T) {
+	db := openDB(t, filepath.Join(t.TempDir(), "session.db"))
+	defer db.Close()
+	if _, err := New(db, "client; DROP TABLE x"); !errors.Is(err, ErrInvalidTableName) {
+		t.Fatalf("expected ErrInvalidTableName, got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// streamedPayload wraps the reader for a PUBLISH payload that is being streamed from the connection (see
+// ClientConfig.StreamPayloadThreshold); done is closed once the payload has been fully read (or an error occurs).
+type streamedPayload struct {
+	r    io.Reader
+	once sync.Once
+	done chan struct{}
+	err  error // nil if the payload was fully read (only valid once done is closed)
+}
+
+// newStreamedPayload creates a streamedPayload that reads from r
+func newStreamedPayload(r io.Reader) *streamedPayload {
+	return &streamedPayload{
+		r:    r,
+		done: make(chan struct{}),
+	}
+}
+
+// Read implements io.Reader
+func (s *streamedPayload) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil {
+		s.finish(err)
+	}
+	return n, err
+}
+
+// discard reads, and discards, any remaining data
+func (s *streamedPayload) discard() {
+	_, _ = io.Copy(io.Discard, s)
+	s.finish(io.EOF) // Copy may end without an error being returned by Read
+}
+
+// finish records the result of reading the payload and closes done
+func (s *streamedPayload) finish(err error) {
+	s.once.Do(func() {
+		if !errors.Is(err, io.EOF) {
+			s.err = err
+		}
+		close(s.done)
+	})
+}
+
+// drained returns true once the payload has been fully read (or reading failed)
+func (s *streamedPayload) drained() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// streamedPayloadKey is the context key under which the *streamedPayload of the message being handled is stored
+type streamedPayloadKey struct{}
+
+// streamNotDrained returns ErrStreamNotDrained if ctx was derived from the context passed to the handler of a message
+// whose streamed payload has not been fully read. The client cannot read further packets (including the response to a
+// request made by the handler) until it has been, so waiting for a response would deadlock.
+func streamNotDrained(ctx context.Context) error {
+	if sp, ok := ctx.Value(streamedPayloadKey{}).(*streamedPayload); ok && !sp.drained() {
+		return ErrStreamNotDrained
+	}
+	return nil
+}
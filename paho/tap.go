@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"net"
+	"slices"
+	"sync"
+)
+
+// tapConn wraps a net.Conn, passing copies of the data read and written to the OnBytesRead/OnBytesWritten hooks.
+// packets.ControlPacket.WriteTo locks the connection (if it implements sync.Locker) whilst each packet is written, so
+// data written whilst the lock is held is collected and passed to onWrite as a single frame when it is released.
+type tapConn struct {
+	net.Conn
+	locker  sync.Locker
+	onRead  func([]byte)
+	onWrite func([]byte)
+
+	locked  bool   // true whilst locker is held (protected by locker)
+	pending []byte // data written whilst locked (protected by locker)
+}
+
+// newTapConn wraps conn such that onRead and onWrite (either may be nil) are called with the data read and written
+func newTapConn(conn net.Conn, onRead, onWrite func([]byte)) *tapConn {
+	locker, ok := conn.(sync.Locker)
+	if !ok {
+		locker = &sync.Mutex{}
+	}
+	return &tapConn{Conn: conn, locker: locker, onRead: onRead, onWrite: onWrite}
+}
+
+// Read implements net.Conn
+func (c *tapConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.onRead != nil {
+		c.onRead(slices.Clone(b[:n]))
+	}
+	return n, err
+}
+
+// Write implements net.Conn
+func (c *tapConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 && c.onWrite != nil {
+		if c.locked {
+			c.pending = append(c.pending, b[:n]...)
+		} else {
+			c.onWrite(slices.Clone(b[:n]))
+		}
+	}
+	return n, err
+}
+
+// Lock implements sync.Locker (passing the call on to the wrapped connection if it supports this)
+func (c *tapConn) Lock() {
+	c.locker.Lock()
+	c.locked = true
+}
+
+// Unlock implements sync.Locker; data written whilst locked is passed to onWrite
+func (c *tapConn) Unlock() {
+	if len(c.pending) > 0 {
+		c.onWrite(c.pending)
+		c.pending = nil
+	}
+	c.locked = false
+	c.locker.Unlock()
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"container/list"
+	"io"
+	"sync"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho/log"
+)
+
+// TopicAliasEviction determines what happens when a PUBLISH is sent to a topic that has no alias, and all of the
+// aliases permitted by the server (Topic Alias Maximum) are in use.
+type TopicAliasEviction int
+
+const (
+	TopicAliasEvictionNone TopicAliasEviction = iota // Aliases are never reassigned (topics without an alias will be sent in full)
+	TopicAliasEvictionLRU                            // The least recently used alias will be reassigned to the new topic
+)
+
+// TopicAliasStats reports on the use of outbound topic aliases on the current connection (see
+// ClientConfig.EnableTopicAliases); this can help when tuning the Topic Alias Maximum requested from the server. A
+// high number of Evictions relative to Hits indicates that the alias space is too small for the set of topics used.
+type TopicAliasStats struct {
+	Maximum   uint16 // Topic Alias Maximum from the CONNACK (0 if aliases are not in use)
+	Size      int    // Number of aliases currently assigned
+	Hits      uint64 // PUBLISH packets sent with only an alias (topic omitted)
+	Misses    uint64 // PUBLISH packets sent with both the topic and alias (assigning the alias)
+	Evictions uint64 // Aliases reassigned to a different topic (TopicAliasEvictionLRU)
+	Unaliased uint64 // PUBLISH packets sent without an alias because all aliases were in use (TopicAliasEvictionNone)
+}
+
+// topicAlias is the value held in outboundTopicAliases.lru and inboundTopicAliases.lru
+type topicAlias struct {
+	topic string
+	alias uint16
+}
+
+// outboundTopicAliases assigns topic aliases to outbound PUBLISH packets. Aliases only remain valid for the life of
+// a network connection, so a new outboundTopicAliases must be created for each connection.
+type outboundTopicAliases struct {
+	mu       sync.Mutex // Held while the packet is written (ensures the server receives aliases in the order assigned)
+	max      uint16
+	eviction TopicAliasEviction
+	topics   map[string]*list.Element // Value is *topicAlias
+	lru      *list.List               // Most recently used at the front
+	debug    log.Logger
+
+	hits, misses, evictions, unaliased uint64 // see TopicAliasStats
+}
+
+// newOutboundTopicAliases creates an outboundTopicAliases that will use aliases 1 to max
+func newOutboundTopicAliases(max uint16, eviction TopicAliasEviction) *outboundTopicAliases {
+	return &outboundTopicAliases{
+		max:      max,
+		eviction: eviction,
+		topics:   make(map[string]*list.Element),
+		lru:      list.New(),
+		debug:    log.NOOPLogger{},
+	}
+}
+
+// stats returns a snapshot of the statistics
+func (t *outboundTopicAliases) stats() TopicAliasStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return TopicAliasStats{
+		Maximum:   t.max,
+		Size:      t.lru.Len(),
+		Hits:      t.hits,
+		Misses:    t.misses,
+		Evictions: t.evictions,
+		Unaliased: t.unaliased,
+	}
+}
+
+// alias returns the alias that should be used when publishing to topic (0 if an alias cannot be used) and a bool
+// indicating whether the server already knows the alias (in which case the topic can be omitted).
+// caller must hold lock on mu
+func (t *outboundTopicAliases) alias(topic string) (uint16, bool) {
+	if e, ok := t.topics[topic]; ok {
+		t.hits++
+		t.lru.MoveToFront(e)
+		return e.Value.(*topicAlias).alias, true
+	}
+	if t.lru.Len() < int(t.max) {
+		t.misses++
+		a := &topicAlias{topic: topic, alias: uint16(t.lru.Len() + 1)}
+		t.topics[topic] = t.lru.PushFront(a)
+		t.debug.Printf("assigned outbound topic alias %d to %s", a.alias, topic)
+		return a.alias, false
+	}
+	if t.eviction != TopicAliasEvictionLRU {
+		t.unaliased++
+		return 0, false
+	}
+	t.misses++
+	t.evictions++
+	e := t.lru.Back()
+	a := e.Value.(*topicAlias)
+	t.debug.Printf("evicted outbound topic alias %d from %s; reassigned to %s", a.alias, a.topic, topic)
+	delete(t.topics, a.topic)
+	a.topic = topic
+	t.topics[topic] = e
+	t.lru.MoveToFront(e)
+	return a.alias, false
+}
+
+// writePublish writes pb to w, substituting a topic alias where possible. pb is not modified (as it may be
+// retransmitted on a future connection where the alias will not be valid).
+func (t *outboundTopicAliases) writePublish(pb *packets.Publish, w io.Writer) (int64, error) {
+	if pb.Topic == "" || (pb.Properties != nil && pb.Properties.TopicAlias != nil) {
+		return pb.WriteTo(w) // User is managing aliases for this message
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	a, known := t.alias(pb.Topic)
+	if a == 0 {
+		return pb.WriteTo(w)
+	}
+	aliased := *pb
+	var props packets.Properties
+	if pb.Properties != nil {
+		props = *pb.Properties
+	}
+	props.TopicAlias = &a
+	aliased.Properties = &props
+	if known {
+		aliased.Topic = ""
+	}
+	return aliased.WriteTo(w)
+}
+
+// inboundTopicAliases maps topic aliases received from the server to topics. Aliases only remain valid for the life
+// of a network connection.
+type inboundTopicAliases struct {
+	mu      sync.Mutex
+	max     uint16                   // Aliases greater than this are a protocol error (0 = no limit)
+	size    int                      // Maximum number of aliases held; the least recently used is evicted (0 = no limit)
+	aliases map[uint16]*list.Element // Value is *topicAlias
+	lru     *list.List               // Most recently used at the front
+}
+
+// newInboundTopicAliases creates an inboundTopicAliases with the specified limits (0 = no limit)
+func newInboundTopicAliases(max uint16, size int) *inboundTopicAliases {
+	return &inboundTopicAliases{
+		max:     max,
+		size:    size,
+		aliases: make(map[uint16]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// valid returns true if alias is permitted (i.e. is not 0, and does not exceed the maximum)
+func (t *inboundTopicAliases) valid(alias uint16) bool {
+	return alias != 0 && (t.max == 0 || alias <= t.max)
+}
+
+// set records that alias refers to topic. If this requires that another alias be evicted, then that alias is
+// returned (otherwise 0).
+func (t *inboundTopicAliases) set(alias uint16, topic string) uint16 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.aliases[alias]; ok {
+		e.Value.(*topicAlias).topic = topic
+		t.lru.MoveToFront(e)
+		return 0
+	}
+	var evicted uint16
+	if t.size > 0 && t.lru.Len() >= t.size {
+		e := t.lru.Back()
+		evicted = e.Value.(*topicAlias).alias
+		delete(t.aliases, evicted)
+		t.lru.Remove(e)
+	}
+	t.aliases[alias] = t.lru.PushFront(&topicAlias{topic: topic, alias: alias})
+	return evicted
+}
+
+// get returns the topic that alias refers to (and a bool indicating whether the alias is known)
+func (t *inboundTopicAliases) get(alias uint16) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.aliases[alias]
+	if !ok {
+		return "", false
+	}
+	t.lru.MoveToFront(e)
+	return e.Value.(*topicAlias).topic, true
+}
+
+// reset discards all aliases (called when a new network connection is established)
+func (t *inboundTopicAliases) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	clear(t.aliases)
+	t.lru.Init()
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutboundTopicAliases(t *testing.T) {
+	type sent struct {
+		topic string
+		alias uint16 // 0 = no alias
+	}
+	tests := []struct {
+		name     string
+		max      uint16
+		eviction TopicAliasEviction
+		topics   []string
+		expected []sent
+		stats    TopicAliasStats
+	}{
+		{
+			name:     "no eviction",
+			max:      2,
+			eviction: TopicAliasEvictionNone,
+			topics:   []string{"a", "a", "b", "c", "b", "c"},
+			expected: []sent{{"a", 1}, {"", 1}, {"b", 2}, {"c", 0}, {"", 2}, {"c", 0}},
+			stats:    TopicAliasStats{Maximum: 2, Size: 2, Hits: 2, Misses: 2, Unaliased: 2},
+		},
+		{
+			name:     "LRU",
+			max:      2,
+			eviction: TopicAliasEvictionLRU,
+			topics:   []string{"a", "b", "a", "c", "a", "b", "c"},
+			expected: []sent{{"a", 1}, {"b", 2}, {"", 1}, {"c", 2}, {"", 1}, {"b", 2}, {"c", 1}},
+			stats:    TopicAliasStats{Maximum: 2, Size: 2, Hits: 2, Misses: 5, Evictions: 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ta := newOutboundTopicAliases(tt.max, tt.eviction)
+			var buf bytes.Buffer
+			for _, topic := range tt.topics {
+				pb := &packets.Publish{Topic: topic, Payload: []byte("test")}
+				_, err := ta.writePublish(pb, &buf)
+				require.NoError(t, err)
+				assert.Equal(t, topic, pb.Topic, "original packet must not be modified")
+				assert.Nil(t, pb.Properties, "original packet must not be modified")
+			}
+			assert.Equal(t, tt.stats, ta.stats())
+			for i, e := range tt.expected {
+				cp, err := packets.ReadPacket(&buf)
+				require.NoError(t, err)
+				p := cp.Content.(*packets.Publish)
+				assert.Equal(t, e.topic, p.Topic, "packet %d", i)
+				if e.alias == 0 {
+					assert.Nil(t, p.Properties.TopicAlias, "packet %d", i)
+				} else if assert.NotNil(t, p.Properties.TopicAlias, "packet %d", i) {
+					assert.Equal(t, e.alias, *p.Properties.TopicAlias, "packet %d", i)
+				}
+			}
+		})
+	}
+
+	// A user specified alias should be passed through unaltered
+	ta := newOutboundTopicAliases(2, TopicAliasEvictionLRU)
+	var buf bytes.Buffer
+	_, err := ta.writePublish(&packets.Publish{Topic: "a", Properties: &packets.Properties{TopicAlias: Uint16(2)}}, &buf)
+	require.NoError(t, err)
+	cp, err := packets.ReadPacket(&buf)
+	require.NoError(t, err)
+	p := cp.Content.(*packets.Publish)
+	assert.Equal(t, "a", p.Topic)
+	assert.Equal(t, uint16(2), *p.Properties.TopicAlias)
+	assert.Empty(t, ta.topics)
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Will simplifies the creation of a Last Will and Testament (the message the server will publish if the connection
+// is lost without a DISCONNECT being sent). Create with NewWill, configure using the With... methods, and then call
+// Build to obtain the values for Connect.WillMessage and Connect.WillProperties (or the equivalent fields in
+// autopaho.ClientConfig). e.g.
+//
+//	cp.WillMessage, cp.WillProperties, err = paho.NewWill("status", []byte("offline")).WithQoS(1).WithRetain(true).Build()
+type Will struct {
+	message    WillMessage
+	properties WillProperties
+	err        error // first error encountered (returned by Build)
+}
+
+// NewWill creates a Will that will publish payload to topic
+func NewWill(topic string, payload []byte) *Will {
+	w := &Will{message: WillMessage{Topic: topic, Payload: payload}}
+	if topic == "" {
+		w.setErr(fmt.Errorf("%w: will topic must not be empty", ErrInvalidArguments))
+	} else if strings.ContainsAny(topic, "+#") {
+		w.setErr(fmt.Errorf("%w: will topic %q must not contain wildcards", ErrInvalidArguments, topic))
+	}
+	return w
+}
+
+// WithQoS sets the QoS of the will message
+func (w *Will) WithQoS(qos byte) *Will {
+	if qos > 2 {
+		w.setErr(fmt.Errorf("%w: will QoS %d is invalid", ErrInvalidArguments, qos))
+	}
+	w.message.QoS = qos
+	return w
+}
+
+// WithRetain sets the retain flag of the will message
+func (w *Will) WithRetain(retain bool) *Will {
+	w.message.Retain = retain
+	return w
+}
+
+// WithDelayInterval sets the Will Delay Interval; the server will delay publishing the will until this period has
+// passed (or the session ends), allowing the client to reconnect without the will being published.
+// The value is rounded up to a whole number of seconds.
+func (w *Will) WithDelayInterval(d time.Duration) *Will {
+	w.properties.WillDelayInterval = w.seconds("delay interval", d)
+	return w
+}
+
+// WithMessageExpiry sets the Message Expiry Interval of the will message (rounded up to a whole number of seconds)
+func (w *Will) WithMessageExpiry(d time.Duration) *Will {
+	w.properties.MessageExpiry = w.seconds("message expiry", d)
+	return w
+}
+
+// WithContentType sets the Content Type of the will message
+func (w *Will) WithContentType(contentType string) *Will {
+	w.properties.ContentType = contentType
+	return w
+}
+
+// WithPayloadFormat sets the Payload Format Indicator of the will message (1 indicates UTF-8 encoded character data)
+func (w *Will) WithPayloadFormat(format byte) *Will {
+	w.properties.PayloadFormat = &format
+	return w
+}
+
+// WithResponseTopic sets the Response Topic of the will message
+func (w *Will) WithResponseTopic(topic string) *Will {
+	w.properties.ResponseTopic = topic
+	return w
+}
+
+// WithCorrelationData sets the Correlation Data of the will message
+func (w *Will) WithCorrelationData(data []byte) *Will {
+	w.properties.CorrelationData = data
+	return w
+}
+
+// WithUserProperty adds a User Property to the will message
+func (w *Will) WithUserProperty(key, value string) *Will {
+	w.properties.User.Add(key, value)
+	return w
+}
+
+// Build returns the WillMessage and WillProperties to be used in the CONNECT packet. An error (wrapping
+// ErrInvalidArguments) will be returned if any of the values provided are invalid.
+func (w *Will) Build() (*WillMessage, *WillProperties, error) {
+	if w.err != nil {
+		return nil, nil, w.err
+	}
+	m, p := w.message, w.properties
+	return &m, &p, nil
+}
+
+// seconds converts d into the number of seconds (rounded up) for use in a four byte integer property
+func (w *Will) seconds(name string, d time.Duration) *uint32 {
+	v, err := durationSeconds("will "+name, d)
+	if err != nil {
+		w.setErr(err)
+	}
+	return v
+}
+
+// durationSeconds converts d into the number of seconds (rounded up) for use in a four byte integer property; name is
+// used in the error returned if d is out of range
+func durationSeconds(name string, d time.Duration) (*uint32, error) {
+	if d < 0 {
+		return nil, fmt.Errorf("%w: %s must not be negative", ErrInvalidArguments, name)
+	}
+	s := d / time.Second
+	if d%time.Second != 0 {
+		s++
+	}
+	if s > math.MaxUint32 {
+		return nil, fmt.Errorf("%w: %s of %s exceeds the maximum (%d seconds)", ErrInvalidArguments, name, d, uint32(math.MaxUint32))
+	}
+	v := uint32(s)
+	return &v, nil
+}
+
+// setErr records err unless an error has already been recorded
+func (w *Will) setErr(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+}
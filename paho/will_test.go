@@ -0,0 +1,62 @@
+/*
+ * Copyright (c) 2024 Contributors to the Eclipse Foundation
+ *
+ *  All rights reserved. This program and the accompanying materials
+ *  are made available under the terms of the Eclipse Public License v2.0
+ *  and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ *  and the Eclipse Distribution License is available at
+ *    http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ *  SPDX-License-Identifier: EPL-2.0 OR BSD-3-Clause
+ */
+
+package paho
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWill(t *testing.T) {
+	m, p, err := NewWill("status/client", []byte("offline")).
+		WithQoS(1).
+		WithRetain(true).
+		WithDelayInterval(1500*time.Millisecond).
+		WithContentType("text/plain").
+		WithUserProperty("key", "value").
+		Build()
+	require.NoError(t, err)
+	assert.Equal(t, &WillMessage{Retain: true, QoS: 1, Topic: "status/client", Payload: []byte("offline")}, m)
+	assert.Equal(t, &WillProperties{
+		WillDelayInterval: Uint32(2),
+		ContentType:       "text/plain",
+		User:              UserProperties{{Key: "key", Value: "value"}},
+	}, p)
+
+	// The packet produced should include the will
+	cp := (&Connect{ClientID: "test", WillMessage: m, WillProperties: p}).Packet()
+	assert.True(t, cp.WillFlag)
+	assert.Equal(t, "status/client", cp.WillTopic)
+	assert.Equal(t, uint32(2), *cp.WillProperties.WillDelayInterval)
+
+	invalid := map[string]*Will{
+		"empty topic":    NewWill("", nil),
+		"wildcard topic": NewWill("status/#", nil),
+		"QoS":            NewWill("status", nil).WithQoS(3),
+		"negative delay": NewWill("status", nil).WithDelayInterval(-time.Second),
+		"delay too long": NewWill("status", nil).WithDelayInterval((math.MaxUint32 + 1) * time.Second),
+	}
+	for name, w := range invalid {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := w.Build()
+			assert.ErrorIs(t, err, ErrInvalidArguments)
+		})
+	}
+}